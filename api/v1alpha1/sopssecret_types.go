@@ -100,6 +100,27 @@ type GcpKmsDataItem struct {
 	CreationDate string `json:"created_at,omitempty"`
 }
 
+// KeyGroup defines a sops key group, the data key is split between key
+// groups with Shamir's secret sharing and any key of a group can decrypt
+// its share
+type KeyGroup struct {
+	// Aws KMS configuration
+	//+optional
+	AwsKms []KmsDataItem `json:"kms,omitempty"`
+
+	// PGP configuration
+	//+optional
+	Pgp []PgpDataItem `json:"pgp,omitempty"`
+
+	// Azure KMS configuration
+	//+optional
+	AzureKms []AzureKmsItem `json:"azure_kv,omitempty"`
+
+	// Gcp KMS configuration
+	//+optional
+	GcpKms []GcpKmsDataItem `json:"gcp_kms,omitempty"`
+}
+
 // SopsMetadata defines the encryption details
 type SopsMetadata struct {
 	// Aws KMS configuration
@@ -118,6 +139,16 @@ type SopsMetadata struct {
 	//+optional
 	GcpKms []GcpKmsDataItem `json:"gcp_kms,omitempty"`
 
+	// KeyGroups - sops key groups, set instead of top level key lists
+	// when SopsSecret is encrypted with several key groups
+	//+optional
+	KeyGroups []KeyGroup `json:"key_groups,omitempty"`
+
+	// ShamirThreshold - number of key groups required to decrypt SopsSecret
+	// (sops --shamir-secret-sharing-threshold)
+	//+optional
+	ShamirThreshold int `json:"shamir_threshold,omitempty"`
+
 	// Mac - sops setting
 	//+optional
 	Mac string `json:"mac,omitempty"`
@@ -134,6 +165,31 @@ type SopsMetadata struct {
 	//+optional
 	EncryptedSuffix string `json:"encrypted_suffix,omitempty"`
 
+	// Suffix of keys sops left unencrypted (sops --unencrypted-suffix)
+	//+optional
+	UnencryptedSuffix string `json:"unencrypted_suffix,omitempty"`
+
+	// Regex used to encrypt SopsSecret resource
+	// This opstion should be used with more care, as it can make resource unapplicable to the cluster.
+	//+optional
+	EncryptedRegex string `json:"encrypted_regex,omitempty"`
+
+	// Regex of keys sops left unencrypted (sops --unencrypted-regex)
+	//+optional
+	UnencryptedRegex string `json:"unencrypted_regex,omitempty"`
+
+	// Regex of comments marking values sops encrypted (sops --encrypted-comment-regex).
+	// Kubernetes API does not preserve comments, so values selected by comments
+	// can not be decrypted by the controller.
+	//+optional
+	EncryptedCommentRegex string `json:"encrypted_comment_regex,omitempty"`
+
+	// Regex of comments marking values sops left unencrypted (sops --unencrypted-comment-regex).
+	// Kubernetes API does not preserve comments, so values selected by comments
+	// can not be decrypted by the controller.
+	//+optional
+	UnencryptedCommentRegex string `json:"unencrypted_comment_regex,omitempty"`
+
 	// MacOnlyEncrypted - sops setting; when true the MAC is computed
 	// over values that end up encrypted only (sops --mac-only-encrypted).
 	//+optional
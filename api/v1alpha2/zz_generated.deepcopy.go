@@ -72,6 +72,51 @@ func (in *HcVaultItem) DeepCopy() *HcVaultItem {
 	return out
 }
 
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *KeyGroup) DeepCopyInto(out *KeyGroup) {
+	*out = *in
+	if in.AwsKms != nil {
+		in, out := &in.AwsKms, &out.AwsKms
+		*out = make([]KmsDataItem, len(*in))
+		copy(*out, *in)
+	}
+	if in.Pgp != nil {
+		in, out := &in.Pgp, &out.Pgp
+		*out = make([]PgpDataItem, len(*in))
+		copy(*out, *in)
+	}
+	if in.AzureKms != nil {
+		in, out := &in.AzureKms, &out.AzureKms
+		*out = make([]AzureKmsItem, len(*in))
+		copy(*out, *in)
+	}
+	if in.HcVault != nil {
+		in, out := &in.HcVault, &out.HcVault
+		*out = make([]HcVaultItem, len(*in))
+		copy(*out, *in)
+	}
+	if in.GcpKms != nil {
+		in, out := &in.GcpKms, &out.GcpKms
+		*out = make([]GcpKmsDataItem, len(*in))
+		copy(*out, *in)
+	}
+	if in.Age != nil {
+		in, out := &in.Age, &out.Age
+		*out = make([]AgeItem, len(*in))
+		copy(*out, *in)
+	}
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new KeyGroup.
+func (in *KeyGroup) DeepCopy() *KeyGroup {
+	if in == nil {
+		return nil
+	}
+	out := new(KeyGroup)
+	in.DeepCopyInto(out)
+	return out
+}
+
 // DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
 func (in *KmsDataItem) DeepCopyInto(out *KmsDataItem) {
 	*out = *in
@@ -135,6 +180,13 @@ func (in *SopsMetadata) DeepCopyInto(out *SopsMetadata) {
 		*out = make([]AgeItem, len(*in))
 		copy(*out, *in)
 	}
+	if in.KeyGroups != nil {
+		in, out := &in.KeyGroups, &out.KeyGroups
+		*out = make([]KeyGroup, len(*in))
+		for i := range *in {
+			(*in)[i].DeepCopyInto(&(*out)[i])
+		}
+	}
 }
 
 // DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new SopsMetadata.
@@ -0,0 +1,74 @@
+/* This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at https://mozilla.org/MPL/2.0/. */
+
+package v1alpha3
+
+import (
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+// ProtectedSecretPolicySpec defines Secrets SopsSecrets can never adopt or
+// overwrite and Secret types SopsSecrets can not create in selected namespaces
+type ProtectedSecretPolicySpec struct {
+	// Names of namespaces the policy applies to
+	//+optional
+	Namespaces []string `json:"namespaces,omitempty"`
+
+	// NamespaceSelector selects namespaces the policy applies to by labels,
+	// empty selector selects all namespaces
+	//+optional
+	NamespaceSelector *metav1.LabelSelector `json:"namespaceSelector,omitempty"`
+
+	// ProtectedSecrets lists existing Secrets which can not be adopted or
+	// overwritten, even if enforceOwnership is set or the Secret is annotated
+	// to be managed
+	//+optional
+	ProtectedSecrets ProtectedSecrets `json:"protectedSecrets,omitempty"`
+
+	// ForbiddenTypes lists Secret types SopsSecret templates can not have
+	//+optional
+	ForbiddenTypes []string `json:"forbiddenTypes,omitempty"`
+}
+
+// ProtectedSecrets defines how protected Secrets are matched, a Secret is
+// protected if it matches any of the types, selectors or names
+type ProtectedSecrets struct {
+	// Secret types, for example `kubernetes.io/service-account-token`
+	//+optional
+	Types []string `json:"types,omitempty"`
+
+	// Label selectors, for example `owner=helm`
+	//+optional
+	Selectors []metav1.LabelSelector `json:"selectors,omitempty"`
+
+	// Secret names matched as shell file name patterns, for example `sh.helm.release.v1.*`
+	//+optional
+	Names []string `json:"names,omitempty"`
+}
+
+//+kubebuilder:object:root=true
+
+// ProtectedSecretPolicy protects Secrets in selected namespaces from being
+// taken over by SopsSecrets
+// +kubebuilder:resource:scope=Cluster
+type ProtectedSecretPolicy struct {
+	metav1.TypeMeta   `json:",inline"`
+	metav1.ObjectMeta `json:"metadata,omitempty"`
+
+	// ProtectedSecretPolicy Spec definition
+	Spec ProtectedSecretPolicySpec `json:"spec,omitempty"`
+}
+
+//+kubebuilder:object:root=true
+
+// ProtectedSecretPolicyList contains a list of ProtectedSecretPolicy
+type ProtectedSecretPolicyList struct {
+	metav1.TypeMeta `json:",inline"`
+	metav1.ListMeta `json:"metadata,omitempty"`
+	Items           []ProtectedSecretPolicy `json:"items"`
+}
+
+func init() {
+	SchemeBuilder.Register(&ProtectedSecretPolicy{}, &ProtectedSecretPolicyList{})
+}
@@ -15,6 +15,64 @@ const (
 	// SopsSecretManagedAnnotation is the name for the annotation for
 	// flagging the existing secret be managed by SopsSecret controller.
 	SopsSecretManagedAnnotation = "sopssecret/managed"
+
+	// SopsSecretManagedLabel is the name of the label set to "true" on child
+	// secrets, the operator caches and watches only secrets with this label.
+	SopsSecretManagedLabel = "sopssecret.isindir.github.com/managed"
+
+	// SopsSecretContentHashAnnotation is the name of the annotation set on
+	// child secrets holding hash of their type and data, it is used to skip
+	// no-op updates and to detect changes made outside of the operator.
+	SopsSecretContentHashAnnotation = "sopssecret.isindir.github.com/content-hash"
+
+	// SopsSecretLastAppliedAnnotation is the name of the annotation set on
+	// child secrets listing keys of labels and annotations set from the
+	// template, only these are updated and removed by the operator.
+	SopsSecretLastAppliedAnnotation = "sopssecret.isindir.github.com/last-applied-metadata"
+
+	// SopsSecretReconcileRequestAnnotation is the name of the annotation
+	// which can be set on SopsSecret to request reconciliation, any change
+	// of its value triggers reconciliation of the object.
+	SopsSecretReconcileRequestAnnotation = "reconcile.isindir.github.com/requestedAt"
+
+	// SopsSecretSuspendAnnotation is the name of the annotation which can be
+	// set to "true" on a Namespace to suspend reconciliation of all SopsSecrets
+	// in that namespace.
+	SopsSecretSuspendAnnotation = "sopssecret/suspend"
+
+	// SopsSecretAgeRecipientsAnnotation is the name of the Namespace annotation
+	// listing comma separated age recipients, plain text SopsSecrets in that
+	// namespace are encrypted for them by the plain text webhook.
+	SopsSecretAgeRecipientsAnnotation = "sopssecret/age-recipients"
+
+	// ExpiryPolicyDelete - child secret is deleted when template expires
+	ExpiryPolicyDelete = "Delete"
+	// ExpiryPolicyBlank - values of child secret are blanked when template expires
+	ExpiryPolicyBlank = "Blank"
+
+	// ConditionTypeExpiringSoon is the type of condition set when any of the
+	// secret templates expires within the warning window
+	ConditionTypeExpiringSoon = "ExpiringSoon"
+
+	// ConditionTypeSuspended is the type of condition set when reconciliation
+	// of SopsSecret is suspended, reason tells whether it is suspended by the
+	// object, its namespace or the global pause
+	ConditionTypeSuspended = "Suspended"
+
+	// ConditionTypeChildRecreated is the type of condition set when a child
+	// secret was deleted and created again because of an immutable field
+	// change, reason tells the recreate strategy
+	ConditionTypeChildRecreated = "ChildRecreated"
+
+	// ConditionTypeSopsCompatibilityWarning is the type of condition set when
+	// sops metadata uses fields the embedded sops or SopsSecret API may not
+	// handle the way the encrypting sops did
+	ConditionTypeSopsCompatibilityWarning = "SopsCompatibilityWarning"
+
+	// ConditionTypeDataKeyMaxAgeExceeded is the type of condition set when the
+	// sops data key of SopsSecret is older than the maximum age configured in
+	// the operator
+	ConditionTypeDataKeyMaxAgeExceeded = "DataKeyMaxAgeExceeded"
 )
 
 // SopsSecretSpec defines the desired state of SopsSecret
@@ -36,6 +94,13 @@ type SopsSecretSpec struct {
 	// When not set, the global default (--default-enforce-ownership flag) is used.
 	//+optional
 	EnforceOwnership *bool `json:"enforceOwnership,omitempty"`
+
+	// VerifyMac tells the controller to verify sops MAC of the object and
+	// refuse to sync secrets on mismatch. MAC is computed over values of the
+	// object as written to the file sops encrypted, in any order of keys. When
+	// --verify-mac flag is set MAC is verified for all objects.
+	//+optional
+	VerifyMac bool `json:"verifyMac,omitempty"`
 }
 
 // SopsSecretTemplate defines the map of secrets to create
@@ -68,6 +133,22 @@ type SopsSecretTemplate struct {
 	// information: https://kubernetes.io/docs/concepts/configuration/secret/#overview-of-secrets)
 	//+optional
 	StringData map[string]string `json:"stringData,omitempty"`
+
+	// NotBefore - RFC3339 time before which the Kubernetes secret is not created.
+	// Value is a string, as it is encrypted together with the template.
+	//+optional
+	NotBefore string `json:"notBefore,omitempty"`
+
+	// ExpiresAt - RFC3339 time after which the Kubernetes secret is deleted or
+	// blanked according to expiryPolicy.
+	//+optional
+	ExpiresAt string `json:"expiresAt,omitempty"`
+
+	// ExpiryPolicy - what happens to the Kubernetes secret when the template
+	// expires. Default: Delete. Possible values: Delete, Blank (keys are kept
+	// with empty values)
+	//+optional
+	ExpiryPolicy string `json:"expiryPolicy,omitempty"`
 }
 
 // KmsDataItem defines AWS KMS specific encryption details
@@ -151,6 +232,35 @@ type GcpKmsDataItem struct {
 	CreationDate string `json:"created_at,omitempty"`
 }
 
+// KeyGroup defines a sops key group, the data key is split between key
+// groups with Shamir's secret sharing and any key of a group can decrypt
+// its share
+type KeyGroup struct {
+	// Aws KMS configuration
+	//+optional
+	AwsKms []KmsDataItem `json:"kms,omitempty"`
+
+	// PGP configuration
+	//+optional
+	Pgp []PgpDataItem `json:"pgp,omitempty"`
+
+	// Azure KMS configuration
+	//+optional
+	AzureKms []AzureKmsItem `json:"azure_kv,omitempty"`
+
+	// Hashicorp Vault KMS configurarion
+	//+optional
+	HcVault []HcVaultItem `json:"hc_vault,omitempty"`
+
+	// Gcp KMS configuration
+	//+optional
+	GcpKms []GcpKmsDataItem `json:"gcp_kms,omitempty"`
+
+	// Age configuration
+	//+optional
+	Age []AgeItem `json:"age,omitempty"`
+}
+
 // SopsMetadata defines the encryption details
 type SopsMetadata struct {
 	// Aws KMS configuration
@@ -177,6 +287,16 @@ type SopsMetadata struct {
 	//+optional
 	Age []AgeItem `json:"age,omitempty"`
 
+	// KeyGroups - sops key groups, set instead of top level key lists
+	// when SopsSecret is encrypted with several key groups
+	//+optional
+	KeyGroups []KeyGroup `json:"key_groups,omitempty"`
+
+	// ShamirThreshold - number of key groups required to decrypt SopsSecret
+	// (sops --shamir-secret-sharing-threshold)
+	//+optional
+	ShamirThreshold int `json:"shamir_threshold,omitempty"`
+
 	// Mac - sops setting
 	//+optional
 	Mac string `json:"mac,omitempty"`
@@ -193,11 +313,31 @@ type SopsMetadata struct {
 	//+optional
 	EncryptedSuffix string `json:"encrypted_suffix,omitempty"`
 
+	// Suffix of keys sops left unencrypted (sops --unencrypted-suffix)
+	//+optional
+	UnencryptedSuffix string `json:"unencrypted_suffix,omitempty"`
+
 	// Regex used to encrypt SopsSecret resource
 	// This opstion should be used with more care, as it can make resource unapplicable to the cluster.
 	//+optional
 	EncryptedRegex string `json:"encrypted_regex,omitempty"`
 
+	// Regex of keys sops left unencrypted (sops --unencrypted-regex)
+	//+optional
+	UnencryptedRegex string `json:"unencrypted_regex,omitempty"`
+
+	// Regex of comments marking values sops encrypted (sops --encrypted-comment-regex).
+	// Kubernetes API does not preserve comments, so values selected by comments
+	// can not be decrypted by the controller.
+	//+optional
+	EncryptedCommentRegex string `json:"encrypted_comment_regex,omitempty"`
+
+	// Regex of comments marking values sops left unencrypted (sops --unencrypted-comment-regex).
+	// Kubernetes API does not preserve comments, so values selected by comments
+	// can not be decrypted by the controller.
+	//+optional
+	UnencryptedCommentRegex string `json:"unencrypted_comment_regex,omitempty"`
+
 	// MacOnlyEncrypted - sops setting; when true the MAC is computed
 	// over values that end up encrypted only (sops --mac-only-encrypted).
 	//+optional
@@ -212,6 +352,63 @@ type SopsSecretStatus struct {
 	// SopsSecret status message
 	//+optional
 	Message string `json:"message,omitempty"`
+
+	// Conditions represent the latest available observations of SopsSecret state
+	//+optional
+	//+listType=map
+	//+listMapKey=type
+	Conditions []metav1.Condition `json:"conditions,omitempty"`
+
+	// LastHandledReconcileAt holds the value of the most recent
+	// reconcile.isindir.github.com/requestedAt annotation handled by the controller
+	//+optional
+	LastHandledReconcileAt string `json:"lastHandledReconcileAt,omitempty"`
+
+	// Encryption describes keys SopsSecret is encrypted for
+	//+optional
+	Encryption *SopsSecretEncryptionStatus `json:"encryption,omitempty"`
+}
+
+// SopsSecretKey is a key listed in sops metadata
+type SopsSecretKey struct {
+	// Provider - sops key provider: kms, pgp, azure_kv, hc_vault, gcp_kms or age
+	Provider string `json:"provider"`
+
+	// ID - key identifier: KMS key ARN or resource ID, PGP fingerprint, key
+	// URL for Azure Key Vault and Hashicorp Vault, age recipient
+	ID string `json:"id"`
+
+	// CreatedAt - time sops encrypted the data key for the key, not recorded
+	// for age keys
+	//+optional
+	CreatedAt string `json:"createdAt,omitempty"`
+
+	// Unverified - set in decryptedBy when the key which decrypted the data
+	// key could not be attributed and ID is taken from sops metadata
+	//+optional
+	Unverified bool `json:"unverified,omitempty"`
+}
+
+// SopsSecretEncryptionStatus describes keys SopsSecret is encrypted for
+type SopsSecretEncryptionStatus struct {
+	// Recipients - keys the data key is encrypted for, including keys of key groups
+	//+optional
+	Recipients []SopsSecretKey `json:"recipients,omitempty"`
+
+	// DataKeyCreatedAt - oldest createdAt of recipients, not set when no
+	// recipient records it
+	//+optional
+	DataKeyCreatedAt *metav1.Time `json:"dataKeyCreatedAt,omitempty"`
+
+	// LastModified - sops lastmodified, time the file was last encrypted or
+	// edited, which is not the creation time of the data key
+	//+optional
+	LastModified *metav1.Time `json:"lastModified,omitempty"`
+
+	// DecryptedBy - keys which decrypted the data key in the last successful
+	// decryption
+	//+optional
+	DecryptedBy []SopsSecretKey `json:"decryptedBy,omitempty"`
 }
 
 //+kubebuilder:object:root=true
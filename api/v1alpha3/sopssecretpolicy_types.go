@@ -0,0 +1,82 @@
+/* This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at https://mozilla.org/MPL/2.0/. */
+
+package v1alpha3
+
+import (
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+// SopsSecretPolicySpec defines namespaces and recipients SopsSecrets in these
+// namespaces are allowed to be encrypted with
+type SopsSecretPolicySpec struct {
+	// Names of namespaces the policy applies to
+	//+optional
+	Namespaces []string `json:"namespaces,omitempty"`
+
+	// NamespaceSelector selects namespaces the policy applies to by labels,
+	// empty selector selects all namespaces
+	//+optional
+	NamespaceSelector *metav1.LabelSelector `json:"namespaceSelector,omitempty"`
+
+	// AllowedRecipients lists keys SopsSecrets in selected namespaces can be
+	// encrypted with, every key listed in sops metadata must be allowed
+	//+required
+	AllowedRecipients AllowedRecipients `json:"allowedRecipients"`
+}
+
+// AllowedRecipients lists allowed keys per sops key type. Values are matched
+// as shell file name patterns, for example `arn:aws:kms:*:111111111111:key/*`.
+type AllowedRecipients struct {
+	// Age recipients
+	//+optional
+	Age []string `json:"age,omitempty"`
+
+	// PGP key fingerprints
+	//+optional
+	Pgp []string `json:"pgp,omitempty"`
+
+	// AWS KMS key ARNs
+	//+optional
+	Kms []string `json:"kms,omitempty"`
+
+	// GCP KMS key resource IDs
+	//+optional
+	GcpKms []string `json:"gcpKms,omitempty"`
+
+	// Azure Key Vault key URLs in `https://<vault>.vault.azure.net/keys/<name>` format
+	//+optional
+	AzureKv []string `json:"azureKv,omitempty"`
+
+	// Hashicorp Vault transit key names
+	//+optional
+	HcVault []string `json:"hcVault,omitempty"`
+}
+
+//+kubebuilder:object:root=true
+
+// SopsSecretPolicy restricts recipients SopsSecrets can be encrypted with in
+// selected namespaces, to prevent replay of SopsSecrets copied from other
+// namespaces
+// +kubebuilder:resource:scope=Cluster
+type SopsSecretPolicy struct {
+	metav1.TypeMeta   `json:",inline"`
+	metav1.ObjectMeta `json:"metadata,omitempty"`
+
+	// SopsSecretPolicy Spec definition
+	Spec SopsSecretPolicySpec `json:"spec,omitempty"`
+}
+
+//+kubebuilder:object:root=true
+
+// SopsSecretPolicyList contains a list of SopsSecretPolicy
+type SopsSecretPolicyList struct {
+	metav1.TypeMeta `json:",inline"`
+	metav1.ListMeta `json:"metadata,omitempty"`
+	Items           []SopsSecretPolicy `json:"items"`
+}
+
+func init() {
+	SchemeBuilder.Register(&SopsSecretPolicy{}, &SopsSecretPolicyList{})
+}
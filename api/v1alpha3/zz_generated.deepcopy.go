@@ -9,6 +9,7 @@
 package v1alpha3
 
 import (
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 	runtime "k8s.io/apimachinery/pkg/runtime"
 )
 
@@ -27,6 +28,51 @@ func (in *AgeItem) DeepCopy() *AgeItem {
 	return out
 }
 
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *AllowedRecipients) DeepCopyInto(out *AllowedRecipients) {
+	*out = *in
+	if in.Age != nil {
+		in, out := &in.Age, &out.Age
+		*out = make([]string, len(*in))
+		copy(*out, *in)
+	}
+	if in.Pgp != nil {
+		in, out := &in.Pgp, &out.Pgp
+		*out = make([]string, len(*in))
+		copy(*out, *in)
+	}
+	if in.Kms != nil {
+		in, out := &in.Kms, &out.Kms
+		*out = make([]string, len(*in))
+		copy(*out, *in)
+	}
+	if in.GcpKms != nil {
+		in, out := &in.GcpKms, &out.GcpKms
+		*out = make([]string, len(*in))
+		copy(*out, *in)
+	}
+	if in.AzureKv != nil {
+		in, out := &in.AzureKv, &out.AzureKv
+		*out = make([]string, len(*in))
+		copy(*out, *in)
+	}
+	if in.HcVault != nil {
+		in, out := &in.HcVault, &out.HcVault
+		*out = make([]string, len(*in))
+		copy(*out, *in)
+	}
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new AllowedRecipients.
+func (in *AllowedRecipients) DeepCopy() *AllowedRecipients {
+	if in == nil {
+		return nil
+	}
+	out := new(AllowedRecipients)
+	in.DeepCopyInto(out)
+	return out
+}
+
 // DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
 func (in *AzureKmsItem) DeepCopyInto(out *AzureKmsItem) {
 	*out = *in
@@ -72,6 +118,51 @@ func (in *HcVaultItem) DeepCopy() *HcVaultItem {
 	return out
 }
 
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *KeyGroup) DeepCopyInto(out *KeyGroup) {
+	*out = *in
+	if in.AwsKms != nil {
+		in, out := &in.AwsKms, &out.AwsKms
+		*out = make([]KmsDataItem, len(*in))
+		copy(*out, *in)
+	}
+	if in.Pgp != nil {
+		in, out := &in.Pgp, &out.Pgp
+		*out = make([]PgpDataItem, len(*in))
+		copy(*out, *in)
+	}
+	if in.AzureKms != nil {
+		in, out := &in.AzureKms, &out.AzureKms
+		*out = make([]AzureKmsItem, len(*in))
+		copy(*out, *in)
+	}
+	if in.HcVault != nil {
+		in, out := &in.HcVault, &out.HcVault
+		*out = make([]HcVaultItem, len(*in))
+		copy(*out, *in)
+	}
+	if in.GcpKms != nil {
+		in, out := &in.GcpKms, &out.GcpKms
+		*out = make([]GcpKmsDataItem, len(*in))
+		copy(*out, *in)
+	}
+	if in.Age != nil {
+		in, out := &in.Age, &out.Age
+		*out = make([]AgeItem, len(*in))
+		copy(*out, *in)
+	}
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new KeyGroup.
+func (in *KeyGroup) DeepCopy() *KeyGroup {
+	if in == nil {
+		return nil
+	}
+	out := new(KeyGroup)
+	in.DeepCopyInto(out)
+	return out
+}
+
 // DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
 func (in *KmsDataItem) DeepCopyInto(out *KmsDataItem) {
 	*out = *in
@@ -102,6 +193,127 @@ func (in *PgpDataItem) DeepCopy() *PgpDataItem {
 	return out
 }
 
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *ProtectedSecretPolicy) DeepCopyInto(out *ProtectedSecretPolicy) {
+	*out = *in
+	out.TypeMeta = in.TypeMeta
+	in.ObjectMeta.DeepCopyInto(&out.ObjectMeta)
+	in.Spec.DeepCopyInto(&out.Spec)
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new ProtectedSecretPolicy.
+func (in *ProtectedSecretPolicy) DeepCopy() *ProtectedSecretPolicy {
+	if in == nil {
+		return nil
+	}
+	out := new(ProtectedSecretPolicy)
+	in.DeepCopyInto(out)
+	return out
+}
+
+// DeepCopyObject is an autogenerated deepcopy function, copying the receiver, creating a new runtime.Object.
+func (in *ProtectedSecretPolicy) DeepCopyObject() runtime.Object {
+	if c := in.DeepCopy(); c != nil {
+		return c
+	}
+	return nil
+}
+
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *ProtectedSecretPolicyList) DeepCopyInto(out *ProtectedSecretPolicyList) {
+	*out = *in
+	out.TypeMeta = in.TypeMeta
+	in.ListMeta.DeepCopyInto(&out.ListMeta)
+	if in.Items != nil {
+		in, out := &in.Items, &out.Items
+		*out = make([]ProtectedSecretPolicy, len(*in))
+		for i := range *in {
+			(*in)[i].DeepCopyInto(&(*out)[i])
+		}
+	}
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new ProtectedSecretPolicyList.
+func (in *ProtectedSecretPolicyList) DeepCopy() *ProtectedSecretPolicyList {
+	if in == nil {
+		return nil
+	}
+	out := new(ProtectedSecretPolicyList)
+	in.DeepCopyInto(out)
+	return out
+}
+
+// DeepCopyObject is an autogenerated deepcopy function, copying the receiver, creating a new runtime.Object.
+func (in *ProtectedSecretPolicyList) DeepCopyObject() runtime.Object {
+	if c := in.DeepCopy(); c != nil {
+		return c
+	}
+	return nil
+}
+
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *ProtectedSecretPolicySpec) DeepCopyInto(out *ProtectedSecretPolicySpec) {
+	*out = *in
+	if in.Namespaces != nil {
+		in, out := &in.Namespaces, &out.Namespaces
+		*out = make([]string, len(*in))
+		copy(*out, *in)
+	}
+	if in.NamespaceSelector != nil {
+		in, out := &in.NamespaceSelector, &out.NamespaceSelector
+		*out = new(metav1.LabelSelector)
+		(*in).DeepCopyInto(*out)
+	}
+	in.ProtectedSecrets.DeepCopyInto(&out.ProtectedSecrets)
+	if in.ForbiddenTypes != nil {
+		in, out := &in.ForbiddenTypes, &out.ForbiddenTypes
+		*out = make([]string, len(*in))
+		copy(*out, *in)
+	}
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new ProtectedSecretPolicySpec.
+func (in *ProtectedSecretPolicySpec) DeepCopy() *ProtectedSecretPolicySpec {
+	if in == nil {
+		return nil
+	}
+	out := new(ProtectedSecretPolicySpec)
+	in.DeepCopyInto(out)
+	return out
+}
+
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *ProtectedSecrets) DeepCopyInto(out *ProtectedSecrets) {
+	*out = *in
+	if in.Types != nil {
+		in, out := &in.Types, &out.Types
+		*out = make([]string, len(*in))
+		copy(*out, *in)
+	}
+	if in.Selectors != nil {
+		in, out := &in.Selectors, &out.Selectors
+		*out = make([]metav1.LabelSelector, len(*in))
+		for i := range *in {
+			(*in)[i].DeepCopyInto(&(*out)[i])
+		}
+	}
+	if in.Names != nil {
+		in, out := &in.Names, &out.Names
+		*out = make([]string, len(*in))
+		copy(*out, *in)
+	}
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new ProtectedSecrets.
+func (in *ProtectedSecrets) DeepCopy() *ProtectedSecrets {
+	if in == nil {
+		return nil
+	}
+	out := new(ProtectedSecrets)
+	in.DeepCopyInto(out)
+	return out
+}
+
 // DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
 func (in *SopsMetadata) DeepCopyInto(out *SopsMetadata) {
 	*out = *in
@@ -135,6 +347,13 @@ func (in *SopsMetadata) DeepCopyInto(out *SopsMetadata) {
 		*out = make([]AgeItem, len(*in))
 		copy(*out, *in)
 	}
+	if in.KeyGroups != nil {
+		in, out := &in.KeyGroups, &out.KeyGroups
+		*out = make([]KeyGroup, len(*in))
+		for i := range *in {
+			(*in)[i].DeepCopyInto(&(*out)[i])
+		}
+	}
 }
 
 // DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new SopsMetadata.
@@ -153,7 +372,7 @@ func (in *SopsSecret) DeepCopyInto(out *SopsSecret) {
 	out.TypeMeta = in.TypeMeta
 	in.ObjectMeta.DeepCopyInto(&out.ObjectMeta)
 	in.Spec.DeepCopyInto(&out.Spec)
-	out.Status = in.Status
+	in.Status.DeepCopyInto(&out.Status)
 	in.Sops.DeepCopyInto(&out.Sops)
 }
 
@@ -175,6 +394,54 @@ func (in *SopsSecret) DeepCopyObject() runtime.Object {
 	return nil
 }
 
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *SopsSecretEncryptionStatus) DeepCopyInto(out *SopsSecretEncryptionStatus) {
+	*out = *in
+	if in.Recipients != nil {
+		in, out := &in.Recipients, &out.Recipients
+		*out = make([]SopsSecretKey, len(*in))
+		copy(*out, *in)
+	}
+	if in.DataKeyCreatedAt != nil {
+		in, out := &in.DataKeyCreatedAt, &out.DataKeyCreatedAt
+		*out = (*in).DeepCopy()
+	}
+	if in.LastModified != nil {
+		in, out := &in.LastModified, &out.LastModified
+		*out = (*in).DeepCopy()
+	}
+	if in.DecryptedBy != nil {
+		in, out := &in.DecryptedBy, &out.DecryptedBy
+		*out = make([]SopsSecretKey, len(*in))
+		copy(*out, *in)
+	}
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new SopsSecretEncryptionStatus.
+func (in *SopsSecretEncryptionStatus) DeepCopy() *SopsSecretEncryptionStatus {
+	if in == nil {
+		return nil
+	}
+	out := new(SopsSecretEncryptionStatus)
+	in.DeepCopyInto(out)
+	return out
+}
+
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *SopsSecretKey) DeepCopyInto(out *SopsSecretKey) {
+	*out = *in
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new SopsSecretKey.
+func (in *SopsSecretKey) DeepCopy() *SopsSecretKey {
+	if in == nil {
+		return nil
+	}
+	out := new(SopsSecretKey)
+	in.DeepCopyInto(out)
+	return out
+}
+
 // DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
 func (in *SopsSecretList) DeepCopyInto(out *SopsSecretList) {
 	*out = *in
@@ -207,6 +474,90 @@ func (in *SopsSecretList) DeepCopyObject() runtime.Object {
 	return nil
 }
 
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *SopsSecretPolicy) DeepCopyInto(out *SopsSecretPolicy) {
+	*out = *in
+	out.TypeMeta = in.TypeMeta
+	in.ObjectMeta.DeepCopyInto(&out.ObjectMeta)
+	in.Spec.DeepCopyInto(&out.Spec)
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new SopsSecretPolicy.
+func (in *SopsSecretPolicy) DeepCopy() *SopsSecretPolicy {
+	if in == nil {
+		return nil
+	}
+	out := new(SopsSecretPolicy)
+	in.DeepCopyInto(out)
+	return out
+}
+
+// DeepCopyObject is an autogenerated deepcopy function, copying the receiver, creating a new runtime.Object.
+func (in *SopsSecretPolicy) DeepCopyObject() runtime.Object {
+	if c := in.DeepCopy(); c != nil {
+		return c
+	}
+	return nil
+}
+
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *SopsSecretPolicyList) DeepCopyInto(out *SopsSecretPolicyList) {
+	*out = *in
+	out.TypeMeta = in.TypeMeta
+	in.ListMeta.DeepCopyInto(&out.ListMeta)
+	if in.Items != nil {
+		in, out := &in.Items, &out.Items
+		*out = make([]SopsSecretPolicy, len(*in))
+		for i := range *in {
+			(*in)[i].DeepCopyInto(&(*out)[i])
+		}
+	}
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new SopsSecretPolicyList.
+func (in *SopsSecretPolicyList) DeepCopy() *SopsSecretPolicyList {
+	if in == nil {
+		return nil
+	}
+	out := new(SopsSecretPolicyList)
+	in.DeepCopyInto(out)
+	return out
+}
+
+// DeepCopyObject is an autogenerated deepcopy function, copying the receiver, creating a new runtime.Object.
+func (in *SopsSecretPolicyList) DeepCopyObject() runtime.Object {
+	if c := in.DeepCopy(); c != nil {
+		return c
+	}
+	return nil
+}
+
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *SopsSecretPolicySpec) DeepCopyInto(out *SopsSecretPolicySpec) {
+	*out = *in
+	if in.Namespaces != nil {
+		in, out := &in.Namespaces, &out.Namespaces
+		*out = make([]string, len(*in))
+		copy(*out, *in)
+	}
+	if in.NamespaceSelector != nil {
+		in, out := &in.NamespaceSelector, &out.NamespaceSelector
+		*out = new(metav1.LabelSelector)
+		(*in).DeepCopyInto(*out)
+	}
+	in.AllowedRecipients.DeepCopyInto(&out.AllowedRecipients)
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new SopsSecretPolicySpec.
+func (in *SopsSecretPolicySpec) DeepCopy() *SopsSecretPolicySpec {
+	if in == nil {
+		return nil
+	}
+	out := new(SopsSecretPolicySpec)
+	in.DeepCopyInto(out)
+	return out
+}
+
 // DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
 func (in *SopsSecretSpec) DeepCopyInto(out *SopsSecretSpec) {
 	*out = *in
@@ -237,6 +588,18 @@ func (in *SopsSecretSpec) DeepCopy() *SopsSecretSpec {
 // DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
 func (in *SopsSecretStatus) DeepCopyInto(out *SopsSecretStatus) {
 	*out = *in
+	if in.Conditions != nil {
+		in, out := &in.Conditions, &out.Conditions
+		*out = make([]metav1.Condition, len(*in))
+		for i := range *in {
+			(*in)[i].DeepCopyInto(&(*out)[i])
+		}
+	}
+	if in.Encryption != nil {
+		in, out := &in.Encryption, &out.Encryption
+		*out = new(SopsSecretEncryptionStatus)
+		(*in).DeepCopyInto(*out)
+	}
 }
 
 // DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new SopsSecretStatus.
@@ -53,3 +53,10 @@ app.kubernetes.io/version: {{ .Chart.AppVersion | quote }}
 {{- end }}
 app.kubernetes.io/managed-by: {{ .Release.Service }}
 {{- end -}}
+
+{{/*
+Service account of the CSI provider DaemonSet
+*/}}
+{{- define "sops-secrets-operator.csiProviderServiceAccountName" -}}
+{{- .Values.csiProvider.serviceAccount.name | default (printf "%s-csi-provider" (include "sops-secrets-operator.fullname" .)) -}}
+{{- end -}}
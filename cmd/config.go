@@ -0,0 +1,83 @@
+/* This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at https://mozilla.org/MPL/2.0/. */
+
+package main
+
+import (
+	"context"
+	"flag"
+	"os"
+
+	uzap "go.uber.org/zap"
+	"go.uber.org/zap/zapcore"
+	"sigs.k8s.io/controller-runtime/pkg/log/zap"
+
+	"github.com/isindir/sops-secrets-operator/internal/controllers"
+	"github.com/isindir/sops-secrets-operator/internal/operatorconfig"
+)
+
+// logLevelFlag is the flag setting log level, which overrides log level of
+// the configuration file
+const logLevelFlag = "zap-log-level"
+
+// loadOperatorConfig reads configuration file and applies its values to flags
+// which were not set on command line, returns configuration and file content
+func loadOperatorConfig(path string, flags *flag.FlagSet) (*operatorconfig.OperatorConfig, []byte, error) {
+	content, err := os.ReadFile(path)
+	if err != nil {
+		return nil, nil, err
+	}
+	config, err := operatorconfig.Parse(content)
+	if err != nil {
+		return nil, nil, err
+	}
+	if err := config.ApplyToFlags(flags); err != nil {
+		return nil, nil, err
+	}
+	return config, content, nil
+}
+
+// atomicLogLevel makes log level of zap options changeable at runtime
+func atomicLogLevel(opts *zap.Options) uzap.AtomicLevel {
+	if level, ok := opts.Level.(uzap.AtomicLevel); ok {
+		return level
+	}
+	// Same defaults as zap.New
+	level := uzap.NewAtomicLevelAt(zapcore.InfoLevel)
+	if opts.Development {
+		level = uzap.NewAtomicLevelAt(zapcore.DebugLevel)
+	}
+	opts.Level = level
+	return level
+}
+
+// isFlagSet returns true when flag was set, must be called before
+// configuration file values are applied to flags
+func isFlagSet(flags *flag.FlagSet, name string) bool {
+	set := false
+	flags.Visit(func(f *flag.Flag) {
+		set = set || f.Name == name
+	})
+	return set
+}
+
+// liveConfig applies configuration file values which are reloaded without restart
+type liveConfig struct {
+	logLevel     uzap.AtomicLevel
+	logLevelFlag bool
+	reconciler   *controllers.SopsSecretReconciler
+}
+
+func (l *liveConfig) apply(ctx context.Context, config *operatorconfig.OperatorConfig) {
+	l.reconciler.SetPaused(ctx, config.Paused())
+
+	if config.Logging.Level == nil || l.logLevelFlag {
+		return
+	}
+	// Level is validated when configuration is parsed
+	if level, err := operatorconfig.ParseLogLevel(*config.Logging.Level); err == nil && level != l.logLevel.Level() {
+		l.logLevel.SetLevel(level)
+		setupLog.V(0).Info("Log level changed by operator configuration", "level", *config.Logging.Level)
+	}
+}
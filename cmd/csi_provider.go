@@ -0,0 +1,196 @@
+/* This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at https://mozilla.org/MPL/2.0/. */
+
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/log/zap"
+	"sigs.k8s.io/controller-runtime/pkg/manager"
+
+	isindirv1alpha3 "github.com/isindir/sops-secrets-operator/api/v1alpha3"
+	"github.com/isindir/sops-secrets-operator/internal/audit"
+	"github.com/isindir/sops-secrets-operator/internal/controllers"
+	"github.com/isindir/sops-secrets-operator/internal/csiprovider"
+	"github.com/isindir/sops-secrets-operator/internal/keyreload"
+)
+
+// runCSIProvider implements `manager csi-provider [flags]` subcommand, which
+// serves Secrets Store CSI driver provider on every node instead of
+// reconciling SopsSecrets
+func runCSIProvider(args []string) int {
+	flags := flag.NewFlagSet("csi-provider", flag.ContinueOnError)
+	socket := flags.String("provider-socket",
+		filepath.Join(csiprovider.DefaultProvidersDir, csiprovider.ProviderName+".sock"),
+		"Path of the unix socket Secrets Store CSI driver connects to.")
+	verifyMAC := flags.Bool("verify-mac", false,
+		"Verify sops MAC of secret templates of all SopsSecret objects, regardless of spec.verifyMac.")
+	recipientPolicy := flags.String("recipient-policy", controllers.RecipientPolicyDisabled,
+		"Check SopsSecret recipients against SopsSecretPolicy objects, one of: "+
+			strings.Join(controllers.RecipientPolicyModes, ", ")+".")
+	var suspension controllers.Suspension
+	flags.BoolVar(&suspension.NamespaceSuspend, "namespace-suspend", false,
+		"Refuse mounts of SopsSecrets in namespaces annotated with "+
+			isindirv1alpha3.SopsSecretSuspendAnnotation+"=true.")
+	flags.StringVar(&suspension.OperatorNamespace, "operator-namespace", os.Getenv("POD_NAMESPACE"),
+		"Namespace the operator runs in (default: POD_NAMESPACE environment variable).")
+	flags.StringVar(&suspension.PauseConfigMap, "pause-configmap", "",
+		"Name of ConfigMap in operator namespace, mounts of all SopsSecrets are refused while its '"+
+			controllers.PauseConfigMapKey+"' key is \"true\".")
+	var keyServices keyServiceFlags
+	keyServices.bind(flags)
+	ageKeysFile := flags.String("age-keys-file", "",
+		"Age key file with identities generated by the operator, e.g. its age keys Secret mounted as a volume, "+
+			"reloaded when it changes.")
+	var reloadAgeKeyFiles []string
+	flags.Func("reload-age-key-file",
+		"Age key file watched for changes, identities are reloaded without restart, can be repeated.",
+		func(path string) error {
+			reloadAgeKeyFiles = append(reloadAgeKeyFiles, path)
+			return nil
+		})
+	keyReloadInterval := flags.Duration("key-reload-interval", keyreload.DefaultInterval,
+		"Time between checks of watched age key files.")
+	var auditOptions audit.Options
+	flags.StringVar(&auditOptions.Path, "audit-log", "",
+		"Write mount audit events as JSON lines to this file, '-' for stdout.")
+	flags.StringVar(&auditOptions.URL, "audit-url", "",
+		"POST mount audit events as newline delimited JSON to this URL.")
+	flags.IntVar(&auditOptions.BufferSize, "audit-buffer-size", 1000,
+		"Number of audit events kept in memory, events are dropped when buffer is full.")
+	flags.IntVar(&auditOptions.BatchSize, "audit-batch-size", 100, "Maximum number of audit events written at once.")
+	flags.DurationVar(&auditOptions.FlushInterval, "audit-flush-interval", 5*time.Second,
+		"Maximum time audit events are kept in memory before being written.")
+	opts := zap.Options{
+		Development: true,
+	}
+	opts.BindFlags(flags)
+	if err := flags.Parse(args); err != nil {
+		return 2
+	}
+
+	ctrl.SetLogger(zap.New(zap.UseFlagOptions(&opts)))
+
+	if !slices.Contains(controllers.RecipientPolicyModes, *recipientPolicy) {
+		setupLog.Error(
+			fmt.Errorf("invalid --recipient-policy value %q", *recipientPolicy),
+			"unable to start CSI provider",
+		)
+		return 1
+	}
+	if suspension.PauseConfigMap != "" && suspension.OperatorNamespace == "" {
+		setupLog.Error(
+			fmt.Errorf("--pause-configmap requires --operator-namespace or POD_NAMESPACE environment variable"),
+			"unable to start CSI provider",
+		)
+		return 1
+	}
+
+	keyServiceClosers, err := keyServices.setup()
+	if err != nil {
+		setupLog.Error(err, "unable to set up sops key services")
+		return 1
+	}
+	defer func() {
+		for _, closer := range keyServiceClosers {
+			_ = closer.Close()
+		}
+	}()
+
+	reader, err := client.New(ctrl.GetConfigOrDie(), client.Options{Scheme: scheme})
+	if err != nil {
+		setupLog.Error(err, "unable to create client")
+		return 1
+	}
+
+	provider := &csiprovider.Provider{
+		Reader:          reader,
+		VerifyMAC:       *verifyMAC,
+		RecipientPolicy: *recipientPolicy,
+		Suspension:      suspension,
+		Log:             ctrl.Log.WithName("csiprovider"),
+	}
+	// Started alongside the provider server and stopped with it
+	var runnables []manager.Runnable
+
+	if auditOptions.Path != "" || auditOptions.URL != "" {
+		auditLogger, err := audit.NewLogger(auditOptions, ctrl.Log.WithName("audit"))
+		if err != nil {
+			setupLog.Error(err, "unable to create audit logger")
+			return 1
+		}
+		runnables = append(runnables, auditLogger)
+		provider.Audit = auditLogger
+		setupLog.V(0).Info("Mount audit log is enabled")
+	}
+
+	// Operator generated and other age identities are reloaded separately,
+	// so that a missing age keys Secret does not block other key files
+	if *ageKeysFile != "" {
+		ageKeysReloader, err := keyreload.NewReloader(keyreload.Options{
+			AgeKeyFiles:     []string{*ageKeysFile},
+			Interval:        *keyReloadInterval,
+			OnAgeIdentities: controllers.SetManagedAgeIdentities,
+		}, ctrl.Log.WithName("agekeys"))
+		if err != nil {
+			setupLog.Error(err, "unable to create age keys reloader")
+			return 1
+		}
+		runnables = append(runnables, ageKeysReloader)
+		setupLog.V(0).Info(fmt.Sprintf("Age identities generated by the operator are loaded from %s", *ageKeysFile))
+	}
+	if len(reloadAgeKeyFiles) > 0 {
+		keyReloader, err := keyreload.NewReloader(keyreload.Options{
+			AgeKeyFiles:     reloadAgeKeyFiles,
+			Interval:        *keyReloadInterval,
+			OnAgeIdentities: controllers.SetReloadedAgeIdentities,
+			OnReload:        func(context.Context) { controllers.ResetKeyCaches() },
+		}, ctrl.Log.WithName("keyreload"))
+		if err != nil {
+			setupLog.Error(err, "unable to create key reloader")
+			return 1
+		}
+		runnables = append(runnables, keyReloader)
+		setupLog.V(0).Info(
+			fmt.Sprintf(
+				"Reloading age key files [%s] every %s",
+				strings.Join(reloadAgeKeyFiles, ", "), *keyReloadInterval,
+			),
+		)
+	}
+
+	ctx, cancel := context.WithCancel(ctrl.SetupSignalHandler())
+	defer cancel()
+	var wg sync.WaitGroup
+	for _, runnable := range runnables {
+		wg.Go(func() {
+			if err := runnable.Start(ctx); err != nil {
+				setupLog.Error(err, "problem running CSI provider")
+			}
+		})
+	}
+
+	server := &csiprovider.Server{Socket: *socket, Provider: provider}
+	setupLog.V(0).Info(fmt.Sprintf("Serving Secrets Store CSI driver provider on %s", *socket))
+	err = server.Start(ctx)
+	// Audit events of the last mounts are flushed before exit
+	cancel()
+	wg.Wait()
+	if err != nil {
+		setupLog.Error(err, "problem running CSI provider")
+		return 1
+	}
+	return 0
+}
@@ -0,0 +1,73 @@
+/* This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at https://mozilla.org/MPL/2.0/. */
+
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io"
+	"strings"
+
+	"github.com/getsops/sops/v3/keyservice"
+
+	"github.com/isindir/sops-secrets-operator/internal/controllers"
+)
+
+// keyServiceFlags configure sops key services data keys are decrypted with,
+// shared by the operator and csi-provider subcommand
+type keyServiceFlags struct {
+	addresses []string
+	local     bool
+	tls       controllers.KeyServiceTLS
+}
+
+func (f *keyServiceFlags) bind(flags *flag.FlagSet) {
+	flags.Func("keyservice",
+		"Remote sops key service to decrypt data keys with, unix:///path/to/socket or tcp://host:port, can be repeated.",
+		func(address string) error {
+			f.addresses = append(f.addresses, address)
+			return nil
+		})
+	flags.BoolVar(&f.local, "local-keyservice", true,
+		"Decrypt data keys with key material available to the operator process, "+
+			"disable to decrypt with remote key services only.")
+	flags.StringVar(&f.tls.CAFile, "keyservice-ca-file", "",
+		"CA bundle TCP key service certificates are verified with.")
+	flags.StringVar(&f.tls.CertFile, "keyservice-cert-file", "",
+		"Client certificate presented to TCP key services.")
+	flags.StringVar(&f.tls.KeyFile, "keyservice-key-file", "",
+		"Private key of the client certificate presented to TCP key services.")
+}
+
+// setup connects to remote key services and configures decryption to use
+// them, returned closers close the connections
+func (f *keyServiceFlags) setup() ([]io.Closer, error) {
+	if !f.local && len(f.addresses) == 0 {
+		return nil, fmt.Errorf("--local-keyservice=false requires at least one --keyservice")
+	}
+
+	var clients []keyservice.KeyServiceClient
+	var closers []io.Closer
+	for _, address := range f.addresses {
+		client, closer, err := controllers.DialKeyService(address, f.tls)
+		if err != nil {
+			for _, c := range closers {
+				_ = c.Close()
+			}
+			return nil, err
+		}
+		clients = append(clients, client)
+		closers = append(closers, closer)
+	}
+	controllers.SetKeyServices(clients, !f.local)
+
+	setupLog.V(0).Info(
+		fmt.Sprintf(
+			"Decrypting data keys with local key service: %t, remote key services: [%s]",
+			f.local, strings.Join(f.addresses, ", "),
+		),
+	)
+	return closers, nil
+}
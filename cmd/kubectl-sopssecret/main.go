@@ -0,0 +1,167 @@
+/* This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at https://mozilla.org/MPL/2.0/. */
+
+// kubectl-sopssecret is a kubectl plugin for operating SopsSecrets in a cluster.
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"time"
+
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/types"
+	utilruntime "k8s.io/apimachinery/pkg/util/runtime"
+	clientgoscheme "k8s.io/client-go/kubernetes/scheme"
+	"k8s.io/client-go/tools/clientcmd"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+
+	// Import all Kubernetes client auth plugins (e.g. Azure, GCP, OIDC, etc.)
+	_ "k8s.io/client-go/plugin/pkg/client/auth"
+
+	isindirv1alpha3 "github.com/isindir/sops-secrets-operator/api/v1alpha3"
+	"github.com/isindir/sops-secrets-operator/internal/kubectlplugin"
+)
+
+const usage = `Operate SopsSecrets in a cluster, decrypted values are never shown.
+
+Usage:
+  kubectl sopssecret get [NAME] [-n NAMESPACE | -A] [-o table|json]
+  kubectl sopssecret resync NAME [-n NAMESPACE] [--wait DURATION]
+  kubectl sopssecret suspend NAME [-n NAMESPACE]
+  kubectl sopssecret resume NAME [-n NAMESPACE]
+  kubectl sopssecret recipients NAME [-n NAMESPACE] [-o table|json]
+
+Flags:
+`
+
+type options struct {
+	kubeconfig    string
+	context       string
+	namespace     string
+	allNamespaces bool
+	output        string
+	wait          time.Duration
+}
+
+func main() {
+	if err := run(os.Args[1:], os.Stdout, os.Stderr); err != nil {
+		_, _ = fmt.Fprintf(os.Stderr, "error: %v\n", err)
+		os.Exit(1)
+	}
+}
+
+func run(args []string, stdout io.Writer, stderr io.Writer) error {
+	opts := &options{}
+	flags := flag.NewFlagSet("kubectl-sopssecret", flag.ContinueOnError)
+	flags.SetOutput(stderr)
+	flags.StringVar(&opts.kubeconfig, "kubeconfig", "", "Path to the kubeconfig file.")
+	flags.StringVar(&opts.context, "context", "", "The name of the kubeconfig context to use.")
+	flags.StringVar(&opts.namespace, "namespace", "", "Namespace of SopsSecrets.")
+	flags.StringVar(&opts.namespace, "n", "", "Namespace of SopsSecrets (shorthand).")
+	flags.BoolVar(&opts.allNamespaces, "all-namespaces", false, "List SopsSecrets in all namespaces.")
+	flags.BoolVar(&opts.allNamespaces, "A", false, "List SopsSecrets in all namespaces (shorthand).")
+	flags.StringVar(&opts.output, "output", kubectlplugin.OutputTable, "Output format: table or json.")
+	flags.StringVar(&opts.output, "o", kubectlplugin.OutputTable, "Output format (shorthand).")
+	flags.DurationVar(&opts.wait, "wait", 0, "Time resync waits for the operator to handle the request (default: no wait).")
+	flags.Usage = func() {
+		_, _ = fmt.Fprint(stderr, usage)
+		flags.PrintDefaults()
+	}
+
+	positional, err := parseInterspersed(flags, args)
+	if err != nil {
+		return err
+	}
+	if len(positional) == 0 {
+		flags.Usage()
+		return fmt.Errorf("command is required")
+	}
+	if opts.output != kubectlplugin.OutputTable && opts.output != kubectlplugin.OutputJSON {
+		return fmt.Errorf("unsupported output format %q", opts.output)
+	}
+
+	k8sClient, namespace, err := newClient(opts)
+	if err != nil {
+		return err
+	}
+	plugin := &kubectlplugin.Plugin{Client: k8sClient, Out: stdout, Output: opts.output, Wait: opts.wait}
+	ctx := context.Background()
+
+	command, commandArgs := positional[0], positional[1:]
+	if command == "get" {
+		if len(commandArgs) > 1 {
+			return fmt.Errorf("get accepts at most one SopsSecret name")
+		}
+		name := ""
+		if len(commandArgs) == 1 {
+			name = commandArgs[0]
+		}
+		if opts.allNamespaces && name == "" {
+			namespace = ""
+		}
+		return plugin.Get(ctx, namespace, name)
+	}
+
+	if len(commandArgs) != 1 {
+		return fmt.Errorf("%s requires exactly one SopsSecret name", command)
+	}
+	key := types.NamespacedName{Namespace: namespace, Name: commandArgs[0]}
+	switch command {
+	case "resync":
+		return plugin.Resync(ctx, key)
+	case "suspend":
+		return plugin.SetSuspend(ctx, key, true)
+	case "resume":
+		return plugin.SetSuspend(ctx, key, false)
+	case "recipients":
+		return plugin.Recipients(ctx, key)
+	default:
+		flags.Usage()
+		return fmt.Errorf("unknown command %q", command)
+	}
+}
+
+// parseInterspersed parses flags placed before and after positional arguments,
+// as kubectl users are used to `kubectl sopssecret get NAME -n NAMESPACE`
+func parseInterspersed(flags *flag.FlagSet, args []string) ([]string, error) {
+	var positional []string
+	for {
+		if err := flags.Parse(args); err != nil {
+			return nil, err
+		}
+		if flags.NArg() == 0 {
+			return positional, nil
+		}
+		positional = append(positional, flags.Arg(0))
+		args = flags.Args()[1:]
+	}
+}
+
+func newClient(opts *options) (client.Client, string, error) {
+	loadingRules := clientcmd.NewDefaultClientConfigLoadingRules()
+	loadingRules.ExplicitPath = opts.kubeconfig
+	overrides := &clientcmd.ConfigOverrides{CurrentContext: opts.context}
+	overrides.Context.Namespace = opts.namespace
+
+	clientConfig := clientcmd.NewNonInteractiveDeferredLoadingClientConfig(loadingRules, overrides)
+	namespace, _, err := clientConfig.Namespace()
+	if err != nil {
+		return nil, "", err
+	}
+	restConfig, err := clientConfig.ClientConfig()
+	if err != nil {
+		return nil, "", err
+	}
+
+	scheme := runtime.NewScheme()
+	utilruntime.Must(clientgoscheme.AddToScheme(scheme))
+	utilruntime.Must(isindirv1alpha3.AddToScheme(scheme))
+
+	k8sClient, err := client.New(restConfig, client.Options{Scheme: scheme})
+	return k8sClient, namespace, err
+}
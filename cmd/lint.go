@@ -0,0 +1,133 @@
+/* This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at https://mozilla.org/MPL/2.0/. */
+
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+
+	sopslogging "github.com/getsops/sops/v3/logging"
+
+	"github.com/isindir/sops-secrets-operator/internal/lint"
+)
+
+const (
+	lintExitOK       = 0
+	lintExitFindings = 1
+	lintExitUsage    = 2
+)
+
+// runLint implements `manager lint [flags] <file|dir|->...` subcommand
+func runLint(args []string, stdin io.Reader, stdout io.Writer, stderr io.Writer) int {
+	flags := flag.NewFlagSet("lint", flag.ContinueOnError)
+	flags.SetOutput(stderr)
+	output := flags.String("output", "json", "Output format: json or text.")
+	decrypt := flags.Bool("decrypt", false,
+		"Decrypt SopsSecrets using key material available in the environment and lint decrypted templates.")
+	verifyMAC := flags.Bool("verify-mac", false,
+		"Verify sops MAC of secret templates the way the operator does with --verify-mac, implies --decrypt.")
+	strict := flags.Bool("strict", false, "Exit with non zero code if warnings are found.")
+	flags.Usage = func() {
+		_, _ = fmt.Fprintf(stderr, "Usage: %s lint [flags] <file|directory|->...\n", filepath.Base(os.Args[0]))
+		flags.PrintDefaults()
+	}
+
+	if err := flags.Parse(args); err != nil {
+		return lintExitUsage
+	}
+	if flags.NArg() == 0 || (*output != "json" && *output != "text") {
+		flags.Usage()
+		return lintExitUsage
+	}
+
+	// sops library logs decryption progress with logrus, keep output machine-readable
+	for k := range sopslogging.Loggers {
+		sopslogging.Loggers[k].Out = io.Discard
+	}
+
+	report := &lint.Report{Findings: []lint.Finding{}}
+	opts := lint.Options{Decrypt: *decrypt, VerifyMAC: *verifyMAC}
+	for _, path := range flags.Args() {
+		if err := lintPath(report, path, stdin, opts); err != nil {
+			_, _ = fmt.Fprintf(stderr, "lint: %v\n", err)
+			return lintExitUsage
+		}
+	}
+
+	if err := writeLintReport(stdout, report, *output); err != nil {
+		_, _ = fmt.Fprintf(stderr, "lint: %v\n", err)
+		return lintExitUsage
+	}
+
+	if report.HasErrors(*strict) {
+		return lintExitFindings
+	}
+	return lintExitOK
+}
+
+func lintPath(report *lint.Report, path string, stdin io.Reader, opts lint.Options) error {
+	if path == "-" {
+		content, err := io.ReadAll(stdin)
+		if err != nil {
+			return err
+		}
+		report.Lint("-", content, opts)
+		return nil
+	}
+
+	return filepath.WalkDir(path, func(file string, entry fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if entry.IsDir() {
+			return nil
+		}
+		// files passed explicitly are always linted, directories are searched for manifests only
+		if file != path {
+			switch filepath.Ext(file) {
+			case ".yaml", ".yml", ".json":
+			default:
+				return nil
+			}
+		}
+		content, err := os.ReadFile(file)
+		if err != nil {
+			return err
+		}
+		report.Lint(file, content, opts)
+		return nil
+	})
+}
+
+func writeLintReport(stdout io.Writer, report *lint.Report, output string) error {
+	if output == "json" {
+		encoder := json.NewEncoder(stdout)
+		encoder.SetIndent("", "  ")
+		return encoder.Encode(report)
+	}
+
+	for _, finding := range report.Findings {
+		location := finding.File
+		if finding.Object != "" {
+			location = fmt.Sprintf("%s: %s", location, finding.Object)
+		}
+		if finding.Field != "" {
+			location = fmt.Sprintf("%s: %s", location, finding.Field)
+		}
+		if _, err := fmt.Fprintf(stdout, "%s: %s [%s] %s\n", location, finding.Severity, finding.Code, finding.Message); err != nil {
+			return err
+		}
+	}
+	_, err := fmt.Fprintf(
+		stdout, "%d file(s), %d SopsSecret(s): %d error(s), %d warning(s)\n",
+		report.Files, report.Objects, report.Errors, report.Warnings,
+	)
+	return err
+}
@@ -5,18 +5,31 @@
 package main
 
 import (
+	"cmp"
+	"context"
+	"errors"
 	"flag"
 	"fmt"
+	"maps"
 	"os"
+	"slices"
+	"strings"
+	"time"
 
+	sopsversion "github.com/getsops/sops/v3/version"
 	"sigs.k8s.io/controller-runtime/pkg/cache"
+	"sigs.k8s.io/controller-runtime/pkg/client"
 	metricsserver "sigs.k8s.io/controller-runtime/pkg/metrics/server"
+	"sigs.k8s.io/controller-runtime/pkg/webhook"
 
 	// Import all Kubernetes client auth plugins (e.g. Azure, GCP, OIDC, etc.)
 	// to ensure that exec-entrypoint and run can make use of them.
 	_ "k8s.io/client-go/plugin/pkg/client/auth"
 
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/labels"
 	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/types"
 	utilruntime "k8s.io/apimachinery/pkg/util/runtime"
 	clientgoscheme "k8s.io/client-go/kubernetes/scheme"
 	_ "k8s.io/client-go/plugin/pkg/client/auth/gcp"
@@ -27,7 +40,12 @@ import (
 	isindirv1alpha1 "github.com/isindir/sops-secrets-operator/api/v1alpha1"
 	isindirv1alpha2 "github.com/isindir/sops-secrets-operator/api/v1alpha2"
 	isindirv1alpha3 "github.com/isindir/sops-secrets-operator/api/v1alpha3"
+	"github.com/isindir/sops-secrets-operator/internal/agekeys"
+	"github.com/isindir/sops-secrets-operator/internal/audit"
 	"github.com/isindir/sops-secrets-operator/internal/controllers"
+	"github.com/isindir/sops-secrets-operator/internal/keyreload"
+	"github.com/isindir/sops-secrets-operator/internal/operatorconfig"
+	sopssecretwebhook "github.com/isindir/sops-secrets-operator/internal/webhook"
 	//+kubebuilder:scaffold:imports
 )
 
@@ -45,103 +63,462 @@ func init() {
 	//+kubebuilder:scaffold:scheme
 }
 
-func main() {
-	var metricsAddr string
-	var enableLeaderElection bool
-	var probeAddr string
-	var requeueAfter int64
-	var watchNamespace string
-	var defaultEnforceOwnership bool
-
-	flag.StringVar(&metricsAddr, "metrics-bind-address", ":8080", "The address the metric endpoint binds to.")
-	flag.StringVar(&probeAddr, "health-probe-bind-address", ":8081", "The address the probe endpoint binds to.")
-	flag.BoolVar(&enableLeaderElection, "leader-elect", false,
+// managerOptions holds command line flags of the operator manager
+type managerOptions struct {
+	configFile              string
+	metricsAddr             string
+	enableLeaderElection    bool
+	probeAddr               string
+	requeueAfter            int64
+	watchNamespace          string
+	defaultEnforceOwnership bool
+	recreateStrategy        string
+	verifyMAC               bool
+	recipientPolicy         string
+	protectedSecretPolicy   bool
+	auditOptions            audit.Options
+	expiryWarningWindow     time.Duration
+	maxDataKeyAge           time.Duration
+	operatorNamespace       string
+	pauseConfigMap          string
+	namespaceSuspend        bool
+	ageKeys                 bool
+	ageKeysOptions          agekeys.Options
+	ageRecipientAddr        string
+	plaintextWebhook        string
+	webhookPort             int
+	webhookCertDir          string
+	keyServices             keyServiceFlags
+	readinessCanary         string
+	readinessCheckInterval  time.Duration
+	keyReloadOptions        keyreload.Options
+	leaderElectionID        string
+	leaderElectionNamespace string
+	leaseDuration           time.Duration
+	renewDeadline           time.Duration
+	retryPeriod             time.Duration
+	maxConcurrentReconciles int
+	backoffBaseDelay        time.Duration
+	backoffMaxDelay         time.Duration
+	cacheSyncPeriod         time.Duration
+
+	// canary is parsed from readinessCanary by validate
+	canary types.NamespacedName
+}
+
+func (o *managerOptions) bind(flags *flag.FlagSet) {
+	flags.StringVar(&o.configFile, "config", "",
+		"Operator configuration file of kind "+operatorconfig.Kind+", flags set on command line override file values.")
+	flags.StringVar(&o.metricsAddr, "metrics-bind-address", ":8080", "The address the metric endpoint binds to.")
+	flags.StringVar(&o.probeAddr, "health-probe-bind-address", ":8081", "The address the probe endpoint binds to.")
+	flags.BoolVar(&o.enableLeaderElection, "leader-elect", false,
 		"Enable leader election for controller manager. "+
 			"Enabling this will ensure there is only one active controller manager.")
-	flag.Int64Var(&requeueAfter, "requeue-decrypt-after", 5, "Requeue failed reconciliation in minutes (min 1).")
-	flag.StringVar(&watchNamespace, "watch-namespace", "", "Namespace to watch for SopsSecret objects (default: all namespaces).")
-	flag.BoolVar(&defaultEnforceOwnership, "default-enforce-ownership", false,
+	flags.StringVar(&o.leaderElectionID, "leader-election-id", "ca57d051.github.com", "Name of the leader election Lease.")
+	flags.StringVar(&o.leaderElectionNamespace, "leader-election-namespace", "",
+		"Namespace of the leader election Lease (default: operator namespace).")
+	flags.DurationVar(&o.leaseDuration, "leader-election-lease-duration", 15*time.Second,
+		"Time non-leader replicas wait before acquiring the leader election Lease.")
+	flags.DurationVar(&o.renewDeadline, "leader-election-renew-deadline", 10*time.Second,
+		"Time the leader retries renewing the leader election Lease before giving up leadership.")
+	flags.DurationVar(&o.retryPeriod, "leader-election-retry-period", 2*time.Second,
+		"Time between attempts to acquire or renew the leader election Lease.")
+	flags.Int64Var(&o.requeueAfter, "requeue-decrypt-after", 5, "Requeue failed reconciliation in minutes (min 1).")
+	flags.StringVar(&o.watchNamespace, "watch-namespace", "",
+		"Comma separated namespaces to watch for SopsSecret objects (default: all namespaces).")
+	flags.IntVar(&o.maxConcurrentReconciles, "max-concurrent-reconciles", 1, "Number of SopsSecrets reconciled in parallel.")
+	flags.DurationVar(&o.backoffBaseDelay, "reconcile-backoff-base-delay", 0,
+		"First delay of exponential backoff of reconciliation errors (default: controller-runtime rate limiter).")
+	flags.DurationVar(&o.backoffMaxDelay, "reconcile-backoff-max-delay", 0,
+		"Maximum delay of exponential backoff of reconciliation errors, used with --reconcile-backoff-base-delay.")
+	flags.DurationVar(&o.cacheSyncPeriod, "cache-sync-period", 0,
+		"Time between resyncs of all watched objects (default: controller-runtime default of 10 hours).")
+	flags.BoolVar(&o.defaultEnforceOwnership, "default-enforce-ownership", false,
 		"Default behavior for enforcing ownership of pre-existing secrets.")
+	flags.StringVar(&o.recreateStrategy, "recreate-strategy", controllers.RecreateStrategyRecreate,
+		"How child secrets are replaced when an immutable field such as type changes, one of: "+
+			strings.Join(controllers.RecreateStrategies, ", ")+".")
+	flags.BoolVar(&o.verifyMAC, "verify-mac", false,
+		"Verify sops MAC of secret templates of all SopsSecret objects, regardless of spec.verifyMac.")
+	flags.StringVar(&o.recipientPolicy, "recipient-policy", controllers.RecipientPolicyDisabled,
+		"Check SopsSecret recipients against SopsSecretPolicy objects, one of: "+
+			strings.Join(controllers.RecipientPolicyModes, ", ")+".")
+	flags.BoolVar(&o.protectedSecretPolicy, "protected-secret-policy", false,
+		"Refuse to adopt or overwrite Secrets protected by ProtectedSecretPolicy objects.")
+	flags.DurationVar(&o.expiryWarningWindow, "expiry-warning-window", controllers.DefaultExpiryWarningWindow,
+		"Set ExpiringSoon condition on SopsSecrets with secret templates expiring within this time.")
+	flags.DurationVar(&o.maxDataKeyAge, "max-data-key-age", 0,
+		"Set DataKeyMaxAgeExceeded condition on SopsSecrets with sops data key older than this (0 disables the check).")
+	flags.StringVar(&o.operatorNamespace, "operator-namespace", os.Getenv("POD_NAMESPACE"),
+		"Namespace the operator runs in (default: POD_NAMESPACE environment variable).")
+	flags.StringVar(&o.pauseConfigMap, "pause-configmap", "",
+		"Name of ConfigMap in operator namespace, reconciliation of all SopsSecrets is paused while its '"+
+			controllers.PauseConfigMapKey+"' key is \"true\".")
+	flags.BoolVar(&o.namespaceSuspend, "namespace-suspend", false,
+		"Suspend reconciliation of SopsSecrets in namespaces annotated with "+
+			isindirv1alpha3.SopsSecretSuspendAnnotation+"=true.")
+	flags.BoolVar(&o.ageKeys, "age-keys", false,
+		"Generate age identity of the operator and persist it in a Secret in operator namespace.")
+	flags.StringVar(&o.ageKeysOptions.SecretName, "age-keys-secret", agekeys.DefaultSecretName,
+		"Name of Secret in operator namespace holding age identities of the operator.")
+	flags.StringVar(&o.ageKeysOptions.ConfigMapName, "age-recipient-configmap", agekeys.DefaultConfigMapName,
+		"Name of ConfigMap in operator namespace publishing the current age recipient.")
+	flags.DurationVar(&o.ageKeysOptions.RotationInterval, "age-key-rotation-interval", 0,
+		"Generate a new age identity when the current one is older, old identities are kept for decryption (0 disables rotation).")
+	flags.StringVar(&o.ageRecipientAddr, "age-recipient-bind-address", "",
+		"The address the age recipient endpoint binds to, empty disables the endpoint.")
+	flags.StringVar(&o.plaintextWebhook, "plaintext-webhook", sopssecretwebhook.PlaintextModeDisabled,
+		"Serve mutating webhook handling plain text SopsSecrets, one of: "+
+			strings.Join(sopssecretwebhook.PlaintextModes, ", ")+".")
+	flags.IntVar(&o.webhookPort, "webhook-port", 9443, "The port the webhook server binds to.")
+	flags.StringVar(&o.webhookCertDir, "webhook-cert-dir", "",
+		"Directory with tls.crt and tls.key of the webhook server (default: <temp-dir>/k8s-webhook-server/serving-certs).")
+	o.keyServices.bind(flags)
+	flags.StringVar(&o.readinessCanary, "readiness-canary", "",
+		"SopsSecret as <namespace>/<name> which data key is decrypted by readiness checks with every key it is encrypted for.")
+	flags.DurationVar(&o.readinessCheckInterval, "readiness-check-interval", controllers.DefaultReadinessCheckInterval,
+		"Time between readiness checks of key material and of the readiness canary.")
+	flags.Func("reload-age-key-file",
+		"Age key file watched for changes, identities are reloaded without restart, can be repeated.",
+		func(path string) error {
+			o.keyReloadOptions.AgeKeyFiles = append(o.keyReloadOptions.AgeKeyFiles, path)
+			return nil
+		})
+	flags.StringVar(&o.keyReloadOptions.GPGKeysDir, "reload-gpg-keys-dir", "",
+		"Directory with GnuPG keyring files watched for changes, keyring is copied to a new directory in GNUPGHOME on change and used instead of GNUPGHOME.")
+	flags.DurationVar(&o.keyReloadOptions.Interval, "key-reload-interval", keyreload.DefaultInterval,
+		"Time between checks of watched age key files and GnuPG keyring files.")
+	flags.StringVar(&o.auditOptions.Path, "audit-log", "",
+		"Write decryption audit events as JSON lines to this file, '-' for stdout.")
+	flags.StringVar(&o.auditOptions.URL, "audit-url", "",
+		"POST decryption audit events as newline delimited JSON to this URL.")
+	flags.IntVar(&o.auditOptions.BufferSize, "audit-buffer-size", 1000,
+		"Number of audit events kept in memory, events are dropped when buffer is full.")
+	flags.IntVar(&o.auditOptions.BatchSize, "audit-batch-size", 100, "Maximum number of audit events written at once.")
+	flags.DurationVar(&o.auditOptions.FlushInterval, "audit-flush-interval", 5*time.Second,
+		"Maximum time audit events are kept in memory before being written.")
+}
+
+// validate checks values of flags and of configuration file applied to
+// flags, all invalid values are reported at once. Values derived from flags
+// are set as well
+func (o *managerOptions) validate() error {
+	var errs []error
+	if o.maxConcurrentReconciles < 1 {
+		errs = append(errs, fmt.Errorf("invalid --max-concurrent-reconciles value %d, must be at least 1", o.maxConcurrentReconciles))
+	}
+	if !slices.Contains(controllers.RecipientPolicyModes, o.recipientPolicy) {
+		errs = append(errs, fmt.Errorf("invalid --recipient-policy value %q", o.recipientPolicy))
+	}
+	if !slices.Contains(controllers.RecreateStrategies, o.recreateStrategy) {
+		errs = append(errs, fmt.Errorf("invalid --recreate-strategy value %q", o.recreateStrategy))
+	}
+	if o.maxDataKeyAge < 0 {
+		errs = append(errs, fmt.Errorf("invalid --max-data-key-age value %s", o.maxDataKeyAge))
+	}
+	if o.pauseConfigMap != "" && o.operatorNamespace == "" {
+		errs = append(errs, fmt.Errorf("--pause-configmap requires --operator-namespace or POD_NAMESPACE environment variable"))
+	}
+	if !slices.Contains(sopssecretwebhook.PlaintextModes, o.plaintextWebhook) {
+		errs = append(errs, fmt.Errorf("invalid --plaintext-webhook value %q", o.plaintextWebhook))
+	}
+	if o.ageKeys && o.operatorNamespace == "" {
+		errs = append(errs, fmt.Errorf("--age-keys requires --operator-namespace or POD_NAMESPACE environment variable"))
+	}
+
+	o.keyReloadOptions.GnuPGHome = os.Getenv("GNUPGHOME")
+	if o.keyReloadOptions.GPGKeysDir != "" && o.keyReloadOptions.GnuPGHome == "" {
+		errs = append(errs, fmt.Errorf("--reload-gpg-keys-dir requires GNUPGHOME environment variable"))
+	}
+
+	if o.readinessCanary != "" {
+		namespace, name, ok := strings.Cut(o.readinessCanary, "/")
+		if ok && namespace != "" && name != "" {
+			o.canary = types.NamespacedName{Namespace: namespace, Name: name}
+		} else {
+			errs = append(errs, fmt.Errorf("invalid --readiness-canary value %q, must be <namespace>/<name>", o.readinessCanary))
+		}
+	}
+
+	if o.requeueAfter < 1 {
+		o.requeueAfter = 1
+	}
+	return errors.Join(errs...)
+}
+
+// logSettings logs settings of reconciliation the operator starts with
+func (o *managerOptions) logSettings() {
+	keysAndValues := []any{
+		"sopsVersion", sopsversion.Version,
+		"watchNamespaces", cmp.Or(o.watchNamespace, "all"),
+		"requeueDecryptAfterMinutes", o.requeueAfter,
+		"defaultEnforceOwnership", o.defaultEnforceOwnership,
+		"recreateStrategy", o.recreateStrategy,
+		"verifyMAC", o.verifyMAC,
+		"recipientPolicy", o.recipientPolicy,
+		"protectedSecretPolicy", o.protectedSecretPolicy,
+		"expiryWarningWindow", o.expiryWarningWindow.String(),
+		"namespaceSuspend", o.namespaceSuspend,
+		"plaintextWebhook", o.plaintextWebhook,
+	}
+	if o.maxDataKeyAge > 0 {
+		keysAndValues = append(keysAndValues, "maxDataKeyAge", o.maxDataKeyAge.String())
+	}
+	if o.pauseConfigMap != "" {
+		keysAndValues = append(keysAndValues, "pauseConfigMap", o.operatorNamespace+"/"+o.pauseConfigMap)
+	}
+	if o.canary.Name != "" {
+		keysAndValues = append(keysAndValues, "readinessCanary", o.canary.String())
+	}
+	setupLog.V(0).Info("Reconciliation settings", keysAndValues...)
+}
 
+func main() {
+	if len(os.Args) > 1 && os.Args[1] == "lint" {
+		os.Exit(runLint(os.Args[2:], os.Stdin, os.Stdout, os.Stderr))
+	}
+	if len(os.Args) > 1 && os.Args[1] == "csi-provider" {
+		os.Exit(runCSIProvider(os.Args[2:]))
+	}
+
+	var options managerOptions
+	options.bind(flag.CommandLine)
 	opts := zap.Options{
 		Development: true,
 	}
-
 	opts.BindFlags(flag.CommandLine)
 	flag.Parse()
 
-	ctrl.SetLogger(zap.New(zap.UseFlagOptions(&opts)))
+	if err := runManager(&options, &opts); err != nil {
+		setupLog.Error(err, "unable to run manager")
+		os.Exit(1)
+	}
+}
+
+// runManager sets up the manager with parsed flags and runs it until the
+// process is signalled
+func runManager(o *managerOptions, opts *zap.Options) error {
+	var operatorConfig *operatorconfig.OperatorConfig
+	var operatorConfigContent []byte
+	var operatorConfigErr error
+	logLevelFromFlag := isFlagSet(flag.CommandLine, logLevelFlag)
+	if o.configFile != "" {
+		operatorConfig, operatorConfigContent, operatorConfigErr = loadOperatorConfig(o.configFile, flag.CommandLine)
+	}
+
+	logLevel := atomicLogLevel(opts)
+	ctrl.SetLogger(zap.New(zap.UseFlagOptions(opts)))
+
+	if operatorConfigErr != nil {
+		return fmt.Errorf("unable to load operator configuration %s: %w", o.configFile, operatorConfigErr)
+	}
+	if operatorConfig != nil {
+		setupLog.V(0).Info(fmt.Sprintf("Loaded operator configuration from %s", o.configFile))
+	}
+	if err := o.validate(); err != nil {
+		return err
+	}
+
+	// Key service connections are kept open for the lifetime of the process
+	if _, err := o.keyServices.setup(); err != nil {
+		return fmt.Errorf("unable to set up sops key services: %w", err)
+	}
 
 	cacheOptions := cache.Options{}
-	if watchNamespace != "" {
-		cacheOptions.DefaultNamespaces = map[string]cache.Config{
-			watchNamespace: {},
-		}
-		setupLog.V(0).Info(fmt.Sprintf("Watching SopsSecret objects in namespace %s", watchNamespace))
-	} else {
-		setupLog.V(0).Info("Watching SopsSecret objects in all namespaces")
-	}
-
-	mgr, err := ctrl.NewManager(
-		ctrl.GetConfigOrDie(),
-		ctrl.Options{
-			Scheme: scheme,
-			Cache:  cacheOptions,
-			Metrics: metricsserver.Options{
-				BindAddress: metricsAddr,
-			},
-			HealthProbeBindAddress: probeAddr,
-			LeaderElection:         enableLeaderElection,
-			LeaderElectionID:       "ca57d051.github.com",
+	if o.cacheSyncPeriod > 0 {
+		cacheOptions.SyncPeriod = &o.cacheSyncPeriod
+	}
+	if o.watchNamespace != "" {
+		cacheOptions.DefaultNamespaces = map[string]cache.Config{}
+		for _, namespace := range strings.Split(o.watchNamespace, ",") {
+			cacheOptions.DefaultNamespaces[strings.TrimSpace(namespace)] = cache.Config{}
+		}
+	}
+	cacheOptions.ByObject = map[client.Object]cache.ByObject{
+		// Only child secrets are cached, other secrets are read from API server
+		&corev1.Secret{}: {
+			Label: labels.SelectorFromSet(labels.Set{isindirv1alpha3.SopsSecretManagedLabel: "true"}),
 		},
-	)
-	if err != nil {
-		setupLog.Error(err, "unable to start manager")
-		os.Exit(1)
+	}
+	if o.pauseConfigMap != "" {
+		// Only the pause ConfigMap is read, do not cache ConfigMaps of watched namespaces
+		cacheOptions.ByObject[&corev1.ConfigMap{}] = cache.ByObject{
+			Namespaces: map[string]cache.Config{o.operatorNamespace: {}},
+		}
 	}
 
-	if requeueAfter < 1 {
-		requeueAfter = 1
+	managerOptions := ctrl.Options{
+		Scheme: scheme,
+		Cache:  cacheOptions,
+		Metrics: metricsserver.Options{
+			BindAddress: o.metricsAddr,
+		},
+		HealthProbeBindAddress:  o.probeAddr,
+		LeaderElection:          o.enableLeaderElection,
+		LeaderElectionID:        o.leaderElectionID,
+		LeaderElectionNamespace: o.leaderElectionNamespace,
+		LeaseDuration:           &o.leaseDuration,
+		RenewDeadline:           &o.renewDeadline,
+		RetryPeriod:             &o.retryPeriod,
+	}
+	if o.plaintextWebhook != sopssecretwebhook.PlaintextModeDisabled {
+		managerOptions.WebhookServer = webhook.NewServer(webhook.Options{
+			Port:    o.webhookPort,
+			CertDir: o.webhookCertDir,
+		})
 	}
 
-	setupLog.V(0).Info(
-		fmt.Sprintf(
-			"SopsSecret reconciliation will be requeued after %d minutes after decryption failures",
-			requeueAfter,
-		),
-	)
+	mgr, err := ctrl.NewManager(ctrl.GetConfigOrDie(), managerOptions)
+	if err != nil {
+		return fmt.Errorf("unable to start manager: %w", err)
+	}
 
-	setupLog.V(0).Info(
-		fmt.Sprintf(
-			"Default enforce ownership of pre-existing secrets: %t",
-			defaultEnforceOwnership,
-		),
-	)
+	o.logSettings()
 
-	if err = (&controllers.SopsSecretReconciler{
+	reconciler := &controllers.SopsSecretReconciler{
 		Client:                  mgr.GetClient(),
 		Log:                     ctrl.Log.WithName("controllers").WithName("SopsSecret"),
 		Scheme:                  mgr.GetScheme(),
-		RequeueAfter:            requeueAfter,
-		DefaultEnforceOwnership: defaultEnforceOwnership,
-	}).SetupWithManager(mgr); err != nil {
-		setupLog.Error(err, "unable to create controller", "controller", "SopsSecret")
-		os.Exit(1)
+		APIReader:               mgr.GetAPIReader(),
+		RequeueAfter:            o.requeueAfter,
+		DefaultEnforceOwnership: o.defaultEnforceOwnership,
+		RecreateStrategy:        o.recreateStrategy,
+		VerifyMAC:               o.verifyMAC,
+		RecipientPolicy:         o.recipientPolicy,
+		ProtectedSecretPolicy:   o.protectedSecretPolicy,
+		Recorder:                mgr.GetEventRecorder("sops-secrets-operator"),
+		ExpiryWarningWindow:     o.expiryWarningWindow,
+		MaxDataKeyAge:           o.maxDataKeyAge,
+		OperatorNamespace:       o.operatorNamespace,
+		PauseConfigMap:          o.pauseConfigMap,
+		NamespaceSuspend:        o.namespaceSuspend,
+		MaxConcurrentReconciles: o.maxConcurrentReconciles,
+		BackoffBaseDelay:        o.backoffBaseDelay,
+		BackoffMaxDelay:         o.backoffMaxDelay,
+	}
+
+	if operatorConfig != nil {
+		live := &liveConfig{logLevel: logLevel, logLevelFlag: logLevelFromFlag, reconciler: reconciler}
+		// Applied before the controller is set up, SopsSecrets are not re-enqueued
+		live.apply(context.Background(), operatorConfig)
+		if err := mgr.Add(
+			operatorconfig.NewWatcher(o.configFile, operatorConfigContent, live.apply, ctrl.Log.WithName("config")),
+		); err != nil {
+			return fmt.Errorf("unable to add operator configuration watcher: %w", err)
+		}
+	}
+
+	if o.auditOptions.Path != "" || o.auditOptions.URL != "" {
+		auditLogger, err := audit.NewLogger(o.auditOptions, ctrl.Log.WithName("audit"))
+		if err != nil {
+			return fmt.Errorf("unable to create audit logger: %w", err)
+		}
+		if err := mgr.Add(auditLogger); err != nil {
+			return fmt.Errorf("unable to add audit logger: %w", err)
+		}
+		reconciler.Audit = auditLogger
+		setupLog.V(0).Info("Decryption audit log is enabled")
+	}
+
+	var defaultAgeRecipient func() string
+	if o.ageKeys {
+		o.ageKeysOptions.Namespace = o.operatorNamespace
+		o.ageKeysOptions.OnChange = controllers.SetManagedAgeIdentities
+		ageKeysManager, err := agekeys.NewManager(
+			o.ageKeysOptions, mgr.GetClient(), mgr.GetAPIReader(), ctrl.Log.WithName("agekeys"),
+		)
+		if err != nil {
+			return fmt.Errorf("unable to create age keys manager: %w", err)
+		}
+		if err := mgr.Add(ageKeysManager); err != nil {
+			return fmt.Errorf("unable to add age keys manager: %w", err)
+		}
+		if o.ageRecipientAddr != "" {
+			if err := mgr.Add(&agekeys.RecipientServer{Addr: o.ageRecipientAddr, Handler: ageKeysManager}); err != nil {
+				return fmt.Errorf("unable to add age recipient server: %w", err)
+			}
+		}
+		defaultAgeRecipient = ageKeysManager.Recipient
+		setupLog.V(0).Info(
+			fmt.Sprintf(
+				"Age identities are managed in Secret %s/%s, recipient is published in ConfigMap %s/%s",
+				o.operatorNamespace, o.ageKeysOptions.SecretName, o.operatorNamespace, o.ageKeysOptions.ConfigMapName,
+			),
+		)
+	}
+
+	if err := reconciler.SetupWithManager(mgr); err != nil {
+		return fmt.Errorf("unable to create controller SopsSecret: %w", err)
+	}
+	if err := mgr.Add(&controllers.ManagedLabelMigration{
+		Client:     mgr.GetClient(),
+		APIReader:  mgr.GetAPIReader(),
+		Namespaces: slices.Collect(maps.Keys(cacheOptions.DefaultNamespaces)),
+		Log:        ctrl.Log.WithName("controllers").WithName("ManagedLabelMigration"),
+	}); err != nil {
+		return fmt.Errorf("unable to add managed label migration: %w", err)
+	}
+	if len(o.keyReloadOptions.AgeKeyFiles) > 0 || o.keyReloadOptions.GPGKeysDir != "" {
+		o.keyReloadOptions.OnAgeIdentities = controllers.SetReloadedAgeIdentities
+		o.keyReloadOptions.OnReload = func(ctx context.Context) {
+			controllers.ResetKeyCaches()
+			reconciler.RequeueDecryptErrors(ctx)
+		}
+		keyReloader, err := keyreload.NewReloader(o.keyReloadOptions, ctrl.Log.WithName("keyreload"))
+		if err != nil {
+			return fmt.Errorf("unable to create key reloader: %w", err)
+		}
+		if err := mgr.Add(keyReloader); err != nil {
+			return fmt.Errorf("unable to add key reloader: %w", err)
+		}
+		if o.keyReloadOptions.GPGKeysDir != "" {
+			controllers.SetGnuPGHome(keyReloader.AcquireGnuPGHome)
+		}
+		setupLog.V(0).Info(
+			fmt.Sprintf(
+				"Reloading age key files [%s] and GnuPG keyring from %q every %s",
+				strings.Join(o.keyReloadOptions.AgeKeyFiles, ", "), o.keyReloadOptions.GPGKeysDir, o.keyReloadOptions.Interval,
+			),
+		)
+	}
+	if o.plaintextWebhook != sopssecretwebhook.PlaintextModeDisabled {
+		defaulter := &sopssecretwebhook.PlaintextSopsSecretDefaulter{
+			Mode:             o.plaintextWebhook,
+			Reader:           mgr.GetAPIReader(),
+			DefaultRecipient: defaultAgeRecipient,
+			Log:              ctrl.Log.WithName("webhooks").WithName("SopsSecret"),
+		}
+		if err := defaulter.SetupWithManager(mgr); err != nil {
+			return fmt.Errorf("unable to create webhook SopsSecret: %w", err)
+		}
 	}
 	//+kubebuilder:scaffold:builder
 
 	if err := mgr.AddHealthzCheck("healthz", healthz.Ping); err != nil {
-		setupLog.Error(err, "unable to set up health check")
-		os.Exit(1)
+		return fmt.Errorf("unable to set up health check: %w", err)
 	}
 	if err := mgr.AddReadyzCheck("readyz", healthz.Ping); err != nil {
-		setupLog.Error(err, "unable to set up ready check")
-		os.Exit(1)
+		return fmt.Errorf("unable to set up ready check: %w", err)
+	}
+
+	decryptionReadiness := &controllers.DecryptionReadiness{
+		Reader:   mgr.GetAPIReader(),
+		Canary:   o.canary,
+		Interval: o.readinessCheckInterval,
+		Log:      ctrl.Log.WithName("readiness"),
+	}
+	if err := mgr.Add(decryptionReadiness); err != nil {
+		return fmt.Errorf("unable to add decryption readiness checks: %w", err)
+	}
+	for _, name := range decryptionReadiness.Checks() {
+		if err := mgr.AddReadyzCheck("decrypt-"+name, decryptionReadiness.Checker(name)); err != nil {
+			return fmt.Errorf("unable to set up ready check: %w", err)
+		}
 	}
 
 	setupLog.Info("starting manager")
 	if err := mgr.Start(ctrl.SetupSignalHandler()); err != nil {
-		setupLog.Error(err, "problem running manager")
-		os.Exit(1)
+		return fmt.Errorf("problem running manager: %w", err)
 	}
+	return nil
 }
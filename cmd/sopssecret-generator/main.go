@@ -0,0 +1,36 @@
+/* This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at https://mozilla.org/MPL/2.0/. */
+
+// sopssecret-generator is a KRM function which generates encrypted SopsSecret
+// resources, it can be used as kustomize generator.
+package main
+
+import (
+	"fmt"
+	"io"
+	"os"
+
+	sopslogging "github.com/getsops/sops/v3/logging"
+
+	"github.com/isindir/sops-secrets-operator/internal/generator"
+)
+
+func main() {
+	// sops library logs with logrus to stderr, which is reserved for function errors
+	for k := range sopslogging.Loggers {
+		sopslogging.Loggers[k].Out = io.Discard
+	}
+
+	// kustomize runs exec functions in the kustomization directory
+	baseDir, err := os.Getwd()
+	if err != nil {
+		_, _ = fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+
+	if err := generator.RunFunction(os.Stdin, os.Stdout, baseDir); err != nil {
+		_, _ = fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+}
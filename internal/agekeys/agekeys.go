@@ -0,0 +1,323 @@
+/* This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at https://mozilla.org/MPL/2.0/. */
+
+// Package agekeys manages age identities of the operator, identities are
+// persisted in a Secret in operator namespace and the current recipient is
+// published in a ConfigMap and over HTTP
+package agekeys
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"filippo.io/age"
+	"github.com/go-logr/logr"
+	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+)
+
+const (
+	// IdentitiesKey is the key of the Secret holding age identities in age
+	// key file format, the last identity is the current one
+	IdentitiesKey = "keys.txt"
+	// RecipientKey is the key of the ConfigMap holding the current recipient
+	RecipientKey = "recipient"
+
+	// DefaultSecretName is the default name of the Secret holding age identities
+	DefaultSecretName = "sops-secrets-operator-age-keys"
+	// DefaultConfigMapName is the default name of the ConfigMap publishing the current recipient
+	DefaultConfigMapName = "sops-secrets-operator-age-recipient"
+
+	createdPrefix   = "# created: "
+	publicKeyPrefix = "# public key: "
+
+	// resyncInterval is the maximum time between reads of the Secret, so that
+	// restored or manually edited identities are picked up
+	resyncInterval = 10 * time.Minute
+	// retryInterval is the time to wait after failed sync
+	retryInterval = 30 * time.Second
+)
+
+// Identity is an age identity with its creation time
+type Identity struct {
+	Created  time.Time
+	Identity *age.X25519Identity
+}
+
+// Recipient returns the public key of the identity
+func (i Identity) Recipient() string {
+	return i.Identity.Recipient().String()
+}
+
+// Options configures Manager
+type Options struct {
+	// Namespace of the Secret and ConfigMap, normally operator namespace
+	Namespace string
+	// SecretName is the name of the Secret holding age identities
+	SecretName string
+	// ConfigMapName is the name of the ConfigMap publishing the current recipient
+	ConfigMapName string
+	// RotationInterval is the age of the current identity after which a new
+	// identity is generated, zero disables rotation
+	RotationInterval time.Duration
+	// OnChange is called with all identities every time they are loaded
+	OnChange func(identities []age.Identity)
+}
+
+// Manager generates, rotates and loads age identities of the operator
+type Manager struct {
+	opts   Options
+	client client.Client
+	reader client.Reader
+	log    logr.Logger
+
+	mu        sync.RWMutex
+	recipient string
+}
+
+// NewManager creates age identities manager, reader should not be backed by
+// cache, so that concurrent replicas do not generate conflicting identities
+func NewManager(opts Options, c client.Client, reader client.Reader, log logr.Logger) (*Manager, error) {
+	if opts.Namespace == "" {
+		return nil, errors.New("age keys namespace must be set")
+	}
+	if opts.SecretName == "" {
+		opts.SecretName = DefaultSecretName
+	}
+	if opts.ConfigMapName == "" {
+		opts.ConfigMapName = DefaultConfigMapName
+	}
+	if opts.RotationInterval < 0 {
+		return nil, errors.New("age key rotation interval must not be negative")
+	}
+	return &Manager{opts: opts, client: c, reader: reader, log: log}, nil
+}
+
+// Start syncs identities until ctx is done
+func (m *Manager) Start(ctx context.Context) error {
+	for {
+		wait, err := m.sync(ctx, time.Now())
+		if err != nil {
+			m.log.Error(err, "Failed to sync age identities")
+			wait = retryInterval
+		}
+
+		timer := time.NewTimer(wait)
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return nil
+		case <-timer.C:
+		}
+	}
+}
+
+// NeedLeaderElection returns false, all replicas need identities to decrypt,
+// concurrent writes are resolved by optimistic concurrency of the API server
+func (m *Manager) NeedLeaderElection() bool {
+	return false
+}
+
+// Recipient returns the current recipient, empty before identities are loaded
+func (m *Manager) Recipient() string {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	return m.recipient
+}
+
+// ServeHTTP responds with the current recipient
+func (m *Manager) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		w.Header().Set("Allow", "GET, HEAD")
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	recipient := m.Recipient()
+	if recipient == "" {
+		http.Error(w, "age recipient is not available yet", http.StatusServiceUnavailable)
+		return
+	}
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	_, _ = fmt.Fprintln(w, recipient)
+}
+
+// sync loads identities from the Secret, generates the first identity or
+// rotates the current one when needed and publishes the current recipient,
+// returns time to wait before the next sync
+func (m *Manager) sync(ctx context.Context, now time.Time) (time.Duration, error) {
+	secret := &corev1.Secret{}
+	err := m.reader.Get(ctx, types.NamespacedName{Namespace: m.opts.Namespace, Name: m.opts.SecretName}, secret)
+	secretExists := err == nil
+	if err != nil && !apierrors.IsNotFound(err) {
+		return 0, err
+	}
+
+	identities, err := ParseIdentities(secret.Data[IdentitiesKey])
+	if err != nil {
+		return 0, fmt.Errorf("secret %s/%s: %w", m.opts.Namespace, m.opts.SecretName, err)
+	}
+
+	if len(identities) == 0 || m.rotationDue(identities[len(identities)-1], now) {
+		identity, err := age.GenerateX25519Identity()
+		if err != nil {
+			return 0, err
+		}
+		identities = append(identities, Identity{Created: now.UTC().Truncate(time.Second), Identity: identity})
+		if err := m.writeSecret(ctx, secret, secretExists, identities); err != nil {
+			return 0, err
+		}
+		m.log.V(0).Info("Generated age identity", "recipient", identity.Recipient().String())
+	}
+
+	current := identities[len(identities)-1]
+	if err := m.publishRecipient(ctx, current.Recipient()); err != nil {
+		return 0, err
+	}
+
+	m.mu.Lock()
+	m.recipient = current.Recipient()
+	m.mu.Unlock()
+
+	if m.opts.OnChange != nil {
+		ageIdentities := make([]age.Identity, 0, len(identities))
+		for _, identity := range identities {
+			ageIdentities = append(ageIdentities, identity.Identity)
+		}
+		m.opts.OnChange(ageIdentities)
+	}
+
+	wait := resyncInterval
+	if m.opts.RotationInterval > 0 {
+		if untilRotation := current.Created.Add(m.opts.RotationInterval).Sub(now); untilRotation < wait {
+			wait = untilRotation
+		}
+	}
+	return wait, nil
+}
+
+func (m *Manager) rotationDue(current Identity, now time.Time) bool {
+	return m.opts.RotationInterval > 0 && !now.Before(current.Created.Add(m.opts.RotationInterval))
+}
+
+func (m *Manager) writeSecret(ctx context.Context, secret *corev1.Secret, exists bool, identities []Identity) error {
+	if !exists {
+		secret = &corev1.Secret{
+			ObjectMeta: metav1.ObjectMeta{Namespace: m.opts.Namespace, Name: m.opts.SecretName},
+			Type:       corev1.SecretTypeOpaque,
+		}
+	}
+	secret.Data = map[string][]byte{IdentitiesKey: FormatIdentities(identities)}
+	if exists {
+		return m.client.Update(ctx, secret)
+	}
+	return m.client.Create(ctx, secret)
+}
+
+func (m *Manager) publishRecipient(ctx context.Context, recipient string) error {
+	configMap := &corev1.ConfigMap{}
+	err := m.reader.Get(ctx, types.NamespacedName{Namespace: m.opts.Namespace, Name: m.opts.ConfigMapName}, configMap)
+	if apierrors.IsNotFound(err) {
+		configMap = &corev1.ConfigMap{
+			ObjectMeta: metav1.ObjectMeta{Namespace: m.opts.Namespace, Name: m.opts.ConfigMapName},
+			Data:       map[string]string{RecipientKey: recipient},
+		}
+		return m.client.Create(ctx, configMap)
+	}
+	if err != nil {
+		return err
+	}
+	if configMap.Data[RecipientKey] == recipient {
+		return nil
+	}
+	if configMap.Data == nil {
+		configMap.Data = map[string]string{}
+	}
+	configMap.Data[RecipientKey] = recipient
+	return m.client.Update(ctx, configMap)
+}
+
+// ParseIdentities parses age key file, creation time is read from
+// "# created:" comment preceding the identity
+func ParseIdentities(data []byte) ([]Identity, error) {
+	var identities []Identity
+	var created time.Time
+
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		switch {
+		case strings.HasPrefix(line, createdPrefix):
+			t, err := time.Parse(time.RFC3339, strings.TrimPrefix(line, createdPrefix))
+			if err != nil {
+				return nil, fmt.Errorf("invalid identity creation time: %w", err)
+			}
+			created = t
+		case line == "" || strings.HasPrefix(line, "#"):
+		default:
+			identity, err := age.ParseX25519Identity(line)
+			if err != nil {
+				return nil, fmt.Errorf("invalid age identity: %w", err)
+			}
+			identities = append(identities, Identity{Created: created, Identity: identity})
+			created = time.Time{}
+		}
+	}
+	return identities, scanner.Err()
+}
+
+// FormatIdentities formats identities as age key file, which can be used
+// with SOPS_AGE_KEY_FILE
+func FormatIdentities(identities []Identity) []byte {
+	var buf bytes.Buffer
+	for _, identity := range identities {
+		if !identity.Created.IsZero() {
+			buf.WriteString(createdPrefix + identity.Created.UTC().Format(time.RFC3339) + "\n")
+		}
+		buf.WriteString(publicKeyPrefix + identity.Recipient() + "\n")
+		buf.WriteString(identity.Identity.String() + "\n")
+	}
+	return buf.Bytes()
+}
+
+// RecipientServer serves the current recipient over HTTP
+type RecipientServer struct {
+	Addr    string
+	Handler http.Handler
+}
+
+// Start serves until ctx is done
+func (s *RecipientServer) Start(ctx context.Context) error {
+	mux := http.NewServeMux()
+	mux.Handle("/v1/recipient", s.Handler)
+	server := &http.Server{Addr: s.Addr, Handler: mux, ReadHeaderTimeout: 10 * time.Second}
+
+	errs := make(chan error, 1)
+	go func() {
+		errs <- server.ListenAndServe()
+	}()
+
+	select {
+	case err := <-errs:
+		return err
+	case <-ctx.Done():
+		shutdownCtx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		return server.Shutdown(shutdownCtx)
+	}
+}
+
+// NeedLeaderElection returns false, recipient is served by all replicas
+func (s *RecipientServer) NeedLeaderElection() bool {
+	return false
+}
@@ -0,0 +1,143 @@
+/* This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at https://mozilla.org/MPL/2.0/. */
+
+package agekeys
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"filippo.io/age"
+	"github.com/go-logr/logr"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/types"
+	clientgoscheme "k8s.io/client-go/kubernetes/scheme"
+	"sigs.k8s.io/controller-runtime/pkg/client/fake"
+)
+
+func TestFormatParseIdentities(t *testing.T) {
+	identity, err := age.GenerateX25519Identity()
+	if err != nil {
+		t.Fatal(err)
+	}
+	created := time.Date(2026, 1, 10, 12, 0, 0, 0, time.UTC)
+
+	identities, err := ParseIdentities(FormatIdentities([]Identity{{Created: created, Identity: identity}}))
+	if err != nil {
+		t.Fatalf("ParseIdentities() error = %v", err)
+	}
+	if len(identities) != 1 || !identities[0].Created.Equal(created) || identities[0].Recipient() != identity.Recipient().String() {
+		t.Errorf("expected identity created at %s to round trip, got %v", created, identities)
+	}
+
+	if _, err := ParseIdentities([]byte("AGE-SECRET-KEY-INVALID\n")); err == nil {
+		t.Error("expected error for invalid identity")
+	}
+}
+
+func TestManagerSync(t *testing.T) {
+	scheme := runtime.NewScheme()
+	if err := clientgoscheme.AddToScheme(scheme); err != nil {
+		t.Fatal(err)
+	}
+	k8sClient := fake.NewClientBuilder().WithScheme(scheme).Build()
+
+	var loaded []age.Identity
+	m, err := NewManager(Options{
+		Namespace:        "sops",
+		RotationInterval: 24 * time.Hour,
+		OnChange:         func(identities []age.Identity) { loaded = identities },
+	}, k8sClient, k8sClient, logr.Discard())
+	if err != nil {
+		t.Fatalf("NewManager() error = %v", err)
+	}
+
+	ctx := context.Background()
+	now := time.Date(2026, 1, 10, 12, 0, 0, 0, time.UTC)
+	readSecret := func() []Identity {
+		t.Helper()
+		secret := &corev1.Secret{}
+		if err := k8sClient.Get(ctx, types.NamespacedName{Namespace: "sops", Name: DefaultSecretName}, secret); err != nil {
+			t.Fatalf("failed to get age keys secret: %v", err)
+		}
+		identities, err := ParseIdentities(secret.Data[IdentitiesKey])
+		if err != nil {
+			t.Fatal(err)
+		}
+		return identities
+	}
+	readRecipient := func() string {
+		t.Helper()
+		configMap := &corev1.ConfigMap{}
+		if err := k8sClient.Get(ctx, types.NamespacedName{Namespace: "sops", Name: DefaultConfigMapName}, configMap); err != nil {
+			t.Fatalf("failed to get age recipient configmap: %v", err)
+		}
+		return configMap.Data[RecipientKey]
+	}
+
+	// First sync generates identity
+	wait, err := m.sync(ctx, now)
+	if err != nil {
+		t.Fatalf("sync() error = %v", err)
+	}
+	identities := readSecret()
+	if len(identities) != 1 || len(loaded) != 1 {
+		t.Fatalf("expected 1 identity generated and loaded, got %d and %d", len(identities), len(loaded))
+	}
+	first := identities[0].Recipient()
+	if readRecipient() != first || m.Recipient() != first {
+		t.Errorf("expected recipient %s to be published, got %q and %q", first, readRecipient(), m.Recipient())
+	}
+	if wait != resyncInterval {
+		t.Errorf("expected next sync after %s, got %s", resyncInterval, wait)
+	}
+
+	// Sync before rotation is due keeps identity
+	if _, err := m.sync(ctx, now.Add(time.Hour)); err != nil {
+		t.Fatalf("sync() error = %v", err)
+	}
+	if identities := readSecret(); len(identities) != 1 {
+		t.Fatalf("expected identity not to be rotated, got %d identities", len(identities))
+	}
+
+	// Rotation keeps old identity for decryption
+	if _, err := m.sync(ctx, now.Add(24*time.Hour)); err != nil {
+		t.Fatalf("sync() error = %v", err)
+	}
+	identities = readSecret()
+	if len(identities) != 2 || len(loaded) != 2 || identities[0].Recipient() != first {
+		t.Fatalf("expected old identity to be kept after rotation, got %d identities and %d loaded", len(identities), len(loaded))
+	}
+	if current := identities[1].Recipient(); readRecipient() != current || current == first {
+		t.Errorf("expected new recipient %s to be published, got %q", current, readRecipient())
+	}
+}
+
+func TestManagerServeHTTP(t *testing.T) {
+	m := &Manager{}
+
+	rec := httptest.NewRecorder()
+	m.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/v1/recipient", nil))
+	if rec.Code != http.StatusServiceUnavailable {
+		t.Errorf("expected status %d before identities are loaded, got %d", http.StatusServiceUnavailable, rec.Code)
+	}
+
+	m.recipient = "age1recipient"
+	rec = httptest.NewRecorder()
+	m.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/v1/recipient", nil))
+	if rec.Code != http.StatusOK || strings.TrimSpace(rec.Body.String()) != "age1recipient" {
+		t.Errorf("expected recipient to be served, got %d %q", rec.Code, rec.Body.String())
+	}
+
+	rec = httptest.NewRecorder()
+	m.ServeHTTP(rec, httptest.NewRequest(http.MethodPost, "/v1/recipient", nil))
+	if rec.Code != http.StatusMethodNotAllowed {
+		t.Errorf("expected status %d for POST, got %d", http.StatusMethodNotAllowed, rec.Code)
+	}
+}
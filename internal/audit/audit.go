@@ -0,0 +1,276 @@
+/* This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at https://mozilla.org/MPL/2.0/. */
+
+// Package audit records SopsSecret decryptions and child Secret writes as
+// JSON lines. Events carry object names, key identifiers and key names only,
+// values of secrets are never recorded.
+package audit
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"time"
+
+	"github.com/go-logr/logr"
+	"github.com/prometheus/client_golang/prometheus"
+	"sigs.k8s.io/controller-runtime/pkg/metrics"
+)
+
+const (
+	// ActionDecrypt - SopsSecret was decrypted
+	ActionDecrypt = "decrypt"
+	// ActionCreate - child Secret was created
+	ActionCreate = "create"
+	// ActionUpdate - child Secret was updated
+	ActionUpdate = "update"
+	// ActionDelete - child Secret was deleted to be recreated or because it is
+	// no longer templated
+	ActionDelete = "delete"
+	// ActionMount - secret template was mounted into a pod volume by the
+	// Secrets Store CSI driver provider
+	ActionMount = "mount"
+
+	// ResultSuccess - action succeeded
+	ResultSuccess = "success"
+	// ResultFailure - action failed
+	ResultFailure = "failure"
+)
+
+// Key identifies a sops master key, Provider is one of age, pgp, kms,
+// gcp_kms, azure_kv, hc_vault. Unverified is set when the key which decrypted
+// the data key could not be attributed and ID is taken from sops metadata,
+// e.g. age data key decrypted by a remote key service.
+type Key struct {
+	Provider   string `json:"provider"`
+	ID         string `json:"id"`
+	Unverified bool   `json:"unverified,omitempty"`
+}
+
+// Event is an audit record. Reason is a SopsSecret status message, error
+// messages are not recorded as they can not be guaranteed free of secret data.
+// Secret of a mount event is the secret template name, Reason of a failed
+// mount without a matching status message is the gRPC status code returned to
+// the CSI driver.
+type Event struct {
+	Time        time.Time `json:"time"`
+	Action      string    `json:"action"`
+	Namespace   string    `json:"namespace"`
+	SopsSecret  string    `json:"sopsSecret"`
+	UID         string    `json:"uid,omitempty"`
+	Keys        []Key     `json:"keys,omitempty"`
+	Secret      string    `json:"secret,omitempty"`
+	Pod         string    `json:"pod,omitempty"`
+	ChangedKeys []string  `json:"changedKeys,omitempty"`
+	Result      string    `json:"result"`
+	Reason      string    `json:"reason,omitempty"`
+}
+
+// Recorder accepts audit events
+type Recorder interface {
+	Record(event Event)
+}
+
+// Options configure Logger
+type Options struct {
+	// Path of the file to append events to, "-" writes to stdout
+	Path string
+	// URL to POST batches of events to as newline delimited JSON
+	URL string
+	// BufferSize is the number of events kept in memory, events are dropped
+	// when the buffer is full
+	BufferSize int
+	// BatchSize is the maximum number of events sent in a single request
+	BatchSize int
+	// FlushInterval is the maximum time events are kept in the buffer
+	FlushInterval time.Duration
+	// Timeout of HTTP requests
+	Timeout time.Duration
+}
+
+var (
+	auditEventsDropped = prometheus.NewCounter(
+		prometheus.CounterOpts{
+			Name: "sopssecrets_audit_events_dropped_total",
+			Help: "Number of audit events dropped because buffer was full or sink failed",
+		},
+	)
+
+	auditEventsWritten = prometheus.NewCounter(
+		prometheus.CounterOpts{
+			Name: "sopssecrets_audit_events_written_total",
+			Help: "Number of audit events written to sink",
+		},
+	)
+)
+
+func init() {
+	metrics.Registry.MustRegister(
+		auditEventsDropped,
+		auditEventsWritten,
+	)
+}
+
+// Logger buffers events and writes them to a file, stdout or HTTP endpoint
+// in batches. Logger implements manager.Runnable, events are written only
+// after Start is called.
+type Logger struct {
+	opts   Options
+	events chan Event
+	send   func(ctx context.Context, batch []byte) error
+	closer io.Closer
+	log    logr.Logger
+}
+
+// NewLogger validates options and creates Logger
+func NewLogger(opts Options, log logr.Logger) (*Logger, error) {
+	if (opts.Path == "") == (opts.URL == "") {
+		return nil, fmt.Errorf("exactly one of audit log path or url must be set")
+	}
+	if opts.BufferSize < 1 {
+		opts.BufferSize = 1000
+	}
+	if opts.BatchSize < 1 {
+		opts.BatchSize = 100
+	}
+	if opts.FlushInterval <= 0 {
+		opts.FlushInterval = 5 * time.Second
+	}
+	if opts.Timeout <= 0 {
+		opts.Timeout = 10 * time.Second
+	}
+
+	l := &Logger{
+		opts:   opts,
+		events: make(chan Event, opts.BufferSize),
+		log:    log,
+	}
+
+	switch {
+	case opts.Path == "-":
+		l.send = writerSender(os.Stdout)
+	case opts.Path != "":
+		file, err := os.OpenFile(opts.Path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0o600)
+		if err != nil {
+			return nil, fmt.Errorf("failed to open audit log: %w", err)
+		}
+		l.send = writerSender(file)
+		l.closer = file
+	default:
+		client := &http.Client{Timeout: opts.Timeout}
+		l.send = httpSender(client, opts.URL)
+	}
+	return l, nil
+}
+
+// Record queues event, event is dropped if the buffer is full
+func (l *Logger) Record(event Event) {
+	if event.Time.IsZero() {
+		event.Time = time.Now().UTC()
+	}
+	select {
+	case l.events <- event:
+	default:
+		auditEventsDropped.Inc()
+	}
+}
+
+// Start writes queued events until ctx is cancelled, remaining events are
+// flushed and the audit log file is closed before returning
+func (l *Logger) Start(ctx context.Context) error {
+	ticker := time.NewTicker(l.opts.FlushInterval)
+	defer ticker.Stop()
+	if l.closer != nil {
+		defer func() {
+			if err := l.closer.Close(); err != nil {
+				l.log.Error(err, "Failed to close audit log")
+			}
+		}()
+	}
+
+	var batch []Event
+	flush := func(ctx context.Context) {
+		if len(batch) == 0 {
+			return
+		}
+		if err := l.write(ctx, batch); err != nil {
+			l.log.Error(err, "Failed to write audit events", "events", len(batch))
+			auditEventsDropped.Add(float64(len(batch)))
+		} else {
+			auditEventsWritten.Add(float64(len(batch)))
+		}
+		batch = batch[:0]
+	}
+
+	for {
+		select {
+		case event := <-l.events:
+			batch = append(batch, event)
+			if len(batch) >= l.opts.BatchSize {
+				flush(ctx)
+			}
+		case <-ticker.C:
+			flush(ctx)
+		case <-ctx.Done():
+			for {
+				select {
+				case event := <-l.events:
+					batch = append(batch, event)
+				default:
+					shutdownCtx, cancel := context.WithTimeout(context.Background(), l.opts.Timeout)
+					flush(shutdownCtx)
+					cancel()
+					return nil
+				}
+			}
+		}
+	}
+}
+
+func (l *Logger) write(ctx context.Context, batch []Event) error {
+	var buf bytes.Buffer
+	encoder := json.NewEncoder(&buf)
+	for _, event := range batch {
+		if err := encoder.Encode(event); err != nil {
+			return err
+		}
+	}
+	return l.send(ctx, buf.Bytes())
+}
+
+func writerSender(w io.Writer) func(context.Context, []byte) error {
+	return func(_ context.Context, batch []byte) error {
+		_, err := w.Write(batch)
+		return err
+	}
+}
+
+func httpSender(client *http.Client, url string) func(context.Context, []byte) error {
+	return func(ctx context.Context, batch []byte) error {
+		req, err := http.NewRequestWithContext(ctx, http.MethodPost, url, bytes.NewReader(batch))
+		if err != nil {
+			return err
+		}
+		req.Header.Set("Content-Type", "application/x-ndjson")
+		resp, err := client.Do(req)
+		if err != nil {
+			return err
+		}
+		defer func() { _ = resp.Body.Close() }()
+		_, _ = io.Copy(io.Discard, resp.Body)
+		if resp.StatusCode < 200 || resp.StatusCode > 299 {
+			return fmt.Errorf("audit endpoint returned %s", resp.Status)
+		}
+		return nil
+	}
+}
+
+// NeedLeaderElection returns false, events are written by every replica
+func (l *Logger) NeedLeaderElection() bool {
+	return false
+}
@@ -0,0 +1,144 @@
+/* This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at https://mozilla.org/MPL/2.0/. */
+
+package audit
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/go-logr/logr"
+)
+
+func testEvent(secret string) Event {
+	return Event{
+		Action:      ActionUpdate,
+		Namespace:   "default",
+		SopsSecret:  "sopssecret",
+		Secret:      secret,
+		ChangedKeys: []string{"password"},
+		Result:      ResultSuccess,
+	}
+}
+
+func TestNewLoggerValidation(t *testing.T) {
+	if _, err := NewLogger(Options{}, logr.Discard()); err == nil {
+		t.Error("expected error when neither path nor url is set")
+	}
+	if _, err := NewLogger(Options{Path: "-", URL: "http://localhost"}, logr.Discard()); err == nil {
+		t.Error("expected error when both path and url are set")
+	}
+}
+
+func TestLoggerFile(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "audit.log")
+	logger, err := NewLogger(Options{Path: path, FlushInterval: time.Hour}, logr.Discard())
+	if err != nil {
+		t.Fatalf("NewLogger() error = %v", err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		_ = logger.Start(ctx)
+		close(done)
+	}()
+
+	logger.Record(testEvent("secret-0"))
+	logger.Record(testEvent("secret-1"))
+	cancel()
+	<-done
+
+	if err := logger.closer.Close(); !errors.Is(err, os.ErrClosed) {
+		t.Errorf("expected audit log file closed when Start returns, got %v", err)
+	}
+
+	file, err := os.Open(path)
+	if err != nil {
+		t.Fatalf("failed to open audit log: %v", err)
+	}
+	defer func() { _ = file.Close() }()
+
+	var secrets []string
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		event := Event{}
+		if err := json.Unmarshal(scanner.Bytes(), &event); err != nil {
+			t.Fatalf("audit log line is not JSON: %v", err)
+		}
+		if event.Time.IsZero() {
+			t.Error("expected event time to be set")
+		}
+		secrets = append(secrets, event.Secret)
+	}
+	if strings.Join(secrets, ",") != "secret-0,secret-1" {
+		t.Errorf("expected events for secret-0 and secret-1 flushed on shutdown, got %v", secrets)
+	}
+}
+
+func TestLoggerHTTPBatching(t *testing.T) {
+	var mu sync.Mutex
+	var batches []int
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Content-Type") != "application/x-ndjson" {
+			t.Errorf("unexpected content type %q", r.Header.Get("Content-Type"))
+		}
+		body, _ := io.ReadAll(r.Body)
+		mu.Lock()
+		batches = append(batches, strings.Count(string(body), "\n"))
+		mu.Unlock()
+	}))
+	defer server.Close()
+
+	logger, err := NewLogger(Options{URL: server.URL, BatchSize: 2, FlushInterval: time.Hour}, logr.Discard())
+	if err != nil {
+		t.Fatalf("NewLogger() error = %v", err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		_ = logger.Start(ctx)
+		close(done)
+	}()
+
+	for i := 0; i < 3; i++ {
+		logger.Record(testEvent("secret"))
+	}
+	time.Sleep(100 * time.Millisecond)
+	cancel()
+	<-done
+
+	mu.Lock()
+	defer mu.Unlock()
+	if len(batches) != 2 || batches[0] != 2 || batches[1] != 1 {
+		t.Errorf("expected batches of 2 and 1 events, got %v", batches)
+	}
+}
+
+func TestLoggerBoundedBuffer(t *testing.T) {
+	logger, err := NewLogger(Options{Path: filepath.Join(t.TempDir(), "audit.log"), BufferSize: 2}, logr.Discard())
+	if err != nil {
+		t.Fatalf("NewLogger() error = %v", err)
+	}
+
+	// Logger is not started, Record must not block when buffer is full
+	for i := 0; i < 5; i++ {
+		logger.Record(testEvent("secret"))
+	}
+	if len(logger.events) != 2 {
+		t.Errorf("expected 2 buffered events, got %d", len(logger.events))
+	}
+}
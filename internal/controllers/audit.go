@@ -0,0 +1,84 @@
+/* This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at https://mozilla.org/MPL/2.0/. */
+
+package controllers
+
+import (
+	"bytes"
+	"sort"
+
+	corev1 "k8s.io/api/core/v1"
+
+	isindirv1alpha3 "github.com/isindir/sops-secrets-operator/api/v1alpha3"
+	"github.com/isindir/sops-secrets-operator/internal/audit"
+)
+
+// auditDecrypt records decryption of SopsSecret, failureStatus is empty on success
+func (r *SopsSecretReconciler) auditDecrypt(
+	sopsSecret *isindirv1alpha3.SopsSecret, keys []audit.Key, failureStatus string,
+) {
+	if r.Audit == nil {
+		return
+	}
+	r.Audit.Record(newAuditEvent(sopsSecret, audit.ActionDecrypt, failureStatus, func(event *audit.Event) {
+		event.Keys = keys
+	}))
+}
+
+// auditSecretWrite records creation or update of a child secret, only names
+// of changed keys are recorded, failureStatus is empty on success
+func (r *SopsSecretReconciler) auditSecretWrite(
+	sopsSecret *isindirv1alpha3.SopsSecret, action string, secretName string, changedKeys []string, failureStatus string,
+) {
+	if r.Audit == nil {
+		return
+	}
+	r.Audit.Record(newAuditEvent(sopsSecret, action, failureStatus, func(event *audit.Event) {
+		event.Secret = secretName
+		event.ChangedKeys = changedKeys
+	}))
+}
+
+func newAuditEvent(
+	sopsSecret *isindirv1alpha3.SopsSecret, action string, failureStatus string, setFields func(*audit.Event),
+) audit.Event {
+	event := audit.Event{
+		Action:     action,
+		Namespace:  sopsSecret.Namespace,
+		SopsSecret: sopsSecret.Name,
+		UID:        string(sopsSecret.UID),
+		Result:     audit.ResultSuccess,
+	}
+	if failureStatus != "" {
+		event.Result = audit.ResultFailure
+		event.Reason = failureStatus
+	}
+	setFields(&event)
+	return event
+}
+
+// changedSecretKeys returns sorted names of keys added, removed or changed in
+// desired secret compared to existing secret, existing may be nil
+func changedSecretKeys(existing *corev1.Secret, desired *corev1.Secret) []string {
+	desiredData := secretData(desired)
+
+	var existingData map[string][]byte
+	if existing != nil {
+		existingData = existing.Data
+	}
+
+	var changed []string
+	for key, value := range desiredData {
+		if existingValue, ok := existingData[key]; !ok || !bytes.Equal(existingValue, value) {
+			changed = append(changed, key)
+		}
+	}
+	for key := range existingData {
+		if _, ok := desiredData[key]; !ok {
+			changed = append(changed, key)
+		}
+	}
+	sort.Strings(changed)
+	return changed
+}
@@ -0,0 +1,99 @@
+/* This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at https://mozilla.org/MPL/2.0/. */
+
+package controllers
+
+import (
+	"encoding/json"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/go-logr/logr"
+	corev1 "k8s.io/api/core/v1"
+
+	"github.com/isindir/sops-secrets-operator/internal/audit"
+)
+
+type testAuditRecorder struct {
+	events []audit.Event
+}
+
+func (r *testAuditRecorder) Record(event audit.Event) {
+	r.events = append(r.events, event)
+}
+
+func TestChangedSecretKeys(t *testing.T) {
+	tests := []struct {
+		name     string
+		existing *corev1.Secret
+		desired  *corev1.Secret
+		expected []string
+	}{
+		{
+			name:     "New secret - all keys changed",
+			desired:  &corev1.Secret{StringData: map[string]string{"b": "1", "a": "2"}},
+			expected: []string{"a", "b"},
+		},
+		{
+			name:     "Unchanged secret - no keys changed",
+			existing: &corev1.Secret{Data: map[string][]byte{"a": []byte("1")}},
+			desired:  &corev1.Secret{StringData: map[string]string{"a": "1"}},
+		},
+		{
+			name:     "Changed, added and removed keys",
+			existing: &corev1.Secret{Data: map[string][]byte{"a": []byte("1"), "b": []byte("2"), "c": []byte("3")}},
+			desired:  &corev1.Secret{StringData: map[string]string{"a": "1", "b": "changed", "d": "4"}},
+			expected: []string{"b", "c", "d"},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if result := changedSecretKeys(tt.existing, tt.desired); !reflect.DeepEqual(result, tt.expected) {
+				t.Errorf("changedSecretKeys() = %v, expected %v", result, tt.expected)
+			}
+		})
+	}
+}
+
+func TestAuditDecryptRecordsKeys(t *testing.T) {
+	setAgeKeyFile(t, filepath.Join("..", "..", "config", "age-test-key", "key-file.txt"))
+
+	sopsSecret := readTestSopsSecret(t, "00-test-secrets.yaml")
+	plainTextSopsSecret, keys, err := decryptSopsSecretInstance(sopsSecret, false, nil, logr.Discard())
+	if err != nil {
+		t.Fatalf("decryptSopsSecretInstance() error = %v", err)
+	}
+
+	recorder := &testAuditRecorder{}
+	r := &SopsSecretReconciler{Audit: recorder}
+	r.auditDecrypt(sopsSecret, keys, "")
+
+	if len(recorder.events) != 1 {
+		t.Fatalf("expected 1 audit event, got %d", len(recorder.events))
+	}
+	event := recorder.events[0]
+	expectedKey := audit.Key{Provider: "age", ID: sopsSecret.Sops.Age[0].Recipient}
+	if len(event.Keys) != 1 || event.Keys[0] != expectedKey {
+		t.Errorf("expected decrypting key %v, got %v", expectedKey, event.Keys)
+	}
+	if event.Result != audit.ResultSuccess {
+		t.Errorf("expected success result, got %q", event.Result)
+	}
+
+	// no plaintext value may appear in the audit record
+	encoded, err := json.Marshal(event)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, template := range plainTextSopsSecret.Spec.SecretsTemplate {
+		for _, value := range template.StringData {
+			if strings.Contains(string(encoded), value) {
+				t.Errorf("audit event contains plaintext value of %s", template.Name)
+			}
+		}
+	}
+}
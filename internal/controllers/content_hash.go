@@ -0,0 +1,91 @@
+/* This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at https://mozilla.org/MPL/2.0/. */
+
+package controllers
+
+import (
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"hash"
+	"slices"
+
+	corev1 "k8s.io/api/core/v1"
+	apiequality "k8s.io/apimachinery/pkg/api/equality"
+
+	isindirv1alpha3 "github.com/isindir/sops-secrets-operator/api/v1alpha3"
+)
+
+// EventReasonChildSecretDrift is the reason of events emitted when content
+// of a child secret was changed outside of the operator
+const EventReasonChildSecretDrift = "ChildSecretDrift"
+
+// contentHashPrefix prefixes hash algorithm to the content hash annotation value
+const contentHashPrefix = "sha256:"
+
+// secretData returns effective content of secret, StringData overrides Data
+// the same way as API server merges them on write
+func secretData(secret *corev1.Secret) map[string][]byte {
+	data := make(map[string][]byte, len(secret.Data)+len(secret.StringData))
+	for key, value := range secret.Data {
+		data[key] = value
+	}
+	for key, value := range secret.StringData {
+		data[key] = []byte(value)
+	}
+	return data
+}
+
+// secretContentHash returns hash of secret type and data, keys are hashed in
+// sorted order and every field is length prefixed
+func secretContentHash(secretType corev1.SecretType, data map[string][]byte) string {
+	h := sha256.New()
+	writeHashField(h, []byte(secretType))
+	keys := make([]string, 0, len(data))
+	for key := range data {
+		keys = append(keys, key)
+	}
+	slices.Sort(keys)
+	for _, key := range keys {
+		writeHashField(h, []byte(key))
+		writeHashField(h, data[key])
+	}
+	return contentHashPrefix + hex.EncodeToString(h.Sum(nil))
+}
+
+func writeHashField(h hash.Hash, field []byte) {
+	_ = binary.Write(h, binary.BigEndian, uint64(len(field)))
+	h.Write(field)
+}
+
+// setContentHash sets content hash annotation on secret created from template
+func setContentHash(secret *corev1.Secret) {
+	if secret.Annotations == nil {
+		secret.Annotations = map[string]string{}
+	}
+	secret.Annotations[isindirv1alpha3.SopsSecretContentHashAnnotation] = secretContentHash(secret.Type, secretData(secret))
+}
+
+// isContentDrifted returns true when data of secret in cluster does not match
+// its content hash annotation, secrets without annotation never drift
+func isContentDrifted(secret *corev1.Secret) bool {
+	recorded, ok := secret.Annotations[isindirv1alpha3.SopsSecretContentHashAnnotation]
+	return ok && recorded != secretContentHash(secret.Type, secret.Data)
+}
+
+// isSecretUpToDate compares type, labels, annotations, owner references and
+// effective content of secret in cluster with desired secret. Equal content
+// hash annotations stand for equal content unless secret in cluster drifted
+func isSecretUpToDate(inCluster *corev1.Secret, desired *corev1.Secret, drifted bool) bool {
+	if inCluster.Type != desired.Type ||
+		!apiequality.Semantic.DeepEqual(inCluster.Labels, desired.Labels) ||
+		!apiequality.Semantic.DeepEqual(inCluster.Annotations, desired.Annotations) ||
+		!apiequality.Semantic.DeepEqual(inCluster.OwnerReferences, desired.OwnerReferences) {
+		return false
+	}
+	if _, ok := desired.Annotations[isindirv1alpha3.SopsSecretContentHashAnnotation]; ok && !drifted {
+		return true
+	}
+	return apiequality.Semantic.DeepEqual(inCluster.Data, secretData(desired))
+}
@@ -0,0 +1,137 @@
+/* This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at https://mozilla.org/MPL/2.0/. */
+
+package controllers
+
+import (
+	"context"
+	"testing"
+
+	"github.com/go-logr/logr"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"sigs.k8s.io/controller-runtime/pkg/client/interceptor"
+
+	isindirv1alpha3 "github.com/isindir/sops-secrets-operator/api/v1alpha3"
+)
+
+func TestSecretContentHash(t *testing.T) {
+	base := secretContentHash(corev1.SecretTypeOpaque, map[string][]byte{"a": []byte("bc"), "d": []byte("e")})
+	if base != secretContentHash(corev1.SecretTypeOpaque, map[string][]byte{"d": []byte("e"), "a": []byte("bc")}) {
+		t.Error("expected hash not to depend on key order")
+	}
+	for name, other := range map[string]string{
+		"Different type":  secretContentHash(corev1.SecretTypeBasicAuth, map[string][]byte{"a": []byte("bc"), "d": []byte("e")}),
+		"Different value": secretContentHash(corev1.SecretTypeOpaque, map[string][]byte{"a": []byte("bc"), "d": []byte("f")}),
+		"Shifted bytes":   secretContentHash(corev1.SecretTypeOpaque, map[string][]byte{"ab": []byte("c"), "d": []byte("e")}),
+	} {
+		if other == base {
+			t.Errorf("%s: expected different hash", name)
+		}
+	}
+}
+
+func TestIsSecretUpToDate(t *testing.T) {
+	desired := &corev1.Secret{
+		ObjectMeta: metav1.ObjectMeta{Labels: map[string]string{"app": "jenkins"}},
+		Type:       corev1.SecretTypeOpaque,
+		StringData: map[string]string{"token": "secret"},
+	}
+	setContentHash(desired)
+	stored := func(mutate func(*corev1.Secret)) *corev1.Secret {
+		secret := desired.DeepCopy()
+		secret.Data = secretData(desired)
+		secret.StringData = nil
+		if mutate != nil {
+			mutate(secret)
+		}
+		return secret
+	}
+	desiredData := desired.DeepCopy()
+	desiredData.Data = secretData(desired)
+	desiredData.StringData = nil
+
+	tests := []struct {
+		name      string
+		inCluster *corev1.Secret
+		expected  bool
+	}{
+		{
+			name:      "Stored secret with same content",
+			inCluster: stored(nil),
+			expected:  true,
+		},
+		{
+			name: "Changed label",
+			inCluster: stored(func(s *corev1.Secret) {
+				s.Labels["app"] = "other"
+			}),
+		},
+		{
+			name: "Changed type",
+			inCluster: stored(func(s *corev1.Secret) {
+				s.Type = corev1.SecretTypeBasicAuth
+			}),
+		},
+		{
+			name: "Changed data",
+			inCluster: stored(func(s *corev1.Secret) {
+				s.Data["token"] = []byte("changed")
+			}),
+		},
+		{
+			name: "Same content without hash annotation",
+			inCluster: stored(func(s *corev1.Secret) {
+				delete(s.Annotations, isindirv1alpha3.SopsSecretContentHashAnnotation)
+			}),
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			result := isSecretUpToDate(tt.inCluster, desiredData, isContentDrifted(tt.inCluster))
+			if result != tt.expected {
+				t.Errorf("isSecretUpToDate() = %v, expected %v", result, tt.expected)
+			}
+		})
+	}
+}
+
+func TestRefreshKubeSecretIfNeededSkipsNoOpUpdate(t *testing.T) {
+	sopsSecret := &isindirv1alpha3.SopsSecret{ObjectMeta: metav1.ObjectMeta{Name: "app", Namespace: "default"}}
+	template := &isindirv1alpha3.SopsSecretTemplate{Name: "app", StringData: map[string]string{"token": "secret"}}
+	fromTemplate, err := createKubeSecretFromTemplate(sopsSecret, template, logr.Discard())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	f := newChildSecretFixture(t, interceptor.Funcs{}, fromTemplate.DeepCopy())
+	k8sClient, r, req, get := f.client, f.r, f.req, f.get
+
+	inCluster := get()
+	if err := k8sClient.Update(context.Background(), inCluster); err != nil {
+		t.Fatal(err)
+	}
+	inCluster = get()
+	if reschedule, err := r.refreshKubeSecretIfNeeded(context.Background(), req, sopsSecret, fromTemplate, inCluster); reschedule || err != nil {
+		t.Fatal("expected refresh to succeed")
+	}
+	if updated := get(); updated.ResourceVersion != inCluster.ResourceVersion {
+		t.Errorf("expected unchanged secret not to be updated, resource version %s -> %s",
+			inCluster.ResourceVersion, updated.ResourceVersion)
+	}
+
+	// Content changed outside of the operator is restored
+	inCluster.Data["token"] = []byte("changed")
+	if err := k8sClient.Update(context.Background(), inCluster); err != nil {
+		t.Fatal(err)
+	}
+	inCluster = get()
+	if reschedule, err := r.refreshKubeSecretIfNeeded(context.Background(), req, sopsSecret, fromTemplate, inCluster); reschedule || err != nil {
+		t.Fatal("expected refresh to succeed")
+	}
+	if restored := get(); string(restored.Data["token"]) != "secret" {
+		t.Errorf("expected drifted content to be restored, got %q", restored.Data["token"])
+	}
+}
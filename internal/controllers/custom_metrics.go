@@ -32,6 +32,76 @@ var (
 			Help: "Number of SopsSecrets reconcilations suspends",
 		},
 	)
+
+	sopsSecretsSuspended = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Name: "sopssecrets_suspended",
+			Help: "SopsSecrets which reconciliation is suspended, by reason",
+		},
+		[]string{"namespace", "name", "reason"},
+	)
+
+	sopsSecretsOperatorPaused = prometheus.NewGauge(
+		prometheus.GaugeOpts{
+			Name: "sopssecrets_operator_paused",
+			Help: "Set to 1 when reconciliation of all SopsSecrets is paused by the pause ConfigMap",
+		},
+	)
+
+	sopsSecretsDecryptionReady = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Name: "sopssecrets_decryption_ready",
+			Help: "Set to 1 when key material of configured sops key provider passes readiness check, 0 when it fails",
+		},
+		[]string{"provider"},
+	)
+
+	sopsSecretsDecryptionCheckFailures = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "sopssecrets_decryption_check_failures_total",
+			Help: "Number of failed decryption readiness checks per sops key provider",
+		},
+		[]string{"provider"},
+	)
+
+	sopsSecretsTemplatesExpiringSoon = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Name: "sopssecrets_templates_expiring_soon",
+			Help: "Number of SopsSecret secret templates expiring within the warning window",
+		},
+		[]string{"namespace", "name"},
+	)
+
+	sopsSecretsDataKeyCreated = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Name: "sopssecrets_data_key_created_timestamp_seconds",
+			Help: "Time the sops data key of SopsSecret was created, as unix timestamp",
+		},
+		[]string{"namespace", "name"},
+	)
+
+	sopsSecretsRecipients = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Name: "sopssecrets_recipients",
+			Help: "Set to 1 for each key the sops data key of SopsSecret is encrypted for",
+		},
+		[]string{"namespace", "name", "provider", "id"},
+	)
+
+	sopsSecretsDecryptedBy = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Name: "sopssecrets_decrypted_by",
+			Help: "Set to 1 for each key which decrypted the sops data key of SopsSecret in the last decryption",
+		},
+		[]string{"namespace", "name", "provider", "id"},
+	)
+
+	sopsSecretsManagedLabelMigrationFailed = prometheus.NewGauge(
+		prometheus.GaugeOpts{
+			Name: "sopssecrets_managed_label_migration_failed",
+			Help: "Set to 1 while labelling child secrets created by previous operator versions fails and is retried",
+		},
+	)
 )
 
 func init() {
@@ -40,5 +110,14 @@ func init() {
 		sopsSecretsReconciliations,
 		sopsSecretsReconciliationFailures,
 		sopsSecretsReconciliationsSuspended,
+		sopsSecretsSuspended,
+		sopsSecretsOperatorPaused,
+		sopsSecretsTemplatesExpiringSoon,
+		sopsSecretsDecryptionReady,
+		sopsSecretsDecryptionCheckFailures,
+		sopsSecretsDataKeyCreated,
+		sopsSecretsRecipients,
+		sopsSecretsDecryptedBy,
+		sopsSecretsManagedLabelMigrationFailed,
 	)
 }
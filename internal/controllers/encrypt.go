@@ -0,0 +1,98 @@
+/* This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at https://mozilla.org/MPL/2.0/. */
+
+package controllers
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/getsops/sops/v3"
+	sopsaes "github.com/getsops/sops/v3/aes"
+	sopsage "github.com/getsops/sops/v3/age"
+	"github.com/getsops/sops/v3/keys"
+	"github.com/getsops/sops/v3/keyservice"
+	sopsjson "github.com/getsops/sops/v3/stores/json"
+	sopsversion "github.com/getsops/sops/v3/version"
+
+	isindirv1alpha3 "github.com/isindir/sops-secrets-operator/api/v1alpha3"
+)
+
+// EncryptSopsSecret encrypts all values of spec.secretTemplates of a plain
+// text SopsSecret in place for the given age recipients, the same way
+// `sops --encrypt --age` does. Sops MAC is computed over canonical form, so
+// encrypted object passes MAC verification. Only age recipients are
+// supported, KMS and PGP master keys are not.
+func EncryptSopsSecret(sopsSecret *isindirv1alpha3.SopsSecret, ageRecipients []string) error {
+	if len(ageRecipients) == 0 {
+		return errors.New("no age recipients to encrypt for")
+	}
+	masterKeys, err := sopsage.MasterKeysFromRecipients(strings.Join(ageRecipients, ","))
+	if err != nil {
+		return err
+	}
+	keyGroup := make(sops.KeyGroup, 0, len(masterKeys))
+	for _, masterKey := range masterKeys {
+		keyGroup = append(keyGroup, keys.MasterKey(masterKey))
+	}
+
+	// Same document as passed to sops for decryption, without sops metadata
+	plainDocument := sopsDocument{}
+	plainDocument.Spec.SecretsTemplate = sopsSecret.Spec.SecretsTemplate
+	plainDocumentAsBytes, err := json.Marshal(map[string]interface{}{"spec": plainDocument.Spec})
+	if err != nil {
+		return err
+	}
+	plainDocumentAsBytes, err = canonicalJSON(plainDocumentAsBytes)
+	if err != nil {
+		return err
+	}
+
+	store := &sopsjson.Store{}
+	branches, err := store.LoadPlainFile(plainDocumentAsBytes)
+	if err != nil {
+		return err
+	}
+	tree := sops.Tree{
+		Branches: branches,
+		Metadata: sops.Metadata{
+			KeyGroups: []sops.KeyGroup{keyGroup},
+			Version:   sopsversion.Version,
+		},
+	}
+
+	dataKey, errs := tree.GenerateDataKeyWithKeyServices([]keyservice.KeyServiceClient{keyservice.NewCustomLocalClient(localKeyServer{})})
+	if len(errs) > 0 {
+		return fmt.Errorf("failed to encrypt data key: %w", errors.Join(errs...))
+	}
+
+	cipher := sopsaes.NewCipher()
+	mac, err := tree.Encrypt(dataKey, cipher)
+	if err != nil {
+		return err
+	}
+	tree.Metadata.LastModified = time.Now().UTC()
+	tree.Metadata.MessageAuthenticationCode, err = cipher.Encrypt(
+		mac, dataKey, tree.Metadata.LastModified.Format(time.RFC3339),
+	)
+	if err != nil {
+		return err
+	}
+
+	encryptedDocumentAsBytes, err := store.EmitEncryptedFile(tree)
+	if err != nil {
+		return err
+	}
+	encryptedDocument := sopsDocument{}
+	if err := json.Unmarshal(encryptedDocumentAsBytes, &encryptedDocument); err != nil {
+		return err
+	}
+
+	sopsSecret.Spec.SecretsTemplate = encryptedDocument.Spec.SecretsTemplate
+	sopsSecret.Sops = encryptedDocument.Sops
+	return nil
+}
@@ -0,0 +1,61 @@
+/* This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at https://mozilla.org/MPL/2.0/. */
+
+package controllers
+
+import (
+	"strings"
+	"testing"
+
+	"filippo.io/age"
+	"github.com/go-logr/logr"
+
+	isindirv1alpha3 "github.com/isindir/sops-secrets-operator/api/v1alpha3"
+)
+
+func TestEncryptSopsSecret(t *testing.T) {
+	identity, err := age.GenerateX25519Identity()
+	if err != nil {
+		t.Fatal(err)
+	}
+	SetManagedAgeIdentities([]age.Identity{identity})
+	defer SetManagedAgeIdentities(nil)
+
+	template := isindirv1alpha3.SopsSecretTemplate{
+		Name:       "my-secret",
+		Labels:     map[string]string{"app": "jenkins"},
+		StringData: map[string]string{"password": "plain-text-password"},
+		Data:       map[string]string{"token": "dG9rZW4="},
+	}
+	sopsSecret := &isindirv1alpha3.SopsSecret{
+		Spec: isindirv1alpha3.SopsSecretSpec{SecretsTemplate: []isindirv1alpha3.SopsSecretTemplate{template}},
+	}
+
+	if err := EncryptSopsSecret(sopsSecret, []string{identity.Recipient().String()}); err != nil {
+		t.Fatalf("EncryptSopsSecret() error = %v", err)
+	}
+	encrypted := sopsSecret.Spec.SecretsTemplate[0]
+	for _, value := range []string{encrypted.Name, encrypted.StringData["password"], encrypted.Data["token"]} {
+		if !strings.HasPrefix(value, sopsEncryptedValuePrefix) {
+			t.Errorf("expected value to be encrypted, got %q", value)
+		}
+	}
+	if len(sopsSecret.Sops.Age) != 1 || sopsSecret.Sops.Age[0].Recipient != identity.Recipient().String() {
+		t.Fatalf("expected age recipient in sops metadata, got %v", sopsSecret.Sops.Age)
+	}
+
+	plainTextSopsSecret, _, err := decryptSopsSecretInstance(sopsSecret, true, nil, logr.Discard())
+	if err != nil {
+		t.Fatalf("decryptSopsSecretInstance() error = %v", err)
+	}
+	decrypted := plainTextSopsSecret.Spec.SecretsTemplate[0]
+	if decrypted.Name != template.Name || decrypted.StringData["password"] != "plain-text-password" ||
+		decrypted.Data["token"] != "dG9rZW4=" || decrypted.Labels["app"] != "jenkins" {
+		t.Errorf("expected encrypted object to decrypt to original template, got %+v", decrypted)
+	}
+
+	if err := EncryptSopsSecret(sopsSecret, nil); err == nil {
+		t.Error("expected error without recipients")
+	}
+}
@@ -0,0 +1,154 @@
+/* This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at https://mozilla.org/MPL/2.0/. */
+
+package controllers
+
+import (
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"k8s.io/apimachinery/pkg/api/meta"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+
+	isindirv1alpha3 "github.com/isindir/sops-secrets-operator/api/v1alpha3"
+	"github.com/isindir/sops-secrets-operator/internal/audit"
+)
+
+// EventReasonDataKeyMaxAgeExceeded is the reason of events emitted when the
+// data key of SopsSecret becomes older than --max-data-key-age
+const EventReasonDataKeyMaxAgeExceeded = "DataKeyMaxAgeExceeded"
+
+// sopsSecretKeys returns keys listed in sops metadata, including keys of key
+// groups, identifiers are the same as of keys recorded by the key service
+func sopsSecretKeys(metadata *isindirv1alpha3.SopsMetadata) []isindirv1alpha3.SopsSecretKey {
+	var keys []isindirv1alpha3.SopsSecretKey
+	add := func(provider, id, createdAt string) {
+		keys = append(keys, isindirv1alpha3.SopsSecretKey{Provider: provider, ID: id, CreatedAt: createdAt})
+	}
+
+	for _, group := range keyGroups(metadata) {
+		for _, key := range group.AwsKms {
+			add("kms", key.Arn, key.CreationDate)
+		}
+		for _, key := range group.Pgp {
+			add("pgp", key.FingerPrint, key.CreationDate)
+		}
+		for _, key := range group.AzureKms {
+			add("azure_kv", strings.TrimSuffix(key.VaultURL, "/")+"/keys/"+key.KeyName, key.CreationDate)
+		}
+		for _, key := range group.HcVault {
+			id := strings.TrimSuffix(key.VaultAddress, "/") + "/v1/" + strings.Trim(key.EnginePath, "/") + "/keys/" + key.KeyName
+			add("hc_vault", id, key.CreationDate)
+		}
+		for _, key := range group.GcpKms {
+			add("gcp_kms", key.VaultURL, key.CreationDate)
+		}
+		for _, key := range group.Age {
+			add("age", key.Recipient, "")
+		}
+	}
+	return keys
+}
+
+// dataKeyCreatedAt returns the oldest creation time of keys, which is when
+// the data key was first encrypted. False is returned when no key records it,
+// sops lastmodified changes on every edit and does not tell the data key age.
+func dataKeyCreatedAt(keys []isindirv1alpha3.SopsSecretKey) (time.Time, bool) {
+	var oldest time.Time
+	for _, key := range keys {
+		createdAt, err := time.Parse(time.RFC3339, key.CreatedAt)
+		if err == nil && (oldest.IsZero() || createdAt.Before(oldest)) {
+			oldest = createdAt
+		}
+	}
+	return oldest, !oldest.IsZero()
+}
+
+// setEncryptionStatus records recipients, data key creation time, sops last
+// modification time and keys which decrypted the data key in status and
+// metrics, decryptedBy is empty when the data key was not decrypted and the
+// previous value is kept
+func (r *SopsSecretReconciler) setEncryptionStatus(
+	sopsSecret *isindirv1alpha3.SopsSecret, decryptedBy []audit.Key, now time.Time,
+) {
+	encryption := &isindirv1alpha3.SopsSecretEncryptionStatus{Recipients: sopsSecretKeys(&sopsSecret.Sops)}
+	if createdAt, ok := dataKeyCreatedAt(encryption.Recipients); ok {
+		encryption.DataKeyCreatedAt = &metav1.Time{Time: createdAt}
+	}
+	if lastModified, err := time.Parse(time.RFC3339, sopsSecret.Sops.LastModified); err == nil {
+		encryption.LastModified = &metav1.Time{Time: lastModified}
+	}
+	if sopsSecret.Status.Encryption != nil {
+		encryption.DecryptedBy = sopsSecret.Status.Encryption.DecryptedBy
+	}
+	if len(decryptedBy) > 0 {
+		encryption.DecryptedBy = nil
+		for _, key := range decryptedBy {
+			encryption.DecryptedBy = append(encryption.DecryptedBy, isindirv1alpha3.SopsSecretKey{
+				Provider: key.Provider, ID: key.ID, Unverified: key.Unverified,
+			})
+		}
+	}
+	sopsSecret.Status.Encryption = encryption
+
+	labels := prometheus.Labels{"namespace": sopsSecret.Namespace, "name": sopsSecret.Name}
+	sopsSecretsDataKeyCreated.DeletePartialMatch(labels)
+	sopsSecretsRecipients.DeletePartialMatch(labels)
+	sopsSecretsDecryptedBy.DeletePartialMatch(labels)
+	if encryption.DataKeyCreatedAt != nil {
+		sopsSecretsDataKeyCreated.WithLabelValues(sopsSecret.Namespace, sopsSecret.Name).
+			Set(float64(encryption.DataKeyCreatedAt.Unix()))
+	}
+	for _, key := range encryption.Recipients {
+		sopsSecretsRecipients.WithLabelValues(sopsSecret.Namespace, sopsSecret.Name, key.Provider, key.ID).Set(1)
+	}
+	for _, key := range encryption.DecryptedBy {
+		sopsSecretsDecryptedBy.WithLabelValues(sopsSecret.Namespace, sopsSecret.Name, key.Provider, key.ID).Set(1)
+	}
+
+	r.setDataKeyMaxAgeCondition(sopsSecret, now)
+}
+
+// dataKeyMaxAgeAt returns the time data key of SopsSecret exceeds
+// --max-data-key-age, zero when maximum age is not set or creation time of
+// the data key is not known
+func (r *SopsSecretReconciler) dataKeyMaxAgeAt(sopsSecret *isindirv1alpha3.SopsSecret) time.Time {
+	encryption := sopsSecret.Status.Encryption
+	if r.MaxDataKeyAge <= 0 || encryption == nil || encryption.DataKeyCreatedAt == nil {
+		return time.Time{}
+	}
+	return encryption.DataKeyCreatedAt.Add(r.MaxDataKeyAge)
+}
+
+// setDataKeyMaxAgeCondition sets or removes DataKeyMaxAgeExceeded condition,
+// warning event is emitted when the condition is set
+func (r *SopsSecretReconciler) setDataKeyMaxAgeCondition(sopsSecret *isindirv1alpha3.SopsSecret, now time.Time) {
+	maxAgeAt := r.dataKeyMaxAgeAt(sopsSecret)
+	if maxAgeAt.IsZero() || !now.After(maxAgeAt) {
+		meta.RemoveStatusCondition(&sopsSecret.Status.Conditions, isindirv1alpha3.ConditionTypeDataKeyMaxAgeExceeded)
+		return
+	}
+
+	message := fmt.Sprintf(
+		"data key created at %s is older than %s",
+		sopsSecret.Status.Encryption.DataKeyCreatedAt.UTC().Format(time.RFC3339), r.MaxDataKeyAge,
+	)
+	if !meta.IsStatusConditionTrue(sopsSecret.Status.Conditions, isindirv1alpha3.ConditionTypeDataKeyMaxAgeExceeded) {
+		r.Log.V(0).Info(
+			"SopsSecret data key exceeded maximum age",
+			"sopssecret", fmt.Sprintf("%s/%s", sopsSecret.Namespace, sopsSecret.Name),
+			"dataKeyCreatedAt", sopsSecret.Status.Encryption.DataKeyCreatedAt.UTC().Format(time.RFC3339),
+		)
+		r.recordWarning(sopsSecret, nil, EventReasonDataKeyMaxAgeExceeded, "Decrypt", message)
+	}
+	meta.SetStatusCondition(&sopsSecret.Status.Conditions, metav1.Condition{
+		Type:               isindirv1alpha3.ConditionTypeDataKeyMaxAgeExceeded,
+		Status:             metav1.ConditionTrue,
+		ObservedGeneration: sopsSecret.Generation,
+		Reason:             "DataKeyTooOld",
+		Message:            message,
+	})
+}
@@ -0,0 +1,177 @@
+/* This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at https://mozilla.org/MPL/2.0/. */
+
+package controllers
+
+import (
+	"context"
+	"path/filepath"
+	"slices"
+	"testing"
+	"time"
+
+	"github.com/getsops/sops/v3/keyservice"
+	"github.com/go-logr/logr"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"k8s.io/apimachinery/pkg/api/meta"
+	"k8s.io/apimachinery/pkg/runtime"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/client/fake"
+
+	isindirv1alpha3 "github.com/isindir/sops-secrets-operator/api/v1alpha3"
+	"github.com/isindir/sops-secrets-operator/internal/audit"
+)
+
+func TestSopsSecretKeys(t *testing.T) {
+	metadata := &isindirv1alpha3.SopsMetadata{
+		AwsKms: []isindirv1alpha3.KmsDataItem{{Arn: "arn:aws:kms:eu-west-1:111111111111:key/a", CreationDate: "2026-01-01T00:00:00Z"}},
+		KeyGroups: []isindirv1alpha3.KeyGroup{{
+			AzureKms: []isindirv1alpha3.AzureKmsItem{{VaultURL: "https://vault.vault.azure.net/", KeyName: "sops"}},
+			HcVault:  []isindirv1alpha3.HcVaultItem{{VaultAddress: "https://vault:8200", EnginePath: "/sops/", KeyName: "key"}},
+			Age:      []isindirv1alpha3.AgeItem{{Recipient: "age1"}},
+		}},
+	}
+
+	keys := sopsSecretKeys(metadata)
+	expected := []isindirv1alpha3.SopsSecretKey{
+		{Provider: "kms", ID: "arn:aws:kms:eu-west-1:111111111111:key/a", CreatedAt: "2026-01-01T00:00:00Z"},
+		{Provider: "azure_kv", ID: "https://vault.vault.azure.net/keys/sops"},
+		{Provider: "hc_vault", ID: "https://vault:8200/v1/sops/keys/key"},
+		{Provider: "age", ID: "age1"},
+	}
+	if !slices.Equal(keys, expected) {
+		t.Fatalf("sopsSecretKeys() = %v, expected %v", keys, expected)
+	}
+
+	// Identifiers match keys recorded by the key service
+	for i, key := range []*keyservice.Key{
+		{KeyType: &keyservice.Key_AzureKeyvaultKey{AzureKeyvaultKey: &keyservice.AzureKeyVaultKey{
+			VaultUrl: "https://vault.vault.azure.net/", Name: "sops",
+		}}},
+		{KeyType: &keyservice.Key_VaultKey{VaultKey: &keyservice.VaultKey{
+			VaultAddress: "https://vault:8200", EnginePath: "/sops/", KeyName: "key",
+		}}},
+	} {
+		if recorded := keyFromProto(key); recorded.ID != expected[i+1].ID {
+			t.Errorf("expected key service identifier %q, got %q", expected[i+1].ID, recorded.ID)
+		}
+	}
+}
+
+func TestDataKeyCreatedAt(t *testing.T) {
+	tests := []struct {
+		name          string
+		metadata      isindirv1alpha3.SopsMetadata
+		expected      string
+		expectedKnown bool
+	}{
+		{
+			name: "Oldest key creation time",
+			metadata: isindirv1alpha3.SopsMetadata{
+				AwsKms:       []isindirv1alpha3.KmsDataItem{{Arn: "a", CreationDate: "2026-03-01T00:00:00Z"}},
+				Pgp:          []isindirv1alpha3.PgpDataItem{{FingerPrint: "b", CreationDate: "2026-01-01T00:00:00Z"}},
+				LastModified: "2026-06-01T00:00:00Z",
+			},
+			expected:      "2026-01-01T00:00:00Z",
+			expectedKnown: true,
+		},
+		{
+			name: "Last modified is not data key creation time",
+			metadata: isindirv1alpha3.SopsMetadata{
+				Age:          []isindirv1alpha3.AgeItem{{Recipient: "age1"}},
+				LastModified: "2026-06-01T00:00:00Z",
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			createdAt, ok := dataKeyCreatedAt(sopsSecretKeys(&tt.metadata))
+			if ok != tt.expectedKnown || (ok && createdAt.Format(time.RFC3339) != tt.expected) {
+				t.Errorf("dataKeyCreatedAt() = %s, %t, expected %s, %t", createdAt, ok, tt.expected, tt.expectedKnown)
+			}
+		})
+	}
+}
+
+func TestSetEncryptionStatus(t *testing.T) {
+	r := &SopsSecretReconciler{Log: logr.Discard(), MaxDataKeyAge: 90 * 24 * time.Hour}
+	sopsSecret := &isindirv1alpha3.SopsSecret{}
+	sopsSecret.Namespace = "default"
+	sopsSecret.Name = "encryption-status"
+	sopsSecret.Sops = isindirv1alpha3.SopsMetadata{
+		AwsKms: []isindirv1alpha3.KmsDataItem{{Arn: "arn", CreationDate: "2026-01-01T00:00:00Z"}},
+		Age:    []isindirv1alpha3.AgeItem{{Recipient: "age1"}},
+	}
+	createdAt := time.Date(2026, 1, 1, 0, 0, 0, 0, time.UTC)
+
+	r.setEncryptionStatus(sopsSecret, []audit.Key{{Provider: "age", ID: "age1"}}, createdAt.Add(24*time.Hour))
+	encryption := sopsSecret.Status.Encryption
+	if encryption == nil || len(encryption.Recipients) != 2 || !encryption.DataKeyCreatedAt.Time.Equal(createdAt) {
+		t.Fatalf("unexpected encryption status %+v", encryption)
+	}
+	if meta.FindStatusCondition(sopsSecret.Status.Conditions, isindirv1alpha3.ConditionTypeDataKeyMaxAgeExceeded) != nil {
+		t.Error("expected no DataKeyMaxAgeExceeded condition for recent data key")
+	}
+	if value := testutil.ToFloat64(sopsSecretsDataKeyCreated.WithLabelValues("default", "encryption-status")); value != float64(createdAt.Unix()) {
+		t.Errorf("expected data key creation metric %d, got %f", createdAt.Unix(), value)
+	}
+	if value := testutil.ToFloat64(sopsSecretsDecryptedBy.WithLabelValues("default", "encryption-status", "age", "age1")); value != 1 {
+		t.Errorf("expected decrypted by metric, got %f", value)
+	}
+
+	// Keys of the last successful decryption are kept when data key was not decrypted
+	r.setEncryptionStatus(sopsSecret, nil, createdAt.Add(91*24*time.Hour))
+	if decryptedBy := sopsSecret.Status.Encryption.DecryptedBy; len(decryptedBy) != 1 || decryptedBy[0].ID != "age1" {
+		t.Errorf("expected decryptedBy to be kept, got %v", decryptedBy)
+	}
+	if !meta.IsStatusConditionTrue(sopsSecret.Status.Conditions, isindirv1alpha3.ConditionTypeDataKeyMaxAgeExceeded) {
+		t.Error("expected DataKeyMaxAgeExceeded condition for data key older than maximum age")
+	}
+	if maxAgeAt := r.dataKeyMaxAgeAt(sopsSecret); !maxAgeAt.Equal(createdAt.Add(90 * 24 * time.Hour)) {
+		t.Errorf("unexpected time data key exceeds maximum age %s", maxAgeAt)
+	}
+
+	// Condition is removed when the data key is rotated
+	sopsSecret.Sops.AwsKms[0].CreationDate = "2026-04-01T00:00:00Z"
+	r.setEncryptionStatus(sopsSecret, nil, createdAt.Add(91*24*time.Hour))
+	if meta.FindStatusCondition(sopsSecret.Status.Conditions, isindirv1alpha3.ConditionTypeDataKeyMaxAgeExceeded) != nil {
+		t.Error("expected DataKeyMaxAgeExceeded condition to be removed")
+	}
+}
+
+func TestDecryptSopsSecretRecordsDecryptingKey(t *testing.T) {
+	setAgeKeyFile(t, filepath.Join("..", "..", "config", "age-test-key", "key-file.txt"))
+	scheme := runtime.NewScheme()
+	if err := isindirv1alpha3.AddToScheme(scheme); err != nil {
+		t.Fatal(err)
+	}
+
+	sopsSecret := readTestSopsSecret(t, "04-test-secrets-mac-only.yaml")
+	k8sClient := fake.NewClientBuilder().WithScheme(scheme).WithRuntimeObjects(sopsSecret).
+		WithStatusSubresource(sopsSecret).Build()
+	r := &SopsSecretReconciler{Client: k8sClient, Log: logr.Discard()}
+
+	if _, reschedule, err := r.decryptSopsSecret(context.Background(), sopsSecret, nil); reschedule || err != nil {
+		t.Fatal("expected SopsSecret to be decrypted")
+	}
+	if err := r.UpdateSopsSecretStatus(context.Background(), sopsSecret, STATUS_HEALTHY); err != nil {
+		t.Fatal(err)
+	}
+	updated := &isindirv1alpha3.SopsSecret{}
+	if err := k8sClient.Get(context.Background(), client.ObjectKeyFromObject(sopsSecret), updated); err != nil {
+		t.Fatal(err)
+	}
+	encryption := updated.Status.Encryption
+	if encryption == nil || len(encryption.DecryptedBy) != 1 || encryption.DecryptedBy[0].Provider != "age" ||
+		encryption.DecryptedBy[0].ID != sopsSecret.Sops.Age[0].Recipient {
+		t.Errorf("expected age key to be recorded as decrypting key, got %+v", encryption)
+	}
+	if encryption.DataKeyCreatedAt != nil {
+		t.Errorf("expected unknown data key creation time for age key, got %s", encryption.DataKeyCreatedAt)
+	}
+	if encryption.LastModified == nil || encryption.LastModified.UTC().Format(time.RFC3339) != sopsSecret.Sops.LastModified {
+		t.Errorf("expected sops lastmodified %s in status, got %v", sopsSecret.Sops.LastModified, encryption.LastModified)
+	}
+}
@@ -0,0 +1,66 @@
+/* This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at https://mozilla.org/MPL/2.0/. */
+
+package controllers
+
+import (
+	"context"
+	"testing"
+
+	"github.com/go-logr/logr"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/types"
+	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/client/fake"
+	"sigs.k8s.io/controller-runtime/pkg/client/interceptor"
+
+	isindirv1alpha3 "github.com/isindir/sops-secrets-operator/api/v1alpha3"
+)
+
+// childSecretFixture is a reconciler of SopsSecret default/app backed by fake
+// client, for tests of child secret default/app refresh
+type childSecretFixture struct {
+	t      *testing.T
+	client client.Client
+	r      *SopsSecretReconciler
+	req    ctrl.Request
+}
+
+// newChildSecretFixture returns fixture with fake client holding objects,
+// calls of the fake client are intercepted by funcs
+func newChildSecretFixture(t *testing.T, funcs interceptor.Funcs, objects ...client.Object) *childSecretFixture {
+	t.Helper()
+	scheme := runtime.NewScheme()
+	if err := corev1.AddToScheme(scheme); err != nil {
+		t.Fatal(err)
+	}
+	if err := isindirv1alpha3.AddToScheme(scheme); err != nil {
+		t.Fatal(err)
+	}
+	k8sClient := fake.NewClientBuilder().WithScheme(scheme).WithObjects(objects...).
+		WithStatusSubresource(&isindirv1alpha3.SopsSecret{}).
+		WithInterceptorFuncs(funcs).
+		Build()
+	return &childSecretFixture{
+		t:      t,
+		client: k8sClient,
+		r:      &SopsSecretReconciler{Client: k8sClient, Log: logr.Discard()},
+		req:    ctrl.Request{NamespacedName: types.NamespacedName{Name: "app", Namespace: "default"}},
+	}
+}
+
+// get returns child secret default/app, fake client does not merge
+// StringData into Data as API server does
+func (f *childSecretFixture) get() *corev1.Secret {
+	f.t.Helper()
+	secret := &corev1.Secret{}
+	if err := f.client.Get(context.Background(), f.req.NamespacedName, secret); err != nil {
+		f.t.Fatal(err)
+	}
+	secret.Data = secretData(secret)
+	secret.StringData = nil
+	return secret
+}
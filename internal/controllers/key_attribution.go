@@ -0,0 +1,264 @@
+/* This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at https://mozilla.org/MPL/2.0/. */
+
+package controllers
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"filippo.io/age"
+	"github.com/ProtonMail/go-crypto/openpgp/armor"
+	"github.com/ProtonMail/go-crypto/openpgp/packet"
+	sopsage "github.com/getsops/sops/v3/age"
+	sopspgp "github.com/getsops/sops/v3/pgp"
+
+	"github.com/isindir/sops-secrets-operator/internal/audit"
+)
+
+// gpgListTimeout limits the time gpg lists keys of a PGP fingerprint
+const gpgListTimeout = 10 * time.Second
+
+// ageKeySource is content of an age key file or environment variable
+type ageKeySource struct {
+	name    string
+	content []byte
+}
+
+// ageKeySources reads age identities from the locations sops loads them from:
+// SOPS_AGE_KEY, SOPS_AGE_KEY_FILE and keys.txt in the user configuration
+// directory. SOPS_AGE_KEY_CMD and SSH keys are not read.
+func ageKeySources() ([]ageKeySource, []error) {
+	var sources []ageKeySource
+	var errs []error
+
+	if value, ok := os.LookupEnv(sopsage.SopsAgeKeyEnv); ok {
+		// Environment variable may have several keys per line
+		var lines []string
+		for _, line := range strings.Split(value, "\n") {
+			if strings.HasPrefix(strings.TrimSpace(line), "#") {
+				continue
+			}
+			lines = append(lines, strings.FieldsFunc(line, func(r rune) bool { return r == ',' || r == ' ' })...)
+		}
+		sources = append(sources, ageKeySource{name: sopsage.SopsAgeKeyEnv, content: []byte(strings.Join(lines, "\n"))})
+	}
+	if path, ok := os.LookupEnv(sopsage.SopsAgeKeyFileEnv); ok {
+		content, err := os.ReadFile(path)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("%s: %w", sopsage.SopsAgeKeyFileEnv, err))
+		} else {
+			sources = append(sources, ageKeySource{name: path, content: content})
+		}
+	}
+	if configDir, err := os.UserConfigDir(); err == nil {
+		path := filepath.Join(configDir, filepath.FromSlash(sopsage.SopsAgeKeyUserConfigPath))
+		if content, err := os.ReadFile(path); err == nil {
+			sources = append(sources, ageKeySource{name: path, content: content})
+		}
+	}
+	return sources, errs
+}
+
+// ageKeyFileIdentities are identities of loadAgeKeyFileIdentities, loaded on
+// first decryption and after ResetKeyCaches
+var ageKeyFileIdentities struct {
+	sync.Mutex
+	loaded     bool
+	identities []age.Identity
+}
+
+// pgpKeyIDs are results of gpgKeyIDs per GnuPG home and fingerprint
+var pgpKeyIDs = struct {
+	sync.Mutex
+	results map[pgpKeyIDsKey]pgpKeyIDsResult
+}{results: map[pgpKeyIDsKey]pgpKeyIDsResult{}}
+
+type pgpKeyIDsKey struct {
+	home        string
+	fingerprint string
+}
+
+type pgpKeyIDsResult struct {
+	keyIDs map[uint64]bool
+	err    error
+}
+
+// ResetKeyCaches drops key material cached for key attribution, it is loaded
+// again on next decryption. Called when key files are reloaded.
+func ResetKeyCaches() {
+	ageKeyFileIdentities.Lock()
+	ageKeyFileIdentities.loaded = false
+	ageKeyFileIdentities.identities = nil
+	ageKeyFileIdentities.Unlock()
+
+	pgpKeyIDs.Lock()
+	clear(pgpKeyIDs.results)
+	pgpKeyIDs.Unlock()
+}
+
+// getAgeKeyFileIdentities returns cached identities of
+// loadAgeKeyFileIdentities. Identities added to key files are not known until
+// ResetKeyCaches, data keys they decrypt are decrypted by sops and recorded
+// unverified.
+func getAgeKeyFileIdentities() []age.Identity {
+	ageKeyFileIdentities.Lock()
+	defer ageKeyFileIdentities.Unlock()
+	if !ageKeyFileIdentities.loaded {
+		ageKeyFileIdentities.identities = loadAgeKeyFileIdentities()
+		ageKeyFileIdentities.loaded = true
+	}
+	return ageKeyFileIdentities.identities
+}
+
+// loadAgeKeyFileIdentities returns age identities from ageKeySources with
+// known recipient, lines with other identities are skipped
+func loadAgeKeyFileIdentities() []age.Identity {
+	sources, _ := ageKeySources()
+	var identities []age.Identity
+	for _, source := range sources {
+		scanner := bufio.NewScanner(bytes.NewReader(source.content))
+		for scanner.Scan() {
+			line := strings.TrimSpace(scanner.Text())
+			switch {
+			case strings.HasPrefix(line, "AGE-SECRET-KEY-PQ-1"):
+				if identity, err := age.ParseHybridIdentity(line); err == nil {
+					identities = append(identities, identity)
+				}
+			case strings.HasPrefix(line, "AGE-SECRET-KEY-1"):
+				if identity, err := age.ParseX25519Identity(line); err == nil {
+					identities = append(identities, identity)
+				}
+			}
+		}
+	}
+	return identities
+}
+
+// attributePGPKey checks that PGP data key is encrypted for the key listed in
+// sops metadata, GnuPG decrypts with any secret key it holds whatever
+// fingerprint is listed. Key IDs of the encrypted data key are compared with
+// the listed key and its subkeys in the local keyring. The key is returned
+// unverified when the listed key is not in the local keyring, e.g. when it is
+// held by a remote key service, or the data key hides its recipients. Empty
+// home is GNUPGHOME.
+func attributePGPKey(key audit.Key, home string, ciphertext []byte) (audit.Key, error) {
+	recipientKeyIDs, err := pgpRecipientKeyIDs(ciphertext)
+	if err != nil || len(recipientKeyIDs) == 0 {
+		key.Unverified = true
+		return key, nil
+	}
+	for _, keyID := range recipientKeyIDs {
+		// Hidden recipient
+		if keyID == 0 {
+			key.Unverified = true
+			return key, nil
+		}
+	}
+
+	listedKeyIDs, err := getGPGKeyIDs(home, key.ID)
+	if err != nil || len(listedKeyIDs) == 0 {
+		key.Unverified = true
+		return key, nil
+	}
+	for _, keyID := range recipientKeyIDs {
+		if listedKeyIDs[keyID] {
+			return key, nil
+		}
+	}
+	return key, fmt.Errorf("pgp data key is not encrypted for %s listed in sops metadata", key.ID)
+}
+
+// pgpRecipientKeyIDs returns key IDs PGP message is encrypted for
+func pgpRecipientKeyIDs(ciphertext []byte) ([]uint64, error) {
+	block, err := armor.Decode(bytes.NewReader(ciphertext))
+	if err != nil {
+		return nil, err
+	}
+	var keyIDs []uint64
+	packets := packet.NewReader(block.Body)
+	for {
+		p, err := packets.Next()
+		if errors.Is(err, io.EOF) {
+			return keyIDs, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+		encryptedKey, ok := p.(*packet.EncryptedKey)
+		if !ok {
+			// Encrypted key packets precede encrypted data
+			return keyIDs, nil
+		}
+		keyIDs = append(keyIDs, encryptedKey.KeyId)
+	}
+}
+
+// getGPGKeyIDs returns cached results of gpgKeyIDs. Keys missing in the
+// keyring are cached as well, gpg is run again after ResetKeyCaches or when
+// gpg did not finish, e.g. on timeout.
+func getGPGKeyIDs(home, fingerprint string) (map[uint64]bool, error) {
+	cacheKey := pgpKeyIDsKey{home: home, fingerprint: fingerprint}
+	pgpKeyIDs.Lock()
+	result, ok := pgpKeyIDs.results[cacheKey]
+	pgpKeyIDs.Unlock()
+	if ok {
+		return result.keyIDs, result.err
+	}
+
+	keyIDs, err := gpgKeyIDs(home, fingerprint)
+	var exitErr *exec.ExitError
+	if err == nil || errors.As(err, &exitErr) {
+		pgpKeyIDs.Lock()
+		pgpKeyIDs.results[cacheKey] = pgpKeyIDsResult{keyIDs: keyIDs, err: err}
+		pgpKeyIDs.Unlock()
+	}
+	return keyIDs, err
+}
+
+// gpgKeyIDs returns IDs of the key with fingerprint and its subkeys from the
+// GnuPG keyring in home, empty home is GNUPGHOME
+func gpgKeyIDs(home, fingerprint string) (map[uint64]bool, error) {
+	binary := "gpg"
+	if value := os.Getenv(sopspgp.SopsGpgExecEnv); value != "" {
+		binary = value
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), gpgListTimeout)
+	defer cancel()
+	var args []string
+	if home != "" {
+		args = append(args, "--homedir", home)
+	}
+	args = append(args, "--batch", "--with-colons", "--list-keys", "--", fingerprint)
+	output, err := exec.CommandContext(ctx, binary, args...).Output()
+	if ctx.Err() != nil {
+		return nil, ctx.Err()
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	keyIDs := map[uint64]bool{}
+	for _, line := range strings.Split(string(output), "\n") {
+		fields := strings.Split(line, ":")
+		if len(fields) < 5 || (fields[0] != "pub" && fields[0] != "sub") {
+			continue
+		}
+		if keyID, err := strconv.ParseUint(fields[4], 16, 64); err == nil {
+			keyIDs[keyID] = true
+		}
+	}
+	return keyIDs, nil
+}
@@ -0,0 +1,59 @@
+/* This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at https://mozilla.org/MPL/2.0/. */
+
+package controllers
+
+import (
+	"context"
+
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/event"
+
+	isindirv1alpha3 "github.com/isindir/sops-secrets-operator/api/v1alpha3"
+)
+
+// requeueBufferSize is the number of SopsSecrets waiting to be re-enqueued
+// on events originating outside the cluster, e.g. key reload
+const requeueBufferSize = 1024
+
+// RequeueDecryptErrors enqueues SopsSecrets failing with STATUS_DECRYPT_ERROR,
+// so that they are decrypted with reloaded key material right away instead
+// of after RequeueAfter
+func (r *SopsSecretReconciler) RequeueDecryptErrors(ctx context.Context) {
+	requeued := r.requeueSopsSecrets(ctx, func(sopsSecret *isindirv1alpha3.SopsSecret) bool {
+		return sopsSecret.Status.Message == STATUS_DECRYPT_ERROR
+	})
+	r.Log.V(0).Info("Re-enqueued SopsSecrets failing to decrypt after key reload", "count", requeued)
+}
+
+// requeueSopsSecrets enqueues SopsSecrets matching filter and returns their
+// number. SopsSecrets which do not fit into the buffer, e.g. while this
+// replica is not the leader, are not enqueued.
+func (r *SopsSecretReconciler) requeueSopsSecrets(
+	ctx context.Context, filter func(sopsSecret *isindirv1alpha3.SopsSecret) bool,
+) int {
+	if r.requeues == nil {
+		return 0
+	}
+	sopsSecrets := &isindirv1alpha3.SopsSecretList{}
+	if err := r.List(ctx, sopsSecrets); err != nil {
+		r.Log.Error(err, "Failed to list SopsSecrets to re-enqueue")
+		return 0
+	}
+
+	requeued := 0
+	for i := range sopsSecrets.Items {
+		sopsSecret := &sopsSecrets.Items[i]
+		if !filter(sopsSecret) {
+			continue
+		}
+		select {
+		case r.requeues <- event.GenericEvent{Object: sopsSecret}:
+			requeued++
+		default:
+			r.Log.V(1).Info("Re-enqueue buffer is full", "sopssecret", client.ObjectKeyFromObject(sopsSecret))
+		}
+	}
+	return requeued
+}
@@ -0,0 +1,56 @@
+/* This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at https://mozilla.org/MPL/2.0/. */
+
+package controllers
+
+import (
+	"context"
+	"testing"
+
+	"github.com/go-logr/logr"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"sigs.k8s.io/controller-runtime/pkg/client/fake"
+	"sigs.k8s.io/controller-runtime/pkg/event"
+
+	isindirv1alpha3 "github.com/isindir/sops-secrets-operator/api/v1alpha3"
+)
+
+func TestRequeueDecryptErrors(t *testing.T) {
+	scheme := runtime.NewScheme()
+	if err := isindirv1alpha3.AddToScheme(scheme); err != nil {
+		t.Fatal(err)
+	}
+	sopsSecret := func(name, message string) *isindirv1alpha3.SopsSecret {
+		return &isindirv1alpha3.SopsSecret{
+			ObjectMeta: metav1.ObjectMeta{Name: name, Namespace: "default"},
+			Status:     isindirv1alpha3.SopsSecretStatus{Message: message},
+		}
+	}
+
+	r := &SopsSecretReconciler{
+		Client: fake.NewClientBuilder().WithScheme(scheme).WithRuntimeObjects(
+			sopsSecret("failing", STATUS_DECRYPT_ERROR),
+			sopsSecret("healthy", "Healthy"),
+			sopsSecret("mac-mismatch", STATUS_MAC_MISMATCH),
+		).Build(),
+		Log: logr.Discard(),
+	}
+
+	// Without controller there is nothing to enqueue to
+	r.RequeueDecryptErrors(context.Background())
+
+	r.requeues = make(chan event.GenericEvent, 1)
+	r.RequeueDecryptErrors(context.Background())
+	if len(r.requeues) != 1 {
+		t.Fatalf("expected 1 SopsSecret to be re-enqueued, got %d", len(r.requeues))
+	}
+	if e := <-r.requeues; e.Object.GetName() != "failing" {
+		t.Errorf("expected SopsSecret failing to decrypt to be re-enqueued, got %s", e.Object.GetName())
+	}
+
+	// Full buffer does not block
+	r.requeues <- event.GenericEvent{}
+	r.RequeueDecryptErrors(context.Background())
+}
@@ -0,0 +1,365 @@
+/* This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at https://mozilla.org/MPL/2.0/. */
+
+package controllers
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"slices"
+	"strings"
+	"sync"
+
+	"filippo.io/age"
+	"filippo.io/age/armor"
+	sopsage "github.com/getsops/sops/v3/age"
+	"github.com/getsops/sops/v3/keyservice"
+	sopspgp "github.com/getsops/sops/v3/pgp"
+	"google.golang.org/grpc"
+
+	"github.com/isindir/sops-secrets-operator/internal/audit"
+)
+
+// managedAgeIdentities are age identities generated by the operator and
+// identities reloaded from key files, these are tried before identities
+// loaded from the environment
+var managedAgeIdentities struct {
+	sync.RWMutex
+	generated sopsage.ParsedIdentities
+	reloaded  sopsage.ParsedIdentities
+}
+
+// SetManagedAgeIdentities replaces age identities generated by the operator
+func SetManagedAgeIdentities(identities []age.Identity) {
+	managedAgeIdentities.Lock()
+	defer managedAgeIdentities.Unlock()
+	managedAgeIdentities.generated = identities
+}
+
+// SetReloadedAgeIdentities replaces age identities loaded from key files
+// watched by the operator
+func SetReloadedAgeIdentities(identities []age.Identity) {
+	managedAgeIdentities.Lock()
+	defer managedAgeIdentities.Unlock()
+	managedAgeIdentities.reloaded = identities
+}
+
+func getManagedAgeIdentities() sopsage.ParsedIdentities {
+	managedAgeIdentities.RLock()
+	defer managedAgeIdentities.RUnlock()
+	return slices.Concat(managedAgeIdentities.generated, managedAgeIdentities.reloaded)
+}
+
+// gnupgHome returns the GnuPG home PGP keys are used from
+var gnupgHome struct {
+	sync.RWMutex
+	acquire func() (home string, release func())
+}
+
+// SetGnuPGHome sets the function returning the GnuPG home PGP data keys are
+// encrypted and decrypted with, e.g. keyring reloaded by the operator.
+// release is called when the home is no longer used, GNUPGHOME is used when
+// the returned home is empty.
+func SetGnuPGHome(acquire func() (home string, release func())) {
+	gnupgHome.Lock()
+	defer gnupgHome.Unlock()
+	gnupgHome.acquire = acquire
+}
+
+// acquireGnuPGHome returns the GnuPG home PGP keys are used from, empty for
+// GNUPGHOME
+func acquireGnuPGHome() (string, func()) {
+	gnupgHome.RLock()
+	defer gnupgHome.RUnlock()
+	if gnupgHome.acquire == nil {
+		return "", func() {}
+	}
+	return gnupgHome.acquire()
+}
+
+// gnupgHomeKey is the context key of the GnuPG home acquired for decryption
+type gnupgHomeKey struct{}
+
+// localKeyServer is sops local key service using PGP keys of the GnuPG home
+// set by SetGnuPGHome, other keys are used as by sops
+type localKeyServer struct {
+	keyservice.Server
+}
+
+// Encrypt encrypts data key, PGP data keys with the public key of the GnuPG home
+func (s localKeyServer) Encrypt(ctx context.Context, in *keyservice.EncryptRequest) (*keyservice.EncryptResponse, error) {
+	pgpKey := in.GetKey().GetPgpKey()
+	if pgpKey == nil {
+		return s.Server.Encrypt(ctx, in)
+	}
+	home, release := acquireGnuPGHome()
+	defer release()
+	masterKey := newPGPMasterKey(pgpKey.GetFingerprint(), home)
+	if err := masterKey.EncryptContext(ctx, in.GetPlaintext()); err != nil {
+		return nil, err
+	}
+	return &keyservice.EncryptResponse{Ciphertext: masterKey.EncryptedDataKey()}, nil
+}
+
+// Decrypt decrypts data key, PGP data keys with the private key of the GnuPG
+// home acquired by recordingKeyService
+func (s localKeyServer) Decrypt(ctx context.Context, in *keyservice.DecryptRequest) (*keyservice.DecryptResponse, error) {
+	pgpKey := in.GetKey().GetPgpKey()
+	if pgpKey == nil {
+		return s.Server.Decrypt(ctx, in)
+	}
+	home, ok := ctx.Value(gnupgHomeKey{}).(string)
+	if !ok {
+		var release func()
+		home, release = acquireGnuPGHome()
+		defer release()
+	}
+	masterKey := newPGPMasterKey(pgpKey.GetFingerprint(), home)
+	masterKey.EncryptedKey = string(in.GetCiphertext())
+	plaintext, err := masterKey.DecryptContext(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return &keyservice.DecryptResponse{Plaintext: plaintext}, nil
+}
+
+// newPGPMasterKey returns PGP key of fingerprint using the GnuPG home, empty
+// home uses GNUPGHOME
+func newPGPMasterKey(fingerprint, home string) *sopspgp.MasterKey {
+	masterKey := sopspgp.NewMasterKeyFromFingerprint(fingerprint)
+	if home != "" {
+		sopspgp.GnuPGHome(home).ApplyToMasterKey(masterKey)
+	}
+	return masterKey
+}
+
+// keyServices are sops key services data keys are decrypted with, in
+// addition to managed age identities
+var keyServices struct {
+	sync.RWMutex
+	remote       []keyservice.KeyServiceClient
+	disableLocal bool
+}
+
+// SetKeyServices configures remote sops key services, which are tried after
+// the local key service. With disableLocal key material available to the
+// operator process is not used, only managed age identities and remote key
+// services decrypt data keys.
+func SetKeyServices(remote []keyservice.KeyServiceClient, disableLocal bool) {
+	keyServices.Lock()
+	defer keyServices.Unlock()
+	keyServices.remote = remote
+	keyServices.disableLocal = disableLocal
+}
+
+// newKeyService returns sops key service used to decrypt data keys, keys
+// which decrypt data keys must be allowed by policies, nil policies allow all
+// keys
+func newKeyService(policies *RecipientPolicies) *recordingKeyService {
+	keyServices.RLock()
+	defer keyServices.RUnlock()
+	var chain chainKeyService
+	if !keyServices.disableLocal {
+		chain = append(chain, keyservice.NewCustomLocalClient(localKeyServer{}))
+	}
+	chain = append(chain, keyServices.remote...)
+	return &recordingKeyService{
+		KeyServiceClient: chain,
+		localAge:         !keyServices.disableLocal,
+		policies:         policies,
+	}
+}
+
+// chainKeyService tries sops key services in order until one succeeds
+type chainKeyService []keyservice.KeyServiceClient
+
+// Encrypt encrypts data key with the first key service which succeeds
+func (c chainKeyService) Encrypt(
+	ctx context.Context, in *keyservice.EncryptRequest, opts ...grpc.CallOption,
+) (*keyservice.EncryptResponse, error) {
+	var errs []error
+	for _, client := range c {
+		rsp, err := client.Encrypt(ctx, in, opts...)
+		if err == nil {
+			return rsp, nil
+		}
+		errs = append(errs, err)
+	}
+	return nil, c.err(errs)
+}
+
+// Decrypt decrypts data key with the first key service which succeeds
+func (c chainKeyService) Decrypt(
+	ctx context.Context, in *keyservice.DecryptRequest, opts ...grpc.CallOption,
+) (*keyservice.DecryptResponse, error) {
+	var errs []error
+	for _, client := range c {
+		rsp, err := client.Decrypt(ctx, in, opts...)
+		if err == nil {
+			return rsp, nil
+		}
+		errs = append(errs, err)
+	}
+	return nil, c.err(errs)
+}
+
+func (c chainKeyService) err(errs []error) error {
+	if len(c) == 0 {
+		return errors.New("no sops key service is configured")
+	}
+	return errors.Join(errs...)
+}
+
+// recordingKeyService wraps a sops key service and records keys which
+// successfully decrypted the data key, one key per key group is used by sops.
+// Age and PGP key services decrypt with any identity they hold, whatever
+// recipient sops metadata lists, so the key which decrypted the data key is
+// attributed from the identity or the ciphertext rather than taken from
+// metadata. Keys not allowed by policies do not decrypt the data key.
+type recordingKeyService struct {
+	keyservice.KeyServiceClient
+	// localAge allows age identities sops loads from the environment
+	localAge bool
+	policies *RecipientPolicies
+
+	mu     sync.Mutex
+	keys   []audit.Key
+	denied []error
+}
+
+// Decrypt decrypts data key with wrapped key service and records the key on success
+func (s *recordingKeyService) Decrypt(
+	ctx context.Context, in *keyservice.DecryptRequest, opts ...grpc.CallOption,
+) (*keyservice.DecryptResponse, error) {
+	key := keyFromProto(in.GetKey())
+	var rsp *keyservice.DecryptResponse
+	var err error
+	switch key.Provider {
+	case "age":
+		rsp, key, err = s.decryptAge(ctx, in, opts...)
+	case "pgp":
+		// Key is attributed and decrypted with the same keyring
+		home, release := acquireGnuPGHome()
+		defer release()
+		if key, err = attributePGPKey(key, home, in.GetCiphertext()); err == nil {
+			rsp, err = s.KeyServiceClient.Decrypt(context.WithValue(ctx, gnupgHomeKey{}, home), in, opts...)
+		}
+	default:
+		// Cloud KMS and Vault decrypt only with the key named in the request
+		rsp, err = s.KeyServiceClient.Decrypt(ctx, in, opts...)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if err := s.policies.AllowKey(key); err != nil {
+		s.denied = append(s.denied, err)
+		return nil, err
+	}
+	s.keys = append(s.keys, key)
+	return rsp, nil
+}
+
+// decryptAge decrypts age data key with identities of known recipient one by
+// one, so that the identity which decrypted it is known. Data keys none of
+// them decrypts are passed to the wrapped key service, which may hold SSH,
+// plugin or remote identities, and the key is recorded unverified.
+func (s *recordingKeyService) decryptAge(
+	ctx context.Context, in *keyservice.DecryptRequest, opts ...grpc.CallOption,
+) (*keyservice.DecryptResponse, audit.Key, error) {
+	listed := in.GetKey().GetAgeKey().GetRecipient()
+	identities := getManagedAgeIdentities()
+	if s.localAge {
+		identities = append(identities, getAgeKeyFileIdentities()...)
+	}
+	for _, identity := range identities {
+		recipient, ok := ageIdentityRecipient(identity)
+		if !ok {
+			continue
+		}
+		reader, err := age.Decrypt(armor.NewReader(bytes.NewReader(in.GetCiphertext())), identity)
+		if err != nil {
+			continue
+		}
+		plaintext, err := io.ReadAll(reader)
+		if err != nil {
+			return nil, audit.Key{}, err
+		}
+		key := audit.Key{Provider: "age", ID: recipient}
+		if recipient != listed {
+			return nil, key, fmt.Errorf("age data key is encrypted for %s, not for %s listed in sops metadata", recipient, listed)
+		}
+		return &keyservice.DecryptResponse{Plaintext: plaintext}, key, nil
+	}
+
+	rsp, err := s.KeyServiceClient.Decrypt(ctx, in, opts...)
+	return rsp, audit.Key{Provider: "age", ID: listed, Unverified: true}, err
+}
+
+// usedKeys returns keys which decrypted the data key
+func (s *recordingKeyService) usedKeys() []audit.Key {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([]audit.Key(nil), s.keys...)
+}
+
+// deniedErr returns error of keys which decrypted the data key but are not
+// allowed by policies, nil if no key was denied
+func (s *recordingKeyService) deniedErr() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if len(s.denied) == 0 {
+		return nil
+	}
+	return s.denied[0]
+}
+
+// ageIdentityRecipient returns recipient of age identity, false for
+// identities which do not expose it, e.g. plugin identities
+func ageIdentityRecipient(identity age.Identity) (string, bool) {
+	switch identity := identity.(type) {
+	case *age.X25519Identity:
+		return identity.Recipient().String(), true
+	case *age.HybridIdentity:
+		return identity.Recipient().String(), true
+	}
+	return "", false
+}
+
+// keyFromProto converts sops key service key to provider name, as used in sops
+// metadata, and key identifier. Age and PGP identifiers are taken from sops
+// metadata and are attributed by recordingKeyService.
+func keyFromProto(key *keyservice.Key) audit.Key {
+	switch {
+	case key.GetAgeKey() != nil:
+		return audit.Key{Provider: "age", ID: key.GetAgeKey().GetRecipient()}
+	case key.GetPgpKey() != nil:
+		return audit.Key{Provider: "pgp", ID: key.GetPgpKey().GetFingerprint()}
+	case key.GetKmsKey() != nil:
+		return audit.Key{Provider: "kms", ID: key.GetKmsKey().GetArn()}
+	case key.GetGcpKmsKey() != nil:
+		return audit.Key{Provider: "gcp_kms", ID: key.GetGcpKmsKey().GetResourceId()}
+	case key.GetAzureKeyvaultKey() != nil:
+		azureKey := key.GetAzureKeyvaultKey()
+		return audit.Key{
+			Provider: "azure_kv",
+			ID:       strings.TrimSuffix(azureKey.GetVaultUrl(), "/") + "/keys/" + azureKey.GetName(),
+		}
+	case key.GetVaultKey() != nil:
+		vaultKey := key.GetVaultKey()
+		return audit.Key{
+			Provider: "hc_vault",
+			ID: strings.TrimSuffix(vaultKey.GetVaultAddress(), "/") + "/v1/" +
+				strings.Trim(vaultKey.GetEnginePath(), "/") + "/keys/" + vaultKey.GetKeyName(),
+		}
+	case key.GetHckmsKey() != nil:
+		return audit.Key{Provider: "hckms", ID: key.GetHckmsKey().GetKeyId()}
+	}
+	return audit.Key{Provider: "unknown"}
+}
@@ -0,0 +1,277 @@
+/* This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at https://mozilla.org/MPL/2.0/. */
+
+package controllers
+
+import (
+	"bytes"
+	"context"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"filippo.io/age"
+	"github.com/ProtonMail/go-crypto/openpgp"
+	"github.com/ProtonMail/go-crypto/openpgp/armor"
+	sopsage "github.com/getsops/sops/v3/age"
+	"github.com/getsops/sops/v3/keyservice"
+	sopspgp "github.com/getsops/sops/v3/pgp"
+	"google.golang.org/grpc"
+
+	isindirv1alpha3 "github.com/isindir/sops-secrets-operator/api/v1alpha3"
+	"github.com/isindir/sops-secrets-operator/internal/audit"
+)
+
+type failingKeyService struct {
+	keyservice.KeyServiceClient
+}
+
+func (failingKeyService) Decrypt(context.Context, *keyservice.DecryptRequest, ...grpc.CallOption) (*keyservice.DecryptResponse, error) {
+	return nil, errors.New("no key")
+}
+
+// setAgeKeyFile sets SOPS_AGE_KEY_FILE for the test, dropping identities
+// cached from other key files
+func setAgeKeyFile(t *testing.T, path string) {
+	t.Helper()
+	t.Setenv(sopsage.SopsAgeKeyFileEnv, path)
+	ResetKeyCaches()
+	t.Cleanup(ResetKeyCaches)
+}
+
+func TestAgeKeyFileIdentitiesCache(t *testing.T) {
+	identities := make([]*age.X25519Identity, 2)
+	for i := range identities {
+		identity, err := age.GenerateX25519Identity()
+		if err != nil {
+			t.Fatal(err)
+		}
+		identities[i] = identity
+	}
+	path := filepath.Join(t.TempDir(), "keys.txt")
+	if err := os.WriteFile(path, []byte(identities[0].String()+"\n"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	setAgeKeyFile(t, path)
+	if loaded := getAgeKeyFileIdentities(); len(loaded) != 1 {
+		t.Fatalf("expected 1 identity, got %d", len(loaded))
+	}
+
+	// Key file is not read again until keys are reloaded
+	if err := os.WriteFile(path, []byte(identities[0].String()+"\n"+identities[1].String()+"\n"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	if loaded := getAgeKeyFileIdentities(); len(loaded) != 1 {
+		t.Errorf("expected cached identity, got %d identities", len(loaded))
+	}
+	ResetKeyCaches()
+	if loaded := getAgeKeyFileIdentities(); len(loaded) != 2 {
+		t.Errorf("expected 2 identities after reset, got %d", len(loaded))
+	}
+}
+
+// ageDecryptRequest returns request to decrypt data key encrypted for
+// identity, listing recipient in sops metadata
+func ageDecryptRequest(t *testing.T, identity *age.X25519Identity, recipient string, dataKey []byte) *keyservice.DecryptRequest {
+	t.Helper()
+	masterKey := &sopsage.MasterKey{Recipient: identity.Recipient().String()}
+	if err := masterKey.Encrypt(dataKey); err != nil {
+		t.Fatal(err)
+	}
+	return &keyservice.DecryptRequest{
+		Key:        &keyservice.Key{KeyType: &keyservice.Key_AgeKey{AgeKey: &keyservice.AgeKey{Recipient: recipient}}},
+		Ciphertext: masterKey.EncryptedDataKey(),
+	}
+}
+
+func TestRecordingKeyServiceAge(t *testing.T) {
+	identity, err := age.GenerateX25519Identity()
+	if err != nil {
+		t.Fatal(err)
+	}
+	allowed, err := age.GenerateX25519Identity()
+	if err != nil {
+		t.Fatal(err)
+	}
+	dataKey := []byte("0123456789abcdef0123456789abcdef")
+	recipient := identity.Recipient().String()
+	policies := &RecipientPolicies{
+		namespace: "team-a",
+		policies: []isindirv1alpha3.SopsSecretPolicy{newPolicy(nil, nil, isindirv1alpha3.AllowedRecipients{
+			Age: []string{allowed.Recipient().String()},
+		})},
+	}
+
+	tests := []struct {
+		name        string
+		identities  []age.Identity
+		recipient   string
+		policies    *RecipientPolicies
+		expectedKey *audit.Key
+		denied      bool
+	}{
+		{
+			name:      "Falls back to wrapped key service without identities",
+			recipient: recipient,
+		},
+		{
+			name:        "Decrypting identity is recorded",
+			identities:  []age.Identity{allowed, identity},
+			recipient:   recipient,
+			expectedKey: &audit.Key{Provider: "age", ID: recipient},
+		},
+		{
+			name:       "Recipient listed in metadata must decrypt the data key",
+			identities: []age.Identity{allowed, identity},
+			recipient:  allowed.Recipient().String(),
+		},
+		{
+			name:       "Decrypting identity must be allowed by policies",
+			identities: []age.Identity{identity},
+			recipient:  recipient,
+			policies:   policies,
+			denied:     true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			SetManagedAgeIdentities(tt.identities)
+			defer SetManagedAgeIdentities(nil)
+			ks := &recordingKeyService{KeyServiceClient: failingKeyService{}, policies: tt.policies}
+
+			rsp, err := ks.Decrypt(context.Background(), ageDecryptRequest(t, identity, tt.recipient, dataKey))
+			if tt.expectedKey == nil {
+				if err == nil {
+					t.Fatal("expected data key not to be decrypted")
+				}
+				if denied := ks.deniedErr() != nil; denied != tt.denied {
+					t.Errorf("expected denied %t, got %v", tt.denied, ks.deniedErr())
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("Decrypt() error = %v", err)
+			}
+			if !bytes.Equal(rsp.GetPlaintext(), dataKey) {
+				t.Errorf("expected data key to be decrypted")
+			}
+			if keys := ks.usedKeys(); len(keys) != 1 || keys[0] != *tt.expectedKey {
+				t.Errorf("expected recorded key %v, got %v", *tt.expectedKey, keys)
+			}
+		})
+	}
+}
+
+func TestRecordingKeyServiceUnverifiedAge(t *testing.T) {
+	identity, err := age.GenerateX25519Identity()
+	if err != nil {
+		t.Fatal(err)
+	}
+	dataKey := []byte("0123456789abcdef0123456789abcdef")
+	recipient := identity.Recipient().String()
+	request := ageDecryptRequest(t, identity, recipient, dataKey)
+	// Identity is held by wrapped key service only, e.g. remote key service
+	plaintext := keyservice.DecryptResponse{Plaintext: dataKey}
+
+	ks := &recordingKeyService{KeyServiceClient: staticKeyService{rsp: &plaintext}}
+	if _, err := ks.Decrypt(context.Background(), request); err != nil {
+		t.Fatalf("Decrypt() error = %v", err)
+	}
+	if keys := ks.usedKeys(); len(keys) != 1 || !keys[0].Unverified || keys[0].ID != recipient {
+		t.Errorf("expected unverified key listed in metadata, got %v", keys)
+	}
+
+	ks = &recordingKeyService{
+		KeyServiceClient: staticKeyService{rsp: &plaintext},
+		policies: &RecipientPolicies{
+			namespace: "team-a",
+			policies:  []isindirv1alpha3.SopsSecretPolicy{newPolicy(nil, nil, isindirv1alpha3.AllowedRecipients{Age: []string{recipient}})},
+		},
+	}
+	if _, err := ks.Decrypt(context.Background(), request); err == nil {
+		t.Error("expected unverified key not to be allowed by policies")
+	}
+}
+
+type staticKeyService struct {
+	keyservice.KeyServiceClient
+	rsp *keyservice.DecryptResponse
+}
+
+func (s staticKeyService) Decrypt(context.Context, *keyservice.DecryptRequest, ...grpc.CallOption) (*keyservice.DecryptResponse, error) {
+	return s.rsp, nil
+}
+
+func TestAttributePGPKey(t *testing.T) {
+	if _, err := exec.LookPath("gpg"); err != nil {
+		t.Skip("gpg is not installed")
+	}
+	gnupgHome, err := sopspgp.NewGnuPGHome()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() { _ = gnupgHome.Cleanup() }()
+	ResetKeyCaches()
+	t.Cleanup(ResetKeyCaches)
+
+	fingerprints := make([]string, 2)
+	for i := range fingerprints {
+		entity, err := openpgp.NewEntity(fmt.Sprintf("test %d", i), "", fmt.Sprintf("test%d@example.com", i), nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		armored := &bytes.Buffer{}
+		writer, err := armor.Encode(armored, openpgp.PublicKeyType, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := entity.Serialize(writer); err != nil {
+			t.Fatal(err)
+		}
+		_ = writer.Close()
+		if err := gnupgHome.Import(armored.Bytes()); err != nil {
+			t.Fatal(err)
+		}
+		fingerprints[i] = strings.ToUpper(hex.EncodeToString(entity.PrimaryKey.Fingerprint))
+	}
+
+	masterKey := sopspgp.NewMasterKeyFromFingerprint(fingerprints[0])
+	gnupgHome.ApplyToMasterKey(masterKey)
+	if err := masterKey.Encrypt([]byte("0123456789abcdef0123456789abcdef")); err != nil {
+		t.Fatal(err)
+	}
+
+	// Data key is encrypted for a subkey of the listed key
+	key, err := attributePGPKey(audit.Key{Provider: "pgp", ID: fingerprints[0]}, gnupgHome.String(), masterKey.EncryptedDataKey())
+	if err != nil || key.Unverified {
+		t.Errorf("expected verified key, got %v, %v", key, err)
+	}
+	// Metadata lists another key of the keyring
+	if _, err := attributePGPKey(audit.Key{Provider: "pgp", ID: fingerprints[1]}, gnupgHome.String(), masterKey.EncryptedDataKey()); err == nil {
+		t.Error("expected error for data key not encrypted for the listed key")
+	}
+	// Listed key is not in the keyring
+	key, err = attributePGPKey(audit.Key{Provider: "pgp", ID: "0000000000000000000000000000000000000000"}, gnupgHome.String(), masterKey.EncryptedDataKey())
+	if err != nil || !key.Unverified {
+		t.Errorf("expected unverified key, got %v, %v", key, err)
+	}
+
+	// Keys listed by gpg are cached until keys are reloaded
+	t.Setenv(sopspgp.SopsGpgExecEnv, "false")
+	key, err = attributePGPKey(audit.Key{Provider: "pgp", ID: fingerprints[0]}, gnupgHome.String(), masterKey.EncryptedDataKey())
+	if err != nil || key.Unverified {
+		t.Errorf("expected cached verified key, got %v, %v", key, err)
+	}
+	ResetKeyCaches()
+	key, err = attributePGPKey(audit.Key{Provider: "pgp", ID: fingerprints[0]}, gnupgHome.String(), masterKey.EncryptedDataKey())
+	if err != nil || !key.Unverified {
+		t.Errorf("expected unverified key after cache reset, got %v, %v", key, err)
+	}
+}
@@ -0,0 +1,66 @@
+/* This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at https://mozilla.org/MPL/2.0/. */
+
+package controllers
+
+import (
+	"encoding/json"
+	"maps"
+	"slices"
+
+	corev1 "k8s.io/api/core/v1"
+
+	isindirv1alpha3 "github.com/isindir/sops-secrets-operator/api/v1alpha3"
+)
+
+// lastAppliedMetadata lists keys of labels and annotations the operator set
+// on a child secret
+type lastAppliedMetadata struct {
+	Labels      []string `json:"labels,omitempty"`
+	Annotations []string `json:"annotations,omitempty"`
+}
+
+// setLastApplied records keys of labels and annotations of secret created
+// from template in the last applied annotation
+func setLastApplied(secret *corev1.Secret) {
+	applied := lastAppliedMetadata{
+		Labels:      slices.Sorted(maps.Keys(secret.Labels)),
+		Annotations: slices.Sorted(maps.Keys(secret.Annotations)),
+	}
+	// Keys can always be marshalled
+	value, _ := json.Marshal(applied)
+	if secret.Annotations == nil {
+		secret.Annotations = map[string]string{}
+	}
+	secret.Annotations[isindirv1alpha3.SopsSecretLastAppliedAnnotation] = string(value)
+}
+
+// getLastApplied returns keys of labels and annotations the operator set on
+// secret in cluster, nothing for secrets without valid annotation. Secrets
+// written by previous operator versions have no annotation, keys removed from
+// their template are kept as those set by other tools. The annotation is
+// seeded with keys of the current template when the secret is refreshed.
+func getLastApplied(secret *corev1.Secret) lastAppliedMetadata {
+	applied := lastAppliedMetadata{}
+	if value, ok := secret.Annotations[isindirv1alpha3.SopsSecretLastAppliedAnnotation]; ok {
+		if err := json.Unmarshal([]byte(value), &applied); err != nil {
+			return lastAppliedMetadata{}
+		}
+	}
+	return applied
+}
+
+// mergeMetadata returns labels or annotations of secret in cluster with keys
+// previously applied by the operator and no longer desired removed, and
+// desired keys added or updated, other keys are preserved
+func mergeMetadata(inCluster map[string]string, desired map[string]string, lastApplied []string) map[string]string {
+	merged := cloneMap(inCluster)
+	for _, key := range lastApplied {
+		if _, ok := desired[key]; !ok {
+			delete(merged, key)
+		}
+	}
+	maps.Copy(merged, desired)
+	return merged
+}
@@ -0,0 +1,167 @@
+/* This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at https://mozilla.org/MPL/2.0/. */
+
+package controllers
+
+import (
+	"context"
+	"maps"
+	"slices"
+	"testing"
+
+	"github.com/go-logr/logr"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"sigs.k8s.io/controller-runtime/pkg/client/interceptor"
+
+	isindirv1alpha3 "github.com/isindir/sops-secrets-operator/api/v1alpha3"
+)
+
+func TestMergeMetadata(t *testing.T) {
+	tests := []struct {
+		name        string
+		inCluster   map[string]string
+		desired     map[string]string
+		lastApplied []string
+		expected    map[string]string
+	}{
+		{
+			name:      "Foreign keys are preserved",
+			inCluster: map[string]string{"app": "old", "argocd.argoproj.io/instance": "app"},
+			desired:   map[string]string{"app": "jenkins"},
+			expected:  map[string]string{"app": "jenkins", "argocd.argoproj.io/instance": "app"},
+		},
+		{
+			name:        "Keys removed from template are removed",
+			inCluster:   map[string]string{"app": "jenkins", "team": "a", "velero.io/backup-name": "daily"},
+			desired:     map[string]string{"app": "jenkins"},
+			lastApplied: []string{"app", "team"},
+			expected:    map[string]string{"app": "jenkins", "velero.io/backup-name": "daily"},
+		},
+		{
+			name:        "Foreign keys are not removed without last applied annotation",
+			inCluster:   map[string]string{"team": "a"},
+			desired:     map[string]string{"app": "jenkins"},
+			lastApplied: nil,
+			expected:    map[string]string{"app": "jenkins", "team": "a"},
+		},
+		{
+			name:        "Template overrides foreign value",
+			inCluster:   map[string]string{"team": "b"},
+			desired:     map[string]string{"team": "a"},
+			lastApplied: []string{"team"},
+			expected:    map[string]string{"team": "a"},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if result := mergeMetadata(tt.inCluster, tt.desired, tt.lastApplied); !maps.Equal(result, tt.expected) {
+				t.Errorf("mergeMetadata() = %v, expected %v", result, tt.expected)
+			}
+		})
+	}
+}
+
+func TestRefreshKubeSecretIfNeededPreservesForeignMetadata(t *testing.T) {
+	sopsSecret := &isindirv1alpha3.SopsSecret{ObjectMeta: metav1.ObjectMeta{Name: "app", Namespace: "default"}}
+	template := &isindirv1alpha3.SopsSecretTemplate{
+		Name:        "app",
+		Labels:      map[string]string{"app": "jenkins", "team": "a"},
+		Annotations: map[string]string{"description": "credentials"},
+		StringData:  map[string]string{"token": "secret"},
+	}
+	fromTemplate, err := createKubeSecretFromTemplate(sopsSecret, template, logr.Discard())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if applied := getLastApplied(fromTemplate); !slices.Equal(
+		applied.Labels, []string{"app", isindirv1alpha3.SopsSecretManagedLabel, "team"},
+	) {
+		t.Fatalf("expected all labels set from template to be recorded, got %v", applied.Labels)
+	}
+
+	// Other tools label and annotate the secret
+	inCluster := fromTemplate.DeepCopy()
+	inCluster.Data = secretData(fromTemplate)
+	inCluster.StringData = nil
+	inCluster.Labels["kyverno.io/generated"] = "true"
+	inCluster.Annotations["reflector.v1.k8s.emberstack.com/reflection-allowed"] = "true"
+	f := newChildSecretFixture(t, interceptor.Funcs{}, inCluster)
+	r, req, get := f.r, f.req, f.get
+
+	inCluster = get()
+	if reschedule, err := r.refreshKubeSecretIfNeeded(context.Background(), req, sopsSecret, fromTemplate, inCluster); reschedule || err != nil {
+		t.Fatal("expected refresh to succeed")
+	}
+	if updated := get(); updated.ResourceVersion != inCluster.ResourceVersion {
+		t.Error("expected secret with foreign metadata only not to be updated")
+	}
+
+	// Label removed from template is removed, foreign metadata is kept
+	delete(template.Labels, "team")
+	fromTemplate, err = createKubeSecretFromTemplate(sopsSecret, template, logr.Discard())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if reschedule, err := r.refreshKubeSecretIfNeeded(context.Background(), req, sopsSecret, fromTemplate, get()); reschedule || err != nil {
+		t.Fatal("expected refresh to succeed")
+	}
+	updated := get()
+	if _, ok := updated.Labels["team"]; ok {
+		t.Error("expected label removed from template to be removed")
+	}
+	if updated.Labels["kyverno.io/generated"] != "true" ||
+		updated.Annotations["reflector.v1.k8s.emberstack.com/reflection-allowed"] != "true" {
+		t.Errorf("expected foreign metadata to be preserved, got %v %v", updated.Labels, updated.Annotations)
+	}
+}
+
+func TestRefreshKubeSecretIfNeededSeedsLastApplied(t *testing.T) {
+	sopsSecret := &isindirv1alpha3.SopsSecret{ObjectMeta: metav1.ObjectMeta{Name: "app", Namespace: "default"}}
+	template := &isindirv1alpha3.SopsSecretTemplate{
+		Name:       "app",
+		Labels:     map[string]string{"app": "jenkins", "team": "a"},
+		StringData: map[string]string{"token": "secret"},
+	}
+	fromTemplate, err := createKubeSecretFromTemplate(sopsSecret, template, logr.Discard())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Secret written by previous operator version without last applied
+	// annotation, label "old" was removed from template before the upgrade
+	inCluster := fromTemplate.DeepCopy()
+	inCluster.Data = secretData(fromTemplate)
+	inCluster.StringData = nil
+	inCluster.Labels["old"] = "label"
+	delete(inCluster.Annotations, isindirv1alpha3.SopsSecretLastAppliedAnnotation)
+	f := newChildSecretFixture(t, interceptor.Funcs{}, inCluster)
+	r, req, get := f.r, f.req, f.get
+
+	if reschedule, err := r.refreshKubeSecretIfNeeded(context.Background(), req, sopsSecret, fromTemplate, get()); reschedule || err != nil {
+		t.Fatal("expected refresh to succeed")
+	}
+	updated := get()
+	if updated.Labels["old"] != "label" {
+		t.Error("expected label removed before the upgrade to be kept as a foreign label")
+	}
+	if applied := getLastApplied(updated); !slices.Equal(
+		applied.Labels, []string{"app", isindirv1alpha3.SopsSecretManagedLabel, "team"},
+	) {
+		t.Fatalf("expected last applied annotation seeded from template, got %v", applied.Labels)
+	}
+
+	// Label removed from template after the upgrade is removed
+	delete(template.Labels, "team")
+	fromTemplate, err = createKubeSecretFromTemplate(sopsSecret, template, logr.Discard())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if reschedule, err := r.refreshKubeSecretIfNeeded(context.Background(), req, sopsSecret, fromTemplate, get()); reschedule || err != nil {
+		t.Fatal("expected refresh to succeed")
+	}
+	if updated := get(); updated.Labels["team"] != "" || updated.Labels["old"] != "label" {
+		t.Errorf("expected label removed from template to be removed, got %v", updated.Labels)
+	}
+}
@@ -0,0 +1,342 @@
+/* This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at https://mozilla.org/MPL/2.0/. */
+
+package controllers
+
+import (
+	"crypto/sha256"
+	"crypto/sha512"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash"
+	"slices"
+	"strings"
+	"sync"
+
+	"github.com/getsops/sops/v3"
+	sopsaes "github.com/getsops/sops/v3/aes"
+	corev1 "k8s.io/api/core/v1"
+
+	isindirv1alpha3 "github.com/isindir/sops-secrets-operator/api/v1alpha3"
+)
+
+// maxMACOrderings is the number of key orderings tried by MAC verification
+const maxMACOrderings = 1 << 20
+
+// maxVerifiedMACs is the number of MAC verification results remembered
+const maxVerifiedMACs = 1024
+
+// macKeyRank orders keys of SopsSecret the way manifests are usually written,
+// orderings are tried starting with this order. Other keys, e.g. keys of
+// secret data, keep the sorted order of the stored object.
+var macKeyRank = map[string]int{
+	"apiVersion":      1,
+	"kind":            2,
+	"metadata":        3,
+	"name":            4,
+	"namespace":       5,
+	"labels":          6,
+	"annotations":     7,
+	"spec":            8,
+	"type":            9,
+	"data":            10,
+	"stringData":      11,
+	"secretTemplates": 12,
+}
+
+// verifiedMACs remembers results of MAC verification of documents, so that
+// ordering search is not repeated on every reconciliation of the same object
+var verifiedMACs = struct {
+	sync.Mutex
+	results map[string]error
+}{results: map[string]error{}}
+
+// macDocument returns SopsSecret the way it was written to the file sops
+// encrypted: fields set by Kubernetes and the operator are dropped, keys are
+// sorted. sops MAC covers values of all fields of the file unless
+// mac_only_encrypted is set.
+func macDocument(sopsSecret *isindirv1alpha3.SopsSecret) ([]byte, error) {
+	metadata := map[string]any{"name": sopsSecret.Name}
+	if sopsSecret.Namespace != "" {
+		metadata["namespace"] = sopsSecret.Namespace
+	}
+	if len(sopsSecret.Labels) > 0 {
+		metadata["labels"] = sopsSecret.Labels
+	}
+	annotations := map[string]string{}
+	for key, value := range sopsSecret.Annotations {
+		if key != corev1.LastAppliedConfigAnnotation && key != isindirv1alpha3.SopsSecretReconcileRequestAnnotation {
+			annotations[key] = value
+		}
+	}
+	if len(annotations) > 0 {
+		metadata["annotations"] = annotations
+	}
+
+	document := map[string]any{
+		"apiVersion": isindirv1alpha3.GroupVersion.String(),
+		"kind":       "SopsSecret",
+		"metadata":   metadata,
+		"spec":       sopsSecret.Spec,
+		"sops":       sopsSecret.Sops,
+	}
+	encoded, err := json.Marshal(document)
+	if err != nil {
+		return nil, err
+	}
+	return canonicalJSON(encoded)
+}
+
+// macNode is a value of sops tree contributing to MAC, children of mappings
+// can be hashed in any order, children of lists in their order
+type macNode struct {
+	key      string
+	leaf     bool
+	value    []byte
+	mapping  bool
+	children []*macNode
+	// optional node may be missing in the file, e.g. metadata.namespace
+	optional bool
+}
+
+// newMACNode returns node of decrypted value, encrypted value tells which
+// values were encrypted. Nil is returned for values which do not contribute
+// to MAC.
+func newMACNode(key string, encrypted, decrypted any, macOnlyEncrypted bool, path []string) (*macNode, error) {
+	node := &macNode{key: key, optional: slices.Equal(path, []string{"metadata", "namespace"})}
+	switch decrypted := decrypted.(type) {
+	case sops.TreeBranch:
+		encryptedBranch, _ := encrypted.(sops.TreeBranch)
+		node.mapping = true
+		for i, item := range decrypted {
+			var encryptedValue any
+			if i < len(encryptedBranch) {
+				encryptedValue = encryptedBranch[i].Value
+			}
+			itemKey := fmt.Sprint(item.Key)
+			child, err := newMACNode(itemKey, encryptedValue, item.Value, macOnlyEncrypted, append(path, itemKey))
+			if err != nil {
+				return nil, err
+			}
+			if child != nil {
+				node.children = append(node.children, child)
+			}
+		}
+	case []any:
+		encryptedList, _ := encrypted.([]any)
+		for i, item := range decrypted {
+			var encryptedValue any
+			if i < len(encryptedList) {
+				encryptedValue = encryptedList[i]
+			}
+			child, err := newMACNode("", encryptedValue, item, macOnlyEncrypted, append(path, fmt.Sprint(i)))
+			if err != nil {
+				return nil, err
+			}
+			if child != nil {
+				node.children = append(node.children, child)
+			}
+		}
+	default:
+		encryptedValue, _ := encrypted.(string)
+		if macOnlyEncrypted && !strings.HasPrefix(encryptedValue, sopsEncryptedValuePrefix) {
+			return nil, nil
+		}
+		value, err := sops.ToBytes(decrypted)
+		if err != nil {
+			return nil, err
+		}
+		node.leaf = true
+		node.value = value
+		return node, nil
+	}
+	if len(node.children) == 0 {
+		return nil, nil
+	}
+	if node.mapping {
+		slices.SortStableFunc(node.children, func(a, b *macNode) int {
+			return macKeyOrder(a.key) - macKeyOrder(b.key)
+		})
+	}
+	return node, nil
+}
+
+// macKeyOrder returns position of key in the first tried ordering
+func macKeyOrder(key string) int {
+	if rank, ok := macKeyRank[key]; ok {
+		return rank
+	}
+	return len(macKeyRank) + 1
+}
+
+// macSearch looks for ordering of mapping keys which values hash to mac
+type macSearch struct {
+	mac       string
+	orderings int
+}
+
+// match returns true when values of pending nodes, hashed in some ordering
+// after values already written to h, match the MAC
+func (s *macSearch) match(h hash.Cloner, pending []*macNode) (bool, error) {
+	if len(pending) == 0 {
+		s.orderings++
+		if s.orderings > maxMACOrderings {
+			return false, fmt.Errorf(
+				"%w: no match in the first %d key orderings of the document", ErrMACMismatch, maxMACOrderings,
+			)
+		}
+		return fmt.Sprintf("%X", h.Sum(nil)) == s.mac, nil
+	}
+
+	node, rest := pending[0], pending[1:]
+	switch {
+	case node.leaf:
+		next, err := h.Clone()
+		if err != nil {
+			return false, err
+		}
+		next.Write(node.value)
+		return s.match(next, rest)
+	case !node.mapping:
+		return s.match(h, append(slices.Clone(node.children), rest...))
+	}
+
+	for _, children := range macChildVariants(node.children) {
+		matched, err := s.permute(h, children, 0, rest)
+		if matched || err != nil {
+			return matched, err
+		}
+	}
+	return false, nil
+}
+
+// permute tries all orderings of children starting at index i
+func (s *macSearch) permute(h hash.Cloner, children []*macNode, i int, rest []*macNode) (bool, error) {
+	if i == len(children) {
+		return s.match(h, append(slices.Clone(children), rest...))
+	}
+	for j := i; j < len(children); j++ {
+		children[i], children[j] = children[j], children[i]
+		matched, err := s.permute(h, children, i+1, rest)
+		children[i], children[j] = children[j], children[i]
+		if matched || err != nil {
+			return matched, err
+		}
+	}
+	return false, nil
+}
+
+// macChildVariants returns children with and without optional children
+func macChildVariants(children []*macNode) [][]*macNode {
+	required := slices.DeleteFunc(slices.Clone(children), func(node *macNode) bool { return node.optional })
+	if len(required) == len(children) {
+		return [][]*macNode{slices.Clone(children)}
+	}
+	return [][]*macNode{slices.Clone(children), required}
+}
+
+// verifyDocumentMAC verifies mac of SopsSecret. Files encrypted by sops are
+// verified over macData, the object as written to the file, objects encrypted
+// by the operator over data, secret templates only. tree is data decrypted,
+// treeMAC is computed over its values in stored order.
+func verifyDocumentMAC(
+	store sops.Store, data []byte, tree sops.Tree, treeMAC string, macData []byte, key []byte, mac string,
+) error {
+	// Keys of the stored object are sorted, other orderings are only tried
+	// when the file was written in a different order
+	if treeMAC == mac {
+		return nil
+	}
+
+	encryptedObject, err := store.LoadEncryptedFile(macData)
+	if err != nil {
+		return err
+	}
+	object, err := store.LoadEncryptedFile(macData)
+	if err != nil {
+		return err
+	}
+	// Values left unencrypted which selectors encrypt mean the object was not
+	// encrypted as a whole, e.g. by the operator
+	if objectMAC, err := object.Decrypt(key, sopsaes.NewCipher()); err == nil {
+		if objectMAC == mac {
+			return nil
+		}
+		if err := verifyTreeMAC(encryptedObject, object, mac); !errors.Is(err, ErrMACMismatch) {
+			return err
+		}
+	}
+
+	encryptedTree, err := store.LoadEncryptedFile(data)
+	if err != nil {
+		return err
+	}
+	return verifyTreeMAC(encryptedTree, tree, mac)
+}
+
+// verifyTreeMAC verifies mac against values of decrypted tree hashed in the
+// order of the file sops encrypted. The order of keys is not preserved by
+// Kubernetes API, orderings of mapping keys are tried until one matches.
+// Lists keep their order, so reordered or swapped list items do not match.
+// Encrypted values are bound to their keys by sops, so trying orderings does
+// not allow moving encrypted values between keys. Results are remembered per
+// encrypted document.
+func verifyTreeMAC(encrypted, decrypted sops.Tree, mac string) error {
+	document, err := json.Marshal(encrypted.Branches)
+	if err != nil {
+		return err
+	}
+	digest := sha256.Sum256(append([]byte(mac), document...))
+	cacheKey := hex.EncodeToString(digest[:])
+	verifiedMACs.Lock()
+	result, ok := verifiedMACs.results[cacheKey]
+	verifiedMACs.Unlock()
+	if ok {
+		return result
+	}
+
+	result = searchTreeMAC(encrypted, decrypted, mac)
+	verifiedMACs.Lock()
+	if len(verifiedMACs.results) >= maxVerifiedMACs {
+		clear(verifiedMACs.results)
+	}
+	verifiedMACs.results[cacheKey] = result
+	verifiedMACs.Unlock()
+	return result
+}
+
+// searchTreeMAC tries orderings of mapping keys of decrypted tree until
+// values hash to mac
+func searchTreeMAC(encrypted, decrypted sops.Tree, mac string) error {
+	var roots []*macNode
+	for i, branch := range decrypted.Branches {
+		var encryptedBranch sops.TreeBranch
+		if i < len(encrypted.Branches) {
+			encryptedBranch = encrypted.Branches[i]
+		}
+		root, err := newMACNode("", encryptedBranch, branch, decrypted.Metadata.MACOnlyEncrypted, nil)
+		if err != nil {
+			return err
+		}
+		if root != nil {
+			roots = append(roots, root)
+		}
+	}
+
+	h := sha512.New().(hash.Cloner)
+	if decrypted.Metadata.MACOnlyEncrypted {
+		h.Write(sops.MACOnlyEncryptedInitialization)
+	}
+	search := &macSearch{mac: mac}
+	matched, err := search.match(h, roots)
+	if err != nil {
+		return err
+	}
+	if !matched {
+		return ErrMACMismatch
+	}
+	return nil
+}
@@ -0,0 +1,166 @@
+/* This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at https://mozilla.org/MPL/2.0/. */
+
+package controllers
+
+import (
+	"cmp"
+	"context"
+	"errors"
+	"fmt"
+	"slices"
+	"time"
+
+	"github.com/go-logr/logr"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/apimachinery/pkg/selection"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+
+	isindirv1alpha3 "github.com/isindir/sops-secrets-operator/api/v1alpha3"
+)
+
+const (
+	// managedLabelMigrationPageSize is the number of secrets listed at once
+	managedLabelMigrationPageSize = 500
+	// managedLabelMigrationBaseDelay is the default delay of the first retry
+	// of failed migration, it doubles up to managedLabelMigrationMaxDelay
+	managedLabelMigrationBaseDelay = 10 * time.Second
+	managedLabelMigrationMaxDelay  = 10 * time.Minute
+)
+
+var corev1SecretListGVK = schema.GroupVersionKind{Version: "v1", Kind: "SecretList"}
+
+// ManagedLabelMigration sets SopsSecretManagedLabel on child secrets created
+// by operator versions which did not set it. Only labelled secrets are cached,
+// so unlabelled children which are no longer templated would never be garbage
+// collected. Migration runs on the leader until it succeeds, secrets are
+// listed with metadata only from API server.
+type ManagedLabelMigration struct {
+	Client client.Client
+	// APIReader lists secrets from API server, bypassing the cache
+	APIReader client.Reader
+	// Namespaces are the watched namespaces, namespaces of SopsSecrets when
+	// empty
+	Namespaces []string
+	// BaseDelay and MaxDelay bound the time between retries of failed
+	// migration, defaults are used when not set
+	BaseDelay time.Duration
+	MaxDelay  time.Duration
+	Log       logr.Logger
+}
+
+// Start labels unlabelled child secrets, failed migration is retried with
+// exponential backoff until it succeeds or ctx is done. Failure is reported by
+// sopssecrets_managed_label_migration_failed metric.
+func (m *ManagedLabelMigration) Start(ctx context.Context) error {
+	delay := cmp.Or(m.BaseDelay, managedLabelMigrationBaseDelay)
+	maxDelay := cmp.Or(m.MaxDelay, managedLabelMigrationMaxDelay)
+	for {
+		err := m.migrate(ctx)
+		if err == nil {
+			sopsSecretsManagedLabelMigrationFailed.Set(0)
+			return nil
+		}
+		if ctx.Err() != nil {
+			return nil
+		}
+		sopsSecretsManagedLabelMigrationFailed.Set(1)
+		m.Log.Error(err, "Failed to set managed label on child secrets, retrying", "after", delay)
+
+		timer := time.NewTimer(delay)
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return nil
+		case <-timer.C:
+		}
+		delay = min(2*delay, maxDelay)
+	}
+}
+
+// migrate labels unlabelled child secrets of watched namespaces, secrets
+// which fail to be labelled are skipped and reported in the returned error
+func (m *ManagedLabelMigration) migrate(ctx context.Context) error {
+	unlabelled, err := labels.NewRequirement(isindirv1alpha3.SopsSecretManagedLabel, selection.DoesNotExist, nil)
+	if err != nil {
+		return err
+	}
+	selector := labels.NewSelector().Add(*unlabelled)
+
+	namespaces, err := m.namespaces(ctx)
+	if err != nil {
+		return err
+	}
+	labelled := 0
+	var errs []error
+	for _, namespace := range namespaces {
+		continueToken := ""
+		for {
+			secrets := &metav1.PartialObjectMetadataList{}
+			secrets.SetGroupVersionKind(corev1SecretListGVK)
+			if err := m.APIReader.List(
+				ctx, secrets,
+				client.InNamespace(namespace),
+				client.MatchingLabelsSelector{Selector: selector},
+				client.Limit(managedLabelMigrationPageSize),
+				client.Continue(continueToken),
+			); err != nil {
+				return errors.Join(append(errs, fmt.Errorf("failed to list secrets in namespace %s: %w", namespace, err))...)
+			}
+
+			for i := range secrets.Items {
+				secret := &secrets.Items[i]
+				if len(indexSecretOwnerUID(secret)) == 0 {
+					continue
+				}
+				secret.SetGroupVersionKind(corev1SecretListGVK.GroupVersion().WithKind("Secret"))
+				patch := client.MergeFrom(secret.DeepCopy())
+				if secret.Labels == nil {
+					secret.Labels = map[string]string{}
+				}
+				secret.Labels[isindirv1alpha3.SopsSecretManagedLabel] = "true"
+				if err := m.Client.Patch(ctx, secret, patch); err != nil {
+					errs = append(errs, fmt.Errorf("failed to label secret %s: %w", client.ObjectKeyFromObject(secret), err))
+					continue
+				}
+				labelled++
+			}
+
+			continueToken = secrets.Continue
+			if continueToken == "" {
+				break
+			}
+		}
+	}
+	if labelled > 0 {
+		m.Log.V(0).Info("Set managed label on child secrets created by previous operator versions", "secrets", labelled)
+	}
+	return errors.Join(errs...)
+}
+
+// namespaces returns watched namespaces, or namespaces of SopsSecrets when
+// all namespaces are watched, child secrets are in the namespace of their
+// SopsSecret
+func (m *ManagedLabelMigration) namespaces(ctx context.Context) ([]string, error) {
+	if len(m.Namespaces) > 0 {
+		return m.Namespaces, nil
+	}
+	sopsSecrets := &isindirv1alpha3.SopsSecretList{}
+	if err := m.Client.List(ctx, sopsSecrets); err != nil {
+		return nil, fmt.Errorf("failed to list SopsSecrets: %w", err)
+	}
+	namespaces := make([]string, 0, len(sopsSecrets.Items))
+	for _, sopsSecret := range sopsSecrets.Items {
+		namespaces = append(namespaces, sopsSecret.Namespace)
+	}
+	slices.Sort(namespaces)
+	return slices.Compact(namespaces), nil
+}
+
+// NeedLeaderElection returns true, only the leader writes child secrets
+func (m *ManagedLabelMigration) NeedLeaderElection() bool {
+	return true
+}
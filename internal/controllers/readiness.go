@@ -0,0 +1,242 @@
+/* This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at https://mozilla.org/MPL/2.0/. */
+
+package controllers
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	goerrors "errors"
+	"fmt"
+	"net/http"
+	"os"
+	"path/filepath"
+	"slices"
+	"sync"
+	"time"
+
+	"filippo.io/age"
+	"github.com/getsops/sops/v3/keyservice"
+	sopsjson "github.com/getsops/sops/v3/stores/json"
+	"github.com/go-logr/logr"
+	"k8s.io/apimachinery/pkg/types"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/healthz"
+
+	isindirv1alpha3 "github.com/isindir/sops-secrets-operator/api/v1alpha3"
+)
+
+const (
+	// DefaultReadinessCheckInterval is the default time between decryption readiness checks
+	DefaultReadinessCheckInterval = time.Minute
+
+	// ReadinessCanaryCheck is the name of readiness check failing when the
+	// canary SopsSecret can not be read
+	ReadinessCanaryCheck = "canary"
+
+	gnupgHomeEnv = "GNUPGHOME"
+
+	canaryTimeout = 30 * time.Second
+)
+
+// DecryptionProviders lists sops key providers readiness is checked for,
+// named as in sops metadata
+var DecryptionProviders = []string{"age", "pgp", "kms", "gcp_kms", "azure_kv", "hc_vault", "hckms"}
+
+// localDecryptionProviders lists providers which key material is checked
+// without canary, other providers are only checked by decrypting the canary
+var localDecryptionProviders = []string{"age", "pgp"}
+
+// providerStatus is the result of checking a sops key provider, providers
+// without key material are not configured and do not affect readiness
+type providerStatus struct {
+	configured bool
+	err        error
+}
+
+// DecryptionReadiness periodically checks that key material of every
+// configured sops key provider loads and, when canary SopsSecret is set,
+// that its data key is decrypted by every provider it is encrypted for
+type DecryptionReadiness struct {
+	// Reader reads the canary SopsSecret
+	Reader client.Reader
+	// Canary is the SopsSecret decrypted on every check, empty name disables
+	// the canary check
+	Canary types.NamespacedName
+	// Interval is the time between checks
+	Interval time.Duration
+	Log      logr.Logger
+
+	mu       sync.RWMutex
+	checked  bool
+	statuses map[string]providerStatus
+}
+
+// Start checks decryption capability every Interval until ctx is done
+func (d *DecryptionReadiness) Start(ctx context.Context) error {
+	interval := d.Interval
+	if interval <= 0 {
+		interval = DefaultReadinessCheckInterval
+	}
+	for {
+		d.check(ctx)
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-time.After(interval):
+		}
+	}
+}
+
+// NeedLeaderElection returns false, readiness is checked by all replicas
+func (d *DecryptionReadiness) NeedLeaderElection() bool {
+	return false
+}
+
+// Checks returns names of readiness checks which are really checked: local
+// providers, and with canary all DecryptionProviders and ReadinessCanaryCheck
+func (d *DecryptionReadiness) Checks() []string {
+	if d.Canary.Name == "" {
+		return slices.Clone(localDecryptionProviders)
+	}
+	return append(slices.Clone(DecryptionProviders), ReadinessCanaryCheck)
+}
+
+// Checker returns readiness check of a provider from DecryptionProviders or
+// of ReadinessCanaryCheck, failing while configured key material can not be
+// loaded or used
+func (d *DecryptionReadiness) Checker(name string) healthz.Checker {
+	return func(*http.Request) error {
+		d.mu.RLock()
+		defer d.mu.RUnlock()
+		if !d.checked {
+			return goerrors.New("decryption capability has not been checked yet")
+		}
+		return d.statuses[name].err
+	}
+}
+
+func (d *DecryptionReadiness) check(ctx context.Context) {
+	statuses := map[string]providerStatus{
+		"age": checkAgeKeys(),
+		"pgp": checkPGPKeys(),
+	}
+	if d.Canary.Name != "" {
+		results, err := d.checkCanary(ctx)
+		statuses[ReadinessCanaryCheck] = providerStatus{configured: true, err: err}
+		if err != nil {
+			d.Log.Error(err, "Failed to check canary SopsSecret", "sopssecret", d.Canary)
+		}
+		for provider, err := range results {
+			status := statuses[provider]
+			status.configured = true
+			if status.err == nil {
+				status.err = err
+			}
+			statuses[provider] = status
+		}
+	}
+
+	for _, provider := range DecryptionProviders {
+		status := statuses[provider]
+		switch {
+		case !status.configured:
+			sopsSecretsDecryptionReady.DeleteLabelValues(provider)
+		case status.err != nil:
+			d.Log.Error(status.err, "Decryption readiness check failed", "provider", provider)
+			sopsSecretsDecryptionReady.WithLabelValues(provider).Set(0)
+			sopsSecretsDecryptionCheckFailures.WithLabelValues(provider).Inc()
+		default:
+			sopsSecretsDecryptionReady.WithLabelValues(provider).Set(1)
+		}
+	}
+
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.statuses = statuses
+	d.checked = true
+}
+
+// checkCanary decrypts data key of the canary SopsSecret with every master
+// key, a provider passes when at least one of its keys decrypts the data key
+func (d *DecryptionReadiness) checkCanary(ctx context.Context) (map[string]error, error) {
+	ctx, cancel := context.WithTimeout(ctx, canaryTimeout)
+	defer cancel()
+
+	canary := &isindirv1alpha3.SopsSecret{}
+	if err := d.Reader.Get(ctx, d.Canary, canary); err != nil {
+		return nil, err
+	}
+	document := sopsDocument{Sops: canary.Sops}
+	document.Spec.SecretsTemplate = canary.Spec.SecretsTemplate
+	documentAsBytes, err := json.Marshal(document)
+	if err != nil {
+		return nil, err
+	}
+	documentAsBytes, err = canonicalJSON(documentAsBytes)
+	if err != nil {
+		return nil, err
+	}
+	tree, err := (&sopsjson.Store{}).LoadEncryptedFile(documentAsBytes)
+	if err != nil {
+		return nil, err
+	}
+
+	keyService := newKeyService(nil)
+	results := map[string]error{}
+	for _, group := range tree.Metadata.KeyGroups {
+		for _, masterKey := range group {
+			key := keyservice.KeyFromMasterKey(masterKey)
+			provider := keyFromProto(&key).Provider
+			if err, ok := results[provider]; ok && err == nil {
+				continue
+			}
+			_, err := keyService.Decrypt(ctx, &keyservice.DecryptRequest{
+				Key:        &key,
+				Ciphertext: masterKey.EncryptedDataKey(),
+			})
+			if err != nil {
+				err = fmt.Errorf("failed to decrypt data key of canary SopsSecret %s with %s: %w", d.Canary, masterKey.ToString(), err)
+			}
+			results[provider] = err
+		}
+	}
+	return results, nil
+}
+
+// checkAgeKeys parses age identities from the locations sops loads them from,
+// SOPS_AGE_KEY_CMD is not run as it is called per recipient
+func checkAgeKeys() providerStatus {
+	sources, errs := ageKeySources()
+	status := providerStatus{configured: len(getManagedAgeIdentities()) > 0 || len(sources) > 0 || len(errs) > 0}
+	for _, source := range sources {
+		if _, err := age.ParseIdentities(bytes.NewReader(source.content)); err != nil {
+			errs = append(errs, fmt.Errorf("%s: %w", source.name, err))
+		}
+	}
+	status.err = goerrors.Join(errs...)
+	return status
+}
+
+// checkPGPKeys checks that the GnuPG home PGP keys are used from has private
+// keys, PGP is not configured when GNUPGHOME is not set
+func checkPGPKeys() providerStatus {
+	home, release := acquireGnuPGHome()
+	defer release()
+	if home == "" {
+		var ok bool
+		if home, ok = os.LookupEnv(gnupgHomeEnv); !ok {
+			return providerStatus{}
+		}
+	}
+	if entries, err := os.ReadDir(filepath.Join(home, "private-keys-v1.d")); err == nil && len(entries) > 0 {
+		return providerStatus{configured: true}
+	}
+	// Keyrings created by GnuPG 1.x
+	if info, err := os.Stat(filepath.Join(home, "secring.gpg")); err == nil && info.Size() > 0 {
+		return providerStatus{configured: true}
+	}
+	return providerStatus{configured: true, err: fmt.Errorf("no private keys found in GnuPG home %s", home)}
+}
@@ -0,0 +1,197 @@
+/* This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at https://mozilla.org/MPL/2.0/. */
+
+package controllers
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"slices"
+	"testing"
+
+	"filippo.io/age"
+	sopsage "github.com/getsops/sops/v3/age"
+	"github.com/go-logr/logr"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/types"
+	"sigs.k8s.io/controller-runtime/pkg/client/fake"
+
+	isindirv1alpha3 "github.com/isindir/sops-secrets-operator/api/v1alpha3"
+)
+
+// isolateKeyEnvironment points sops key locations to an empty directory
+func isolateKeyEnvironment(t *testing.T) string {
+	t.Helper()
+	dir := t.TempDir()
+	t.Setenv("XDG_CONFIG_HOME", dir)
+	for _, name := range []string{sopsage.SopsAgeKeyEnv, sopsage.SopsAgeKeyFileEnv, gnupgHomeEnv} {
+		if value, ok := os.LookupEnv(name); ok {
+			_ = os.Unsetenv(name)
+			t.Cleanup(func() { _ = os.Setenv(name, value) })
+		}
+	}
+	return dir
+}
+
+func TestCheckLocalKeys(t *testing.T) {
+	identity, err := age.GenerateX25519Identity()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name          string
+		env           map[string]string
+		files         map[string]string
+		check         func() providerStatus
+		expectedReady bool
+		configured    bool
+	}{
+		{
+			name:          "Age is not configured without keys",
+			check:         checkAgeKeys,
+			expectedReady: true,
+		},
+		{
+			name:          "Age key from environment",
+			env:           map[string]string{sopsage.SopsAgeKeyEnv: identity.String()},
+			check:         checkAgeKeys,
+			expectedReady: true,
+			configured:    true,
+		},
+		{
+			name:       "Missing age key file",
+			env:        map[string]string{sopsage.SopsAgeKeyFileEnv: "missing.txt"},
+			check:      checkAgeKeys,
+			configured: true,
+		},
+		{
+			name:       "Invalid age key in default location",
+			files:      map[string]string{"sops/age/keys.txt": "AGE-SECRET-KEY-INVALID"},
+			check:      checkAgeKeys,
+			configured: true,
+		},
+		{
+			name:          "PGP is not configured without GNUPGHOME",
+			check:         checkPGPKeys,
+			expectedReady: true,
+		},
+		{
+			name:       "Empty GNUPGHOME",
+			env:        map[string]string{gnupgHomeEnv: "gnupg"},
+			files:      map[string]string{"gnupg/pubring.kbx": "public keys"},
+			check:      checkPGPKeys,
+			configured: true,
+		},
+		{
+			name:          "GNUPGHOME with private keys",
+			env:           map[string]string{gnupgHomeEnv: "gnupg"},
+			files:         map[string]string{"gnupg/private-keys-v1.d/key.key": "private key"},
+			check:         checkPGPKeys,
+			expectedReady: true,
+			configured:    true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dir := isolateKeyEnvironment(t)
+			for path, content := range tt.files {
+				path = filepath.Join(dir, path)
+				if err := os.MkdirAll(filepath.Dir(path), 0o700); err != nil {
+					t.Fatal(err)
+				}
+				if err := os.WriteFile(path, []byte(content), 0o600); err != nil {
+					t.Fatal(err)
+				}
+			}
+			for name, value := range tt.env {
+				if name != sopsage.SopsAgeKeyEnv {
+					value = filepath.Join(dir, value)
+				}
+				t.Setenv(name, value)
+			}
+
+			status := tt.check()
+			if status.configured != tt.configured {
+				t.Errorf("expected configured %t, got %t", tt.configured, status.configured)
+			}
+			if (status.err == nil) != tt.expectedReady {
+				t.Errorf("expected ready %t, got error %v", tt.expectedReady, status.err)
+			}
+		})
+	}
+}
+
+func TestDecryptionReadinessCanary(t *testing.T) {
+	isolateKeyEnvironment(t)
+	identity, err := age.GenerateX25519Identity()
+	if err != nil {
+		t.Fatal(err)
+	}
+	canary := &isindirv1alpha3.SopsSecret{
+		ObjectMeta: metav1.ObjectMeta{Name: "canary", Namespace: "sops"},
+		Spec: isindirv1alpha3.SopsSecretSpec{SecretsTemplate: []isindirv1alpha3.SopsSecretTemplate{{
+			Name:       "canary",
+			StringData: map[string]string{"canary": "canary"},
+		}}},
+	}
+	if err := EncryptSopsSecret(canary, []string{identity.Recipient().String()}); err != nil {
+		t.Fatal(err)
+	}
+
+	scheme := runtime.NewScheme()
+	if err := isindirv1alpha3.AddToScheme(scheme); err != nil {
+		t.Fatal(err)
+	}
+	d := &DecryptionReadiness{
+		Reader: fake.NewClientBuilder().WithScheme(scheme).WithRuntimeObjects(canary).Build(),
+		Canary: types.NamespacedName{Namespace: "sops", Name: "canary"},
+		Log:    logr.Discard(),
+	}
+	ageCheck := d.Checker("age")
+	if err := ageCheck(nil); err == nil {
+		t.Error("expected readiness to fail before the first check")
+	}
+
+	// Data key can not be decrypted without identity, age key is configured by canary
+	d.check(context.Background())
+	if err := ageCheck(nil); err == nil {
+		t.Error("expected age readiness to fail without identity")
+	}
+	if err := d.Checker(ReadinessCanaryCheck)(nil); err != nil {
+		t.Errorf("expected canary to be read, got %v", err)
+	}
+	if err := d.Checker("kms")(nil); err != nil {
+		t.Errorf("expected provider not used by canary to be ready, got %v", err)
+	}
+
+	SetManagedAgeIdentities([]age.Identity{identity})
+	defer SetManagedAgeIdentities(nil)
+	d.check(context.Background())
+	if err := ageCheck(nil); err != nil {
+		t.Errorf("expected age readiness to pass, got %v", err)
+	}
+
+	d.Canary.Name = "missing"
+	d.check(context.Background())
+	if err := d.Checker(ReadinessCanaryCheck)(nil); err == nil {
+		t.Error("expected canary check to fail when canary SopsSecret is missing")
+	}
+}
+
+func TestDecryptionReadinessChecks(t *testing.T) {
+	d := &DecryptionReadiness{}
+	if checks := d.Checks(); !slices.Equal(checks, []string{"age", "pgp"}) {
+		t.Errorf("expected only local providers to be checked without canary, got %v", checks)
+	}
+
+	d.Canary = types.NamespacedName{Name: "canary", Namespace: "sops"}
+	expected := append(slices.Clone(DecryptionProviders), ReadinessCanaryCheck)
+	if checks := d.Checks(); !slices.Equal(checks, expected) {
+		t.Errorf("expected all providers to be checked with canary, got %v", checks)
+	}
+}
@@ -0,0 +1,307 @@
+/* This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at https://mozilla.org/MPL/2.0/. */
+
+package controllers
+
+import (
+	"context"
+	"fmt"
+	"path"
+	"strings"
+
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/apimachinery/pkg/types"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+
+	isindirv1alpha3 "github.com/isindir/sops-secrets-operator/api/v1alpha3"
+	"github.com/isindir/sops-secrets-operator/internal/audit"
+)
+
+const (
+	// RecipientPolicyDisabled - SopsSecretPolicy objects are ignored
+	RecipientPolicyDisabled = "disabled"
+	// RecipientPolicyEnabled - recipients are checked in namespaces selected by
+	// at least one SopsSecretPolicy, other namespaces are not restricted
+	RecipientPolicyEnabled = "enabled"
+	// RecipientPolicyRequired - SopsSecrets in namespaces not selected by any
+	// SopsSecretPolicy are not decrypted
+	RecipientPolicyRequired = "required"
+)
+
+// RecipientPolicyModes lists valid values of --recipient-policy flag
+var RecipientPolicyModes = []string{RecipientPolicyDisabled, RecipientPolicyEnabled, RecipientPolicyRequired}
+
+// RecipientPolicyError is returned when SopsSecret recipients are not allowed
+// in its namespace
+type RecipientPolicyError struct {
+	Namespace  string
+	Recipients []string
+}
+
+func (e *RecipientPolicyError) Error() string {
+	if len(e.Recipients) == 0 {
+		return fmt.Sprintf("namespace %q is not selected by any SopsSecretPolicy", e.Namespace)
+	}
+	return fmt.Sprintf(
+		"recipients not allowed in namespace %q: %s",
+		e.Namespace, strings.Join(e.Recipients, ", "),
+	)
+}
+
+// recipient is a sops key identifier together with the allowed recipients
+// list of the same key type
+type recipient struct {
+	kind string
+	id   string
+}
+
+// sopsRecipients returns all keys listed in sops metadata, including keys of
+// key groups
+func sopsRecipients(metadata *isindirv1alpha3.SopsMetadata) []recipient {
+	var result []recipient
+	add := func(
+		kms []isindirv1alpha3.KmsDataItem,
+		pgp []isindirv1alpha3.PgpDataItem,
+		azureKv []isindirv1alpha3.AzureKmsItem,
+		hcVault []isindirv1alpha3.HcVaultItem,
+		gcpKms []isindirv1alpha3.GcpKmsDataItem,
+		age []isindirv1alpha3.AgeItem,
+	) {
+		for _, item := range kms {
+			result = append(result, recipient{kind: "kms", id: item.Arn})
+		}
+		for _, item := range pgp {
+			result = append(result, recipient{kind: "pgp", id: item.FingerPrint})
+		}
+		for _, item := range azureKv {
+			id := strings.TrimSuffix(item.VaultURL, "/") + "/keys/" + item.KeyName
+			result = append(result, recipient{kind: "azureKv", id: id})
+		}
+		for _, item := range hcVault {
+			result = append(result, recipient{kind: "hcVault", id: item.KeyName})
+		}
+		for _, item := range gcpKms {
+			result = append(result, recipient{kind: "gcpKms", id: item.VaultURL})
+		}
+		for _, item := range age {
+			result = append(result, recipient{kind: "age", id: item.Recipient})
+		}
+	}
+
+	add(metadata.AwsKms, metadata.Pgp, metadata.AzureKms, metadata.HcVault, metadata.GcpKms, metadata.Age)
+	for _, group := range metadata.KeyGroups {
+		add(group.AwsKms, group.Pgp, group.AzureKms, group.HcVault, group.GcpKms, group.Age)
+	}
+	return result
+}
+
+func allowedPatterns(allowed *isindirv1alpha3.AllowedRecipients, kind string) []string {
+	switch kind {
+	case "kms":
+		return allowed.Kms
+	case "pgp":
+		return allowed.Pgp
+	case "azureKv":
+		return allowed.AzureKv
+	case "hcVault":
+		return allowed.HcVault
+	case "gcpKms":
+		return allowed.GcpKms
+	case "age":
+		return allowed.Age
+	}
+	return nil
+}
+
+func isAllowed(r recipient, policies []isindirv1alpha3.SopsSecretPolicy) bool {
+	for i := range policies {
+		for _, pattern := range allowedPatterns(&policies[i].Spec.AllowedRecipients, r.kind) {
+			if pattern == r.id {
+				return true
+			}
+			if matched, err := path.Match(pattern, r.id); err == nil && matched {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// selectsNamespace returns true if policy applies to the namespace, a policy
+// applies when namespace is listed by name or matches its selector
+func selectsNamespace(
+	policyName string, namespaces []string, namespaceSelector *metav1.LabelSelector, namespace *corev1.Namespace,
+) (bool, error) {
+	for _, name := range namespaces {
+		if name == namespace.Name {
+			return true, nil
+		}
+	}
+	if namespaceSelector == nil {
+		return false, nil
+	}
+	selector, err := metav1.LabelSelectorAsSelector(namespaceSelector)
+	if err != nil {
+		return false, fmt.Errorf("invalid namespaceSelector of policy %s: %w", policyName, err)
+	}
+	return selector.Matches(labels.Set(namespace.Labels)), nil
+}
+
+// RecipientPolicies are SopsSecretPolicy objects selecting a namespace,
+// nil RecipientPolicies do not restrict recipients
+type RecipientPolicies struct {
+	namespace string
+	policies  []isindirv1alpha3.SopsSecretPolicy
+}
+
+// SelectRecipientPolicies returns policies selecting namespace. When no
+// policy selects namespace nil is returned, unless required is set.
+func SelectRecipientPolicies(
+	namespace *corev1.Namespace,
+	policies []isindirv1alpha3.SopsSecretPolicy,
+	required bool,
+) (*RecipientPolicies, error) {
+	selected := &RecipientPolicies{namespace: namespace.Name}
+	for i := range policies {
+		ok, err := selectsNamespace(
+			policies[i].Name, policies[i].Spec.Namespaces, policies[i].Spec.NamespaceSelector, namespace,
+		)
+		if err != nil {
+			return nil, err
+		}
+		if ok {
+			selected.policies = append(selected.policies, policies[i])
+		}
+	}
+
+	if len(selected.policies) == 0 {
+		if required {
+			return nil, &RecipientPolicyError{Namespace: namespace.Name}
+		}
+		return nil, nil
+	}
+	return selected, nil
+}
+
+// CheckMetadata verifies that every recipient in sops metadata is allowed by
+// at least one of the policies
+func (p *RecipientPolicies) CheckMetadata(metadata *isindirv1alpha3.SopsMetadata) error {
+	if p == nil {
+		return nil
+	}
+	var denied []string
+	for _, r := range sopsRecipients(metadata) {
+		if !isAllowed(r, p.policies) {
+			denied = append(denied, r.kind+":"+r.id)
+		}
+	}
+	if len(denied) > 0 {
+		return &RecipientPolicyError{Namespace: p.namespace, Recipients: denied}
+	}
+	return nil
+}
+
+// AllowKey verifies that the key which decrypted the data key is allowed by
+// at least one of the policies. Unverified keys are not allowed, as their
+// identifiers are taken from sops metadata, which anyone who can create the
+// SopsSecret controls.
+func (p *RecipientPolicies) AllowKey(key audit.Key) error {
+	if p == nil {
+		return nil
+	}
+	r, ok := keyRecipient(key)
+	if key.Unverified {
+		return &RecipientPolicyError{Namespace: p.namespace, Recipients: []string{r.kind + ":" + r.id + " (unverified)"}}
+	}
+	if !ok || !isAllowed(r, p.policies) {
+		return &RecipientPolicyError{Namespace: p.namespace, Recipients: []string{r.kind + ":" + r.id}}
+	}
+	return nil
+}
+
+// keyRecipient converts key which decrypted the data key to recipient of the
+// same key type as in allowed recipients lists, false for key types policies
+// can not allow
+func keyRecipient(key audit.Key) (recipient, bool) {
+	switch key.Provider {
+	case "age", "pgp", "kms":
+		return recipient{kind: key.Provider, id: key.ID}, true
+	case "azure_kv":
+		return recipient{kind: "azureKv", id: key.ID}, true
+	case "hc_vault":
+		// Policies list Vault transit key names
+		id := key.ID
+		if i := strings.LastIndex(id, "/keys/"); i >= 0 {
+			id = id[i+len("/keys/"):]
+		}
+		return recipient{kind: "hcVault", id: id}, true
+	case "gcp_kms":
+		return recipient{kind: "gcpKms", id: key.ID}, true
+	}
+	return recipient{kind: key.Provider, id: key.ID}, false
+}
+
+// CheckRecipientPolicies verifies that every recipient in sops metadata is
+// allowed by at least one of the policies selecting namespace. When no policy
+// selects namespace the check passes, unless required is set.
+func CheckRecipientPolicies(
+	metadata *isindirv1alpha3.SopsMetadata,
+	namespace *corev1.Namespace,
+	policies []isindirv1alpha3.SopsSecretPolicy,
+	required bool,
+) error {
+	selected, err := SelectRecipientPolicies(namespace, policies, required)
+	if err != nil {
+		return err
+	}
+	return selected.CheckMetadata(metadata)
+}
+
+// recipientPolicies checks SopsSecret recipients against SopsSecretPolicy
+// objects selecting its namespace and updates status on failure. Returned
+// policies restrict keys which may decrypt the data key of SopsSecret. The
+// error of status update on failure is returned.
+func (r *SopsSecretReconciler) recipientPolicies(
+	ctx context.Context, encryptedSopsSecret *isindirv1alpha3.SopsSecret,
+) (*RecipientPolicies, bool, error) {
+	if r.RecipientPolicy == "" || r.RecipientPolicy == RecipientPolicyDisabled {
+		return nil, true, nil
+	}
+
+	namespace, ok, statusErr := r.getNamespace(ctx, encryptedSopsSecret)
+	if !ok {
+		return nil, false, statusErr
+	}
+
+	policies := &isindirv1alpha3.SopsSecretPolicyList{}
+	if err := r.List(ctx, policies); err != nil {
+		r.Log.Error(err, "Failed to list SopsSecretPolicy objects", "sopssecret", client.ObjectKeyFromObject(encryptedSopsSecret))
+		return nil, false, r.UpdateSopsSecretStatus(ctx, encryptedSopsSecret, STATUS_UNKNOWN_ERROR)
+	}
+
+	selected, err := SelectRecipientPolicies(namespace, policies.Items, r.RecipientPolicy == RecipientPolicyRequired)
+	if err == nil {
+		err = selected.CheckMetadata(&encryptedSopsSecret.Sops)
+	}
+	if err != nil {
+		r.Log.Error(err, "SopsSecret recipients are not allowed", "sopssecret", client.ObjectKeyFromObject(encryptedSopsSecret))
+		return nil, false, r.UpdateSopsSecretStatus(ctx, encryptedSopsSecret, STATUS_RECIPIENTS_NOT_ALLOWED)
+	}
+	return selected, true, nil
+}
+
+// getNamespace returns namespace of SopsSecret and updates status on failure,
+// returning the error of status update
+func (r *SopsSecretReconciler) getNamespace(
+	ctx context.Context, encryptedSopsSecret *isindirv1alpha3.SopsSecret,
+) (*corev1.Namespace, bool, error) {
+	namespace := &corev1.Namespace{}
+	if err := r.Get(ctx, types.NamespacedName{Name: encryptedSopsSecret.Namespace}, namespace); err != nil {
+		r.Log.Error(err, "Failed to get namespace", "sopssecret", client.ObjectKeyFromObject(encryptedSopsSecret))
+		return nil, false, r.UpdateSopsSecretStatus(ctx, encryptedSopsSecret, STATUS_UNKNOWN_ERROR)
+	}
+	return namespace, true, nil
+}
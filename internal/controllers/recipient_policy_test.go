@@ -0,0 +1,243 @@
+/* This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at https://mozilla.org/MPL/2.0/. */
+
+package controllers
+
+import (
+	goerrors "errors"
+	"path/filepath"
+	"testing"
+
+	"github.com/go-logr/logr"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+
+	isindirv1alpha3 "github.com/isindir/sops-secrets-operator/api/v1alpha3"
+	"github.com/isindir/sops-secrets-operator/internal/audit"
+)
+
+const (
+	allowedAgeRecipient = "age1pnmp2nq5qx9z4lpmachyn2ld07xjumn98hpeq77e4glddu96zvms9nn7c8"
+	otherAgeRecipient   = "age1ql3z7hjy54pw3hyww5ayyfg7zqgvc7w3j2elw8zmrj2kg5sfn9aqmcac8p"
+)
+
+func newPolicy(namespaces []string, selector *metav1.LabelSelector, allowed isindirv1alpha3.AllowedRecipients) isindirv1alpha3.SopsSecretPolicy {
+	return isindirv1alpha3.SopsSecretPolicy{
+		ObjectMeta: metav1.ObjectMeta{Name: "policy"},
+		Spec: isindirv1alpha3.SopsSecretPolicySpec{
+			Namespaces:        namespaces,
+			NamespaceSelector: selector,
+			AllowedRecipients: allowed,
+		},
+	}
+}
+
+func TestCheckRecipientPolicies(t *testing.T) {
+	namespace := &corev1.Namespace{
+		ObjectMeta: metav1.ObjectMeta{Name: "team-a", Labels: map[string]string{"team": "a"}},
+	}
+	ageMetadata := &isindirv1alpha3.SopsMetadata{
+		Age: []isindirv1alpha3.AgeItem{{Recipient: allowedAgeRecipient}},
+	}
+	allowAge := isindirv1alpha3.AllowedRecipients{Age: []string{allowedAgeRecipient}}
+
+	tests := []struct {
+		name            string
+		metadata        *isindirv1alpha3.SopsMetadata
+		policies        []isindirv1alpha3.SopsSecretPolicy
+		required        bool
+		expectedDenied  []string
+		expectedFailure bool
+	}{
+		{
+			name:     "No policies, not required - allowed",
+			metadata: ageMetadata,
+		},
+		{
+			name:            "No policies, required - denied",
+			metadata:        ageMetadata,
+			required:        true,
+			expectedFailure: true,
+		},
+		{
+			name:     "Policy for other namespace, not required - allowed",
+			metadata: ageMetadata,
+			policies: []isindirv1alpha3.SopsSecretPolicy{
+				newPolicy([]string{"team-b"}, nil, isindirv1alpha3.AllowedRecipients{}),
+			},
+		},
+		{
+			name:     "Policy selects namespace by name - allowed",
+			metadata: ageMetadata,
+			policies: []isindirv1alpha3.SopsSecretPolicy{
+				newPolicy([]string{"team-a"}, nil, allowAge),
+			},
+			required: true,
+		},
+		{
+			name:     "Policy selects namespace by labels - allowed",
+			metadata: ageMetadata,
+			policies: []isindirv1alpha3.SopsSecretPolicy{
+				newPolicy(nil, &metav1.LabelSelector{MatchLabels: map[string]string{"team": "a"}}, allowAge),
+			},
+			required: true,
+		},
+		{
+			name: "Recipient not allowed - denied",
+			metadata: &isindirv1alpha3.SopsMetadata{
+				Age: []isindirv1alpha3.AgeItem{{Recipient: otherAgeRecipient}},
+			},
+			policies: []isindirv1alpha3.SopsSecretPolicy{
+				newPolicy(nil, &metav1.LabelSelector{}, allowAge),
+			},
+			expectedDenied:  []string{"age:" + otherAgeRecipient},
+			expectedFailure: true,
+		},
+		{
+			name: "One of recipients not allowed - denied",
+			metadata: &isindirv1alpha3.SopsMetadata{
+				Age: []isindirv1alpha3.AgeItem{{Recipient: allowedAgeRecipient}},
+				Pgp: []isindirv1alpha3.PgpDataItem{{FingerPrint: "ABCDEF"}},
+			},
+			policies: []isindirv1alpha3.SopsSecretPolicy{
+				newPolicy([]string{"team-a"}, nil, allowAge),
+			},
+			expectedDenied:  []string{"pgp:ABCDEF"},
+			expectedFailure: true,
+		},
+		{
+			name: "Recipients allowed by union of policies - allowed",
+			metadata: &isindirv1alpha3.SopsMetadata{
+				Age: []isindirv1alpha3.AgeItem{{Recipient: allowedAgeRecipient}},
+				Pgp: []isindirv1alpha3.PgpDataItem{{FingerPrint: "ABCDEF"}},
+			},
+			policies: []isindirv1alpha3.SopsSecretPolicy{
+				newPolicy([]string{"team-a"}, nil, allowAge),
+				newPolicy([]string{"team-a"}, nil, isindirv1alpha3.AllowedRecipients{Pgp: []string{"ABCDEF"}}),
+			},
+		},
+		{
+			name: "Key group recipient not allowed - denied",
+			metadata: &isindirv1alpha3.SopsMetadata{
+				KeyGroups: []isindirv1alpha3.KeyGroup{
+					{Age: []isindirv1alpha3.AgeItem{{Recipient: allowedAgeRecipient}}},
+					{Age: []isindirv1alpha3.AgeItem{{Recipient: otherAgeRecipient}}},
+				},
+			},
+			policies: []isindirv1alpha3.SopsSecretPolicy{
+				newPolicy([]string{"team-a"}, nil, allowAge),
+			},
+			expectedDenied:  []string{"age:" + otherAgeRecipient},
+			expectedFailure: true,
+		},
+		{
+			name: "KMS ARN matches pattern - allowed",
+			metadata: &isindirv1alpha3.SopsMetadata{
+				AwsKms: []isindirv1alpha3.KmsDataItem{{Arn: "arn:aws:kms:eu-west-1:111111111111:key/abcd"}},
+			},
+			policies: []isindirv1alpha3.SopsSecretPolicy{
+				newPolicy([]string{"team-a"}, nil, isindirv1alpha3.AllowedRecipients{
+					Kms: []string{"arn:aws:kms:*:111111111111:key/*"},
+				}),
+			},
+		},
+		{
+			name: "KMS ARN of other account - denied",
+			metadata: &isindirv1alpha3.SopsMetadata{
+				AwsKms: []isindirv1alpha3.KmsDataItem{{Arn: "arn:aws:kms:eu-west-1:222222222222:key/abcd"}},
+			},
+			policies: []isindirv1alpha3.SopsSecretPolicy{
+				newPolicy([]string{"team-a"}, nil, isindirv1alpha3.AllowedRecipients{
+					Kms: []string{"arn:aws:kms:*:111111111111:key/*"},
+				}),
+			},
+			expectedDenied:  []string{"kms:arn:aws:kms:eu-west-1:222222222222:key/abcd"},
+			expectedFailure: true,
+		},
+		{
+			name: "Azure and Vault keys allowed - allowed",
+			metadata: &isindirv1alpha3.SopsMetadata{
+				AzureKms: []isindirv1alpha3.AzureKmsItem{{VaultURL: "https://team-a.vault.azure.net/", KeyName: "sops"}},
+				HcVault:  []isindirv1alpha3.HcVaultItem{{KeyName: "team-a"}},
+			},
+			policies: []isindirv1alpha3.SopsSecretPolicy{
+				newPolicy([]string{"team-a"}, nil, isindirv1alpha3.AllowedRecipients{
+					AzureKv: []string{"https://team-a.vault.azure.net/keys/*"},
+					HcVault: []string{"team-a"},
+				}),
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := CheckRecipientPolicies(tt.metadata, namespace, tt.policies, tt.required)
+			if !tt.expectedFailure {
+				if err != nil {
+					t.Fatalf("expected no error, got %v", err)
+				}
+				return
+			}
+
+			var policyErr *RecipientPolicyError
+			if !goerrors.As(err, &policyErr) {
+				t.Fatalf("expected RecipientPolicyError, got %v", err)
+			}
+			if len(policyErr.Recipients) != len(tt.expectedDenied) {
+				t.Fatalf("expected denied recipients %v, got %v", tt.expectedDenied, policyErr.Recipients)
+			}
+			for i := range tt.expectedDenied {
+				if policyErr.Recipients[i] != tt.expectedDenied[i] {
+					t.Errorf("expected denied recipients %v, got %v", tt.expectedDenied, policyErr.Recipients)
+				}
+			}
+		})
+	}
+}
+
+func TestDecryptSopsSecretEnforcesRecipientPolicies(t *testing.T) {
+	setAgeKeyFile(t, filepath.Join("..", "..", "config", "age-test-key", "key-file.txt"))
+	sopsSecret := readTestSopsSecret(t, "04-test-secrets-mac-only.yaml")
+	recipient := sopsSecret.Sops.Age[0].Recipient
+	namespace := &corev1.Namespace{ObjectMeta: metav1.ObjectMeta{Name: "team-a"}}
+	selectPolicies := func(allowed string) *RecipientPolicies {
+		policies, err := SelectRecipientPolicies(namespace, []isindirv1alpha3.SopsSecretPolicy{
+			newPolicy([]string{"team-a"}, nil, isindirv1alpha3.AllowedRecipients{Age: []string{allowed}}),
+		}, true)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return policies
+	}
+
+	// Decrypting identity is allowed
+	policies := selectPolicies(recipient)
+	_, keys, err := decryptSopsSecretInstance(sopsSecret, false, policies, logr.Discard())
+	if err != nil {
+		t.Fatalf("decryptSopsSecretInstance() error = %v", err)
+	}
+	if len(keys) != 1 || keys[0] != (audit.Key{Provider: "age", ID: recipient}) {
+		t.Errorf("expected data key decrypted with %s, got %v", recipient, keys)
+	}
+
+	// SopsSecret copied from another namespace with recipient in metadata
+	// replaced by the allowed one passes metadata check, but is not decrypted
+	policies = selectPolicies(otherAgeRecipient)
+	sopsSecret.Sops.Age[0].Recipient = otherAgeRecipient
+	if err := policies.CheckMetadata(&sopsSecret.Sops); err != nil {
+		t.Fatalf("expected metadata to be allowed, got %v", err)
+	}
+	if _, _, err := decryptSopsSecretInstance(sopsSecret, false, policies, logr.Discard()); err == nil {
+		t.Fatal("expected SopsSecret with forged recipient not to be decrypted")
+	}
+
+	// Data key is decrypted only with allowed identities
+	sopsSecret.Sops.Age[0].Recipient = recipient
+	sopsSecret.Sops.Age = append(sopsSecret.Sops.Age, isindirv1alpha3.AgeItem{Recipient: otherAgeRecipient})
+	_, _, err = decryptSopsSecretInstance(sopsSecret, false, policies, logr.Discard())
+	var policyErr *RecipientPolicyError
+	if !goerrors.As(err, &policyErr) {
+		t.Fatalf("expected RecipientPolicyError, got %v", err)
+	}
+}
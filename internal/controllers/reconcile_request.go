@@ -0,0 +1,64 @@
+/* This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at https://mozilla.org/MPL/2.0/. */
+
+package controllers
+
+import (
+	"context"
+
+	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+
+	isindirv1alpha3 "github.com/isindir/sops-secrets-operator/api/v1alpha3"
+)
+
+// forcedSyncKey marks context of reconciliation requested by annotation
+type forcedSyncKey struct{}
+
+// pendingReconcileRequest returns value of reconcile request annotation which
+// was not handled yet, empty when there is none
+func pendingReconcileRequest(sopsSecret *isindirv1alpha3.SopsSecret) string {
+	requestedAt := sopsSecret.Annotations[isindirv1alpha3.SopsSecretReconcileRequestAnnotation]
+	if requestedAt == sopsSecret.Status.LastHandledReconcileAt {
+		return ""
+	}
+	return requestedAt
+}
+
+func isForcedSync(ctx context.Context) bool {
+	forced, _ := ctx.Value(forcedSyncKey{}).(bool)
+	return forced
+}
+
+// secretReader returns reader of child secrets, the API server is read
+// directly when reconciliation was requested by annotation
+func (r *SopsSecretReconciler) secretReader(ctx context.Context) client.Reader {
+	if r.APIReader != nil && isForcedSync(ctx) {
+		return r.APIReader
+	}
+	return r.Client
+}
+
+// handleReconcileRequest bypasses informer cache when reconcile request
+// annotation of SopsSecret was not handled yet, the annotation change itself is
+// enqueued immediately regardless of error backoff. Returned context marks
+// forced reconciliation and SopsSecret is read from the API server
+func (r *SopsSecretReconciler) handleReconcileRequest(
+	ctx context.Context, req ctrl.Request, encryptedSopsSecret *isindirv1alpha3.SopsSecret,
+) (context.Context, *isindirv1alpha3.SopsSecret, error) {
+	requestedAt := pendingReconcileRequest(encryptedSopsSecret)
+	if requestedAt == "" {
+		return ctx, encryptedSopsSecret, nil
+	}
+	r.Log.V(0).Info("Reconciliation requested by annotation", "sopssecret", req.NamespacedName, "requestedAt", requestedAt)
+
+	if r.APIReader != nil {
+		latest := &isindirv1alpha3.SopsSecret{}
+		if err := r.APIReader.Get(ctx, req.NamespacedName, latest); err != nil {
+			return ctx, nil, err
+		}
+		encryptedSopsSecret = latest
+	}
+	return context.WithValue(ctx, forcedSyncKey{}, true), encryptedSopsSecret, nil
+}
@@ -0,0 +1,162 @@
+/* This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at https://mozilla.org/MPL/2.0/. */
+
+package controllers
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	"github.com/go-logr/logr"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/types"
+	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/client/fake"
+	"sigs.k8s.io/controller-runtime/pkg/client/interceptor"
+
+	isindirv1alpha3 "github.com/isindir/sops-secrets-operator/api/v1alpha3"
+)
+
+func TestPendingReconcileRequest(t *testing.T) {
+	tests := []struct {
+		name        string
+		requestedAt string
+		lastHandled string
+		expected    string
+	}{
+		{
+			name: "No request",
+		},
+		{
+			name:        "New request",
+			requestedAt: "2026-10-19T12:00:00Z",
+			expected:    "2026-10-19T12:00:00Z",
+		},
+		{
+			name:        "Handled request",
+			requestedAt: "2026-10-19T12:00:00Z",
+			lastHandled: "2026-10-19T12:00:00Z",
+		},
+		{
+			name:        "Request after handled one",
+			requestedAt: "2026-10-19T13:00:00Z",
+			lastHandled: "2026-10-19T12:00:00Z",
+			expected:    "2026-10-19T13:00:00Z",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			sopsSecret := &isindirv1alpha3.SopsSecret{
+				Status: isindirv1alpha3.SopsSecretStatus{LastHandledReconcileAt: tt.lastHandled},
+			}
+			if tt.requestedAt != "" {
+				sopsSecret.Annotations = map[string]string{isindirv1alpha3.SopsSecretReconcileRequestAnnotation: tt.requestedAt}
+			}
+			if result := pendingReconcileRequest(sopsSecret); result != tt.expected {
+				t.Errorf("pendingReconcileRequest() = %q, expected %q", result, tt.expected)
+			}
+		})
+	}
+}
+
+func TestHandleReconcileRequest(t *testing.T) {
+	scheme := runtime.NewScheme()
+	if err := isindirv1alpha3.AddToScheme(scheme); err != nil {
+		t.Fatal(err)
+	}
+	inAPIServer := &isindirv1alpha3.SopsSecret{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:        "app",
+			Namespace:   "default",
+			Annotations: map[string]string{isindirv1alpha3.SopsSecretReconcileRequestAnnotation: "token-2"},
+		},
+	}
+	apiReader := fake.NewClientBuilder().WithScheme(scheme).WithRuntimeObjects(inAPIServer).
+		WithStatusSubresource(inAPIServer).Build()
+	r := &SopsSecretReconciler{
+		Client:    fake.NewClientBuilder().WithScheme(scheme).Build(),
+		APIReader: apiReader,
+		Log:       logr.Discard(),
+	}
+	req := ctrl.Request{NamespacedName: types.NamespacedName{Name: "app", Namespace: "default"}}
+
+	// Cached object without request is not re-read
+	cached := inAPIServer.DeepCopy()
+	cached.Annotations = nil
+	ctx, sopsSecret, err := r.handleReconcileRequest(context.Background(), req, cached)
+	if err != nil || sopsSecret != cached || isForcedSync(ctx) || r.secretReader(ctx) != client.Reader(r.Client) {
+		t.Fatalf("expected reconciliation without request not to be forced, got %v %v", isForcedSync(ctx), err)
+	}
+
+	cached.Annotations = map[string]string{isindirv1alpha3.SopsSecretReconcileRequestAnnotation: "token-1"}
+	ctx, sopsSecret, err = r.handleReconcileRequest(context.Background(), req, cached)
+	if err != nil {
+		t.Fatalf("handleReconcileRequest() error = %v", err)
+	}
+	if !isForcedSync(ctx) || r.secretReader(ctx) != client.Reader(apiReader) {
+		t.Error("expected requested reconciliation to read child secrets from API server")
+	}
+	if sopsSecret.Annotations[isindirv1alpha3.SopsSecretReconcileRequestAnnotation] != "token-2" {
+		t.Error("expected SopsSecret to be read from API server")
+	}
+
+	// Handled request is echoed in status
+	r.Client = apiReader
+	if err := r.UpdateSopsSecretStatus(context.Background(), sopsSecret, STATUS_HEALTHY); err != nil {
+		t.Fatal(err)
+	}
+	updated := &isindirv1alpha3.SopsSecret{}
+	if err := apiReader.Get(context.Background(), req.NamespacedName, updated); err != nil {
+		t.Fatal(err)
+	}
+	if updated.Status.LastHandledReconcileAt != "token-2" || pendingReconcileRequest(updated) != "" {
+		t.Errorf("expected handled request token in status, got %q", updated.Status.LastHandledReconcileAt)
+	}
+}
+
+func TestUpdateSopsSecretStatusError(t *testing.T) {
+	sopsSecret := &isindirv1alpha3.SopsSecret{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:        "app",
+			Namespace:   "default",
+			Annotations: map[string]string{isindirv1alpha3.SopsSecretReconcileRequestAnnotation: "token-1"},
+		},
+	}
+	updateErr := errors.New("conflict")
+	f := newChildSecretFixture(t, interceptor.Funcs{
+		SubResourceUpdate: func(
+			ctx context.Context, c client.Client, subResourceName string, obj client.Object, opts ...client.SubResourceUpdateOption,
+		) error {
+			return updateErr
+		},
+	}, sopsSecret)
+
+	// Failed acknowledgement of reconcile request must be retried
+	if err := f.r.UpdateSopsSecretStatus(context.Background(), sopsSecret, STATUS_HEALTHY); !errors.Is(err, updateErr) {
+		t.Fatalf("expected status update error, got %v", err)
+	}
+	stored := &isindirv1alpha3.SopsSecret{}
+	if err := f.client.Get(context.Background(), f.req.NamespacedName, stored); err != nil {
+		t.Fatal(err)
+	}
+	if pendingReconcileRequest(stored) != "token-1" {
+		t.Errorf("expected reconcile request to stay pending, got %q", stored.Status.LastHandledReconcileAt)
+	}
+
+	// Failed status update on error path is returned instead of requeue
+	unowned := &corev1.Secret{ObjectMeta: metav1.ObjectMeta{Name: "app", Namespace: "default"}}
+	ok, err := f.r.canManageKubeSecret(context.Background(), f.req, sopsSecret, unowned)
+	if ok || !errors.Is(err, updateErr) {
+		t.Fatalf("canManageKubeSecret() = %v, %v, expected false and status update error", ok, err)
+	}
+	result, err := f.r.failedReconcile(err)
+	if !errors.Is(err, updateErr) || result.RequeueAfter != 0 {
+		t.Errorf("failedReconcile() = %v, %v, expected status update error to be returned", result, err)
+	}
+}
@@ -0,0 +1,186 @@
+/* This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at https://mozilla.org/MPL/2.0/. */
+
+package controllers
+
+import (
+	"context"
+	"fmt"
+	"strings"
+
+	corev1 "k8s.io/api/core/v1"
+	apiequality "k8s.io/apimachinery/pkg/api/equality"
+	"k8s.io/apimachinery/pkg/api/meta"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/util/validation"
+	"k8s.io/utils/ptr"
+	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+
+	isindirv1alpha3 "github.com/isindir/sops-secrets-operator/api/v1alpha3"
+	"github.com/isindir/sops-secrets-operator/internal/audit"
+)
+
+const (
+	// RecreateStrategyFail - child secrets are not recreated, SopsSecret gets
+	// error status until the immutable field change is reverted
+	RecreateStrategyFail = "fail"
+	// RecreateStrategyRecreate - child secret is deleted and created again
+	RecreateStrategyRecreate = "recreate"
+	// RecreateStrategyTemporary - new content is created under a temporary
+	// name first, so it exists while the child secret is deleted and created
+	// again, the temporary secret is deleted afterwards
+	RecreateStrategyTemporary = "recreate-with-temporary"
+)
+
+// RecreateStrategies lists valid values of --recreate-strategy flag
+var RecreateStrategies = []string{RecreateStrategyFail, RecreateStrategyRecreate, RecreateStrategyTemporary}
+
+const (
+	// EventReasonChildSecretRecreated is the reason of events emitted when a
+	// child secret is recreated because of an immutable field change
+	EventReasonChildSecretRecreated = "ChildSecretRecreated"
+	// EventReasonImmutableFieldConflict is the reason of events emitted when
+	// a child secret is not recreated by fail strategy
+	EventReasonImmutableFieldConflict = "ImmutableFieldConflict"
+)
+
+// temporarySecretSuffix is appended to name of child secret to get name of
+// temporary secret of recreate-with-temporary strategy
+const temporarySecretSuffix = "-recreate"
+
+// recreateConditionReasons maps recreate strategies to ChildRecreated
+// condition reasons
+var recreateConditionReasons = map[string]string{
+	RecreateStrategyRecreate:  "Recreate",
+	RecreateStrategyTemporary: "RecreateWithTemporary",
+}
+
+// immutableFieldConflict describes change of immutable field of secret in
+// cluster, which can not be applied by update, empty when there is none
+func immutableFieldConflict(inCluster *corev1.Secret, desired *corev1.Secret) string {
+	if inCluster.Type != desired.Type {
+		return fmt.Sprintf("type changed from %s to %s", inCluster.Type, desired.Type)
+	}
+	if ptr.Deref(inCluster.Immutable, false) && !apiequality.Semantic.DeepEqual(inCluster.Data, desired.Data) {
+		return "data of immutable secret changed"
+	}
+	return ""
+}
+
+// temporarySecretName returns name of temporary secret of child secret
+func temporarySecretName(name string) string {
+	if len(name)+len(temporarySecretSuffix) > validation.DNS1123SubdomainMaxLength {
+		name = strings.TrimRight(name[:validation.DNS1123SubdomainMaxLength-len(temporarySecretSuffix)], ".-")
+	}
+	return name + temporarySecretSuffix
+}
+
+// recreateStrategy returns configured recreate strategy, recreate by default
+func (r *SopsSecretReconciler) recreateStrategy() string {
+	if r.RecreateStrategy == "" {
+		return RecreateStrategyRecreate
+	}
+	return r.RecreateStrategy
+}
+
+// recreateKubeSecret replaces secret in cluster with desired secret when an
+// immutable field changes, returns true if reconciliation must be rescheduled
+// and the error of status update
+func (r *SopsSecretReconciler) recreateKubeSecret(
+	ctx context.Context,
+	req ctrl.Request,
+	encryptedSopsSecret *isindirv1alpha3.SopsSecret,
+	kubeSecretInCluster *corev1.Secret,
+	desired *corev1.Secret,
+	conflict string,
+) (bool, error) {
+	strategy := r.recreateStrategy()
+	if strategy == RecreateStrategyFail {
+		statusErr := r.UpdateSopsSecretStatus(ctx, encryptedSopsSecret, STATUS_CHILD_IMMUTABLE_ERROR)
+		r.recordWarning(
+			encryptedSopsSecret, kubeSecretInCluster, EventReasonImmutableFieldConflict, "Update",
+			fmt.Sprintf("secret %s not recreated by %s strategy: %s", kubeSecretInCluster.Name, strategy, conflict),
+		)
+		r.Log.V(0).Info(
+			"Child secret immutable field changed, not recreated",
+			"sopssecret", req.NamespacedName,
+			"secret", kubeSecretInCluster.Name,
+			"conflict", conflict,
+		)
+		return true, statusErr
+	}
+
+	recreated := &corev1.Secret{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:            desired.Name,
+			Namespace:       desired.Namespace,
+			Labels:          desired.Labels,
+			Annotations:     desired.Annotations,
+			OwnerReferences: desired.OwnerReferences,
+		},
+		Type:      desired.Type,
+		Data:      desired.Data,
+		Immutable: desired.Immutable,
+	}
+
+	if strategy == RecreateStrategyTemporary {
+		temporary := recreated.DeepCopy()
+		temporary.Name = temporarySecretName(recreated.Name)
+		// Temporary secret left by interrupted recreation is already garbage
+		// collected, existing secret of the same name is not overwritten
+		if err := r.Create(ctx, temporary); err != nil {
+			return r.recreateFailed(ctx, req, encryptedSopsSecret, err)
+		}
+		defer func() {
+			if err := client.IgnoreNotFound(r.Delete(ctx, temporary, client.Preconditions{UID: &temporary.UID})); err != nil {
+				// Temporary secret is not in templates and is garbage
+				// collected by the next reconciliation
+				r.Log.Error(err, "Failed to delete temporary secret", "sopssecret", req.NamespacedName, "secret", temporary.Name)
+			}
+		}()
+	}
+
+	err := r.Delete(ctx, kubeSecretInCluster, client.Preconditions{UID: &kubeSecretInCluster.UID})
+	if client.IgnoreNotFound(err) != nil {
+		r.auditSecretWrite(encryptedSopsSecret, audit.ActionDelete, kubeSecretInCluster.Name, nil, STATUS_CHILD_UPDATE_ERROR)
+		return r.recreateFailed(ctx, req, encryptedSopsSecret, err)
+	}
+	r.auditSecretWrite(encryptedSopsSecret, audit.ActionDelete, kubeSecretInCluster.Name, nil, "")
+
+	changedKeys := changedSecretKeys(nil, recreated)
+	if err := r.Create(ctx, recreated); err != nil {
+		r.auditSecretWrite(encryptedSopsSecret, audit.ActionCreate, recreated.Name, changedKeys, STATUS_CHILD_UPDATE_ERROR)
+		return r.recreateFailed(ctx, req, encryptedSopsSecret, err)
+	}
+	r.auditSecretWrite(encryptedSopsSecret, audit.ActionCreate, recreated.Name, changedKeys, "")
+
+	message := fmt.Sprintf("secret %s recreated by %s strategy: %s", recreated.Name, strategy, conflict)
+	// Condition is replaced to record time of the latest recreation
+	meta.RemoveStatusCondition(&encryptedSopsSecret.Status.Conditions, isindirv1alpha3.ConditionTypeChildRecreated)
+	meta.SetStatusCondition(&encryptedSopsSecret.Status.Conditions, metav1.Condition{
+		Type:               isindirv1alpha3.ConditionTypeChildRecreated,
+		Status:             metav1.ConditionTrue,
+		ObservedGeneration: encryptedSopsSecret.Generation,
+		Reason:             recreateConditionReasons[strategy],
+		Message:            message,
+	})
+	r.recordNormal(encryptedSopsSecret, recreated, EventReasonChildSecretRecreated, "Recreate", message)
+	r.Log.V(0).Info(
+		"Child secret recreated",
+		"sopssecret", req.NamespacedName,
+		"secret", recreated.Name,
+		"strategy", strategy,
+		"conflict", conflict,
+	)
+	return false, nil
+}
+
+func (r *SopsSecretReconciler) recreateFailed(
+	ctx context.Context, req ctrl.Request, encryptedSopsSecret *isindirv1alpha3.SopsSecret, err error,
+) (bool, error) {
+	statusErr := r.UpdateSopsSecretStatus(ctx, encryptedSopsSecret, STATUS_CHILD_UPDATE_ERROR)
+	r.Log.Error(err, "Child secret recreate error", "sopssecret", req.NamespacedName)
+	return true, statusErr
+}
@@ -0,0 +1,172 @@
+/* This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at https://mozilla.org/MPL/2.0/. */
+
+package controllers
+
+import (
+	"context"
+	"strings"
+	"testing"
+
+	"github.com/go-logr/logr"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/meta"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/utils/ptr"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/client/interceptor"
+
+	isindirv1alpha3 "github.com/isindir/sops-secrets-operator/api/v1alpha3"
+)
+
+func TestImmutableFieldConflict(t *testing.T) {
+	secret := &corev1.Secret{Type: corev1.SecretTypeOpaque, Data: map[string][]byte{"token": []byte("secret")}}
+	changed := func(mutate func(*corev1.Secret)) *corev1.Secret {
+		s := secret.DeepCopy()
+		mutate(s)
+		return s
+	}
+
+	tests := []struct {
+		name      string
+		inCluster *corev1.Secret
+		desired   *corev1.Secret
+		conflict  bool
+	}{
+		{
+			name:      "Changed data of mutable secret",
+			inCluster: secret,
+			desired:   changed(func(s *corev1.Secret) { s.Data["token"] = []byte("changed") }),
+		},
+		{
+			name:      "Changed type",
+			inCluster: secret,
+			desired:   changed(func(s *corev1.Secret) { s.Type = corev1.SecretTypeTLS }),
+			conflict:  true,
+		},
+		{
+			name:      "Changed data of immutable secret",
+			inCluster: changed(func(s *corev1.Secret) { s.Immutable = ptr.To(true) }),
+			desired: changed(func(s *corev1.Secret) {
+				s.Immutable = ptr.To(true)
+				s.Data["token"] = []byte("changed")
+			}),
+			conflict: true,
+		},
+		{
+			name:      "Changed labels of immutable secret",
+			inCluster: changed(func(s *corev1.Secret) { s.Immutable = ptr.To(true) }),
+			desired: changed(func(s *corev1.Secret) {
+				s.Immutable = ptr.To(true)
+				s.Labels = map[string]string{"app": "jenkins"}
+			}),
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if conflict := immutableFieldConflict(tt.inCluster, tt.desired); (conflict != "") != tt.conflict {
+				t.Errorf("immutableFieldConflict() = %q, expected conflict %v", conflict, tt.conflict)
+			}
+		})
+	}
+}
+
+func TestTemporarySecretName(t *testing.T) {
+	if name := temporarySecretName("app"); name != "app-recreate" {
+		t.Errorf("expected app-recreate, got %s", name)
+	}
+	long := strings.Repeat("a", 243) + "-" + strings.Repeat("b", 9)
+	if name := temporarySecretName(long); len(name) > 253 || !strings.HasSuffix(name, "a-recreate") {
+		t.Errorf("expected name truncated to 253 characters, got %d %s", len(name), name)
+	}
+}
+
+func TestRefreshKubeSecretIfNeededRecreates(t *testing.T) {
+	tests := []struct {
+		name              string
+		strategy          string
+		expectedRecreated bool
+		expectedReason    string
+	}{
+		{
+			name:              "Default strategy recreates",
+			expectedRecreated: true,
+			expectedReason:    "Recreate",
+		},
+		{
+			name:              "Recreate with temporary secret",
+			strategy:          RecreateStrategyTemporary,
+			expectedRecreated: true,
+			expectedReason:    "RecreateWithTemporary",
+		},
+		{
+			name:     "Fail strategy keeps secret",
+			strategy: RecreateStrategyFail,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			sopsSecret := &isindirv1alpha3.SopsSecret{ObjectMeta: metav1.ObjectMeta{Name: "app", Namespace: "default"}}
+			inCluster := &corev1.Secret{
+				ObjectMeta: metav1.ObjectMeta{Name: "app", Namespace: "default", UID: "uid-1"},
+				Type:       corev1.SecretTypeOpaque,
+				Data:       map[string][]byte{"tls.crt": []byte("old"), "tls.key": []byte("old")},
+			}
+			template := &isindirv1alpha3.SopsSecretTemplate{
+				Name:       "app",
+				Type:       string(corev1.SecretTypeTLS),
+				StringData: map[string]string{"tls.crt": "new", "tls.key": "new"},
+			}
+			fromTemplate, err := createKubeSecretFromTemplate(sopsSecret, template, logr.Discard())
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			var created []string
+			f := newChildSecretFixture(t, interceptor.Funcs{
+				Create: func(ctx context.Context, c client.WithWatch, obj client.Object, opts ...client.CreateOption) error {
+					created = append(created, obj.GetName())
+					return c.Create(ctx, obj, opts...)
+				},
+			}, inCluster.DeepCopy(), sopsSecret)
+			f.r.RecreateStrategy = tt.strategy
+
+			reschedule, err := f.r.refreshKubeSecretIfNeeded(context.Background(), f.req, sopsSecret, fromTemplate, inCluster)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if reschedule == tt.expectedRecreated {
+				t.Fatalf("refreshKubeSecretIfNeeded() = %v, expected %v", reschedule, !tt.expectedRecreated)
+			}
+
+			secret := f.get()
+			condition := meta.FindStatusCondition(sopsSecret.Status.Conditions, isindirv1alpha3.ConditionTypeChildRecreated)
+			if !tt.expectedRecreated {
+				if secret.Type != corev1.SecretTypeOpaque || sopsSecret.Status.Message != STATUS_CHILD_IMMUTABLE_ERROR || condition != nil {
+					t.Errorf("expected secret to be kept with error status, got %s %q %v", secret.Type, sopsSecret.Status.Message, condition)
+				}
+				return
+			}
+			if secret.Type != corev1.SecretTypeTLS || string(secret.Data["tls.crt"]) != "new" {
+				t.Errorf("expected secret to be recreated with new type and content, got %s %q", secret.Type, secret.Data["tls.crt"])
+			}
+			if condition == nil || condition.Reason != tt.expectedReason {
+				t.Errorf("expected ChildRecreated condition with reason %s, got %v", tt.expectedReason, condition)
+			}
+
+			if tt.strategy == RecreateStrategyTemporary {
+				if len(created) != 2 || created[0] != "app-recreate" {
+					t.Errorf("expected temporary secret to be created first, got %v", created)
+				}
+				err := f.client.Get(context.Background(), types.NamespacedName{Name: "app-recreate", Namespace: "default"}, &corev1.Secret{})
+				if err == nil {
+					t.Error("expected temporary secret to be deleted")
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,104 @@
+/* This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at https://mozilla.org/MPL/2.0/. */
+
+package controllers
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"io"
+	"net/url"
+	"os"
+
+	"github.com/getsops/sops/v3/keyservice"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/credentials/insecure"
+)
+
+// KeyServiceTLS configures mutual TLS of TCP connections to remote sops key
+// services. Files are PEM encoded, client certificate and key are read on
+// every handshake, so rotated certificates are picked up without restart.
+type KeyServiceTLS struct {
+	// CAFile is the CA bundle key service certificates are verified with
+	CAFile string
+	// CertFile is the client certificate presented to key services
+	CertFile string
+	// KeyFile is the private key of the client certificate
+	KeyFile string
+}
+
+// DialKeyService returns client of remote sops key service listening on
+// address, in `sops --keyservice` format: unix:///path/to/socket or
+// tcp://host:port. TCP connections require mutual TLS. Returned closer closes
+// the connection.
+func DialKeyService(address string, tlsOptions KeyServiceTLS) (keyservice.KeyServiceClient, io.Closer, error) {
+	u, err := url.Parse(address)
+	if err != nil {
+		return nil, nil, fmt.Errorf("invalid key service address %q: %w", address, err)
+	}
+
+	var target string
+	var transportCredentials credentials.TransportCredentials
+	switch u.Scheme {
+	case "unix":
+		if u.Path == "" {
+			return nil, nil, fmt.Errorf("invalid key service address %q: socket path is empty", address)
+		}
+		target = "unix://" + u.Path
+		transportCredentials = insecure.NewCredentials()
+	case "tcp":
+		if u.Host == "" {
+			return nil, nil, fmt.Errorf("invalid key service address %q: host is empty", address)
+		}
+		tlsConfig, err := tlsOptions.clientConfig()
+		if err != nil {
+			return nil, nil, fmt.Errorf("key service %s: %w", address, err)
+		}
+		target = "dns:///" + u.Host
+		transportCredentials = credentials.NewTLS(tlsConfig)
+	default:
+		return nil, nil, fmt.Errorf("invalid key service address %q: scheme must be unix or tcp", address)
+	}
+
+	conn, err := grpc.NewClient(target, grpc.WithTransportCredentials(transportCredentials))
+	if err != nil {
+		return nil, nil, fmt.Errorf("key service %s: %w", address, err)
+	}
+	return keyservice.NewKeyServiceClient(conn), conn, nil
+}
+
+// clientConfig returns TLS configuration verifying key service certificate
+// and presenting client certificate
+func (o KeyServiceTLS) clientConfig() (*tls.Config, error) {
+	if o.CAFile == "" || o.CertFile == "" || o.KeyFile == "" {
+		return nil, errors.New("TCP key services require CA, client certificate and key files for mutual TLS")
+	}
+	caBundle, err := os.ReadFile(o.CAFile)
+	if err != nil {
+		return nil, err
+	}
+	rootCAs := x509.NewCertPool()
+	if !rootCAs.AppendCertsFromPEM(caBundle) {
+		return nil, fmt.Errorf("no certificates found in %s", o.CAFile)
+	}
+	// Fail early on unreadable client certificate, it is read again on every handshake
+	if _, err := tls.LoadX509KeyPair(o.CertFile, o.KeyFile); err != nil {
+		return nil, err
+	}
+
+	return &tls.Config{
+		MinVersion: tls.VersionTLS12,
+		RootCAs:    rootCAs,
+		GetClientCertificate: func(*tls.CertificateRequestInfo) (*tls.Certificate, error) {
+			certificate, err := tls.LoadX509KeyPair(o.CertFile, o.KeyFile)
+			if err != nil {
+				return nil, err
+			}
+			return &certificate, nil
+		},
+	}, nil
+}
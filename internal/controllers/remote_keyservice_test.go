@@ -0,0 +1,222 @@
+/* This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at https://mozilla.org/MPL/2.0/. */
+
+package controllers
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"math/big"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"filippo.io/age"
+	sopsage "github.com/getsops/sops/v3/age"
+	"github.com/getsops/sops/v3/keyservice"
+	"github.com/go-logr/logr"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials"
+
+	isindirv1alpha3 "github.com/isindir/sops-secrets-operator/api/v1alpha3"
+)
+
+// ageKeyServiceServer is remote key service holding an age identity
+type ageKeyServiceServer struct {
+	keyservice.UnimplementedKeyServiceServer
+	identity age.Identity
+}
+
+func (s *ageKeyServiceServer) Decrypt(
+	_ context.Context, in *keyservice.DecryptRequest,
+) (*keyservice.DecryptResponse, error) {
+	masterKey := &sopsage.MasterKey{
+		Recipient:    in.GetKey().GetAgeKey().GetRecipient(),
+		EncryptedKey: string(in.GetCiphertext()),
+	}
+	sopsage.ParsedIdentities{s.identity}.ApplyToMasterKey(masterKey)
+	plaintext, err := masterKey.Decrypt()
+	if err != nil {
+		return nil, err
+	}
+	return &keyservice.DecryptResponse{Plaintext: plaintext}, nil
+}
+
+func serveKeyService(t *testing.T, listener net.Listener, identity age.Identity, opts ...grpc.ServerOption) {
+	t.Helper()
+	server := grpc.NewServer(opts...)
+	keyservice.RegisterKeyServiceServer(server, &ageKeyServiceServer{identity: identity})
+	go func() { _ = server.Serve(listener) }()
+	t.Cleanup(server.Stop)
+}
+
+// writeCertificate writes PEM encoded certificate and key signed by parent,
+// self-signed when parent is nil
+func writeCertificate(
+	t *testing.T, dir, name string, template *x509.Certificate, parent *x509.Certificate, parentKey *ecdsa.PrivateKey,
+) (*x509.Certificate, *ecdsa.PrivateKey) {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if parent == nil {
+		parent, parentKey = template, key
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, parent, &key.PublicKey, parentKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyDer, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	certificatePEM := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})
+	keyPEM := pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDer})
+	if err := os.WriteFile(filepath.Join(dir, name+".crt"), certificatePEM, 0o600); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(dir, name+".key"), keyPEM, 0o600); err != nil {
+		t.Fatal(err)
+	}
+	certificate, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return certificate, key
+}
+
+func TestRemoteKeyServices(t *testing.T) {
+	identity, err := age.GenerateX25519Identity()
+	if err != nil {
+		t.Fatal(err)
+	}
+	dir := t.TempDir()
+
+	// Unix socket key service
+	socket := filepath.Join(dir, "keyservice.sock")
+	unixListener, err := net.Listen("unix", socket)
+	if err != nil {
+		t.Fatal(err)
+	}
+	serveKeyService(t, unixListener, identity)
+
+	// TCP key service with mutual TLS
+	notAfter := time.Now().Add(time.Hour)
+	ca, caKey := writeCertificate(t, dir, "ca", &x509.Certificate{
+		SerialNumber: big.NewInt(1), Subject: pkix.Name{CommonName: "ca"}, NotAfter: notAfter,
+		IsCA: true, BasicConstraintsValid: true, KeyUsage: x509.KeyUsageCertSign,
+	}, nil, nil)
+	writeCertificate(t, dir, "server", &x509.Certificate{
+		SerialNumber: big.NewInt(2), Subject: pkix.Name{CommonName: "keyservice"}, NotAfter: notAfter,
+		IPAddresses: []net.IP{net.IPv4(127, 0, 0, 1)}, ExtKeyUsage: []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+	}, ca, caKey)
+	writeCertificate(t, dir, "client", &x509.Certificate{
+		SerialNumber: big.NewInt(3), Subject: pkix.Name{CommonName: "operator"}, NotAfter: notAfter,
+		ExtKeyUsage: []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+	}, ca, caKey)
+	serverCertificate, err := tls.LoadX509KeyPair(filepath.Join(dir, "server.crt"), filepath.Join(dir, "server.key"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	clientCAs := x509.NewCertPool()
+	clientCAs.AddCert(ca)
+	tcpListener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	serveKeyService(t, tcpListener, identity, grpc.Creds(credentials.NewTLS(&tls.Config{
+		MinVersion:   tls.VersionTLS12,
+		Certificates: []tls.Certificate{serverCertificate},
+		ClientAuth:   tls.RequireAndVerifyClientCert,
+		ClientCAs:    clientCAs,
+	})))
+	tlsOptions := KeyServiceTLS{
+		CAFile:   filepath.Join(dir, "ca.crt"),
+		CertFile: filepath.Join(dir, "client.crt"),
+		KeyFile:  filepath.Join(dir, "client.key"),
+	}
+
+	// Encrypt for identity only remote key services hold
+	SetManagedAgeIdentities([]age.Identity{identity})
+	sopsSecret := &isindirv1alpha3.SopsSecret{
+		Spec: isindirv1alpha3.SopsSecretSpec{SecretsTemplate: []isindirv1alpha3.SopsSecretTemplate{{
+			Name:       "my-secret",
+			StringData: map[string]string{"password": "plain-text-password"},
+		}}},
+	}
+	if err := EncryptSopsSecret(sopsSecret, []string{identity.Recipient().String()}); err != nil {
+		t.Fatal(err)
+	}
+	SetManagedAgeIdentities(nil)
+	defer SetKeyServices(nil, false)
+
+	tests := []struct {
+		name        string
+		address     string
+		tlsOptions  KeyServiceTLS
+		expectedErr bool
+	}{
+		{
+			name:    "Unix socket key service",
+			address: "unix://" + socket,
+		},
+		{
+			name:       "TCP key service with mutual TLS",
+			address:    "tcp://" + tcpListener.Addr().String(),
+			tlsOptions: tlsOptions,
+		},
+		{
+			name:        "TCP key service requires mutual TLS",
+			address:     "tcp://" + tcpListener.Addr().String(),
+			expectedErr: true,
+		},
+		{
+			name:        "Unsupported scheme",
+			address:     "http://" + tcpListener.Addr().String(),
+			expectedErr: true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			client, closer, err := DialKeyService(tt.address, tt.tlsOptions)
+			if tt.expectedErr {
+				if err == nil {
+					t.Fatal("expected error")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("DialKeyService() error = %v", err)
+			}
+			defer func() { _ = closer.Close() }()
+
+			SetKeyServices(nil, true)
+			if _, _, err := decryptSopsSecretInstance(sopsSecret, true, nil, logr.Discard()); err == nil {
+				t.Fatal("expected decryption to fail without key services")
+			}
+
+			SetKeyServices([]keyservice.KeyServiceClient{client}, true)
+			plainTextSopsSecret, keys, err := decryptSopsSecretInstance(sopsSecret, true, nil, logr.Discard())
+			if err != nil {
+				t.Fatalf("decryptSopsSecretInstance() error = %v", err)
+			}
+			if plainTextSopsSecret.Spec.SecretsTemplate[0].StringData["password"] != "plain-text-password" {
+				t.Errorf("unexpected decrypted template %+v", plainTextSopsSecret.Spec.SecretsTemplate[0])
+			}
+			if len(keys) != 1 || keys[0].ID != identity.Recipient().String() || !keys[0].Unverified {
+				t.Errorf("expected data key decrypted with unverified remote age key, got %v", keys)
+			}
+		})
+	}
+}
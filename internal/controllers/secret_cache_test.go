@@ -0,0 +1,328 @@
+/* This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at https://mozilla.org/MPL/2.0/. */
+
+package controllers
+
+import (
+	"context"
+	"errors"
+	"slices"
+	"testing"
+	"time"
+
+	"github.com/go-logr/logr"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/utils/ptr"
+	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/client/fake"
+	"sigs.k8s.io/controller-runtime/pkg/client/interceptor"
+
+	isindirv1alpha3 "github.com/isindir/sops-secrets-operator/api/v1alpha3"
+	"github.com/isindir/sops-secrets-operator/internal/audit"
+)
+
+func ownedSecret(name string, owner metav1.OwnerReference) *corev1.Secret {
+	return &corev1.Secret{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:            name,
+			Namespace:       "default",
+			OwnerReferences: []metav1.OwnerReference{owner},
+		},
+	}
+}
+
+func TestIndexSecretOwnerUID(t *testing.T) {
+	tests := []struct {
+		name     string
+		owner    metav1.OwnerReference
+		expected []string
+	}{
+		{
+			name: "Controlled by SopsSecret",
+			owner: metav1.OwnerReference{
+				APIVersion: "isindir.github.com/v1alpha3", Kind: "SopsSecret", UID: "uid-1", Controller: ptr.To(true),
+			},
+			expected: []string{"uid-1"},
+		},
+		{
+			name: "Controlled by older SopsSecret version",
+			owner: metav1.OwnerReference{
+				APIVersion: "isindir.github.com/v1alpha1", Kind: "SopsSecret", UID: "uid-1", Controller: ptr.To(true),
+			},
+			expected: []string{"uid-1"},
+		},
+		{
+			name:  "Owned but not controlled by SopsSecret",
+			owner: metav1.OwnerReference{APIVersion: "isindir.github.com/v1alpha3", Kind: "SopsSecret", UID: "uid-1"},
+		},
+		{
+			name: "Controlled by other kind",
+			owner: metav1.OwnerReference{
+				APIVersion: "apps/v1", Kind: "Deployment", UID: "uid-1", Controller: ptr.To(true),
+			},
+		},
+		{
+			name: "Controlled by SopsSecret of other group",
+			owner: metav1.OwnerReference{
+				APIVersion: "example.com/v1", Kind: "SopsSecret", UID: "uid-1", Controller: ptr.To(true),
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			result := indexSecretOwnerUID(ownedSecret("secret", tt.owner))
+			if len(result) != len(tt.expected) || (len(result) == 1 && result[0] != tt.expected[0]) {
+				t.Errorf("indexSecretOwnerUID() = %v, expected %v", result, tt.expected)
+			}
+		})
+	}
+}
+
+func TestGarbageCollectOrphanedSecretsByIndex(t *testing.T) {
+	scheme := runtime.NewScheme()
+	if err := corev1.AddToScheme(scheme); err != nil {
+		t.Fatal(err)
+	}
+	if err := isindirv1alpha3.AddToScheme(scheme); err != nil {
+		t.Fatal(err)
+	}
+	encryptedSopsSecret := &isindirv1alpha3.SopsSecret{
+		TypeMeta:   metav1.TypeMeta{APIVersion: "isindir.github.com/v1alpha3", Kind: "SopsSecret"},
+		ObjectMeta: metav1.ObjectMeta{Name: "app", Namespace: "default", UID: "uid-1"},
+	}
+	owner := metav1.OwnerReference{
+		APIVersion: "isindir.github.com/v1alpha3", Kind: "SopsSecret", Name: "app", UID: "uid-1", Controller: ptr.To(true),
+	}
+	otherOwner := owner
+	otherOwner.UID = "uid-2"
+
+	k8sClient := fake.NewClientBuilder().WithScheme(scheme).
+		WithIndex(&corev1.Secret{}, secretOwnerUIDIndex, indexSecretOwnerUID).
+		WithRuntimeObjects(
+			ownedSecret("expected", owner),
+			ownedSecret("orphaned", owner),
+			ownedSecret("other-owner", otherOwner),
+			&corev1.Secret{ObjectMeta: metav1.ObjectMeta{Name: "unowned", Namespace: "default"}},
+		).Build()
+	recorder := &testAuditRecorder{}
+	r := &SopsSecretReconciler{Client: k8sClient, Log: logr.Discard(), Audit: recorder}
+
+	sopsSecret := encryptedSopsSecret.DeepCopy()
+	sopsSecret.Spec.SecretsTemplate = []isindirv1alpha3.SopsSecretTemplate{{Name: "expected"}}
+	req := ctrl.Request{NamespacedName: types.NamespacedName{Name: "app", Namespace: "default"}}
+	if err := r.garbageCollectOrphanedSecrets(context.Background(), req, encryptedSopsSecret, sopsSecret); err != nil {
+		t.Fatalf("garbageCollectOrphanedSecrets() error = %v", err)
+	}
+
+	var secrets corev1.SecretList
+	if err := k8sClient.List(context.Background(), &secrets, client.InNamespace("default")); err != nil {
+		t.Fatal(err)
+	}
+	remaining := map[string]bool{}
+	for _, secret := range secrets.Items {
+		remaining[secret.Name] = true
+	}
+	if len(remaining) != 3 || !remaining["expected"] || !remaining["other-owner"] || !remaining["unowned"] {
+		t.Errorf("expected only orphaned secret to be deleted, remaining %v", remaining)
+	}
+	if len(recorder.events) != 1 ||
+		recorder.events[0].Action != audit.ActionDelete ||
+		recorder.events[0].Secret != "orphaned" ||
+		recorder.events[0].Result != audit.ResultSuccess {
+		t.Errorf("expected successful delete of orphaned secret audited, got %+v", recorder.events)
+	}
+}
+
+func TestCreateKubeSecretFromTemplateSetsManagedLabel(t *testing.T) {
+	sopsSecret := &isindirv1alpha3.SopsSecret{ObjectMeta: metav1.ObjectMeta{Name: "app", Namespace: "default"}}
+	template := &isindirv1alpha3.SopsSecretTemplate{Name: "app", Labels: map[string]string{"app": "jenkins"}}
+
+	secret, err := createKubeSecretFromTemplate(sopsSecret, template, logr.Discard())
+	if err != nil {
+		t.Fatalf("createKubeSecretFromTemplate() error = %v", err)
+	}
+	if secret.Labels[isindirv1alpha3.SopsSecretManagedLabel] != "true" || secret.Labels["app"] != "jenkins" {
+		t.Errorf("expected managed and template labels, got %v", secret.Labels)
+	}
+	if _, ok := template.Labels[isindirv1alpha3.SopsSecretManagedLabel]; ok {
+		t.Error("expected template labels not to be modified")
+	}
+}
+
+func TestManagedLabelMigration(t *testing.T) {
+	scheme := runtime.NewScheme()
+	if err := corev1.AddToScheme(scheme); err != nil {
+		t.Fatal(err)
+	}
+	if err := isindirv1alpha3.AddToScheme(scheme); err != nil {
+		t.Fatal(err)
+	}
+	encryptedSopsSecret := &isindirv1alpha3.SopsSecret{
+		TypeMeta:   metav1.TypeMeta{APIVersion: "isindir.github.com/v1alpha3", Kind: "SopsSecret"},
+		ObjectMeta: metav1.ObjectMeta{Name: "app", Namespace: "default", UID: "uid-1"},
+	}
+	owner := metav1.OwnerReference{
+		APIVersion: "isindir.github.com/v1alpha3", Kind: "SopsSecret", Name: "app", UID: "uid-1", Controller: ptr.To(true),
+	}
+	labelled := ownedSecret("labelled", owner)
+	labelled.Labels = map[string]string{isindirv1alpha3.SopsSecretManagedLabel: "true"}
+
+	apiReader := fake.NewClientBuilder().WithScheme(scheme).
+		WithIndex(&corev1.Secret{}, secretOwnerUIDIndex, indexSecretOwnerUID).
+		WithRuntimeObjects(
+			// created by operator version which did not label child secrets
+			encryptedSopsSecret,
+			ownedSecret("pre-existing", owner),
+			labelled,
+			&corev1.Secret{ObjectMeta: metav1.ObjectMeta{Name: "unowned", Namespace: "default"}},
+		).Build()
+	// cached client sees only secrets with managed label
+	cachedClient := interceptor.NewClient(apiReader, interceptor.Funcs{
+		List: func(ctx context.Context, c client.WithWatch, list client.ObjectList, opts ...client.ListOption) error {
+			if err := c.List(ctx, list, opts...); err != nil {
+				return err
+			}
+			if secrets, ok := list.(*corev1.SecretList); ok {
+				secrets.Items = slices.DeleteFunc(secrets.Items, func(secret corev1.Secret) bool {
+					return secret.Labels[isindirv1alpha3.SopsSecretManagedLabel] != "true"
+				})
+			}
+			return nil
+		},
+	})
+	r := &SopsSecretReconciler{Client: cachedClient, Log: logr.Discard()}
+
+	// SopsSecret no longer templates any secret
+	req := ctrl.Request{NamespacedName: types.NamespacedName{Name: "app", Namespace: "default"}}
+	garbageCollect := func() {
+		t.Helper()
+		if err := r.garbageCollectOrphanedSecrets(
+			context.Background(), req, encryptedSopsSecret, encryptedSopsSecret.DeepCopy(),
+		); err != nil {
+			t.Fatalf("garbageCollectOrphanedSecrets() error = %v", err)
+		}
+	}
+	remaining := func() map[string]bool {
+		t.Helper()
+		var secrets corev1.SecretList
+		if err := apiReader.List(context.Background(), &secrets); err != nil {
+			t.Fatal(err)
+		}
+		names := map[string]bool{}
+		for _, secret := range secrets.Items {
+			names[secret.Name] = true
+		}
+		return names
+	}
+
+	garbageCollect()
+	if names := remaining(); !names["pre-existing"] || names["labelled"] {
+		t.Fatalf("expected only labelled child to be garbage collected before migration, remaining %v", names)
+	}
+
+	migration := &ManagedLabelMigration{Client: cachedClient, APIReader: apiReader, Log: logr.Discard()}
+	if err := migration.Start(context.Background()); err != nil {
+		t.Fatalf("Start() error = %v", err)
+	}
+	unowned := &corev1.Secret{}
+	if err := apiReader.Get(context.Background(), types.NamespacedName{Name: "unowned", Namespace: "default"}, unowned); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := unowned.Labels[isindirv1alpha3.SopsSecretManagedLabel]; ok {
+		t.Error("expected secret not controlled by SopsSecret to be left unlabelled")
+	}
+
+	garbageCollect()
+	if names := remaining(); len(names) != 1 || !names["unowned"] {
+		t.Errorf("expected pre-existing child to be garbage collected after migration, remaining %v", names)
+	}
+}
+
+func TestManagedLabelMigrationRetries(t *testing.T) {
+	scheme := runtime.NewScheme()
+	if err := corev1.AddToScheme(scheme); err != nil {
+		t.Fatal(err)
+	}
+	if err := isindirv1alpha3.AddToScheme(scheme); err != nil {
+		t.Fatal(err)
+	}
+	owner := metav1.OwnerReference{
+		APIVersion: "isindir.github.com/v1alpha3", Kind: "SopsSecret", Name: "app", UID: "uid-1", Controller: ptr.To(true),
+	}
+	elsewhere := ownedSecret("elsewhere", owner)
+	elsewhere.Namespace = "kube-system"
+	k8sClient := fake.NewClientBuilder().WithScheme(scheme).WithRuntimeObjects(
+		&isindirv1alpha3.SopsSecret{ObjectMeta: metav1.ObjectMeta{Name: "app", Namespace: "default", UID: "uid-1"}},
+		ownedSecret("pre-existing", owner),
+		elsewhere,
+	).Build()
+
+	// API server fails the first list of secrets
+	var listed []string
+	var failedMetric float64
+	apiReader := interceptor.NewClient(k8sClient, interceptor.Funcs{
+		List: func(ctx context.Context, c client.WithWatch, list client.ObjectList, opts ...client.ListOption) error {
+			listOpts := &client.ListOptions{}
+			listOpts.ApplyOptions(opts)
+			listed = append(listed, listOpts.Namespace)
+			if len(listed) == 1 {
+				return errors.New("etcdserver: request timed out")
+			}
+			failedMetric = testutil.ToFloat64(sopsSecretsManagedLabelMigrationFailed)
+			return c.List(ctx, list, opts...)
+		},
+	})
+
+	migration := &ManagedLabelMigration{
+		Client: k8sClient, APIReader: apiReader, BaseDelay: time.Millisecond, MaxDelay: time.Millisecond, Log: logr.Discard(),
+	}
+	if err := migration.Start(context.Background()); err != nil {
+		t.Fatalf("Start() error = %v", err)
+	}
+	if !slices.Equal(listed, []string{"default", "default"}) {
+		t.Errorf("expected secrets of SopsSecret namespaces to be listed until success, listed %q", listed)
+	}
+	if failedMetric != 1 {
+		t.Errorf("expected migration failure metric to be set while retrying, got %v", failedMetric)
+	}
+	if value := testutil.ToFloat64(sopsSecretsManagedLabelMigrationFailed); value != 0 {
+		t.Errorf("expected migration failure metric to be reset, got %v", value)
+	}
+
+	for _, key := range []types.NamespacedName{
+		{Name: "pre-existing", Namespace: "default"}, {Name: "elsewhere", Namespace: "kube-system"},
+	} {
+		secret := &corev1.Secret{}
+		if err := k8sClient.Get(context.Background(), key, secret); err != nil {
+			t.Fatal(err)
+		}
+		if labelled := secret.Labels[isindirv1alpha3.SopsSecretManagedLabel] == "true"; labelled != (key.Namespace == "default") {
+			t.Errorf("unexpected managed label of secret %s: %v", key, secret.Labels)
+		}
+	}
+}
+
+func TestManagedLabelMigrationStopsWithContext(t *testing.T) {
+	scheme := runtime.NewScheme()
+	if err := isindirv1alpha3.AddToScheme(scheme); err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	k8sClient := interceptor.NewClient(fake.NewClientBuilder().WithScheme(scheme).Build(), interceptor.Funcs{
+		List: func(context.Context, client.WithWatch, client.ObjectList, ...client.ListOption) error {
+			cancel()
+			return errors.New("forbidden")
+		},
+	})
+	migration := &ManagedLabelMigration{Client: k8sClient, APIReader: k8sClient, Log: logr.Discard()}
+	if err := migration.Start(ctx); err != nil {
+		t.Fatalf("Start() error = %v", err)
+	}
+}
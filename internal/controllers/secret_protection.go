@@ -0,0 +1,191 @@
+/* This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at https://mozilla.org/MPL/2.0/. */
+
+package controllers
+
+import (
+	"context"
+	"fmt"
+	"path"
+
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/labels"
+	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+
+	isindirv1alpha3 "github.com/isindir/sops-secrets-operator/api/v1alpha3"
+)
+
+const (
+	// EventReasonProtectedSecret is the reason of events emitted when a
+	// SopsSecret template targets a protected Secret
+	EventReasonProtectedSecret = "ProtectedSecret"
+	// EventReasonForbiddenSecretType is the reason of events emitted when a
+	// SopsSecret template has a Secret type forbidden in its namespace
+	EventReasonForbiddenSecretType = "ForbiddenSecretType"
+)
+
+// ProtectedSecretError is returned when a SopsSecret template violates a
+// ProtectedSecretPolicy
+type ProtectedSecretError struct {
+	Policy string
+	Secret string
+	Reason string
+}
+
+func (e *ProtectedSecretError) Error() string {
+	return fmt.Sprintf("secret %q %s (ProtectedSecretPolicy %s)", e.Secret, e.Reason, e.Policy)
+}
+
+// SelectProtectedSecretPolicies returns policies applying to the namespace
+func SelectProtectedSecretPolicies(
+	namespace *corev1.Namespace, policies []isindirv1alpha3.ProtectedSecretPolicy,
+) ([]isindirv1alpha3.ProtectedSecretPolicy, error) {
+	var selected []isindirv1alpha3.ProtectedSecretPolicy
+	for i := range policies {
+		ok, err := selectsNamespace(
+			policies[i].Name, policies[i].Spec.Namespaces, policies[i].Spec.NamespaceSelector, namespace,
+		)
+		if err != nil {
+			return nil, err
+		}
+		if ok {
+			selected = append(selected, policies[i])
+		}
+	}
+	return selected, nil
+}
+
+// CheckForbiddenType verifies that secret created from a SopsSecret template
+// does not have a type forbidden by policies
+func CheckForbiddenType(policies []isindirv1alpha3.ProtectedSecretPolicy, secret *corev1.Secret) error {
+	for _, policy := range policies {
+		for _, forbidden := range policy.Spec.ForbiddenTypes {
+			if forbidden == string(secret.Type) {
+				return &ProtectedSecretError{
+					Policy: policy.Name,
+					Secret: secret.Name,
+					Reason: fmt.Sprintf("type %s is forbidden", secret.Type),
+				}
+			}
+		}
+	}
+	return nil
+}
+
+// CheckProtectedSecret verifies that existing secret is not protected by
+// policies, a protected secret can not be adopted or overwritten
+func CheckProtectedSecret(policies []isindirv1alpha3.ProtectedSecretPolicy, secret *corev1.Secret) error {
+	for _, policy := range policies {
+		protected := policy.Spec.ProtectedSecrets
+		for _, protectedType := range protected.Types {
+			if protectedType == string(secret.Type) {
+				return &ProtectedSecretError{
+					Policy: policy.Name,
+					Secret: secret.Name,
+					Reason: fmt.Sprintf("of type %s is protected", secret.Type),
+				}
+			}
+		}
+		for i := range protected.Selectors {
+			selector, err := metav1.LabelSelectorAsSelector(&protected.Selectors[i])
+			if err != nil {
+				return fmt.Errorf("invalid selector of ProtectedSecretPolicy %s: %w", policy.Name, err)
+			}
+			if selector.Matches(labels.Set(secret.Labels)) {
+				return &ProtectedSecretError{
+					Policy: policy.Name,
+					Secret: secret.Name,
+					Reason: fmt.Sprintf("with labels matching %s is protected", selector),
+				}
+			}
+		}
+		for _, pattern := range protected.Names {
+			if matched, err := path.Match(pattern, secret.Name); err == nil && matched {
+				return &ProtectedSecretError{
+					Policy: policy.Name,
+					Secret: secret.Name,
+					Reason: fmt.Sprintf("with name matching %s is protected", pattern),
+				}
+			}
+		}
+	}
+	return nil
+}
+
+// getProtectedSecretPolicies returns ProtectedSecretPolicy objects applying
+// to namespace of SopsSecret and updates status on failure, returning the
+// error of status update
+func (r *SopsSecretReconciler) getProtectedSecretPolicies(
+	ctx context.Context, encryptedSopsSecret *isindirv1alpha3.SopsSecret,
+) ([]isindirv1alpha3.ProtectedSecretPolicy, bool, error) {
+	if !r.ProtectedSecretPolicy {
+		return nil, true, nil
+	}
+
+	namespace, ok, statusErr := r.getNamespace(ctx, encryptedSopsSecret)
+	if !ok {
+		return nil, false, statusErr
+	}
+
+	policies := &isindirv1alpha3.ProtectedSecretPolicyList{}
+	if err := r.List(ctx, policies); err != nil {
+		r.Log.Error(err, "Failed to list ProtectedSecretPolicy objects", "sopssecret", client.ObjectKeyFromObject(encryptedSopsSecret))
+		return nil, false, r.UpdateSopsSecretStatus(ctx, encryptedSopsSecret, STATUS_UNKNOWN_ERROR)
+	}
+
+	selected, err := SelectProtectedSecretPolicies(namespace, policies.Items)
+	if err != nil {
+		r.Log.Error(err, "Failed to select ProtectedSecretPolicy objects", "sopssecret", client.ObjectKeyFromObject(encryptedSopsSecret))
+		return nil, false, r.UpdateSopsSecretStatus(ctx, encryptedSopsSecret, STATUS_UNKNOWN_ERROR)
+	}
+	return selected, true, nil
+}
+
+// isChildTypeAllowed checks secret created from a template against forbidden
+// types of policies, reports violation in status and events, returning the
+// error of status update
+func (r *SopsSecretReconciler) isChildTypeAllowed(
+	ctx context.Context,
+	req ctrl.Request,
+	encryptedSopsSecret *isindirv1alpha3.SopsSecret,
+	policies []isindirv1alpha3.ProtectedSecretPolicy,
+	kubeSecretFromTemplate *corev1.Secret,
+) (bool, error) {
+	err := CheckForbiddenType(policies, kubeSecretFromTemplate)
+	if err == nil {
+		return true, nil
+	}
+
+	statusErr := r.UpdateSopsSecretStatus(ctx, encryptedSopsSecret, STATUS_CHILD_TYPE_FORBIDDEN)
+	r.recordWarning(encryptedSopsSecret, nil, EventReasonForbiddenSecretType, "Create", err.Error())
+	r.Log.Error(err, "Child secret type is forbidden", "sopssecret", req.NamespacedName)
+	return false, statusErr
+}
+
+// isChildProtected checks existing secret not controlled by SopsSecret
+// against protected secrets of policies, reports violation in status and
+// events, returning the error of status update
+func (r *SopsSecretReconciler) isChildProtected(
+	ctx context.Context,
+	req ctrl.Request,
+	encryptedSopsSecret *isindirv1alpha3.SopsSecret,
+	policies []isindirv1alpha3.ProtectedSecretPolicy,
+	kubeSecretInCluster *corev1.Secret,
+) (bool, error) {
+	if metav1.IsControlledBy(kubeSecretInCluster, encryptedSopsSecret) {
+		return false, nil
+	}
+
+	err := CheckProtectedSecret(policies, kubeSecretInCluster)
+	if err == nil {
+		return false, nil
+	}
+
+	statusErr := r.UpdateSopsSecretStatus(ctx, encryptedSopsSecret, STATUS_CHILD_PROTECTED)
+	r.recordWarning(encryptedSopsSecret, kubeSecretInCluster, EventReasonProtectedSecret, "Adopt", err.Error())
+	r.Log.Error(err, "Child secret is protected", "sopssecret", req.NamespacedName)
+	return true, statusErr
+}
@@ -0,0 +1,150 @@
+/* This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at https://mozilla.org/MPL/2.0/. */
+
+package controllers
+
+import (
+	goerrors "errors"
+	"testing"
+
+	isindirv1alpha3 "github.com/isindir/sops-secrets-operator/api/v1alpha3"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+func TestSelectProtectedSecretPolicies(t *testing.T) {
+	namespace := &corev1.Namespace{
+		ObjectMeta: metav1.ObjectMeta{Name: "team-a", Labels: map[string]string{"team": "a"}},
+	}
+	policies := []isindirv1alpha3.ProtectedSecretPolicy{
+		{
+			ObjectMeta: metav1.ObjectMeta{Name: "by-name"},
+			Spec:       isindirv1alpha3.ProtectedSecretPolicySpec{Namespaces: []string{"team-a"}},
+		},
+		{
+			ObjectMeta: metav1.ObjectMeta{Name: "all-namespaces"},
+			Spec:       isindirv1alpha3.ProtectedSecretPolicySpec{NamespaceSelector: &metav1.LabelSelector{}},
+		},
+		{
+			ObjectMeta: metav1.ObjectMeta{Name: "other-team"},
+			Spec: isindirv1alpha3.ProtectedSecretPolicySpec{
+				NamespaceSelector: &metav1.LabelSelector{MatchLabels: map[string]string{"team": "b"}},
+			},
+		},
+		{
+			ObjectMeta: metav1.ObjectMeta{Name: "no-selector"},
+		},
+	}
+
+	selected, err := SelectProtectedSecretPolicies(namespace, policies)
+	if err != nil {
+		t.Fatalf("expected no error, got %v", err)
+	}
+	if len(selected) != 2 || selected[0].Name != "by-name" || selected[1].Name != "all-namespaces" {
+		t.Errorf("expected by-name and all-namespaces policies to be selected, got %v", selected)
+	}
+}
+
+func TestCheckProtectedSecret(t *testing.T) {
+	policies := []isindirv1alpha3.ProtectedSecretPolicy{
+		{
+			ObjectMeta: metav1.ObjectMeta{Name: "protected"},
+			Spec: isindirv1alpha3.ProtectedSecretPolicySpec{
+				ProtectedSecrets: isindirv1alpha3.ProtectedSecrets{
+					Types: []string{string(corev1.SecretTypeServiceAccountToken)},
+					Selectors: []metav1.LabelSelector{
+						{MatchLabels: map[string]string{"owner": "helm"}},
+					},
+					Names: []string{"*-cert-manager-*"},
+				},
+			},
+		},
+	}
+
+	tests := []struct {
+		name              string
+		secret            *corev1.Secret
+		expectedProtected bool
+	}{
+		{
+			name: "Opaque secret - not protected",
+			secret: &corev1.Secret{
+				ObjectMeta: metav1.ObjectMeta{Name: "app"},
+				Type:       corev1.SecretTypeOpaque,
+			},
+		},
+		{
+			name: "Service account token - protected by type",
+			secret: &corev1.Secret{
+				ObjectMeta: metav1.ObjectMeta{Name: "app"},
+				Type:       corev1.SecretTypeServiceAccountToken,
+			},
+			expectedProtected: true,
+		},
+		{
+			name: "Helm release - protected by labels",
+			secret: &corev1.Secret{
+				ObjectMeta: metav1.ObjectMeta{Name: "sh.helm.release.v1.app.v1", Labels: map[string]string{"owner": "helm"}},
+				Type:       "helm.sh/release.v1",
+			},
+			expectedProtected: true,
+		},
+		{
+			name: "Certificate - protected by name",
+			secret: &corev1.Secret{
+				ObjectMeta: metav1.ObjectMeta{Name: "app-cert-manager-tls"},
+				Type:       corev1.SecretTypeTLS,
+			},
+			expectedProtected: true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := CheckProtectedSecret(policies, tt.secret)
+			var protectedErr *ProtectedSecretError
+			if goerrors.As(err, &protectedErr) != tt.expectedProtected {
+				t.Errorf("expected protected %t, got %v", tt.expectedProtected, err)
+			}
+		})
+	}
+}
+
+func TestCheckForbiddenType(t *testing.T) {
+	policies := []isindirv1alpha3.ProtectedSecretPolicy{
+		{
+			ObjectMeta: metav1.ObjectMeta{Name: "forbidden"},
+			Spec: isindirv1alpha3.ProtectedSecretPolicySpec{
+				ForbiddenTypes: []string{string(corev1.SecretTypeServiceAccountToken)},
+			},
+		},
+	}
+
+	tests := []struct {
+		name              string
+		secretType        corev1.SecretType
+		expectedForbidden bool
+	}{
+		{
+			name:       "Opaque - allowed",
+			secretType: corev1.SecretTypeOpaque,
+		},
+		{
+			name:              "Service account token - forbidden",
+			secretType:        corev1.SecretTypeServiceAccountToken,
+			expectedForbidden: true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			secret := &corev1.Secret{ObjectMeta: metav1.ObjectMeta{Name: "app"}, Type: tt.secretType}
+			err := CheckForbiddenType(policies, secret)
+			var protectedErr *ProtectedSecretError
+			if goerrors.As(err, &protectedErr) != tt.expectedForbidden {
+				t.Errorf("expected forbidden %t, got %v", tt.expectedForbidden, err)
+			}
+		})
+	}
+}
@@ -0,0 +1,288 @@
+/* This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at https://mozilla.org/MPL/2.0/. */
+
+package controllers
+
+import (
+	"encoding/json"
+	goerrors "errors"
+	"fmt"
+	"maps"
+	"reflect"
+	"slices"
+	"strconv"
+	"strings"
+
+	sopsversion "github.com/getsops/sops/v3/version"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/meta"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+
+	isindirv1alpha3 "github.com/isindir/sops-secrets-operator/api/v1alpha3"
+)
+
+// ErrUnsupportedSopsVersion is returned when sops metadata was written by a
+// sops version newer than the embedded sops
+var ErrUnsupportedSopsVersion = goerrors.New("sops version is not supported")
+
+// EventReasonSopsCompatibilityWarning is the reason of events emitted when
+// compatibility warnings of sops metadata change
+const EventReasonSopsCompatibilityWarning = "SopsCompatibilityWarning"
+
+// SopsCompatibilityWarning is a field of sops metadata which may not be
+// handled the way the encrypting sops did
+type SopsCompatibilityWarning struct {
+	Field   string
+	Message string
+}
+
+func (w SopsCompatibilityWarning) String() string {
+	return w.Field + ": " + w.Message
+}
+
+// sopsFeatures lists sops metadata fields with the sops version which
+// introduced them
+var sopsFeatures = []struct {
+	field   string
+	version [3]int
+	used    func(metadata *isindirv1alpha3.SopsMetadata) bool
+}{
+	{"sops.encrypted_regex", [3]int{3, 4, 0}, func(m *isindirv1alpha3.SopsMetadata) bool { return m.EncryptedRegex != "" }},
+	{"sops.hc_vault", [3]int{3, 6, 0}, func(m *isindirv1alpha3.SopsMetadata) bool {
+		return slices.ContainsFunc(keyGroups(m), func(g isindirv1alpha3.KeyGroup) bool { return len(g.HcVault) > 0 })
+	}},
+	{"sops.unencrypted_regex", [3]int{3, 6, 1}, func(m *isindirv1alpha3.SopsMetadata) bool { return m.UnencryptedRegex != "" }},
+	{"sops.age", [3]int{3, 7, 0}, func(m *isindirv1alpha3.SopsMetadata) bool {
+		return slices.ContainsFunc(keyGroups(m), func(g isindirv1alpha3.KeyGroup) bool { return len(g.Age) > 0 })
+	}},
+	{"sops.encrypted_comment_regex", [3]int{3, 9, 0}, func(m *isindirv1alpha3.SopsMetadata) bool { return m.EncryptedCommentRegex != "" }},
+	{"sops.unencrypted_comment_regex", [3]int{3, 9, 0}, func(m *isindirv1alpha3.SopsMetadata) bool { return m.UnencryptedCommentRegex != "" }},
+	{"sops.mac_only_encrypted", [3]int{3, 9, 0}, func(m *isindirv1alpha3.SopsMetadata) bool { return m.MacOnlyEncrypted }},
+}
+
+// ParseSopsVersion parses major, minor and patch of sops version, pre-release
+// and build suffixes are ignored
+func ParseSopsVersion(version string) ([3]int, error) {
+	var parsed [3]int
+
+	trimmed := strings.TrimPrefix(version, "v")
+	if i := strings.IndexAny(trimmed, "-+"); i >= 0 {
+		trimmed = trimmed[:i]
+	}
+	parts := strings.Split(trimmed, ".")
+	if version == "" || len(parts) > 3 {
+		return parsed, fmt.Errorf("sops version %q is not a valid version", version)
+	}
+	for i, part := range parts {
+		number, err := strconv.Atoi(part)
+		if err != nil || number < 0 {
+			return parsed, fmt.Errorf("sops version %q is not a valid version", version)
+		}
+		parsed[i] = number
+	}
+	return parsed, nil
+}
+
+// CompareSopsVersions returns 1 if version a is newer than b, -1 if it is
+// older and 0 if they are equal
+func CompareSopsVersions(a, b [3]int) int {
+	for i := range a {
+		if a[i] != b[i] {
+			if a[i] > b[i] {
+				return 1
+			}
+			return -1
+		}
+	}
+	return 0
+}
+
+// CheckSopsVersion returns error wrapping ErrUnsupportedSopsVersion when sops
+// metadata of given version may use format the embedded sops does not know:
+// version has newer major or minor version. Newer patch versions do not
+// change the format, older versions are decrypted by the embedded sops.
+// Missing or invalid versions are not rejected, SopsVersionWarnings reports
+// them.
+func CheckSopsVersion(version string) error {
+	objectVersion, err := ParseSopsVersion(version)
+	if err != nil {
+		return nil
+	}
+	// version of embedded sops is always valid
+	embeddedVersion, _ := ParseSopsVersion(sopsversion.Version)
+
+	if CompareSopsVersions([3]int{objectVersion[0], objectVersion[1]}, [3]int{embeddedVersion[0], embeddedVersion[1]}) > 0 {
+		return fmt.Errorf(
+			"%w: object was encrypted by sops %s, embedded sops %s supports versions up to %d.%d",
+			ErrUnsupportedSopsVersion, version, sopsversion.Version, embeddedVersion[0], embeddedVersion[1],
+		)
+	}
+	return nil
+}
+
+// SopsVersionWarnings returns warnings for sops version which is not rejected
+// by CheckSopsVersion, but compatibility with the embedded sops can not be
+// ensured: version is missing, invalid or a newer patch version
+func SopsVersionWarnings(version string) []SopsCompatibilityWarning {
+	objectVersion, err := ParseSopsVersion(version)
+	// version of embedded sops is always valid
+	embeddedVersion, _ := ParseSopsVersion(sopsversion.Version)
+	switch {
+	case version == "":
+		return []SopsCompatibilityWarning{{
+			Field:   "sops.version",
+			Message: "version is not set, compatibility with embedded sops " + sopsversion.Version + " can not be checked",
+		}}
+	case err != nil:
+		return []SopsCompatibilityWarning{{Field: "sops.version", Message: err.Error()}}
+	case CheckSopsVersion(version) == nil && CompareSopsVersions(objectVersion, embeddedVersion) > 0:
+		return []SopsCompatibilityWarning{{
+			Field:   "sops.version",
+			Message: fmt.Sprintf("object was encrypted by sops %s which is newer than embedded sops %s", version, sopsversion.Version),
+		}}
+	}
+	return nil
+}
+
+// SopsFeatureWarnings returns warnings for sops metadata fields introduced
+// after the sops version recorded in metadata, such metadata was not written
+// by the recorded sops version
+func SopsFeatureWarnings(metadata *isindirv1alpha3.SopsMetadata) []SopsCompatibilityWarning {
+	objectVersion, err := ParseSopsVersion(metadata.Version)
+	if err != nil {
+		return nil
+	}
+
+	var warnings []SopsCompatibilityWarning
+	for _, feature := range sopsFeatures {
+		if feature.used(metadata) && CompareSopsVersions(objectVersion, feature.version) < 0 {
+			warnings = append(warnings, SopsCompatibilityWarning{
+				Field: feature.field,
+				Message: fmt.Sprintf(
+					"field requires sops %d.%d.%d, but metadata records sops %s",
+					feature.version[0], feature.version[1], feature.version[2], metadata.Version,
+				),
+			})
+		}
+	}
+	return warnings
+}
+
+// sopsCompatibilityWarnings returns all compatibility warnings of sops
+// metadata of SopsSecret
+func sopsCompatibilityWarnings(sopsSecret *isindirv1alpha3.SopsSecret) []SopsCompatibilityWarning {
+	metadata := &sopsSecret.Sops
+	warnings := SopsVersionWarnings(metadata.Version)
+	warnings = append(warnings, SopsFeatureWarnings(metadata)...)
+	warnings = append(warnings, prunedSopsFieldWarnings(sopsSecret)...)
+
+	if !slices.ContainsFunc(keyGroups(metadata), hasKeys) {
+		warnings = append(warnings, SopsCompatibilityWarning{
+			Field:   "sops",
+			Message: "no key provider known to SopsSecret API is listed, key providers unknown to the API are dropped by the API server",
+		})
+	}
+	return warnings
+}
+
+// prunedSopsFieldWarnings returns warnings for sops metadata fields unknown
+// to SopsSecret API, which were dropped by the API server. Such fields can
+// only be found in configuration recorded by kubectl client side apply.
+func prunedSopsFieldWarnings(sopsSecret *isindirv1alpha3.SopsSecret) []SopsCompatibilityWarning {
+	lastApplied, ok := sopsSecret.Annotations[corev1.LastAppliedConfigAnnotation]
+	if !ok {
+		return nil
+	}
+	applied := struct {
+		Sops map[string]json.RawMessage `json:"sops"`
+	}{}
+	if err := json.Unmarshal([]byte(lastApplied), &applied); err != nil {
+		return nil
+	}
+
+	var warnings []SopsCompatibilityWarning
+	unknown := func(path string, fields map[string]json.RawMessage, known map[string]bool) {
+		for _, field := range slices.Sorted(maps.Keys(fields)) {
+			if !known[field] {
+				warnings = append(warnings, SopsCompatibilityWarning{
+					Field:   path + "." + field,
+					Message: "field is not part of SopsSecret API and was dropped by the API server",
+				})
+			}
+		}
+	}
+	unknown("sops", applied.Sops, jsonFields(reflect.TypeFor[isindirv1alpha3.SopsMetadata]()))
+
+	var groups []map[string]json.RawMessage
+	if err := json.Unmarshal(applied.Sops["key_groups"], &groups); err == nil {
+		known := jsonFields(reflect.TypeFor[isindirv1alpha3.KeyGroup]())
+		for i, group := range groups {
+			unknown(fmt.Sprintf("sops.key_groups[%d]", i), group, known)
+		}
+	}
+	return warnings
+}
+
+// jsonFields returns JSON names of fields of struct type
+func jsonFields(structType reflect.Type) map[string]bool {
+	fields := map[string]bool{}
+	for field := range structType.Fields() {
+		name, _, _ := strings.Cut(field.Tag.Get("json"), ",")
+		if name != "" && name != "-" {
+			fields[name] = true
+		}
+	}
+	return fields
+}
+
+// keyGroups returns key groups of sops metadata, top level keys are returned
+// as a separate group
+func keyGroups(metadata *isindirv1alpha3.SopsMetadata) []isindirv1alpha3.KeyGroup {
+	topLevel := isindirv1alpha3.KeyGroup{
+		AwsKms:   metadata.AwsKms,
+		Pgp:      metadata.Pgp,
+		AzureKms: metadata.AzureKms,
+		HcVault:  metadata.HcVault,
+		GcpKms:   metadata.GcpKms,
+		Age:      metadata.Age,
+	}
+	return append([]isindirv1alpha3.KeyGroup{topLevel}, metadata.KeyGroups...)
+}
+
+func hasKeys(group isindirv1alpha3.KeyGroup) bool {
+	return len(group.AwsKms)+len(group.Pgp)+len(group.AzureKms)+len(group.HcVault)+len(group.GcpKms)+len(group.Age) > 0
+}
+
+// setSopsCompatibilityCondition sets or removes SopsCompatibilityWarning
+// condition, warning event is emitted when the warnings change
+func (r *SopsSecretReconciler) setSopsCompatibilityCondition(sopsSecret *isindirv1alpha3.SopsSecret) {
+	warnings := sopsCompatibilityWarnings(sopsSecret)
+	if len(warnings) == 0 {
+		meta.RemoveStatusCondition(&sopsSecret.Status.Conditions, isindirv1alpha3.ConditionTypeSopsCompatibilityWarning)
+		return
+	}
+
+	messages := make([]string, 0, len(warnings))
+	for _, warning := range warnings {
+		messages = append(messages, warning.String())
+	}
+	message := strings.Join(messages, "; ")
+
+	previous := meta.FindStatusCondition(sopsSecret.Status.Conditions, isindirv1alpha3.ConditionTypeSopsCompatibilityWarning)
+	if previous == nil || previous.Message != message {
+		r.Log.V(0).Info(
+			"SopsSecret metadata has sops compatibility warnings",
+			"sopssecret", fmt.Sprintf("%s/%s", sopsSecret.Namespace, sopsSecret.Name),
+			"warnings", messages,
+		)
+		r.recordWarning(sopsSecret, nil, EventReasonSopsCompatibilityWarning, "Decrypt", message)
+	}
+	meta.SetStatusCondition(&sopsSecret.Status.Conditions, metav1.Condition{
+		Type:               isindirv1alpha3.ConditionTypeSopsCompatibilityWarning,
+		Status:             metav1.ConditionTrue,
+		ObservedGeneration: sopsSecret.Generation,
+		Reason:             "SopsMetadataWarnings",
+		Message:            message,
+	})
+}
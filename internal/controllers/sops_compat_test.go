@@ -0,0 +1,193 @@
+/* This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at https://mozilla.org/MPL/2.0/. */
+
+package controllers
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"path/filepath"
+	"slices"
+	"testing"
+
+	sopsversion "github.com/getsops/sops/v3/version"
+	"github.com/go-logr/logr"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/meta"
+	"k8s.io/apimachinery/pkg/runtime"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/client/fake"
+
+	isindirv1alpha3 "github.com/isindir/sops-secrets-operator/api/v1alpha3"
+)
+
+func TestCheckSopsVersion(t *testing.T) {
+	embedded, err := ParseSopsVersion(sopsversion.Version)
+	if err != nil {
+		t.Fatalf("embedded sops version %q is not valid: %v", sopsversion.Version, err)
+	}
+
+	tests := []struct {
+		name        string
+		version     string
+		unsupported bool
+	}{
+		{name: "Embedded version", version: sopsversion.Version},
+		{name: "Older version", version: "3.7.3"},
+		{name: "Last patch of older minor version", version: fmt.Sprintf("%d.%d.99", embedded[0], embedded[1]-1)},
+		{name: "Newer patch version", version: fmt.Sprintf("%d.%d.%d", embedded[0], embedded[1], embedded[2]+1)},
+		{name: "Newer minor version", version: fmt.Sprintf("%d.%d.0", embedded[0], embedded[1]+1), unsupported: true},
+		{name: "Newer major version", version: fmt.Sprintf("%d.0.0", embedded[0]+1), unsupported: true},
+		{name: "Older major version", version: "2.0.0"},
+		{name: "Pre-release of newer minor version", version: fmt.Sprintf("v%d.%d.0-rc.1", embedded[0], embedded[1]+1), unsupported: true},
+		{name: "Missing version is not rejected"},
+		{name: "Invalid version is not rejected", version: "three"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := CheckSopsVersion(tt.version)
+			if errors.Is(err, ErrUnsupportedSopsVersion) != tt.unsupported {
+				t.Errorf("CheckSopsVersion(%q) = %v, expected unsupported %v", tt.version, err, tt.unsupported)
+			}
+		})
+	}
+}
+
+func TestSopsCompatibilityWarnings(t *testing.T) {
+	age := []isindirv1alpha3.AgeItem{{Recipient: "age1"}}
+
+	tests := []struct {
+		name           string
+		metadata       isindirv1alpha3.SopsMetadata
+		lastApplied    string
+		expectedFields []string
+	}{
+		{
+			name:     "Compatible metadata",
+			metadata: isindirv1alpha3.SopsMetadata{Age: age, Version: "3.7.3"},
+		},
+		{
+			name:           "Missing version",
+			metadata:       isindirv1alpha3.SopsMetadata{Age: age},
+			expectedFields: []string{"sops.version"},
+		},
+		{
+			name:           "Invalid version",
+			metadata:       isindirv1alpha3.SopsMetadata{Age: age, Version: "three"},
+			expectedFields: []string{"sops.version"},
+		},
+		{
+			name:           "Newer patch version",
+			metadata:       isindirv1alpha3.SopsMetadata{Age: age, Version: "3.13.99"},
+			expectedFields: []string{"sops.version"},
+		},
+		{
+			name:     "Newer minor version is rejected, not warned",
+			metadata: isindirv1alpha3.SopsMetadata{Age: age, Version: "3.99.0"},
+		},
+		{
+			name: "Fields newer than recorded version",
+			metadata: isindirv1alpha3.SopsMetadata{
+				KeyGroups:        []isindirv1alpha3.KeyGroup{{Age: age}},
+				MacOnlyEncrypted: true,
+				Version:          "3.6.1",
+			},
+			expectedFields: []string{"sops.age", "sops.mac_only_encrypted"},
+		},
+		{
+			name:        "Key providers dropped by API server",
+			metadata:    isindirv1alpha3.SopsMetadata{KeyGroups: []isindirv1alpha3.KeyGroup{{}, {Age: age}}, Version: "3.13.1"},
+			lastApplied: `{"sops":{"key_groups":[{"hckms":[{"key_id":"id"}]},{"age":[{"recipient":"age1"}]}],"version":"3.13.1"}}`,
+			expectedFields: []string{
+				"sops.key_groups[0].hckms",
+			},
+		},
+		{
+			name:           "Only key provider dropped by API server",
+			metadata:       isindirv1alpha3.SopsMetadata{Version: "3.13.1"},
+			lastApplied:    `{"sops":{"hckms":[{"key_id":"id"}],"version":"3.13.1"}}`,
+			expectedFields: []string{"sops.hckms", "sops"},
+		},
+		{
+			name:        "Invalid last applied configuration is ignored",
+			metadata:    isindirv1alpha3.SopsMetadata{Age: age, Version: "3.13.1"},
+			lastApplied: `{`,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			sopsSecret := &isindirv1alpha3.SopsSecret{Sops: tt.metadata}
+			if tt.lastApplied != "" {
+				sopsSecret.Annotations = map[string]string{corev1.LastAppliedConfigAnnotation: tt.lastApplied}
+			}
+			var fields []string
+			for _, warning := range sopsCompatibilityWarnings(sopsSecret) {
+				fields = append(fields, warning.Field)
+			}
+			if !slices.Equal(fields, tt.expectedFields) {
+				t.Errorf("sopsCompatibilityWarnings() fields = %v, expected %v", fields, tt.expectedFields)
+			}
+		})
+	}
+}
+
+func TestSetSopsCompatibilityCondition(t *testing.T) {
+	r := &SopsSecretReconciler{Log: logr.Discard()}
+	sopsSecret := &isindirv1alpha3.SopsSecret{
+		Sops: isindirv1alpha3.SopsMetadata{Age: []isindirv1alpha3.AgeItem{{Recipient: "age1"}}},
+	}
+
+	r.setSopsCompatibilityCondition(sopsSecret)
+	condition := meta.FindStatusCondition(sopsSecret.Status.Conditions, isindirv1alpha3.ConditionTypeSopsCompatibilityWarning)
+	if condition == nil || condition.Status != "True" {
+		t.Fatalf("expected SopsCompatibilityWarning condition for metadata without version, got %v", condition)
+	}
+
+	sopsSecret.Sops.Version = "3.7.3"
+	r.setSopsCompatibilityCondition(sopsSecret)
+	if meta.FindStatusCondition(sopsSecret.Status.Conditions, isindirv1alpha3.ConditionTypeSopsCompatibilityWarning) != nil {
+		t.Error("expected SopsCompatibilityWarning condition to be removed")
+	}
+}
+
+func TestDecryptSopsSecretUnsupportedVersion(t *testing.T) {
+	setAgeKeyFile(t, filepath.Join("..", "..", "config", "age-test-key", "key-file.txt"))
+	scheme := runtime.NewScheme()
+	if err := isindirv1alpha3.AddToScheme(scheme); err != nil {
+		t.Fatal(err)
+	}
+	embedded, _ := ParseSopsVersion(sopsversion.Version)
+
+	sopsSecret := readTestSopsSecret(t, "04-test-secrets-mac-only.yaml")
+	sopsSecret.Sops.Version = fmt.Sprintf("%d.%d.0", embedded[0], embedded[1]+1)
+	k8sClient := fake.NewClientBuilder().WithScheme(scheme).WithRuntimeObjects(sopsSecret).
+		WithStatusSubresource(sopsSecret).Build()
+	r := &SopsSecretReconciler{Client: k8sClient, Log: logr.Discard()}
+
+	if _, reschedule, err := r.decryptSopsSecret(context.Background(), sopsSecret, nil); !reschedule || err != nil {
+		t.Fatal("expected SopsSecret encrypted by newer sops not to be decrypted")
+	}
+	updated := &isindirv1alpha3.SopsSecret{}
+	if err := k8sClient.Get(context.Background(), client.ObjectKeyFromObject(sopsSecret), updated); err != nil {
+		t.Fatal(err)
+	}
+	if updated.Status.Message != STATUS_SOPS_VERSION_ERROR {
+		t.Errorf("expected status %q, got %q", STATUS_SOPS_VERSION_ERROR, updated.Status.Message)
+	}
+}
+
+func TestDecryptSopsSecretOlderVersion(t *testing.T) {
+	setAgeKeyFile(t, filepath.Join("..", "..", "config", "age-test-key", "key-file.txt"))
+
+	for _, version := range []string{"2.0.0", "3.0.0"} {
+		sopsSecret := readTestSopsSecret(t, "04-test-secrets-mac-only.yaml")
+		sopsSecret.Sops.Version = version
+		if _, _, err := decryptSopsSecretInstance(sopsSecret, false, nil, logr.Discard()); err != nil {
+			t.Errorf("expected SopsSecret encrypted by sops %s to be decrypted, got %v", version, err)
+		}
+	}
+}
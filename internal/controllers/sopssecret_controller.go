@@ -8,29 +8,41 @@ import (
 	"context"
 	"encoding/base64"
 	"encoding/json"
+	goerrors "errors"
 	"fmt"
 	"io"
+	"strings"
+	"sync/atomic"
 	"time"
 
 	"github.com/go-logr/logr"
+	"github.com/prometheus/client_golang/prometheus"
 	"github.com/sirupsen/logrus"
 	corev1 "k8s.io/api/core/v1"
-	apiequality "k8s.io/apimachinery/pkg/api/equality"
 	"k8s.io/apimachinery/pkg/api/errors"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/runtime/schema"
 	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/client-go/tools/events"
+	"k8s.io/client-go/util/workqueue"
 	ctrl "sigs.k8s.io/controller-runtime"
 	"sigs.k8s.io/controller-runtime/pkg/builder"
 	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/controller"
 	"sigs.k8s.io/controller-runtime/pkg/controller/controllerutil"
+	"sigs.k8s.io/controller-runtime/pkg/event"
+	"sigs.k8s.io/controller-runtime/pkg/handler"
 	"sigs.k8s.io/controller-runtime/pkg/predicate"
 	"sigs.k8s.io/controller-runtime/pkg/reconcile"
+	"sigs.k8s.io/controller-runtime/pkg/source"
 
 	isindirv1alpha3 "github.com/isindir/sops-secrets-operator/api/v1alpha3"
+	"github.com/isindir/sops-secrets-operator/internal/audit"
 
 	"github.com/getsops/sops/v3"
 	sopsaes "github.com/getsops/sops/v3/aes"
+	"github.com/getsops/sops/v3/keyservice"
 	sopslogging "github.com/getsops/sops/v3/logging"
 	sopsdotenv "github.com/getsops/sops/v3/stores/dotenv"
 	sopsjson "github.com/getsops/sops/v3/stores/json"
@@ -46,22 +58,62 @@ const (
 	STATUS_SETTING_OWNERSHIP_ERROR = "Setting controller ownership of the child secret error"
 	STATUS_RECONCILE_SUSPENDED     = "Reconciliation is suspended"
 	STATUS_UNKNOWN_ERROR           = "Unknown Error"
+	STATUS_MAC_MISMATCH            = "MAC verification error"
+	STATUS_RECIPIENTS_NOT_ALLOWED  = "Recipients are not allowed in namespace"
+	STATUS_CHILD_PROTECTED         = "Child secret is protected by policy error"
+	STATUS_CHILD_TYPE_FORBIDDEN    = "Child secret type is forbidden by policy error"
+	STATUS_INVALID_VALIDITY_WINDOW = "Invalid secret template validity window"
+	STATUS_CHILD_IMMUTABLE_ERROR   = "Child secret immutable field change error"
+	STATUS_SOPS_VERSION_ERROR      = "Unsupported sops version error"
 )
 
+// ErrMACMismatch is returned when sops MAC verification of secret templates fails
+var ErrMACMismatch = goerrors.New("sops mac verification of secret templates failed")
+
+// sopsEncryptedValuePrefix is the prefix of values encrypted by sops
+const sopsEncryptedValuePrefix = "ENC[AES256_GCM,"
+
 // SopsSecretReconciler reconciles a SopsSecret object
 type SopsSecretReconciler struct {
 	client.Client
 	Log                     logr.Logger
 	Scheme                  *runtime.Scheme
+	APIReader               client.Reader
 	RequeueAfter            int64
 	DefaultEnforceOwnership bool
+	VerifyMAC               bool
+	RecipientPolicy         string
+	ProtectedSecretPolicy   bool
+	Recorder                events.EventRecorder
+	Audit                   audit.Recorder
+	ExpiryWarningWindow     time.Duration
+	OperatorNamespace       string
+	PauseConfigMap          string
+	NamespaceSuspend        bool
+	RecreateStrategy        string
+	MaxDataKeyAge           time.Duration
+
+	MaxConcurrentReconciles int
+	BackoffBaseDelay        time.Duration
+	BackoffMaxDelay         time.Duration
+
+	// paused is set by operator configuration file
+	paused atomic.Bool
+	// requeues receives SopsSecrets to reconcile on events originating
+	// outside the cluster, e.g. key reload
+	requeues chan event.GenericEvent
 }
 
 //+kubebuilder:rbac:groups=isindir.github.com,resources=sopssecrets,verbs=get;list;watch;create;update;patch;delete
 //+kubebuilder:rbac:groups=isindir.github.com,resources=sopssecrets/status,verbs=get;update;patch
 //+kubebuilder:rbac:groups=isindir.github.com,resources=sopssecrets/finalizers,verbs=update
-//+kubebuilder:rbac:groups="",resources=secrets,verbs="*"
+//+kubebuilder:rbac:groups="",resources=secrets,verbs=get;list;watch;create;update;patch;delete
 //+kubebuilder:rbac:groups="",resources=secrets/status,verbs=get;update;patch
+//+kubebuilder:rbac:groups=isindir.github.com,resources=sopssecretpolicies,verbs=get;list;watch
+//+kubebuilder:rbac:groups="",resources=namespaces,verbs=get;list;watch
+//+kubebuilder:rbac:groups=isindir.github.com,resources=protectedsecretpolicies,verbs=get;list;watch
+//+kubebuilder:rbac:groups=events.k8s.io,resources=events,verbs=create;patch
+//+kubebuilder:rbac:groups="",resources=configmaps,verbs=get;list;watch;create;update
 
 // Reconcile is part of the main kubernetes reconciliation loop which aims to
 // move the current state of the cluster closer to the desired state.
@@ -78,15 +130,41 @@ func (r *SopsSecretReconciler) Reconcile(ctx context.Context, req ctrl.Request)
 		return reconcile.Result{}, err
 	}
 
-	if r.isSecretSuspended(ctx, encryptedSopsSecret, req) {
+	ctx, encryptedSopsSecret, err = r.handleReconcileRequest(ctx, req, encryptedSopsSecret)
+	if err != nil {
+		return reconcile.Result{}, client.IgnoreNotFound(err)
+	}
+
+	suspended, err := r.isSecretSuspended(ctx, encryptedSopsSecret, req)
+	if err != nil {
+		return r.failedReconcile(err)
+	}
+	if suspended {
 		sopsSecretsReconciliationsSuspended.Inc()
 		return reconcile.Result{}, nil
 	}
 
-	plainTextSopsSecret, rescheduleReconcileLoop := r.decryptSopsSecret(ctx, encryptedSopsSecret)
+	recipientPolicies, ok, err := r.recipientPolicies(ctx, encryptedSopsSecret)
+	if !ok {
+		return r.failedReconcile(err)
+	}
+
+	r.setSopsCompatibilityCondition(encryptedSopsSecret)
+	plainTextSopsSecret, rescheduleReconcileLoop, err := r.decryptSopsSecret(ctx, encryptedSopsSecret, recipientPolicies)
 	if rescheduleReconcileLoop {
-		sopsSecretsReconciliationFailures.Inc()
-		return reconcile.Result{Requeue: true, RequeueAfter: time.Duration(r.RequeueAfter) * time.Minute}, nil
+		return r.failedReconcile(err)
+	}
+
+	now := time.Now()
+	windows, ok, err := r.applyValidityWindows(ctx, req, encryptedSopsSecret, plainTextSopsSecret, now)
+	if !ok {
+		return r.failedReconcile(err)
+	}
+	plainTextSopsSecret.Spec.SecretsTemplate = windows.templates
+
+	protectedSecretPolicies, ok, err := r.getProtectedSecretPolicies(ctx, encryptedSopsSecret)
+	if !ok {
+		return r.failedReconcile(err)
 	}
 
 	err = r.garbageCollectOrphanedSecrets(ctx, req, encryptedSopsSecret, plainTextSopsSecret)
@@ -98,80 +176,162 @@ func (r *SopsSecretReconciler) Reconcile(ctx context.Context, req ctrl.Request)
 	r.Log.V(1).Info("Entering template data loop", "sopssecret", req.NamespacedName)
 	for _, secretTemplate := range plainTextSopsSecret.Spec.SecretsTemplate {
 
-		kubeSecretFromTemplate, rescheduleReconcileLoop := r.newKubeSecretFromTemplate(ctx, req, encryptedSopsSecret, plainTextSopsSecret, &secretTemplate)
+		kubeSecretFromTemplate, rescheduleReconcileLoop, err := r.newKubeSecretFromTemplate(ctx, req, encryptedSopsSecret, plainTextSopsSecret, &secretTemplate)
 		if rescheduleReconcileLoop {
-			sopsSecretsReconciliationFailures.Inc()
-			return reconcile.Result{Requeue: true, RequeueAfter: time.Duration(r.RequeueAfter) * time.Minute}, nil
+			return r.failedReconcile(err)
 		}
 
-		kubeSecretInCluster, rescheduleReconcileLoop := r.getSecretFromClusterOrCreateFromTemplate(ctx, req, encryptedSopsSecret, kubeSecretFromTemplate)
+		if ok, err := r.isChildTypeAllowed(ctx, req, encryptedSopsSecret, protectedSecretPolicies, kubeSecretFromTemplate); !ok {
+			return r.failedReconcile(err)
+		}
+
+		kubeSecretInCluster, rescheduleReconcileLoop, err := r.getSecretFromClusterOrCreateFromTemplate(ctx, req, encryptedSopsSecret, kubeSecretFromTemplate)
 		if rescheduleReconcileLoop {
-			sopsSecretsReconciliationFailures.Inc()
-			return reconcile.Result{Requeue: true, RequeueAfter: time.Duration(r.RequeueAfter) * time.Minute}, nil
+			return r.failedReconcile(err)
 		}
 
-		if !r.canManageKubeSecret(ctx, req, encryptedSopsSecret, kubeSecretInCluster) {
-			sopsSecretsReconciliationFailures.Inc()
-			return reconcile.Result{Requeue: true, RequeueAfter: time.Duration(r.RequeueAfter) * time.Minute}, nil
+		if protected, err := r.isChildProtected(ctx, req, encryptedSopsSecret, protectedSecretPolicies, kubeSecretInCluster); protected {
+			return r.failedReconcile(err)
 		}
 
-		rescheduleReconcileLoop = r.refreshKubeSecretIfNeeded(ctx, req, encryptedSopsSecret, kubeSecretFromTemplate, kubeSecretInCluster)
-		if rescheduleReconcileLoop {
-			sopsSecretsReconciliationFailures.Inc()
-			return reconcile.Result{Requeue: true, RequeueAfter: time.Duration(r.RequeueAfter) * time.Minute}, nil
+		if ok, err := r.canManageKubeSecret(ctx, req, encryptedSopsSecret, kubeSecretInCluster); !ok {
+			return r.failedReconcile(err)
+		}
+
+		if reschedule, err := r.refreshKubeSecretIfNeeded(ctx, req, encryptedSopsSecret, kubeSecretFromTemplate, kubeSecretInCluster); reschedule {
+			return r.failedReconcile(err)
 		}
 	}
 
-	r.UpdateSopsSecretStatus(ctx, encryptedSopsSecret, STATUS_HEALTHY)
+	r.setExpiringSoonCondition(encryptedSopsSecret, windows)
+	r.setSuspended(encryptedSopsSecret, "")
+	if err := r.UpdateSopsSecretStatus(ctx, encryptedSopsSecret, STATUS_HEALTHY); err != nil {
+		r.Log.Error(err, "Failed to update SopsSecret status", "sopssecret", req.NamespacedName)
+		sopsSecretsReconciliationFailures.Inc()
+		return reconcile.Result{}, err
+	}
 	sopsSecretsReconciliations.Inc()
 
 	r.Log.V(1).Info("SopsSecret is Healthy", "sopssecret", req.NamespacedName)
-	return ctrl.Result{}, nil
+	// Requeue when the data key exceeds maximum age to set the condition
+	windows.addBoundary(r.dataKeyMaxAgeAt(encryptedSopsSecret), now)
+	return windows.requeueAt(now), nil
+}
+
+// failedReconcile counts failed reconciliation and requeues it after
+// RequeueAfter minutes, error of failed status update is returned instead so
+// that reconciliation is retried with backoff and the status is not lost
+func (r *SopsSecretReconciler) failedReconcile(err error) (ctrl.Result, error) {
+	sopsSecretsReconciliationFailures.Inc()
+	if err != nil {
+		return reconcile.Result{}, err
+	}
+	return reconcile.Result{Requeue: true, RequeueAfter: time.Duration(r.RequeueAfter) * time.Minute}, nil
 }
 
-func (r *SopsSecretReconciler) UpdateSopsSecretStatus(ctx context.Context, sopsSecret *isindirv1alpha3.SopsSecret, message string) {
+// UpdateSopsSecretStatus persists status with the message, the error must be
+// returned by reconciliation to retry it, otherwise status and reconcile
+// request acknowledgement would be lost
+func (r *SopsSecretReconciler) UpdateSopsSecretStatus(
+	ctx context.Context, sopsSecret *isindirv1alpha3.SopsSecret, message string,
+) error {
 	sopsSecret.Status.Message = message
-	_ = r.Status().Update(ctx, sopsSecret)
+	// Reconcile request is handled by any outcome of reconciliation
+	if requestedAt, ok := sopsSecret.Annotations[isindirv1alpha3.SopsSecretReconcileRequestAnnotation]; ok {
+		sopsSecret.Status.LastHandledReconcileAt = requestedAt
+	}
+	return r.Status().Update(ctx, sopsSecret)
+}
+
+// recordWarning emits a warning event regarding SopsSecret, events are not
+// emitted when reconciler is created without recorder
+func (r *SopsSecretReconciler) recordWarning(
+	sopsSecret *isindirv1alpha3.SopsSecret, related runtime.Object, reason, action, note string,
+) {
+	if r.Recorder == nil {
+		return
+	}
+	r.Recorder.Eventf(sopsSecret, related, corev1.EventTypeWarning, reason, action, "%s", note)
+}
+
+// recordNormal emits a normal event regarding SopsSecret, events are not
+// emitted when reconciler is created without recorder
+func (r *SopsSecretReconciler) recordNormal(
+	sopsSecret *isindirv1alpha3.SopsSecret, related runtime.Object, reason, action, note string,
+) {
+	if r.Recorder == nil {
+		return
+	}
+	r.Recorder.Eventf(sopsSecret, related, corev1.EventTypeNormal, reason, action, "%s", note)
 }
 
 func (r *SopsSecretReconciler) decryptSopsSecret(
 	ctx context.Context,
 	encryptedSopsSecret *isindirv1alpha3.SopsSecret,
-) (*isindirv1alpha3.SopsSecret, bool) {
-	decryptedSopsSecret, err := decryptSopsSecretInstance(encryptedSopsSecret, r.Log)
+	recipientPolicies *RecipientPolicies,
+) (*isindirv1alpha3.SopsSecret, bool, error) {
+	decryptedSopsSecret, keys, err := decryptSopsSecretInstance(
+		encryptedSopsSecret, r.shouldVerifyMAC(encryptedSopsSecret), recipientPolicies, r.Log,
+	)
+	r.setEncryptionStatus(encryptedSopsSecret, keys, time.Now())
 	if err != nil {
 		// will not process plainTextSopsSecret error as we are already in error mode here
-		r.UpdateSopsSecretStatus(ctx, encryptedSopsSecret, STATUS_DECRYPT_ERROR)
+		if goerrors.Is(err, ErrMACMismatch) {
+			statusErr := r.UpdateSopsSecretStatus(ctx, encryptedSopsSecret, STATUS_MAC_MISMATCH)
+			r.auditDecrypt(encryptedSopsSecret, keys, STATUS_MAC_MISMATCH)
+			return nil, true, statusErr
+		}
+		var policyErr *RecipientPolicyError
+		if goerrors.As(err, &policyErr) {
+			statusErr := r.UpdateSopsSecretStatus(ctx, encryptedSopsSecret, STATUS_RECIPIENTS_NOT_ALLOWED)
+			r.auditDecrypt(encryptedSopsSecret, keys, STATUS_RECIPIENTS_NOT_ALLOWED)
+			return nil, true, statusErr
+		}
+		if goerrors.Is(err, ErrUnsupportedSopsVersion) {
+			statusErr := r.UpdateSopsSecretStatus(ctx, encryptedSopsSecret, STATUS_SOPS_VERSION_ERROR)
+			r.auditDecrypt(encryptedSopsSecret, keys, STATUS_SOPS_VERSION_ERROR)
+			return nil, true, statusErr
+		}
+		statusErr := r.UpdateSopsSecretStatus(ctx, encryptedSopsSecret, STATUS_DECRYPT_ERROR)
+		r.auditDecrypt(encryptedSopsSecret, keys, STATUS_DECRYPT_ERROR)
 
 		// Failed to decrypt, re-schedule reconciliation in 5 minutes
-		return nil, true
+		return nil, true, statusErr
 	}
-	return decryptedSopsSecret, false
+	r.auditDecrypt(encryptedSopsSecret, keys, "")
+	return decryptedSopsSecret, false, nil
 }
 
 // canManageKubeSecret checks if the controller can manage the given Kubernetes secret.
 // Returns true if the secret is already owned by this SopsSecret, is annotated to be managed,
-// or if enforceOwnership is enabled.
+// or if enforceOwnership is enabled. Error of status update is returned otherwise.
 func (r *SopsSecretReconciler) canManageKubeSecret(
 	ctx context.Context,
 	req ctrl.Request,
 	encryptedSopsSecret *isindirv1alpha3.SopsSecret,
 	kubeSecretInCluster *corev1.Secret,
-) bool {
+) (bool, error) {
 	if metav1.IsControlledBy(kubeSecretInCluster, encryptedSopsSecret) ||
 		isAnnotatedToBeManaged(kubeSecretInCluster) ||
 		r.shouldEnforceOwnership(encryptedSopsSecret) {
-		return true
+		return true, nil
 	}
 
-	r.UpdateSopsSecretStatus(ctx, encryptedSopsSecret, STATUS_CHILD_NOT_OWNED)
+	statusErr := r.UpdateSopsSecretStatus(ctx, encryptedSopsSecret, STATUS_CHILD_NOT_OWNED)
 
 	r.Log.Error(
 		fmt.Errorf("sopssecret has a conflict with existing kubernetes secret resource, potential reasons: target secret already pre-existed or is managed by multiple sops secrets"),
 		"Child secret is not owned by controller or sopssecret Error",
 		"sopssecret", req.NamespacedName,
 	)
-	return false
+	return false, statusErr
+}
+
+// shouldVerifyMAC determines if sops MAC of the SopsSecret must be verified.
+// Global setting can not be disabled per CR, as anyone who can tamper with
+// encrypted values can also change spec.verifyMac.
+func (r *SopsSecretReconciler) shouldVerifyMAC(sopsSecret *isindirv1alpha3.SopsSecret) bool {
+	return r.VerifyMAC || sopsSecret.Spec.VerifyMac
 }
 
 // shouldEnforceOwnership determines if the controller should take ownership of unowned or stale secrets.
@@ -189,14 +349,21 @@ func (r *SopsSecretReconciler) refreshKubeSecretIfNeeded(
 	encryptedSopsSecret *isindirv1alpha3.SopsSecret,
 	kubeSecretFromTemplate *corev1.Secret,
 	kubeSecretInCluster *corev1.Secret,
-) bool {
+) (bool, error) {
 	copyOfKubeSecretInCluster := kubeSecretInCluster.DeepCopy()
 
-	copyOfKubeSecretInCluster.StringData = kubeSecretFromTemplate.StringData
-	copyOfKubeSecretInCluster.Data = map[string][]byte{}
+	// Stored secrets hold Data only, desired content is compared decoded
+	copyOfKubeSecretInCluster.StringData = nil
+	copyOfKubeSecretInCluster.Data = secretData(kubeSecretFromTemplate)
 	copyOfKubeSecretInCluster.Type = kubeSecretFromTemplate.Type
-	copyOfKubeSecretInCluster.Annotations = kubeSecretFromTemplate.Annotations
-	copyOfKubeSecretInCluster.Labels = kubeSecretFromTemplate.Labels
+	// Labels and annotations set by other tools are preserved
+	lastApplied := getLastApplied(kubeSecretInCluster)
+	copyOfKubeSecretInCluster.Annotations = mergeMetadata(
+		kubeSecretInCluster.Annotations, kubeSecretFromTemplate.Annotations, lastApplied.Annotations,
+	)
+	copyOfKubeSecretInCluster.Labels = mergeMetadata(
+		kubeSecretInCluster.Labels, kubeSecretFromTemplate.Labels, lastApplied.Labels,
+	)
 
 	// Update OwnerReferences if the secret is annotated to be managed
 	// or if enforce ownership is enabled (to take over orphaned secrets)
@@ -220,29 +387,48 @@ func (r *SopsSecretReconciler) refreshKubeSecretIfNeeded(
 		copyOfKubeSecretInCluster.OwnerReferences = kubeSecretFromTemplate.OwnerReferences
 	}
 
-	if !apiequality.Semantic.DeepEqual(kubeSecretInCluster, copyOfKubeSecretInCluster) {
+	drifted := isContentDrifted(kubeSecretInCluster)
+	if drifted {
+		r.Log.V(0).Info(
+			"Secret content was changed outside of the operator",
+			"secret", kubeSecretInCluster.Name,
+			"namespace", kubeSecretInCluster.Namespace,
+		)
+		r.recordWarning(
+			encryptedSopsSecret, kubeSecretInCluster, EventReasonChildSecretDrift, "Update",
+			fmt.Sprintf("content of secret %s was changed outside of the operator and is restored", kubeSecretInCluster.Name),
+		)
+	}
+
+	if !isSecretUpToDate(kubeSecretInCluster, copyOfKubeSecretInCluster, drifted) {
+		if conflict := immutableFieldConflict(kubeSecretInCluster, copyOfKubeSecretInCluster); conflict != "" {
+			return r.recreateKubeSecret(ctx, req, encryptedSopsSecret, kubeSecretInCluster, copyOfKubeSecretInCluster, conflict)
+		}
 		r.Log.V(0).Info(
 			"Secret already exists and needs to be refreshed",
 			"secret", copyOfKubeSecretInCluster.Name,
 			"namespace", copyOfKubeSecretInCluster.Namespace,
 		)
+		changedKeys := changedSecretKeys(kubeSecretInCluster, copyOfKubeSecretInCluster)
 		if err := r.Update(ctx, copyOfKubeSecretInCluster); err != nil {
-			r.UpdateSopsSecretStatus(ctx, encryptedSopsSecret, STATUS_CHILD_UPDATE_ERROR)
+			statusErr := r.UpdateSopsSecretStatus(ctx, encryptedSopsSecret, STATUS_CHILD_UPDATE_ERROR)
+			r.auditSecretWrite(encryptedSopsSecret, audit.ActionUpdate, copyOfKubeSecretInCluster.Name, changedKeys, STATUS_CHILD_UPDATE_ERROR)
 
 			r.Log.Error(
 				err,
 				"Child secret update error",
 				"sopssecret", req.NamespacedName,
 			)
-			return true
+			return true, statusErr
 		}
+		r.auditSecretWrite(encryptedSopsSecret, audit.ActionUpdate, copyOfKubeSecretInCluster.Name, changedKeys, "")
 		r.Log.V(0).Info(
 			"Secret successfully refreshed",
 			"secret", copyOfKubeSecretInCluster.Name,
 			"namespace", copyOfKubeSecretInCluster.Namespace,
 		)
 	}
-	return false
+	return false, nil
 }
 
 func (r *SopsSecretReconciler) getSecretFromClusterOrCreateFromTemplate(
@@ -250,10 +436,10 @@ func (r *SopsSecretReconciler) getSecretFromClusterOrCreateFromTemplate(
 	req ctrl.Request,
 	encryptedSopsSecret *isindirv1alpha3.SopsSecret,
 	kubeSecretFromTemplate *corev1.Secret,
-) (*corev1.Secret, bool) {
+) (*corev1.Secret, bool, error) {
 	// Check if kubeSecretFromTemplate already exists in the cluster store
 	kubeSecretToFindAndCompare := &corev1.Secret{}
-	err := r.Get(
+	err := r.secretReader(ctx).Get(
 		ctx,
 		types.NamespacedName{
 			Name:      kubeSecretFromTemplate.Name,
@@ -261,6 +447,11 @@ func (r *SopsSecretReconciler) getSecretFromClusterOrCreateFromTemplate(
 		},
 		kubeSecretToFindAndCompare,
 	)
+	// Only secrets with SopsSecretManagedLabel are cached, check whether
+	// unmanaged secret exists before creating it
+	if errors.IsNotFound(err) && r.APIReader != nil {
+		err = r.APIReader.Get(ctx, client.ObjectKeyFromObject(kubeSecretFromTemplate), kubeSecretToFindAndCompare)
+	}
 
 	// No kubeSecretFromTemplate alike found - CREATE one
 	if errors.IsNotFound(err) {
@@ -269,23 +460,30 @@ func (r *SopsSecretReconciler) getSecretFromClusterOrCreateFromTemplate(
 			"Creating a new Secret",
 			"sopssecret", req.NamespacedName,
 		)
+		changedKeys := changedSecretKeys(nil, kubeSecretFromTemplate)
 		err = r.Create(ctx, kubeSecretFromTemplate)
 		kubeSecretToFindAndCompare = kubeSecretFromTemplate.DeepCopy()
+
+		failureStatus := ""
+		if err != nil {
+			failureStatus = STATUS_UNKNOWN_ERROR
+		}
+		r.auditSecretWrite(encryptedSopsSecret, audit.ActionCreate, kubeSecretFromTemplate.Name, changedKeys, failureStatus)
 	}
 
 	// Unknown error while trying to find kubeSecretFromTemplate in cluster - reschedule reconciliation
 	if err != nil {
-		r.UpdateSopsSecretStatus(ctx, encryptedSopsSecret, STATUS_UNKNOWN_ERROR)
+		statusErr := r.UpdateSopsSecretStatus(ctx, encryptedSopsSecret, STATUS_UNKNOWN_ERROR)
 
 		r.Log.Error(
 			err,
 			"Unknown Error",
 			"sopssecret", req.NamespacedName,
 		)
-		return nil, true
+		return nil, true, statusErr
 	}
 
-	return kubeSecretToFindAndCompare, false
+	return kubeSecretToFindAndCompare, false, nil
 }
 
 func (r *SopsSecretReconciler) newKubeSecretFromTemplate(
@@ -294,24 +492,24 @@ func (r *SopsSecretReconciler) newKubeSecretFromTemplate(
 	encryptedSopsSecret *isindirv1alpha3.SopsSecret,
 	plainTextSopsSecret *isindirv1alpha3.SopsSecret,
 	secretTemplate *isindirv1alpha3.SopsSecretTemplate,
-) (*corev1.Secret, bool) {
+) (*corev1.Secret, bool, error) {
 	// Define a new secret object
 	kubeSecretFromTemplate, err := createKubeSecretFromTemplate(plainTextSopsSecret, secretTemplate, r.Log)
 	if err != nil {
-		r.UpdateSopsSecretStatus(ctx, encryptedSopsSecret, STATUS_CHILD_CREATION_ERROR)
+		statusErr := r.UpdateSopsSecretStatus(ctx, encryptedSopsSecret, STATUS_CHILD_CREATION_ERROR)
 
 		r.Log.Error(
 			err,
 			"New child secret creation error",
 			"sopssecret", req.NamespacedName,
 		)
-		return nil, true
+		return nil, true, statusErr
 	}
 
 	// Set encryptedSopsSecret as the owner of kubeSecret
 	err = controllerutil.SetControllerReference(encryptedSopsSecret, kubeSecretFromTemplate, r.Scheme)
 	if err != nil {
-		r.UpdateSopsSecretStatus(ctx, encryptedSopsSecret, STATUS_SETTING_OWNERSHIP_ERROR)
+		statusErr := r.UpdateSopsSecretStatus(ctx, encryptedSopsSecret, STATUS_SETTING_OWNERSHIP_ERROR)
 
 		r.Log.Error(
 			err,
@@ -319,28 +517,40 @@ func (r *SopsSecretReconciler) newKubeSecretFromTemplate(
 			"sopssecret", req.NamespacedName,
 		)
 
-		return nil, true
+		return nil, true, statusErr
 	}
 
-	return kubeSecretFromTemplate, false
+	return kubeSecretFromTemplate, false, nil
 }
 
 func (r *SopsSecretReconciler) isSecretSuspended(
 	ctx context.Context, encryptedSopsSecret *isindirv1alpha3.SopsSecret, req ctrl.Request,
-) bool {
+) (bool, error) {
+	reason, err := r.suspendReason(ctx, encryptedSopsSecret)
+	if err != nil {
+		r.Log.Error(err, "Failed to check if reconciliation is suspended", "sopssecret", req.NamespacedName)
+		return false, goerrors.Join(err, r.UpdateSopsSecretStatus(ctx, encryptedSopsSecret, STATUS_UNKNOWN_ERROR))
+	}
+
+	r.setSuspended(encryptedSopsSecret, reason)
 	// Return early if SopsSecret object is suspended.
-	if encryptedSopsSecret.Spec.Suspend {
+	if reason != "" {
 		r.Log.V(0).Info(
-			"Reconciliation is suspended for this object",
+			suspendMessage(reason, encryptedSopsSecret.Namespace),
 			"sopssecret", req.NamespacedName,
+			"reason", reason,
 		)
 
-		r.UpdateSopsSecretStatus(ctx, encryptedSopsSecret, STATUS_RECONCILE_SUSPENDED)
+		if err := r.UpdateSopsSecretStatus(ctx, encryptedSopsSecret, STATUS_RECONCILE_SUSPENDED); err != nil {
+			// Suspended SopsSecret is not requeued, retry to persist status
+			r.Log.Error(err, "Failed to update SopsSecret status", "sopssecret", req.NamespacedName)
+			return true, err
+		}
 
-		return true
+		return true, nil
 	}
 
-	return false
+	return false, nil
 }
 
 func (r *SopsSecretReconciler) getEncryptedSopsSecret(
@@ -359,6 +569,11 @@ func (r *SopsSecretReconciler) getEncryptedSopsSecret(
 				"sopssecret",
 				req.NamespacedName,
 			)
+			sopsSecretsTemplatesExpiringSoon.DeleteLabelValues(req.Namespace, req.Name)
+			sopsSecretsSuspended.DeletePartialMatch(prometheus.Labels{"namespace": req.Namespace, "name": req.Name})
+			sopsSecretsDataKeyCreated.DeleteLabelValues(req.Namespace, req.Name)
+			sopsSecretsRecipients.DeletePartialMatch(prometheus.Labels{"namespace": req.Namespace, "name": req.Name})
+			sopsSecretsDecryptedBy.DeletePartialMatch(prometheus.Labels{"namespace": req.Namespace, "name": req.Name})
 			return nil, true, nil
 		}
 
@@ -381,7 +596,11 @@ func (r *SopsSecretReconciler) garbageCollectOrphanedSecrets(
 ) error {
 	r.Log.V(0).Info("Orphan secret cleanup started", "sopssecret", req.NamespacedName)
 	var namespaceSecrets corev1.SecretList
-	if err := r.List(ctx, &namespaceSecrets, client.InNamespace(req.Namespace)); err != nil {
+	if err := r.List(
+		ctx, &namespaceSecrets,
+		client.InNamespace(req.Namespace),
+		client.MatchingFields{secretOwnerUIDIndex: string(encryptedSopsSecret.UID)},
+	); err != nil {
 		return err
 	}
 
@@ -394,7 +613,10 @@ func (r *SopsSecretReconciler) garbageCollectOrphanedSecrets(
 		if metav1.IsControlledBy(&secret, encryptedSopsSecret) && !expectedSecrets[secret.Name] {
 			if err := r.Delete(ctx, &secret); err != nil {
 				r.Log.Error(err, "Failed to delete orphaned secret", "sopssecret", req.NamespacedName, "secret", secret.Name, "namespace", secret.Namespace)
+				r.auditSecretWrite(encryptedSopsSecret, audit.ActionDelete, secret.Name, nil, STATUS_CHILD_UPDATE_ERROR)
+				continue
 			}
+			r.auditSecretWrite(encryptedSopsSecret, audit.ActionDelete, secret.Name, nil, "")
 			r.Log.V(0).Info("Garbage collected an orphaned secret", "sopssecret", req.NamespacedName, "secret", secret.Name, "namespace", secret.Namespace)
 		}
 	}
@@ -403,6 +625,22 @@ func (r *SopsSecretReconciler) garbageCollectOrphanedSecrets(
 	return nil
 }
 
+// secretOwnerUIDIndex is the name of secrets field index holding UID of
+// controlling SopsSecret
+const secretOwnerUIDIndex = ".metadata.controller.sopsSecretUID"
+
+// indexSecretOwnerUID returns UID of SopsSecret controlling the secret
+func indexSecretOwnerUID(object client.Object) []string {
+	owner := metav1.GetControllerOf(object)
+	if owner == nil || owner.Kind != "SopsSecret" {
+		return nil
+	}
+	if gv, err := schema.ParseGroupVersion(owner.APIVersion); err != nil || gv.Group != isindirv1alpha3.GroupVersion.Group {
+		return nil
+	}
+	return []string{string(owner.UID)}
+}
+
 // checks if the annotation equals to "true", and it's case sensitive
 func isAnnotatedToBeManaged(secret *corev1.Secret) bool {
 	return secret.Annotations[isindirv1alpha3.SopsSecretManagedAnnotation] == "true"
@@ -434,10 +672,56 @@ func (r *SopsSecretReconciler) SetupWithManager(mgr ctrl.Manager) error {
 		sopslogging.Loggers[k].Out = io.Discard
 	}
 
-	return ctrl.NewControllerManagedBy(mgr).
+	// Children of a SopsSecret are listed by index of controller owner UID
+	if err := mgr.GetFieldIndexer().IndexField(
+		context.Background(), &corev1.Secret{}, secretOwnerUIDIndex, indexSecretOwnerUID,
+	); err != nil {
+		return err
+	}
+
+	rateLimiter := workqueue.DefaultTypedControllerRateLimiter[reconcile.Request]()
+	if r.BackoffBaseDelay > 0 && r.BackoffMaxDelay > 0 {
+		rateLimiter = workqueue.NewTypedItemExponentialFailureRateLimiter[reconcile.Request](
+			r.BackoffBaseDelay, r.BackoffMaxDelay,
+		)
+	}
+	controllerOptions := controller.Options{
+		MaxConcurrentReconciles: r.MaxConcurrentReconciles,
+		RateLimiter:             rateLimiter,
+	}
+
+	controllerBuilder := ctrl.NewControllerManagedBy(mgr).
 		For(&isindirv1alpha3.SopsSecret{}, sopsPredicates).
 		Owns(&corev1.Secret{}, secretPredicates).
-		Complete(r)
+		WithOptions(controllerOptions)
+
+	// Reconcile SopsSecrets on events originating outside the cluster
+	r.requeues = make(chan event.GenericEvent, requeueBufferSize)
+	controllerBuilder = controllerBuilder.WatchesRawSource(
+		source.Channel(r.requeues, &handler.EnqueueRequestForObject{}),
+	)
+
+	// Reconcile all SopsSecrets when the pause ConfigMap changes
+	if r.PauseConfigMap != "" {
+		controllerBuilder = controllerBuilder.Watches(
+			&corev1.ConfigMap{},
+			handler.EnqueueRequestsFromMapFunc(r.enqueueAllSopsSecrets),
+			builder.WithPredicates(predicate.NewPredicateFuncs(func(object client.Object) bool {
+				return object.GetNamespace() == r.OperatorNamespace && object.GetName() == r.PauseConfigMap
+			})),
+		)
+	}
+
+	// Reconcile SopsSecrets in a namespace when its annotations change
+	if r.NamespaceSuspend {
+		controllerBuilder = controllerBuilder.Watches(
+			&corev1.Namespace{},
+			handler.EnqueueRequestsFromMapFunc(r.enqueueNamespaceSopsSecrets),
+			builder.WithPredicates(predicate.AnnotationChangedPredicate{}),
+		)
+	}
+
+	return controllerBuilder.Complete(r)
 }
 
 // createKubeSecretFromTemplate returns new Kubernetes secret object, created from decrypted SopsSecret Template
@@ -457,6 +741,7 @@ func createKubeSecretFromTemplate(
 
 	kubeSecretType := getSecretType(sopsSecretTemplate.Type)
 	labels := cloneMap(sopsSecretTemplate.Labels)
+	labels[isindirv1alpha3.SopsSecretManagedLabel] = "true"
 	annotations := cloneMap(sopsSecretTemplate.Annotations)
 
 	logger.V(1).Info("Processing",
@@ -476,6 +761,8 @@ func createKubeSecretFromTemplate(
 		Type:       kubeSecretType,
 		StringData: strData,
 	}
+	setContentHash(secret)
+	setLastApplied(secret)
 	return secret, nil
 }
 
@@ -509,43 +796,186 @@ func getSecretType(templateSecretType string) corev1.SecretType {
 	return corev1.SecretType(templateSecretType)
 }
 
-// decryptSopsSecretInstance decrypts spec.secretTemplates
+// DecryptSopsSecret decrypts spec.secretTemplates with the key material available
+// to the current process, the same way the controller does during reconciliation.
+// If verifyMAC is set, sops MAC is verified as with spec.verifyMac.
+func DecryptSopsSecret(encryptedSopsSecret *isindirv1alpha3.SopsSecret, verifyMAC bool) (*isindirv1alpha3.SopsSecret, error) {
+	decryptedSopsSecret, _, err := decryptSopsSecretInstance(encryptedSopsSecret, verifyMAC, nil, logr.Discard())
+	return decryptedSopsSecret, err
+}
+
+// DecryptSopsSecretWithPolicies decrypts SopsSecret as DecryptSopsSecret does,
+// keys which decrypt the data key must be allowed by recipient policies.
+// Keys which decrypted the data key are returned.
+func DecryptSopsSecretWithPolicies(
+	encryptedSopsSecret *isindirv1alpha3.SopsSecret, verifyMAC bool, recipientPolicies *RecipientPolicies,
+) (*isindirv1alpha3.SopsSecret, []audit.Key, error) {
+	return decryptSopsSecretInstance(encryptedSopsSecret, verifyMAC, recipientPolicies, logr.Discard())
+}
+
+// ValidateSecretTemplate returns the error the controller would report when
+// creating a child secret from the given decrypted template.
+func ValidateSecretTemplate(
+	sopsSecret *isindirv1alpha3.SopsSecret,
+	sopsSecretTemplate *isindirv1alpha3.SopsSecretTemplate,
+) error {
+	_, err := createKubeSecretFromTemplate(sopsSecret, sopsSecretTemplate, logr.Discard())
+	return err
+}
+
+// SecretTemplateData returns values of decrypted secret template, the same
+// values the controller writes to the child secret.
+func SecretTemplateData(sopsSecretTemplate *isindirv1alpha3.SopsSecretTemplate) (map[string]string, error) {
+	return cloneTemplateData(sopsSecretTemplate.StringData, sopsSecretTemplate.Data)
+}
+
+// sopsDocument is the part of SopsSecret passed to sops for decryption. Other
+// fields are either set by Kubernetes (metadata, status) or can not be
+// encrypted (apiVersion, kind, spec.suspend), passing them to sops would make
+// unencrypted_suffix and unencrypted_regex selectors try to decrypt them.
+type sopsDocument struct {
+	Spec struct {
+		SecretsTemplate []isindirv1alpha3.SopsSecretTemplate `json:"secretTemplates"`
+	} `json:"spec"`
+	Sops isindirv1alpha3.SopsMetadata `json:"sops"`
+}
+
+// decryptSopsSecretInstance decrypts spec.secretTemplates, keys which decrypt
+// the data key must be allowed by recipientPolicies
 func decryptSopsSecretInstance(
 	encryptedSopsSecret *isindirv1alpha3.SopsSecret,
+	verifyMAC bool,
+	recipientPolicies *RecipientPolicies,
 	logger logr.Logger,
-) (*isindirv1alpha3.SopsSecret, error) {
-	sopsSecretAsBytes, err := json.Marshal(encryptedSopsSecret)
+) (*isindirv1alpha3.SopsSecret, []audit.Key, error) {
+	// Metadata of newer sops may use format the embedded sops does not know
+	if err := CheckSopsVersion(encryptedSopsSecret.Sops.Version); err != nil {
+		logger.Error(
+			err,
+			"Refusing to decrypt sops secret encrypted by unsupported sops version",
+			"sopssecret", fmt.Sprintf("%s/%s", encryptedSopsSecret.Namespace, encryptedSopsSecret.Name),
+		)
+		return nil, nil, err
+	}
+
+	encryptedDocument := sopsDocument{Sops: encryptedSopsSecret.Sops}
+	encryptedDocument.Spec.SecretsTemplate = encryptedSopsSecret.Spec.SecretsTemplate
+	sopsSecretAsBytes, err := json.Marshal(encryptedDocument)
 	if err != nil {
 		logger.Error(
 			err,
 			"Failed to convert encrypted sops secret to bytes[]",
 			"sopssecret", fmt.Sprintf("%s/%s", encryptedSopsSecret.Namespace, encryptedSopsSecret.Name),
 		)
-		return nil, err
+		return nil, nil, err
+	}
+
+	sopsSecretAsBytes, err = canonicalJSON(sopsSecretAsBytes)
+	if err != nil {
+		logger.Error(
+			err,
+			"Failed to convert encrypted sops secret to canonical form",
+			"sopssecret", fmt.Sprintf("%s/%s", encryptedSopsSecret.Namespace, encryptedSopsSecret.Name),
+		)
+		return nil, nil, err
 	}
 
-	decryptedSopsSecretAsBytes, err := customDecryptData(sopsSecretAsBytes, "json")
+	// MAC of files encrypted by sops covers the whole object
+	var macData []byte
+	if verifyMAC {
+		if macData, err = macDocument(encryptedSopsSecret); err != nil {
+			logger.Error(
+				err,
+				"Failed to convert encrypted sops secret to bytes[]",
+				"sopssecret", fmt.Sprintf("%s/%s", encryptedSopsSecret.Namespace, encryptedSopsSecret.Name),
+			)
+			return nil, nil, err
+		}
+	}
+
+	decryptedSopsSecretAsBytes, keys, err := customDecryptData(sopsSecretAsBytes, "json", macData, recipientPolicies)
 	if err != nil {
 		logger.Error(
 			err,
 			"Failed to Decrypt encrypted sops secret decryptedSopsSecret",
 			"sopssecret", fmt.Sprintf("%s/%s", encryptedSopsSecret.Namespace, encryptedSopsSecret.Name),
 		)
-		return nil, err
+		return nil, keys, err
 	}
 
-	decryptedSopsSecret := &isindirv1alpha3.SopsSecret{}
-	err = json.Unmarshal(decryptedSopsSecretAsBytes, &decryptedSopsSecret)
+	decryptedDocument := sopsDocument{}
+	err = json.Unmarshal(decryptedSopsSecretAsBytes, &decryptedDocument)
 	if err != nil {
 		logger.Error(
 			err,
 			"Failed to Unmarshal decrypted sops secret decryptedSopsSecret",
 			"sopssecret", fmt.Sprintf("%s/%s", encryptedSopsSecret.Namespace, encryptedSopsSecret.Name),
 		)
+		return nil, keys, err
+	}
+	decryptedSopsSecret := encryptedSopsSecret.DeepCopy()
+	decryptedSopsSecret.Spec.SecretsTemplate = decryptedDocument.Spec.SecretsTemplate
+	decryptedSopsSecret.Sops = isindirv1alpha3.SopsMetadata{}
+
+	// Values selected by comment regexes are left as is by sops, because
+	// Kubernetes API does not preserve comments. Refuse to create child
+	// secrets with sops ciphertext in them.
+	if field := findEncryptedTemplateValue(decryptedSopsSecret.Spec.SecretsTemplate); field != "" {
+		err = fmt.Errorf(
+			"%s is still encrypted after decryption, check sops metadata selectors: comments are not preserved by Kubernetes",
+			field,
+		)
+		logger.Error(
+			err,
+			"Failed to Decrypt encrypted sops secret decryptedSopsSecret",
+			"sopssecret", fmt.Sprintf("%s/%s", encryptedSopsSecret.Namespace, encryptedSopsSecret.Name),
+		)
+		return nil, keys, err
+	}
+
+	return decryptedSopsSecret, keys, nil
+}
+
+// canonicalJSON re-encodes JSON document with keys of all objects sorted, the
+// order Kubernetes API returns keys of custom resources in. Lists keep their
+// order.
+func canonicalJSON(document []byte) ([]byte, error) {
+	var value interface{}
+	if err := json.Unmarshal(document, &value); err != nil {
 		return nil, err
 	}
+	return json.Marshal(value)
+}
 
-	return decryptedSopsSecret, nil
+// findEncryptedTemplateValue returns the path of the first template field
+// which is still in sops encrypted format, or empty string
+func findEncryptedTemplateValue(templates []isindirv1alpha3.SopsSecretTemplate) string {
+	for i, template := range templates {
+		path := fmt.Sprintf("spec.secretTemplates[%d]", i)
+		if strings.HasPrefix(template.Name, sopsEncryptedValuePrefix) {
+			return path + ".name"
+		}
+		if strings.HasPrefix(template.Type, sopsEncryptedValuePrefix) {
+			return path + ".type"
+		}
+		fields := []struct {
+			name   string
+			values map[string]string
+		}{
+			{"annotations", template.Annotations},
+			{"labels", template.Labels},
+			{"data", template.Data},
+			{"stringData", template.StringData},
+		}
+		for _, field := range fields {
+			for key, value := range field.values {
+				if strings.HasPrefix(value, sopsEncryptedValuePrefix) {
+					return fmt.Sprintf("%s.%s.%s", path, field.name, key)
+				}
+			}
+		}
+	}
+	return ""
 }
 
 // Data is a helper that takes encrypted data and a format string,
@@ -554,8 +984,11 @@ func decryptSopsSecretInstance(
 // If the format string is empty, binary format is assumed.
 // NOTE: this function is taken from sops code and adjusted
 //
-//	to ignore mac, as CR will always be mutated in k8s
-func customDecryptData(data []byte, format string) (cleartext []byte, err error) {
+//	to ignore mac, as CR will always be mutated in k8s, unless macData, the
+//	object as written to the file, is set (see verifyDocumentMAC)
+func customDecryptData(
+	data []byte, format string, macData []byte, recipientPolicies *RecipientPolicies,
+) (cleartext []byte, keys []audit.Key, err error) {
 	// Initialize a Sops JSON store
 	var store sops.Store
 
@@ -573,22 +1006,45 @@ func customDecryptData(data []byte, format string) (cleartext []byte, err error)
 	// Load SOPS file and access the data key
 	tree, err := store.LoadEncryptedFile(data)
 	if err != nil {
-		return nil, err
+		return nil, nil, err
+	}
+	keyService := newKeyService(recipientPolicies)
+	key, err := tree.Metadata.GetDataKeyWithKeyServices([]keyservice.KeyServiceClient{keyService}, nil)
+	if deniedErr := keyService.deniedErr(); err != nil && deniedErr != nil {
+		return nil, nil, deniedErr
 	}
-	key, err := tree.Metadata.GetDataKey()
 	if userErr, ok := err.(sops.UserError); ok {
 		err = fmt.Errorf("sops user error: %s", userErr.UserError())
 	}
 	if err != nil {
-		return nil, err
+		return nil, nil, err
 	}
+	keys = keyService.usedKeys()
 
 	// Decrypt the tree
 	cipher := sopsaes.NewCipher()
-	_, err = tree.Decrypt(key, cipher)
+	mac, err := tree.Decrypt(key, cipher)
 	if err != nil {
-		return nil, err
+		return nil, keys, err
+	}
+
+	if macData != nil {
+		if tree.Metadata.MessageAuthenticationCode == "" {
+			return nil, keys, fmt.Errorf("%w: sops metadata has no mac", ErrMACMismatch)
+		}
+		originalMac, err := cipher.Decrypt(
+			tree.Metadata.MessageAuthenticationCode,
+			key,
+			tree.Metadata.LastModified.Format(time.RFC3339),
+		)
+		if err != nil {
+			return nil, keys, fmt.Errorf("%w: failed to decrypt original mac: %w", ErrMACMismatch, err)
+		}
+		if err := verifyDocumentMAC(store, data, tree, mac, macData, key, fmt.Sprint(originalMac)); err != nil {
+			return nil, keys, err
+		}
 	}
 
-	return store.EmitPlainFile(tree.Branches)
+	cleartext, err = store.EmitPlainFile(tree.Branches)
+	return cleartext, keys, err
 }
@@ -26,6 +26,11 @@ var _ = Describe("SopssecretController", func() {
 	TestSecretObject02 := &isindirv1alpha3.SopsSecret{}
 	TestSecretObject03 := &isindirv1alpha3.SopsSecret{}
 	TestSecretObject04 := &isindirv1alpha3.SopsSecret{}
+	TestSecretObject05 := &isindirv1alpha3.SopsSecret{}
+	TestSecretObject06 := &isindirv1alpha3.SopsSecret{}
+	TestSecretObject07 := &isindirv1alpha3.SopsSecret{}
+	TestSecretObject08 := &isindirv1alpha3.SopsSecret{}
+	TestSecretObject09 := &isindirv1alpha3.SopsSecret{}
 	BeforeEach(func() {
 		// 00 secret
 		content, err := os.ReadFile(filepath.Join("..", "..", "config", "age-test-key", "00-test-secrets.yaml"))
@@ -66,6 +71,46 @@ var _ = Describe("SopssecretController", func() {
 		obj, _, err = scheme.Codecs.UniversalDeserializer().Decode(content, nil, nil)
 		TestSecretObject04 = obj.(*isindirv1alpha3.SopsSecret)
 		Expect(err).Should(BeNil())
+
+		// 05 secret (encrypted with 3 key groups and shamir threshold 2)
+		content, err = os.ReadFile(filepath.Join("..", "..", "config", "age-test-key", "05-test-secrets-key-groups.yaml"))
+		Expect(err).Should(BeNil())
+
+		obj, _, err = scheme.Codecs.UniversalDeserializer().Decode(content, nil, nil)
+		TestSecretObject05 = obj.(*isindirv1alpha3.SopsSecret)
+		Expect(err).Should(BeNil())
+
+		// 06 secret (encrypted with sops --unencrypted-suffix)
+		content, err = os.ReadFile(filepath.Join("..", "..", "config", "age-test-key", "06-test-secrets-unencrypted-suffix.yaml"))
+		Expect(err).Should(BeNil())
+
+		obj, _, err = scheme.Codecs.UniversalDeserializer().Decode(content, nil, nil)
+		TestSecretObject06 = obj.(*isindirv1alpha3.SopsSecret)
+		Expect(err).Should(BeNil())
+
+		// 07 secret (encrypted with sops --unencrypted-regex)
+		content, err = os.ReadFile(filepath.Join("..", "..", "config", "age-test-key", "07-test-secrets-unencrypted-regex.yaml"))
+		Expect(err).Should(BeNil())
+
+		obj, _, err = scheme.Codecs.UniversalDeserializer().Decode(content, nil, nil)
+		TestSecretObject07 = obj.(*isindirv1alpha3.SopsSecret)
+		Expect(err).Should(BeNil())
+
+		// 08 secret (encrypted with sops --encrypted-comment-regex)
+		content, err = os.ReadFile(filepath.Join("..", "..", "config", "age-test-key", "08-test-secrets-encrypted-comment-regex.yaml"))
+		Expect(err).Should(BeNil())
+
+		obj, _, err = scheme.Codecs.UniversalDeserializer().Decode(content, nil, nil)
+		TestSecretObject08 = obj.(*isindirv1alpha3.SopsSecret)
+		Expect(err).Should(BeNil())
+
+		// 09 secret (encrypted with sops --mac-only-encrypted, spec.verifyMac set)
+		content, err = os.ReadFile(filepath.Join("..", "..", "config", "age-test-key", "09-test-secrets-verify-mac.yaml"))
+		Expect(err).Should(BeNil())
+
+		obj, _, err = scheme.Codecs.UniversalDeserializer().Decode(content, nil, nil)
+		TestSecretObject09 = obj.(*isindirv1alpha3.SopsSecret)
+		Expect(err).Should(BeNil())
 	})
 
 	// Define utility constants for object names and testing timeouts/durations and intervals.
@@ -348,6 +393,153 @@ var _ = Describe("SopssecretController", func() {
 		})
 	})
 
+	Context("When Creating SopsSecret encrypted with key groups and shamir threshold", func() {
+		It("Should keep key groups and decrypt the managed secret using SopsSecret 05", func() {
+			ctx := context.Background()
+
+			By("By creating a new SopsSecret version 05 with key_groups and shamir_threshold set")
+			Expect(controller.K8sClient.Create(ctx, TestSecretObject05)).To(Succeed())
+
+			By("By checking that status of the SopsSecret is Healthy")
+			sourceSopsSecretNamespacedName := types.NamespacedName{Namespace: "default", Name: "test-sopssecret-05"}
+			Eventually(func(g Gomega) {
+				sourceSopsSecret := &isindirv1alpha3.SopsSecret{}
+				g.Expect(controller.K8sClient.Get(ctx, sourceSopsSecretNamespacedName, sourceSopsSecret)).To(Succeed())
+				g.Expect(sourceSopsSecret.Status.Message).To(Equal("Healthy"))
+				// Only 2 of 3 key groups can be decrypted with the test key, so
+				// decryption succeeds only if both fields survive CRD pruning.
+				g.Expect(sourceSopsSecret.Sops.KeyGroups).To(HaveLen(3))
+				g.Expect(sourceSopsSecret.Sops.ShamirThreshold).To(Equal(2))
+			}, timeout, interval).Should(Succeed())
+
+			By("By checking the decrypted content of the managed k8s secret")
+			managedSecretNamespacedName := types.NamespacedName{Namespace: "default", Name: "test-key-groups-token"}
+			Eventually(func(g Gomega) {
+				managedSecret := &corev1.Secret{}
+				g.Expect(controller.K8sClient.Get(ctx, managedSecretNamespacedName, managedSecret)).To(Succeed())
+				g.Expect(string(managedSecret.Data["token"])).To(Equal("shamirKeyGroupsPlaintextValue1234567890"))
+			}, timeout, interval).Should(Succeed())
+
+			By("By deleting SopsSecret version 05")
+			Expect(controller.K8sClient.Delete(ctx, TestSecretObject05)).To(Succeed())
+		})
+	})
+
+	Context("When Creating SopsSecret encrypted with --unencrypted-suffix", func() {
+		It("Should keep unencrypted_suffix and decrypt the managed secret using SopsSecret 06", func() {
+			ctx := context.Background()
+
+			By("By creating a new SopsSecret version 06 with unencrypted_suffix set")
+			Expect(controller.K8sClient.Create(ctx, TestSecretObject06)).To(Succeed())
+
+			By("By checking that status of the SopsSecret is Healthy")
+			sourceSopsSecretNamespacedName := types.NamespacedName{Namespace: "default", Name: "test-sopssecret-06"}
+			Eventually(func(g Gomega) {
+				sourceSopsSecret := &isindirv1alpha3.SopsSecret{}
+				g.Expect(controller.K8sClient.Get(ctx, sourceSopsSecretNamespacedName, sourceSopsSecret)).To(Succeed())
+				g.Expect(sourceSopsSecret.Status.Message).To(Equal("Healthy"))
+				g.Expect(sourceSopsSecret.Sops.UnencryptedSuffix).To(Equal("_unencrypted"))
+			}, timeout, interval).Should(Succeed())
+
+			By("By checking the decrypted and unencrypted content of the managed k8s secret")
+			managedSecretNamespacedName := types.NamespacedName{Namespace: "default", Name: "test-unencrypted-suffix-token"}
+			Eventually(func(g Gomega) {
+				managedSecret := &corev1.Secret{}
+				g.Expect(controller.K8sClient.Get(ctx, managedSecretNamespacedName, managedSecret)).To(Succeed())
+				g.Expect(string(managedSecret.Data["token"])).To(Equal("unencryptedSuffixPlaintextValue1234567890"))
+				g.Expect(string(managedSecret.Data["comment_unencrypted"])).To(Equal("left unencrypted by unencrypted_suffix"))
+			}, timeout, interval).Should(Succeed())
+
+			By("By deleting SopsSecret version 06")
+			Expect(controller.K8sClient.Delete(ctx, TestSecretObject06)).To(Succeed())
+		})
+	})
+
+	Context("When Creating SopsSecret encrypted with --unencrypted-regex", func() {
+		It("Should keep unencrypted_regex and decrypt the managed secret using SopsSecret 07", func() {
+			ctx := context.Background()
+
+			By("By creating a new SopsSecret version 07 with unencrypted_regex set")
+			Expect(controller.K8sClient.Create(ctx, TestSecretObject07)).To(Succeed())
+
+			By("By checking that status of the SopsSecret is Healthy")
+			sourceSopsSecretNamespacedName := types.NamespacedName{Namespace: "default", Name: "test-sopssecret-07"}
+			Eventually(func(g Gomega) {
+				sourceSopsSecret := &isindirv1alpha3.SopsSecret{}
+				g.Expect(controller.K8sClient.Get(ctx, sourceSopsSecretNamespacedName, sourceSopsSecret)).To(Succeed())
+				g.Expect(sourceSopsSecret.Status.Message).To(Equal("Healthy"))
+				g.Expect(sourceSopsSecret.Sops.UnencryptedRegex).To(Equal("^(apiVersion|kind|metadata|labels)$"))
+			}, timeout, interval).Should(Succeed())
+
+			By("By checking the decrypted content and unencrypted labels of the managed k8s secret")
+			managedSecretNamespacedName := types.NamespacedName{Namespace: "default", Name: "test-unencrypted-regex-token"}
+			Eventually(func(g Gomega) {
+				managedSecret := &corev1.Secret{}
+				g.Expect(controller.K8sClient.Get(ctx, managedSecretNamespacedName, managedSecret)).To(Succeed())
+				g.Expect(string(managedSecret.Data["token"])).To(Equal("unencryptedRegexPlaintextValue1234567890"))
+				g.Expect(managedSecret.Labels["app"]).To(Equal("left-unencrypted-by-unencrypted-regex"))
+			}, timeout, interval).Should(Succeed())
+
+			By("By deleting SopsSecret version 07")
+			Expect(controller.K8sClient.Delete(ctx, TestSecretObject07)).To(Succeed())
+		})
+	})
+
+	Context("When Creating SopsSecret encrypted with --encrypted-comment-regex", func() {
+		It("Should keep encrypted_comment_regex and refuse to create secret with ciphertext using SopsSecret 08", func() {
+			ctx := context.Background()
+
+			By("By creating a new SopsSecret version 08 with encrypted_comment_regex set")
+			Expect(controller.K8sClient.Create(ctx, TestSecretObject08)).To(Succeed())
+
+			By("By checking that status of the SopsSecret is Decryption error, as comments are not preserved")
+			sourceSopsSecretNamespacedName := types.NamespacedName{Namespace: "default", Name: "test-sopssecret-08"}
+			Eventually(func(g Gomega) {
+				sourceSopsSecret := &isindirv1alpha3.SopsSecret{}
+				g.Expect(controller.K8sClient.Get(ctx, sourceSopsSecretNamespacedName, sourceSopsSecret)).To(Succeed())
+				g.Expect(sourceSopsSecret.Status.Message).To(Equal("Decryption error"))
+				g.Expect(sourceSopsSecret.Sops.EncryptedCommentRegex).To(Equal("sops:enc"))
+			}, timeout, interval).Should(Succeed())
+
+			By("By checking that the managed k8s secret is not created")
+			managedSecretNamespacedName := types.NamespacedName{Namespace: "default", Name: "test-encrypted-comment-regex-token"}
+			Consistently(func() error {
+				return controller.K8sClient.Get(ctx, managedSecretNamespacedName, &corev1.Secret{})
+			}, time.Second*2, interval).ShouldNot(Succeed())
+
+			By("By deleting SopsSecret version 08")
+			Expect(controller.K8sClient.Delete(ctx, TestSecretObject08)).To(Succeed())
+		})
+	})
+
+	Context("When Creating SopsSecret with spec.verifyMac and swapped encrypted values", func() {
+		It("Should refuse to sync secrets using SopsSecret 09", func() {
+			ctx := context.Background()
+
+			By("By creating a new SopsSecret version 09 with encrypted values swapped between templates")
+			templates := TestSecretObject09.Spec.SecretsTemplate
+			templates[0].StringData, templates[1].StringData = templates[1].StringData, templates[0].StringData
+			Expect(controller.K8sClient.Create(ctx, TestSecretObject09)).To(Succeed())
+
+			By("By checking that status of the SopsSecret is MAC verification error")
+			sourceSopsSecretNamespacedName := types.NamespacedName{Namespace: "default", Name: "test-sopssecret-09"}
+			Eventually(func(g Gomega) {
+				sourceSopsSecret := &isindirv1alpha3.SopsSecret{}
+				g.Expect(controller.K8sClient.Get(ctx, sourceSopsSecretNamespacedName, sourceSopsSecret)).To(Succeed())
+				g.Expect(sourceSopsSecret.Status.Message).To(Equal("MAC verification error"))
+			}, timeout, interval).Should(Succeed())
+
+			By("By checking that the managed k8s secrets are not created")
+			managedSecretNamespacedName := types.NamespacedName{Namespace: "default", Name: "test-verify-mac-first-token"}
+			Consistently(func() error {
+				return controller.K8sClient.Get(ctx, managedSecretNamespacedName, &corev1.Secret{})
+			}, time.Second*2, interval).ShouldNot(Succeed())
+
+			By("By deleting SopsSecret version 09")
+			Expect(controller.K8sClient.Delete(ctx, TestSecretObject09)).To(Succeed())
+		})
+	})
+
 	// TODO: check pre-existing k8s secret being taken over by SopsSecret using sops managed annotation
 	// TODO: check that sopssecret is suspended correctly - not processed - "Reconciliation is suspended"
 	// TODO: check the error message is "createKubeSecretFromTemplate(): secret template name must be specified and not empty string".
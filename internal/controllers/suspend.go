@@ -0,0 +1,171 @@
+/* This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at https://mozilla.org/MPL/2.0/. */
+
+package controllers
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/prometheus/client_golang/prometheus"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/api/meta"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/reconcile"
+
+	isindirv1alpha3 "github.com/isindir/sops-secrets-operator/api/v1alpha3"
+)
+
+const (
+	// PauseConfigMapKey is the key of the pause ConfigMap, reconciliation of
+	// all SopsSecrets is paused while its value is "true"
+	PauseConfigMapKey = "paused"
+
+	// SuspendReasonOperatorPaused - reconciliation is paused by the pause ConfigMap
+	SuspendReasonOperatorPaused = "OperatorPaused"
+	// SuspendReasonNamespaceSuspended - namespace is annotated with sopssecret/suspend
+	SuspendReasonNamespaceSuspended = "NamespaceSuspended"
+	// SuspendReasonSopsSecretSuspended - spec.suspend of SopsSecret is set
+	SuspendReasonSopsSecretSuspended = "SopsSecretSuspended"
+)
+
+// Suspension configures which suspensions of SopsSecrets apply, shared by the
+// reconciler and the CSI provider
+type Suspension struct {
+	// NamespaceSuspend suspends SopsSecrets in namespaces annotated with
+	// sopssecret/suspend
+	NamespaceSuspend bool
+	// OperatorNamespace is the namespace of the pause ConfigMap
+	OperatorNamespace string
+	// PauseConfigMap pauses all SopsSecrets while its paused key is "true"
+	PauseConfigMap string
+}
+
+// SuspendReason returns the reason SopsSecret is suspended, empty string when
+// it is not suspended. paused is set by operator configuration file. Global
+// pause takes precedence over namespace suspension, which takes precedence
+// over spec.suspend.
+func (s Suspension) SuspendReason(
+	ctx context.Context, reader client.Reader, paused bool, sopsSecret *isindirv1alpha3.SopsSecret,
+) (string, error) {
+	if !paused && s.PauseConfigMap != "" {
+		// Missing ConfigMap means the operator is not paused
+		configMap := &corev1.ConfigMap{}
+		err := reader.Get(ctx, types.NamespacedName{Namespace: s.OperatorNamespace, Name: s.PauseConfigMap}, configMap)
+		if err != nil && !errors.IsNotFound(err) {
+			return "", err
+		}
+		paused = err == nil && configMap.Data[PauseConfigMapKey] == "true"
+	}
+	if paused {
+		return SuspendReasonOperatorPaused, nil
+	}
+
+	if s.NamespaceSuspend {
+		namespace := &corev1.Namespace{}
+		if err := reader.Get(ctx, types.NamespacedName{Name: sopsSecret.Namespace}, namespace); err != nil {
+			return "", err
+		}
+		if namespace.Annotations[isindirv1alpha3.SopsSecretSuspendAnnotation] == "true" {
+			return SuspendReasonNamespaceSuspended, nil
+		}
+	}
+
+	if sopsSecret.Spec.Suspend {
+		return SuspendReasonSopsSecretSuspended, nil
+	}
+	return "", nil
+}
+
+// suspendReason returns the reason reconciliation of SopsSecret is suspended
+// and sets the metric of the global pause
+func (r *SopsSecretReconciler) suspendReason(
+	ctx context.Context, encryptedSopsSecret *isindirv1alpha3.SopsSecret,
+) (string, error) {
+	suspension := Suspension{
+		NamespaceSuspend:  r.NamespaceSuspend,
+		OperatorNamespace: r.OperatorNamespace,
+		PauseConfigMap:    r.PauseConfigMap,
+	}
+	reason, err := suspension.SuspendReason(ctx, r, r.paused.Load(), encryptedSopsSecret)
+	if err != nil {
+		return "", err
+	}
+	if reason == SuspendReasonOperatorPaused {
+		sopsSecretsOperatorPaused.Set(1)
+	} else {
+		sopsSecretsOperatorPaused.Set(0)
+	}
+	return reason, nil
+}
+
+// SetPaused pauses or resumes reconciliation of all SopsSecrets as set by
+// operator configuration file, all SopsSecrets are re-enqueued on change
+func (r *SopsSecretReconciler) SetPaused(ctx context.Context, paused bool) {
+	if r.paused.Swap(paused) == paused {
+		return
+	}
+	r.Log.V(0).Info("Reconciliation of all SopsSecrets is paused by operator configuration", "paused", paused)
+	r.requeueSopsSecrets(ctx, func(*isindirv1alpha3.SopsSecret) bool { return true })
+}
+
+// suspendMessage returns the message of Suspended condition for the reason
+func suspendMessage(reason string, namespace string) string {
+	switch reason {
+	case SuspendReasonOperatorPaused:
+		return "Reconciliation of all SopsSecrets is paused"
+	case SuspendReasonNamespaceSuspended:
+		return fmt.Sprintf("Reconciliation is suspended for namespace %s", namespace)
+	default:
+		return "Reconciliation is suspended for this object"
+	}
+}
+
+// setSuspended sets or removes Suspended condition and metric, reason is empty
+// when SopsSecret is not suspended
+func (r *SopsSecretReconciler) setSuspended(sopsSecret *isindirv1alpha3.SopsSecret, reason string) {
+	sopsSecretsSuspended.DeletePartialMatch(prometheus.Labels{"namespace": sopsSecret.Namespace, "name": sopsSecret.Name})
+
+	if reason == "" {
+		meta.RemoveStatusCondition(&sopsSecret.Status.Conditions, isindirv1alpha3.ConditionTypeSuspended)
+		return
+	}
+	sopsSecretsSuspended.WithLabelValues(sopsSecret.Namespace, sopsSecret.Name, reason).Set(1)
+	meta.SetStatusCondition(&sopsSecret.Status.Conditions, metav1.Condition{
+		Type:               isindirv1alpha3.ConditionTypeSuspended,
+		Status:             metav1.ConditionTrue,
+		ObservedGeneration: sopsSecret.Generation,
+		Reason:             reason,
+		Message:            suspendMessage(reason, sopsSecret.Namespace),
+	})
+}
+
+// enqueueAllSopsSecrets maps change of the pause ConfigMap to requests for all
+// SopsSecrets, so that they are reconciled when the pause is lifted
+func (r *SopsSecretReconciler) enqueueAllSopsSecrets(ctx context.Context, _ client.Object) []reconcile.Request {
+	return r.sopsSecretRequests(ctx)
+}
+
+// enqueueNamespaceSopsSecrets maps change of a Namespace to requests for all
+// SopsSecrets in that namespace
+func (r *SopsSecretReconciler) enqueueNamespaceSopsSecrets(ctx context.Context, namespace client.Object) []reconcile.Request {
+	return r.sopsSecretRequests(ctx, client.InNamespace(namespace.GetName()))
+}
+
+func (r *SopsSecretReconciler) sopsSecretRequests(ctx context.Context, opts ...client.ListOption) []reconcile.Request {
+	sopsSecrets := &isindirv1alpha3.SopsSecretList{}
+	if err := r.List(ctx, sopsSecrets, opts...); err != nil {
+		r.Log.Error(err, "Failed to list SopsSecrets")
+		return nil
+	}
+
+	requests := make([]reconcile.Request, 0, len(sopsSecrets.Items))
+	for _, sopsSecret := range sopsSecrets.Items {
+		requests = append(requests, reconcile.Request{NamespacedName: client.ObjectKeyFromObject(&sopsSecret)})
+	}
+	return requests
+}
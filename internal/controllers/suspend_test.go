@@ -0,0 +1,157 @@
+/* This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at https://mozilla.org/MPL/2.0/. */
+
+package controllers
+
+import (
+	"context"
+	"testing"
+
+	"github.com/go-logr/logr"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/meta"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	clientgoscheme "k8s.io/client-go/kubernetes/scheme"
+	"sigs.k8s.io/controller-runtime/pkg/client/fake"
+	"sigs.k8s.io/controller-runtime/pkg/event"
+
+	isindirv1alpha3 "github.com/isindir/sops-secrets-operator/api/v1alpha3"
+)
+
+func TestSuspendReason(t *testing.T) {
+	scheme := runtime.NewScheme()
+	if err := clientgoscheme.AddToScheme(scheme); err != nil {
+		t.Fatal(err)
+	}
+
+	pauseConfigMap := func(paused string) *corev1.ConfigMap {
+		return &corev1.ConfigMap{
+			ObjectMeta: metav1.ObjectMeta{Name: "pause", Namespace: "operator"},
+			Data:       map[string]string{PauseConfigMapKey: paused},
+		}
+	}
+	namespace := func(annotations map[string]string) *corev1.Namespace {
+		return &corev1.Namespace{ObjectMeta: metav1.ObjectMeta{Name: "default", Annotations: annotations}}
+	}
+	suspendedNamespace := namespace(map[string]string{isindirv1alpha3.SopsSecretSuspendAnnotation: "true"})
+
+	tests := []struct {
+		name             string
+		objects          []runtime.Object
+		namespaceSuspend bool
+		suspend          bool
+		expected         string
+	}{
+		{
+			name:     "Not suspended - no pause ConfigMap",
+			objects:  []runtime.Object{namespace(nil)},
+			expected: "",
+		},
+		{
+			name:     "Not suspended - pause ConfigMap not set to true",
+			objects:  []runtime.Object{pauseConfigMap("false"), namespace(nil)},
+			expected: "",
+		},
+		{
+			name:     "Paused - takes precedence over spec.suspend",
+			objects:  []runtime.Object{pauseConfigMap("true"), namespace(nil)},
+			suspend:  true,
+			expected: SuspendReasonOperatorPaused,
+		},
+		{
+			name:             "Namespace suspended",
+			objects:          []runtime.Object{suspendedNamespace},
+			namespaceSuspend: true,
+			expected:         SuspendReasonNamespaceSuspended,
+		},
+		{
+			name:     "Namespace annotation ignored when namespace suspension is disabled",
+			objects:  []runtime.Object{suspendedNamespace},
+			expected: "",
+		},
+		{
+			name:             "Object suspended",
+			objects:          []runtime.Object{namespace(nil)},
+			namespaceSuspend: true,
+			suspend:          true,
+			expected:         SuspendReasonSopsSecretSuspended,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := &SopsSecretReconciler{
+				Client:            fake.NewClientBuilder().WithScheme(scheme).WithRuntimeObjects(tt.objects...).Build(),
+				Log:               logr.Discard(),
+				OperatorNamespace: "operator",
+				PauseConfigMap:    "pause",
+				NamespaceSuspend:  tt.namespaceSuspend,
+			}
+			sopsSecret := &isindirv1alpha3.SopsSecret{
+				ObjectMeta: metav1.ObjectMeta{Name: "sopssecret", Namespace: "default"},
+				Spec:       isindirv1alpha3.SopsSecretSpec{Suspend: tt.suspend},
+			}
+
+			reason, err := r.suspendReason(context.Background(), sopsSecret)
+			if err != nil {
+				t.Fatalf("suspendReason() error = %v", err)
+			}
+			if reason != tt.expected {
+				t.Errorf("suspendReason() = %q, expected %q", reason, tt.expected)
+			}
+		})
+	}
+}
+
+func TestSetSuspended(t *testing.T) {
+	r := &SopsSecretReconciler{}
+	sopsSecret := &isindirv1alpha3.SopsSecret{ObjectMeta: metav1.ObjectMeta{Name: "sopssecret", Namespace: "default"}}
+
+	r.setSuspended(sopsSecret, SuspendReasonNamespaceSuspended)
+	condition := meta.FindStatusCondition(sopsSecret.Status.Conditions, isindirv1alpha3.ConditionTypeSuspended)
+	if condition == nil || condition.Reason != SuspendReasonNamespaceSuspended {
+		t.Fatalf("expected Suspended condition with NamespaceSuspended reason, got %v", sopsSecret.Status.Conditions)
+	}
+
+	r.setSuspended(sopsSecret, "")
+	if meta.FindStatusCondition(sopsSecret.Status.Conditions, isindirv1alpha3.ConditionTypeSuspended) != nil {
+		t.Errorf("expected Suspended condition to be removed, got %v", sopsSecret.Status.Conditions)
+	}
+}
+
+func TestSetPaused(t *testing.T) {
+	scheme := runtime.NewScheme()
+	if err := isindirv1alpha3.AddToScheme(scheme); err != nil {
+		t.Fatal(err)
+	}
+	sopsSecret := &isindirv1alpha3.SopsSecret{ObjectMeta: metav1.ObjectMeta{Name: "sopssecret", Namespace: "default"}}
+	r := &SopsSecretReconciler{
+		Client:   fake.NewClientBuilder().WithScheme(scheme).WithRuntimeObjects(sopsSecret).Build(),
+		Log:      logr.Discard(),
+		requeues: make(chan event.GenericEvent, 10),
+	}
+
+	r.SetPaused(context.Background(), true)
+	if reason, err := r.suspendReason(context.Background(), sopsSecret); err != nil || reason != SuspendReasonOperatorPaused {
+		t.Errorf("expected OperatorPaused reason, got %q %v", reason, err)
+	}
+	if len(r.requeues) != 1 {
+		t.Errorf("expected SopsSecrets to be re-enqueued when paused, got %d", len(r.requeues))
+	}
+
+	// Unchanged pause does not re-enqueue
+	r.SetPaused(context.Background(), true)
+	if len(r.requeues) != 1 {
+		t.Errorf("expected SopsSecrets not to be re-enqueued again, got %d", len(r.requeues))
+	}
+
+	r.SetPaused(context.Background(), false)
+	if reason, err := r.suspendReason(context.Background(), sopsSecret); err != nil || reason != "" {
+		t.Errorf("expected SopsSecret not to be suspended, got %q %v", reason, err)
+	}
+	if len(r.requeues) != 2 {
+		t.Errorf("expected SopsSecrets to be re-enqueued when resumed, got %d", len(r.requeues))
+	}
+}
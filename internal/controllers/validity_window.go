@@ -0,0 +1,193 @@
+/* This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at https://mozilla.org/MPL/2.0/. */
+
+package controllers
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"time"
+
+	"k8s.io/apimachinery/pkg/api/meta"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	ctrl "sigs.k8s.io/controller-runtime"
+
+	isindirv1alpha3 "github.com/isindir/sops-secrets-operator/api/v1alpha3"
+)
+
+// DefaultExpiryWarningWindow is the default time before expiresAt of a secret
+// template when ExpiringSoon condition is set
+const DefaultExpiryWarningWindow = 72 * time.Hour
+
+// validityWindows is the result of applying notBefore and expiresAt of secret
+// templates at a point in time
+type validityWindows struct {
+	// templates to sync, templates outside of their window are left out, expired
+	// templates with Blank policy have values blanked
+	templates []isindirv1alpha3.SopsSecretTemplate
+	// nextBoundary is the earliest notBefore, expiresAt or start of warning
+	// window after now, zero if there is none, the reconciler also adds time
+	// the data key exceeds maximum age
+	nextBoundary time.Time
+	// expiringSoon lists templates expiring within the warning window
+	expiringSoon []string
+}
+
+func parseWindowTime(templateName, field, value string) (time.Time, error) {
+	if value == "" {
+		return time.Time{}, nil
+	}
+	t, err := time.Parse(time.RFC3339, value)
+	if err != nil {
+		return time.Time{}, fmt.Errorf("secret template %s: invalid %s: %w", templateName, field, err)
+	}
+	return t, nil
+}
+
+// applyValidityWindows filters secret templates by their validity windows
+func applyValidityWindows(
+	templates []isindirv1alpha3.SopsSecretTemplate, now time.Time, warningWindow time.Duration,
+) (*validityWindows, error) {
+	result := &validityWindows{}
+	addBoundary := func(t time.Time) {
+		result.addBoundary(t, now)
+	}
+
+	for _, template := range templates {
+		notBefore, err := parseWindowTime(template.Name, "notBefore", template.NotBefore)
+		if err != nil {
+			return nil, err
+		}
+		expiresAt, err := parseWindowTime(template.Name, "expiresAt", template.ExpiresAt)
+		if err != nil {
+			return nil, err
+		}
+		switch template.ExpiryPolicy {
+		case "", isindirv1alpha3.ExpiryPolicyDelete, isindirv1alpha3.ExpiryPolicyBlank:
+		default:
+			return nil, fmt.Errorf(
+				"secret template %s: invalid expiryPolicy %q, must be one of %s, %s",
+				template.Name, template.ExpiryPolicy, isindirv1alpha3.ExpiryPolicyDelete, isindirv1alpha3.ExpiryPolicyBlank,
+			)
+		}
+		if !notBefore.IsZero() && !expiresAt.IsZero() && !expiresAt.After(notBefore) {
+			return nil, fmt.Errorf("secret template %s: expiresAt must be after notBefore", template.Name)
+		}
+
+		if !notBefore.IsZero() && now.Before(notBefore) {
+			addBoundary(notBefore)
+			addBoundary(expiresAt.Add(-warningWindow))
+			addBoundary(expiresAt)
+			continue
+		}
+
+		if !expiresAt.IsZero() && !now.Before(expiresAt) {
+			if template.ExpiryPolicy == isindirv1alpha3.ExpiryPolicyBlank {
+				result.templates = append(result.templates, blankTemplate(template))
+			}
+			continue
+		}
+
+		if !expiresAt.IsZero() {
+			if !now.Before(expiresAt.Add(-warningWindow)) {
+				result.expiringSoon = append(
+					result.expiringSoon,
+					fmt.Sprintf("%s expires at %s", template.Name, expiresAt.UTC().Format(time.RFC3339)),
+				)
+			} else {
+				addBoundary(expiresAt.Add(-warningWindow))
+			}
+			addBoundary(expiresAt)
+		}
+		result.templates = append(result.templates, template)
+	}
+	return result, nil
+}
+
+// SecretTemplatesInEffect returns secret templates within their validity
+// window at now, the same templates the controller syncs to child secrets
+func SecretTemplatesInEffect(
+	templates []isindirv1alpha3.SopsSecretTemplate, now time.Time,
+) ([]isindirv1alpha3.SopsSecretTemplate, error) {
+	windows, err := applyValidityWindows(templates, now, 0)
+	if err != nil {
+		return nil, err
+	}
+	return windows.templates, nil
+}
+
+// blankTemplate returns copy of template with all values set to empty strings,
+// keys are kept as some Secret types require them
+func blankTemplate(template isindirv1alpha3.SopsSecretTemplate) isindirv1alpha3.SopsSecretTemplate {
+	blanked := *template.DeepCopy()
+	blanked.StringData = map[string]string{}
+	for key := range template.StringData {
+		blanked.StringData[key] = ""
+	}
+	for key := range template.Data {
+		blanked.StringData[key] = ""
+	}
+	blanked.Data = nil
+	return blanked
+}
+
+// addBoundary sets nextBoundary to t when it is after now and before current
+// nextBoundary
+func (w *validityWindows) addBoundary(t time.Time, now time.Time) {
+	if t.After(now) && (w.nextBoundary.IsZero() || t.Before(w.nextBoundary)) {
+		w.nextBoundary = t
+	}
+}
+
+// requeueAt returns reconciliation result which requeues at the next window boundary
+func (w *validityWindows) requeueAt(now time.Time) ctrl.Result {
+	if w.nextBoundary.IsZero() {
+		return ctrl.Result{}
+	}
+	// Requeue a second later, so that the boundary has been passed
+	return ctrl.Result{RequeueAfter: w.nextBoundary.Sub(now) + time.Second}
+}
+
+// applyValidityWindows filters secret templates of decrypted SopsSecret and
+// updates status on failure, returning the error of status update
+func (r *SopsSecretReconciler) applyValidityWindows(
+	ctx context.Context,
+	req ctrl.Request,
+	encryptedSopsSecret *isindirv1alpha3.SopsSecret,
+	plainTextSopsSecret *isindirv1alpha3.SopsSecret,
+	now time.Time,
+) (*validityWindows, bool, error) {
+	warningWindow := r.ExpiryWarningWindow
+	if warningWindow == 0 {
+		warningWindow = DefaultExpiryWarningWindow
+	}
+
+	windows, err := applyValidityWindows(plainTextSopsSecret.Spec.SecretsTemplate, now, warningWindow)
+	if err != nil {
+		statusErr := r.UpdateSopsSecretStatus(ctx, encryptedSopsSecret, STATUS_INVALID_VALIDITY_WINDOW)
+		r.Log.Error(err, "Invalid secret template validity window", "sopssecret", req.NamespacedName)
+		return nil, false, statusErr
+	}
+	return windows, true, nil
+}
+
+// setExpiringSoonCondition sets or removes ExpiringSoon condition and metric
+func (r *SopsSecretReconciler) setExpiringSoonCondition(
+	sopsSecret *isindirv1alpha3.SopsSecret, windows *validityWindows,
+) {
+	sopsSecretsTemplatesExpiringSoon.WithLabelValues(sopsSecret.Namespace, sopsSecret.Name).Set(float64(len(windows.expiringSoon)))
+
+	if len(windows.expiringSoon) == 0 {
+		meta.RemoveStatusCondition(&sopsSecret.Status.Conditions, isindirv1alpha3.ConditionTypeExpiringSoon)
+		return
+	}
+	meta.SetStatusCondition(&sopsSecret.Status.Conditions, metav1.Condition{
+		Type:               isindirv1alpha3.ConditionTypeExpiringSoon,
+		Status:             metav1.ConditionTrue,
+		ObservedGeneration: sopsSecret.Generation,
+		Reason:             "SecretTemplatesExpiringSoon",
+		Message:            strings.Join(windows.expiringSoon, ", "),
+	})
+}
@@ -0,0 +1,143 @@
+/* This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at https://mozilla.org/MPL/2.0/. */
+
+package controllers
+
+import (
+	"testing"
+	"time"
+
+	"k8s.io/apimachinery/pkg/api/meta"
+
+	isindirv1alpha3 "github.com/isindir/sops-secrets-operator/api/v1alpha3"
+)
+
+func TestApplyValidityWindows(t *testing.T) {
+	now := time.Date(2026, 1, 10, 12, 0, 0, 0, time.UTC)
+	at := func(d time.Duration) string {
+		return now.Add(d).Format(time.RFC3339)
+	}
+	window := 24 * time.Hour
+
+	tests := []struct {
+		name                 string
+		template             isindirv1alpha3.SopsSecretTemplate
+		expectedSynced       bool
+		expectedBlank        bool
+		expectedExpiringSoon bool
+		expectedNextBoundary time.Duration
+		expectedErr          bool
+	}{
+		{
+			name:           "No window - synced, no requeue",
+			template:       isindirv1alpha3.SopsSecretTemplate{Name: "s"},
+			expectedSynced: true,
+		},
+		{
+			name:                 "Before notBefore - not synced, requeue at notBefore",
+			template:             isindirv1alpha3.SopsSecretTemplate{Name: "s", NotBefore: at(time.Hour)},
+			expectedNextBoundary: time.Hour,
+		},
+		{
+			name:                 "Inside window - synced, requeue at warning window start",
+			template:             isindirv1alpha3.SopsSecretTemplate{Name: "s", NotBefore: at(-time.Hour), ExpiresAt: at(48 * time.Hour)},
+			expectedSynced:       true,
+			expectedNextBoundary: 24 * time.Hour,
+		},
+		{
+			name:                 "Inside warning window - synced, expiring soon, requeue at expiresAt",
+			template:             isindirv1alpha3.SopsSecretTemplate{Name: "s", ExpiresAt: at(2 * time.Hour)},
+			expectedSynced:       true,
+			expectedExpiringSoon: true,
+			expectedNextBoundary: 2 * time.Hour,
+		},
+		{
+			name:     "Expired with default policy - deleted",
+			template: isindirv1alpha3.SopsSecretTemplate{Name: "s", ExpiresAt: at(-time.Second)},
+		},
+		{
+			name: "Expired with Blank policy - synced with blank values",
+			template: isindirv1alpha3.SopsSecretTemplate{
+				Name:         "s",
+				ExpiresAt:    at(0),
+				ExpiryPolicy: isindirv1alpha3.ExpiryPolicyBlank,
+				StringData:   map[string]string{"password": "secret"},
+				Data:         map[string]string{"token": "c2VjcmV0"},
+			},
+			expectedSynced: true,
+			expectedBlank:  true,
+		},
+		{
+			name:        "Invalid time - error",
+			template:    isindirv1alpha3.SopsSecretTemplate{Name: "s", ExpiresAt: "tomorrow"},
+			expectedErr: true,
+		},
+		{
+			name:        "Invalid policy - error",
+			template:    isindirv1alpha3.SopsSecretTemplate{Name: "s", ExpiryPolicy: "Keep"},
+			expectedErr: true,
+		},
+		{
+			name:        "expiresAt before notBefore - error",
+			template:    isindirv1alpha3.SopsSecretTemplate{Name: "s", NotBefore: at(time.Hour), ExpiresAt: at(0)},
+			expectedErr: true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			windows, err := applyValidityWindows([]isindirv1alpha3.SopsSecretTemplate{tt.template}, now, window)
+			if tt.expectedErr {
+				if err == nil {
+					t.Fatal("expected error, got nil")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("expected no error, got %v", err)
+			}
+
+			if synced := len(windows.templates) == 1; synced != tt.expectedSynced {
+				t.Fatalf("expected synced %t, got %t", tt.expectedSynced, synced)
+			}
+			if tt.expectedBlank {
+				synced := windows.templates[0]
+				if len(synced.Data) != 0 || synced.StringData["password"] != "" || synced.StringData["token"] != "" ||
+					len(synced.StringData) != 2 {
+					t.Errorf("expected blank values with keys kept, got %v %v", synced.StringData, synced.Data)
+				}
+				if tt.template.StringData["password"] != "secret" {
+					t.Error("expected original template not to be modified")
+				}
+			}
+			if expiringSoon := len(windows.expiringSoon) > 0; expiringSoon != tt.expectedExpiringSoon {
+				t.Errorf("expected expiring soon %t, got %v", tt.expectedExpiringSoon, windows.expiringSoon)
+			}
+
+			result := windows.requeueAt(now)
+			expectedRequeue := time.Duration(0)
+			if tt.expectedNextBoundary != 0 {
+				expectedRequeue = tt.expectedNextBoundary + time.Second
+			}
+			if result.RequeueAfter != expectedRequeue {
+				t.Errorf("expected requeue after %s, got %s", expectedRequeue, result.RequeueAfter)
+			}
+		})
+	}
+}
+
+func TestSetExpiringSoonCondition(t *testing.T) {
+	r := &SopsSecretReconciler{}
+	sopsSecret := &isindirv1alpha3.SopsSecret{}
+
+	r.setExpiringSoonCondition(sopsSecret, &validityWindows{expiringSoon: []string{"s expires at 2026-01-10T14:00:00Z"}})
+	if !meta.IsStatusConditionTrue(sopsSecret.Status.Conditions, isindirv1alpha3.ConditionTypeExpiringSoon) {
+		t.Fatalf("expected ExpiringSoon condition to be set, got %v", sopsSecret.Status.Conditions)
+	}
+
+	r.setExpiringSoonCondition(sopsSecret, &validityWindows{})
+	if meta.FindStatusCondition(sopsSecret.Status.Conditions, isindirv1alpha3.ConditionTypeExpiringSoon) != nil {
+		t.Errorf("expected ExpiringSoon condition to be removed, got %v", sopsSecret.Status.Conditions)
+	}
+}
@@ -0,0 +1,173 @@
+/* This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at https://mozilla.org/MPL/2.0/. */
+
+package controllers
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/go-logr/logr"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"sigs.k8s.io/yaml"
+
+	isindirv1alpha3 "github.com/isindir/sops-secrets-operator/api/v1alpha3"
+)
+
+func TestShouldVerifyMAC(t *testing.T) {
+	tests := []struct {
+		name           string
+		globalVerify   bool
+		specVerify     bool
+		expectedResult bool
+	}{
+		{name: "Global false, spec false - should return false", expectedResult: false},
+		{name: "Global false, spec true - should return true", specVerify: true, expectedResult: true},
+		{name: "Global true, spec false - should return true (spec can not opt out)", globalVerify: true, expectedResult: true},
+		{name: "Global true, spec true - should return true", globalVerify: true, specVerify: true, expectedResult: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := &SopsSecretReconciler{VerifyMAC: tt.globalVerify}
+			sopsSecret := &isindirv1alpha3.SopsSecret{
+				Spec: isindirv1alpha3.SopsSecretSpec{VerifyMac: tt.specVerify},
+			}
+
+			if result := r.shouldVerifyMAC(sopsSecret); result != tt.expectedResult {
+				t.Errorf("shouldVerifyMAC() = %v, expected %v", result, tt.expectedResult)
+			}
+		})
+	}
+}
+
+func readTestSopsSecret(t *testing.T, name string) *isindirv1alpha3.SopsSecret {
+	t.Helper()
+	content, err := os.ReadFile(filepath.Join("..", "..", "config", "age-test-key", name))
+	if err != nil {
+		t.Fatal(err)
+	}
+	sopsSecret := &isindirv1alpha3.SopsSecret{}
+	if err := yaml.Unmarshal(content, sopsSecret); err != nil {
+		t.Fatal(err)
+	}
+	return sopsSecret
+}
+
+func TestDecryptSopsSecretInstanceVerifyMAC(t *testing.T) {
+	setAgeKeyFile(t, filepath.Join("..", "..", "config", "age-test-key", "key-file.txt"))
+
+	tests := []struct {
+		name        string
+		file        string
+		verifyMAC   bool
+		mutate      func(sopsSecret *isindirv1alpha3.SopsSecret)
+		expectedErr error
+	}{
+		{
+			name:      "Unmodified object - MAC matches",
+			file:      "09-test-secrets-verify-mac.yaml",
+			verifyMAC: true,
+		},
+		{
+			name:      "Object encrypted by sops with --mac-only-encrypted - MAC matches",
+			file:      "04-test-secrets-mac-only.yaml",
+			verifyMAC: true,
+		},
+		{
+			name:      "Server added fields - MAC matches",
+			file:      "09-test-secrets-verify-mac.yaml",
+			verifyMAC: true,
+			mutate: func(sopsSecret *isindirv1alpha3.SopsSecret) {
+				sopsSecret.UID = "uid"
+				sopsSecret.ResourceVersion = "42"
+				sopsSecret.ManagedFields = []metav1.ManagedFieldsEntry{{Manager: "kubectl"}}
+				sopsSecret.Annotations = map[string]string{"kubectl.kubernetes.io/last-applied-configuration": "{}"}
+				sopsSecret.Status.Message = STATUS_HEALTHY
+			},
+		},
+		{
+			name:      "Encrypted values swapped between templates - MAC mismatch",
+			file:      "09-test-secrets-verify-mac.yaml",
+			verifyMAC: true,
+			mutate: func(sopsSecret *isindirv1alpha3.SopsSecret) {
+				templates := sopsSecret.Spec.SecretsTemplate
+				templates[0].StringData, templates[1].StringData = templates[1].StringData, templates[0].StringData
+			},
+			expectedErr: ErrMACMismatch,
+		},
+		{
+			name:      "Templates reordered - MAC mismatch",
+			file:      "09-test-secrets-verify-mac.yaml",
+			verifyMAC: true,
+			mutate: func(sopsSecret *isindirv1alpha3.SopsSecret) {
+				templates := sopsSecret.Spec.SecretsTemplate
+				templates[0], templates[1] = templates[1], templates[0]
+			},
+			expectedErr: ErrMACMismatch,
+		},
+		{
+			name:      "Template deleted - MAC mismatch",
+			file:      "09-test-secrets-verify-mac.yaml",
+			verifyMAC: true,
+			mutate: func(sopsSecret *isindirv1alpha3.SopsSecret) {
+				sopsSecret.Spec.SecretsTemplate = sopsSecret.Spec.SecretsTemplate[:1]
+			},
+			expectedErr: ErrMACMismatch,
+		},
+		{
+			name:      "Object encrypted by sops without sorted keys and --mac-only-encrypted - MAC matches",
+			file:      "00-test-secrets.yaml",
+			verifyMAC: true,
+		},
+		{
+			name:      "Object encrypted without --mac-only-encrypted, server added fields - MAC matches",
+			file:      "00-test-secrets.yaml",
+			verifyMAC: true,
+			mutate: func(sopsSecret *isindirv1alpha3.SopsSecret) {
+				sopsSecret.TypeMeta = metav1.TypeMeta{}
+				sopsSecret.UID = "uid"
+				sopsSecret.Annotations = map[string]string{"kubectl.kubernetes.io/last-applied-configuration": "{}"}
+				sopsSecret.Status.Message = STATUS_HEALTHY
+			},
+		},
+		{
+			name:      "Object encrypted without --mac-only-encrypted, unencrypted value changed - MAC mismatch",
+			file:      "00-test-secrets.yaml",
+			verifyMAC: true,
+			mutate: func(sopsSecret *isindirv1alpha3.SopsSecret) {
+				sopsSecret.Name = "renamed"
+			},
+			expectedErr: ErrMACMismatch,
+		},
+		{
+			name:      "Encrypted values swapped, verification disabled - decrypted",
+			file:      "09-test-secrets-verify-mac.yaml",
+			verifyMAC: false,
+			mutate: func(sopsSecret *isindirv1alpha3.SopsSecret) {
+				templates := sopsSecret.Spec.SecretsTemplate
+				templates[0].StringData, templates[1].StringData = templates[1].StringData, templates[0].StringData
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			sopsSecret := readTestSopsSecret(t, tt.file)
+			if tt.mutate != nil {
+				tt.mutate(sopsSecret)
+			}
+
+			_, _, err := decryptSopsSecretInstance(sopsSecret, tt.verifyMAC, nil, logr.Discard())
+			if tt.expectedErr == nil && err != nil {
+				t.Errorf("decryptSopsSecretInstance() error = %v, expected nil", err)
+			}
+			if tt.expectedErr != nil && !errors.Is(err, tt.expectedErr) {
+				t.Errorf("decryptSopsSecretInstance() error = %v, expected %v", err, tt.expectedErr)
+			}
+		})
+	}
+}
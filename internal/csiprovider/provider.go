@@ -0,0 +1,352 @@
+/* This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at https://mozilla.org/MPL/2.0/. */
+
+// Package csiprovider implements Secrets Store CSI driver provider serving
+// decrypted SopsSecret templates straight into pod volumes, without creating
+// Kubernetes Secrets
+package csiprovider
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	goerrors "errors"
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"runtime/debug"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/go-logr/logr"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/apimachinery/pkg/util/validation"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+
+	isindirv1alpha3 "github.com/isindir/sops-secrets-operator/api/v1alpha3"
+	"github.com/isindir/sops-secrets-operator/internal/audit"
+	"github.com/isindir/sops-secrets-operator/internal/controllers"
+	"github.com/isindir/sops-secrets-operator/internal/csiprovider/v1alpha1"
+)
+
+const (
+	// ProviderName is the provider name used in SecretProviderClass spec.provider
+	ProviderName = "sops-secrets-operator"
+	// DefaultProvidersDir is the directory where the driver looks for provider sockets
+	DefaultProvidersDir = "/etc/kubernetes/secrets-store-csi-providers"
+
+	// SopsSecretParameter is the SecretProviderClass parameter naming the SopsSecret
+	SopsSecretParameter = "sopsSecret"
+	// SecretTemplateParameter is the SecretProviderClass parameter naming the
+	// secret template, optional when SopsSecret has a single template
+	SecretTemplateParameter = "secretTemplate"
+	// NamespaceParameter is the optional SecretProviderClass parameter naming
+	// SopsSecret namespace, it must be the namespace of the pod
+	NamespaceParameter = "namespace"
+
+	podNameAttribute      = "csi.storage.k8s.io/pod.name"
+	podNamespaceAttribute = "csi.storage.k8s.io/pod.namespace"
+
+	providerAPIVersion = "v1alpha1"
+)
+
+// Provider serves decrypted SopsSecret templates to Secrets Store CSI driver
+type Provider struct {
+	// Reader reads SopsSecrets, namespaces and SopsSecretPolicies
+	Reader client.Reader
+	// VerifyMAC verifies sops MAC of all SopsSecrets, as --verify-mac of the operator
+	VerifyMAC bool
+	// RecipientPolicy is one of controllers.RecipientPolicyModes
+	RecipientPolicy string
+	// Suspension refuses mounts of SopsSecrets the operator does not reconcile
+	Suspension controllers.Suspension
+	// Audit records every mount of a read SopsSecret, may be nil
+	Audit audit.Recorder
+	Log   logr.Logger
+
+	now func() time.Time
+}
+
+// Version returns provider API version and provider version
+func (p *Provider) Version(context.Context, *v1alpha1.VersionRequest) (*v1alpha1.VersionResponse, error) {
+	runtimeVersion := "(devel)"
+	if info, ok := debug.ReadBuildInfo(); ok && info.Main.Version != "" {
+		runtimeVersion = info.Main.Version
+	}
+	return &v1alpha1.VersionResponse{
+		Version:        providerAPIVersion,
+		RuntimeName:    ProviderName,
+		RuntimeVersion: runtimeVersion,
+	}, nil
+}
+
+// Mount returns values of the referenced secret template as files, one file
+// per key. SopsSecret is always read from the namespace of the pod, suspended
+// SopsSecrets are not mounted.
+func (p *Provider) Mount(ctx context.Context, req *v1alpha1.MountRequest) (*v1alpha1.MountResponse, error) {
+	attributes := map[string]string{}
+	if err := json.Unmarshal([]byte(req.Attributes), &attributes); err != nil {
+		return nil, status.Errorf(codes.InvalidArgument, "failed to parse attributes: %v", err)
+	}
+	permission := os.FileMode(0o644)
+	if req.Permission != "" {
+		if err := json.Unmarshal([]byte(req.Permission), &permission); err != nil {
+			return nil, status.Errorf(codes.InvalidArgument, "failed to parse permission: %v", err)
+		}
+	}
+
+	podNamespace := attributes[podNamespaceAttribute]
+	if podNamespace == "" {
+		return nil, status.Errorf(codes.InvalidArgument, "missing %s attribute", podNamespaceAttribute)
+	}
+	name := attributes[SopsSecretParameter]
+	if name == "" {
+		return nil, status.Errorf(codes.InvalidArgument, "missing %s parameter", SopsSecretParameter)
+	}
+	if namespace := attributes[NamespaceParameter]; namespace != "" && namespace != podNamespace {
+		return nil, status.Errorf(
+			codes.PermissionDenied, "SopsSecret namespace %s does not match pod namespace %s", namespace, podNamespace,
+		)
+	}
+	key := types.NamespacedName{Namespace: podNamespace, Name: name}
+	log := p.Log.WithValues("sopssecret", key, "pod", attributes[podNameAttribute])
+
+	encryptedSopsSecret := &isindirv1alpha3.SopsSecret{}
+	if err := p.Reader.Get(ctx, key, encryptedSopsSecret); err != nil {
+		if apierrors.IsNotFound(err) {
+			return nil, status.Errorf(codes.NotFound, "SopsSecret %s not found", key)
+		}
+		return nil, status.Errorf(codes.Internal, "failed to get SopsSecret %s: %v", key, err)
+	}
+	if encryptedSopsSecret.Namespace != podNamespace {
+		return nil, status.Errorf(
+			codes.PermissionDenied, "SopsSecret namespace %s does not match pod namespace %s",
+			encryptedSopsSecret.Namespace, podNamespace,
+		)
+	}
+
+	podName := attributes[podNameAttribute]
+	templateName := attributes[SecretTemplateParameter]
+	var decryptingKeys []audit.Key
+	fail := func(failureStatus string, err error) (*v1alpha1.MountResponse, error) {
+		p.audit(encryptedSopsSecret, podName, templateName, decryptingKeys, failureStatus)
+		return nil, err
+	}
+
+	reason, err := p.Suspension.SuspendReason(ctx, p.Reader, false, encryptedSopsSecret)
+	if err != nil {
+		return fail(codes.Internal.String(), status.Errorf(codes.Internal, "failed to check if SopsSecret %s is suspended: %v", key, err))
+	}
+	if reason != "" {
+		return fail(
+			controllers.STATUS_RECONCILE_SUSPENDED,
+			status.Errorf(codes.FailedPrecondition, "SopsSecret %s is suspended: %s", key, reason),
+		)
+	}
+
+	recipientPolicies, err := p.recipientPolicies(ctx, encryptedSopsSecret)
+	if err != nil {
+		if status.Code(err) == codes.PermissionDenied {
+			return fail(controllers.STATUS_RECIPIENTS_NOT_ALLOWED, err)
+		}
+		return fail(status.Code(err).String(), err)
+	}
+
+	plainTextSopsSecret, decryptingKeys, err := controllers.DecryptSopsSecretWithPolicies(
+		encryptedSopsSecret, p.VerifyMAC || encryptedSopsSecret.Spec.VerifyMac, recipientPolicies,
+	)
+	if err != nil {
+		log.Error(err, "Failed to decrypt SopsSecret")
+		var policyErr *controllers.RecipientPolicyError
+		switch {
+		case goerrors.As(err, &policyErr):
+			return fail(controllers.STATUS_RECIPIENTS_NOT_ALLOWED, status.Error(codes.PermissionDenied, err.Error()))
+		case goerrors.Is(err, controllers.ErrMACMismatch):
+			return fail(controllers.STATUS_MAC_MISMATCH, status.Errorf(codes.Internal, "failed to decrypt SopsSecret %s", key))
+		case goerrors.Is(err, controllers.ErrUnsupportedSopsVersion):
+			return fail(controllers.STATUS_SOPS_VERSION_ERROR, status.Errorf(codes.Internal, "failed to decrypt SopsSecret %s", key))
+		}
+		return fail(controllers.STATUS_DECRYPT_ERROR, status.Errorf(codes.Internal, "failed to decrypt SopsSecret %s", key))
+	}
+
+	template, err := p.selectTemplate(plainTextSopsSecret, templateName)
+	if err != nil {
+		return fail(status.Code(err).String(), err)
+	}
+	templateName = template.Name
+	data, err := controllers.SecretTemplateData(template)
+	if err != nil {
+		return fail(
+			codes.InvalidArgument.String(),
+			status.Errorf(codes.InvalidArgument, "secret template %s: %v", template.Name, err),
+		)
+	}
+
+	keys := make([]string, 0, len(data))
+	for k := range data {
+		if errs := validation.IsConfigMapKey(k); len(errs) > 0 {
+			return fail(codes.InvalidArgument.String(), status.Errorf(
+				codes.InvalidArgument, "secret template %s: invalid key %q: %s", template.Name, k, strings.Join(errs, ", "),
+			))
+		}
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	rsp := &v1alpha1.MountResponse{}
+	hash := sha256.New()
+	for _, k := range keys {
+		rsp.Files = append(rsp.Files, &v1alpha1.File{Path: k, Mode: int32(permission), Contents: []byte(data[k])})
+		_, _ = fmt.Fprintf(hash, "%d:%s%d:%s", len(k), k, len(data[k]), data[k])
+	}
+	rsp.ObjectVersion = []*v1alpha1.ObjectVersion{{
+		ID:      name + "/" + template.Name,
+		Version: hex.EncodeToString(hash.Sum(nil)),
+	}}
+
+	p.audit(encryptedSopsSecret, podName, template.Name, decryptingKeys, "")
+	log.V(1).Info("Mounted secret template", "templateItem", template.Name, "keys", keys)
+	return rsp, nil
+}
+
+// audit records mount of the secret template into pod volume, failureStatus
+// is empty on success
+func (p *Provider) audit(
+	sopsSecret *isindirv1alpha3.SopsSecret, podName string, templateName string, keys []audit.Key, failureStatus string,
+) {
+	if p.Audit == nil {
+		return
+	}
+	event := audit.Event{
+		Action:     audit.ActionMount,
+		Namespace:  sopsSecret.Namespace,
+		SopsSecret: sopsSecret.Name,
+		UID:        string(sopsSecret.UID),
+		Keys:       keys,
+		Secret:     templateName,
+		Pod:        podName,
+		Result:     audit.ResultSuccess,
+	}
+	if failureStatus != "" {
+		event.Result = audit.ResultFailure
+		event.Reason = failureStatus
+	}
+	p.Audit.Record(event)
+}
+
+// recipientPolicies checks SopsSecret recipients against SopsSecretPolicy
+// objects the same way the controller does, returned policies restrict keys
+// which may decrypt the data key
+func (p *Provider) recipientPolicies(
+	ctx context.Context, sopsSecret *isindirv1alpha3.SopsSecret,
+) (*controllers.RecipientPolicies, error) {
+	if p.RecipientPolicy == "" || p.RecipientPolicy == controllers.RecipientPolicyDisabled {
+		return nil, nil
+	}
+
+	namespace := &corev1.Namespace{}
+	if err := p.Reader.Get(ctx, types.NamespacedName{Name: sopsSecret.Namespace}, namespace); err != nil {
+		return nil, status.Errorf(codes.Internal, "failed to get namespace %s: %v", sopsSecret.Namespace, err)
+	}
+	policies := &isindirv1alpha3.SopsSecretPolicyList{}
+	if err := p.Reader.List(ctx, policies); err != nil {
+		return nil, status.Errorf(codes.Internal, "failed to list SopsSecretPolicy objects: %v", err)
+	}
+
+	selected, err := controllers.SelectRecipientPolicies(
+		namespace, policies.Items, p.RecipientPolicy == controllers.RecipientPolicyRequired,
+	)
+	if err == nil {
+		err = selected.CheckMetadata(&sopsSecret.Sops)
+	}
+	if err != nil {
+		var policyErr *controllers.RecipientPolicyError
+		if goerrors.As(err, &policyErr) {
+			return nil, status.Error(codes.PermissionDenied, err.Error())
+		}
+		return nil, status.Error(codes.Internal, err.Error())
+	}
+	return selected, nil
+}
+
+// selectTemplate returns secret template by name, which must be within its
+// validity window, name may be empty when SopsSecret has a single template
+func (p *Provider) selectTemplate(
+	sopsSecret *isindirv1alpha3.SopsSecret, templateName string,
+) (*isindirv1alpha3.SopsSecretTemplate, error) {
+	if templateName == "" {
+		if len(sopsSecret.Spec.SecretsTemplate) != 1 {
+			return nil, status.Errorf(
+				codes.InvalidArgument, "%s parameter is required, SopsSecret %s has %d secret templates",
+				SecretTemplateParameter, sopsSecret.Name, len(sopsSecret.Spec.SecretsTemplate),
+			)
+		}
+		templateName = sopsSecret.Spec.SecretsTemplate[0].Name
+	}
+
+	now := time.Now
+	if p.now != nil {
+		now = p.now
+	}
+	templates, err := controllers.SecretTemplatesInEffect(sopsSecret.Spec.SecretsTemplate, now())
+	if err != nil {
+		return nil, status.Error(codes.InvalidArgument, err.Error())
+	}
+	for i := range templates {
+		if templates[i].Name == templateName {
+			return &templates[i], nil
+		}
+	}
+	return nil, status.Errorf(
+		codes.NotFound, "secret template %s of SopsSecret %s not found or outside of its validity window",
+		templateName, sopsSecret.Name,
+	)
+}
+
+// Server serves Provider on unix socket
+type Server struct {
+	// Socket is the path of the unix socket, normally
+	// <DefaultProvidersDir>/<ProviderName>.sock
+	Socket   string
+	Provider *Provider
+}
+
+// Start serves until ctx is done
+func (s *Server) Start(ctx context.Context) error {
+	if err := os.MkdirAll(filepath.Dir(s.Socket), 0o755); err != nil {
+		return err
+	}
+	// Socket of a previous run is left behind when the process is killed
+	if err := os.Remove(s.Socket); err != nil && !goerrors.Is(err, os.ErrNotExist) {
+		return fmt.Errorf("failed to remove stale socket %s: %w", s.Socket, err)
+	}
+	listener, err := net.Listen("unix", s.Socket)
+	if err != nil {
+		return err
+	}
+
+	server := grpc.NewServer()
+	v1alpha1.RegisterCSIDriverProviderServer(server, s.Provider)
+
+	errs := make(chan error, 1)
+	go func() {
+		errs <- server.Serve(listener)
+	}()
+
+	select {
+	case err := <-errs:
+		return err
+	case <-ctx.Done():
+		server.GracefulStop()
+		return nil
+	}
+}
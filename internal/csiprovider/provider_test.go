@@ -0,0 +1,330 @@
+/* This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at https://mozilla.org/MPL/2.0/. */
+
+package csiprovider
+
+import (
+	"context"
+	"encoding/json"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"filippo.io/age"
+	"github.com/go-logr/logr"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/status"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	clientgoscheme "k8s.io/client-go/kubernetes/scheme"
+	"sigs.k8s.io/controller-runtime/pkg/client/fake"
+
+	isindirv1alpha3 "github.com/isindir/sops-secrets-operator/api/v1alpha3"
+	"github.com/isindir/sops-secrets-operator/internal/audit"
+	"github.com/isindir/sops-secrets-operator/internal/controllers"
+	"github.com/isindir/sops-secrets-operator/internal/csiprovider/v1alpha1"
+)
+
+type testAuditRecorder struct {
+	mu     sync.Mutex
+	events []audit.Event
+}
+
+func (r *testAuditRecorder) Record(event audit.Event) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.events = append(r.events, event)
+}
+
+func newEncryptedSopsSecret(
+	t *testing.T, name string, recipient string, templates ...isindirv1alpha3.SopsSecretTemplate,
+) *isindirv1alpha3.SopsSecret {
+	t.Helper()
+	sopsSecret := &isindirv1alpha3.SopsSecret{
+		ObjectMeta: metav1.ObjectMeta{Name: name, Namespace: "team-a"},
+		Spec:       isindirv1alpha3.SopsSecretSpec{SecretsTemplate: templates},
+	}
+	if err := controllers.EncryptSopsSecret(sopsSecret, []string{recipient}); err != nil {
+		t.Fatal(err)
+	}
+	return sopsSecret
+}
+
+func mountAttributes(t *testing.T, attributes map[string]string) string {
+	t.Helper()
+	attributes[podNamespaceAttribute] = "team-a"
+	attributes[podNameAttribute] = "app"
+	encoded, err := json.Marshal(attributes)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(encoded)
+}
+
+func TestProviderMount(t *testing.T) {
+	identity, err := age.GenerateX25519Identity()
+	if err != nil {
+		t.Fatal(err)
+	}
+	controllers.SetManagedAgeIdentities([]age.Identity{identity})
+	defer controllers.SetManagedAgeIdentities(nil)
+	recipient := identity.Recipient().String()
+
+	scheme := runtime.NewScheme()
+	if err := clientgoscheme.AddToScheme(scheme); err != nil {
+		t.Fatal(err)
+	}
+	if err := isindirv1alpha3.AddToScheme(scheme); err != nil {
+		t.Fatal(err)
+	}
+	reader := fake.NewClientBuilder().WithScheme(scheme).WithRuntimeObjects(
+		newEncryptedSopsSecret(t, "single", recipient, isindirv1alpha3.SopsSecretTemplate{
+			Name:       "db",
+			StringData: map[string]string{"password": "plain-text-password"},
+			Data:       map[string]string{"token": "dG9rZW4="},
+		}),
+		newEncryptedSopsSecret(t, "multiple", recipient,
+			isindirv1alpha3.SopsSecretTemplate{Name: "first", StringData: map[string]string{"a": "1"}},
+			isindirv1alpha3.SopsSecretTemplate{
+				Name:       "expired",
+				StringData: map[string]string{"b": "2"},
+				ExpiresAt:  time.Now().Add(-time.Hour).UTC().Format(time.RFC3339),
+			},
+		),
+	).Build()
+
+	socket := filepath.Join(t.TempDir(), ProviderName+".sock")
+	recorder := &testAuditRecorder{}
+	server := &Server{Socket: socket, Provider: &Provider{Reader: reader, Audit: recorder, Log: logr.Discard()}}
+	ctx, cancel := context.WithCancel(context.Background())
+	errs := make(chan error, 1)
+	go func() {
+		errs <- server.Start(ctx)
+	}()
+	defer func() {
+		cancel()
+		if err := <-errs; err != nil {
+			t.Errorf("Start() error = %v", err)
+		}
+	}()
+
+	conn, err := grpc.NewClient("unix://"+socket, grpc.WithTransportCredentials(insecure.NewCredentials()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() { _ = conn.Close() }()
+	provider := v1alpha1.NewCSIDriverProviderClient(conn)
+
+	callCtx, callCancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer callCancel()
+	version, err := provider.Version(callCtx, &v1alpha1.VersionRequest{Version: "v1alpha1"}, grpc.WaitForReady(true))
+	if err != nil {
+		t.Fatalf("Version() error = %v", err)
+	}
+	if version.RuntimeName != ProviderName || version.Version != "v1alpha1" {
+		t.Errorf("unexpected version response %+v", version)
+	}
+
+	tests := []struct {
+		name         string
+		attributes   map[string]string
+		expectedCode codes.Code
+		expected     map[string]string
+	}{
+		{
+			name:       "Single template is mounted without template parameter",
+			attributes: map[string]string{SopsSecretParameter: "single"},
+			expected:   map[string]string{"password": "plain-text-password", "token": "token"},
+		},
+		{
+			name:       "Template is selected by name",
+			attributes: map[string]string{SopsSecretParameter: "multiple", SecretTemplateParameter: "first"},
+			expected:   map[string]string{"a": "1"},
+		},
+		{
+			name:         "Template parameter is required with multiple templates",
+			attributes:   map[string]string{SopsSecretParameter: "multiple"},
+			expectedCode: codes.InvalidArgument,
+		},
+		{
+			name:         "Expired template is not mounted",
+			attributes:   map[string]string{SopsSecretParameter: "multiple", SecretTemplateParameter: "expired"},
+			expectedCode: codes.NotFound,
+		},
+		{
+			name:         "SopsSecret in other namespace is denied",
+			attributes:   map[string]string{SopsSecretParameter: "single", NamespaceParameter: "team-b"},
+			expectedCode: codes.PermissionDenied,
+		},
+		{
+			name:         "Missing SopsSecret",
+			attributes:   map[string]string{SopsSecretParameter: "missing"},
+			expectedCode: codes.NotFound,
+		},
+		{
+			name:         "Missing SopsSecret parameter",
+			attributes:   map[string]string{},
+			expectedCode: codes.InvalidArgument,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rsp, err := provider.Mount(callCtx, &v1alpha1.MountRequest{
+				Attributes: mountAttributes(t, tt.attributes),
+				Secrets:    "{}",
+				TargetPath: "/var/lib/kubelet/pods/uid/volumes/kubernetes.io~csi/secrets/mount",
+				Permission: "420",
+			})
+			if tt.expectedCode != codes.OK {
+				if status.Code(err) != tt.expectedCode {
+					t.Fatalf("expected %s, got %v", tt.expectedCode, err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("Mount() error = %v", err)
+			}
+
+			files := map[string]string{}
+			for _, file := range rsp.Files {
+				if file.Mode != 0o644 {
+					t.Errorf("expected file %s mode 0644, got %o", file.Path, file.Mode)
+				}
+				files[file.Path] = string(file.Contents)
+			}
+			if len(files) != len(tt.expected) {
+				t.Fatalf("expected files %v, got %v", tt.expected, files)
+			}
+			for path, contents := range tt.expected {
+				if files[path] != contents {
+					t.Errorf("expected file %s to contain %q, got %q", path, contents, files[path])
+				}
+			}
+			if len(rsp.ObjectVersion) != 1 || rsp.ObjectVersion[0].Version == "" {
+				t.Errorf("expected object version, got %v", rsp.ObjectVersion)
+			}
+		})
+	}
+
+	// Every mount of a read SopsSecret is audited
+	recorder.mu.Lock()
+	defer recorder.mu.Unlock()
+	if len(recorder.events) != 4 {
+		t.Fatalf("expected 4 audit events, got %+v", recorder.events)
+	}
+	mounted := recorder.events[0]
+	expectedKey := audit.Key{Provider: "age", ID: recipient}
+	if mounted.Action != audit.ActionMount || mounted.Result != audit.ResultSuccess ||
+		mounted.SopsSecret != "single" || mounted.Secret != "db" || mounted.Pod != "app" ||
+		len(mounted.Keys) != 1 || mounted.Keys[0] != expectedKey {
+		t.Errorf("unexpected audit event of successful mount %+v", mounted)
+	}
+	if failed := recorder.events[2]; failed.Result != audit.ResultFailure || failed.Reason != codes.InvalidArgument.String() {
+		t.Errorf("unexpected audit event of failed mount %+v", failed)
+	}
+}
+
+func TestProviderMountSuspended(t *testing.T) {
+	identity, err := age.GenerateX25519Identity()
+	if err != nil {
+		t.Fatal(err)
+	}
+	controllers.SetManagedAgeIdentities([]age.Identity{identity})
+	defer controllers.SetManagedAgeIdentities(nil)
+	recipient := identity.Recipient().String()
+
+	scheme := runtime.NewScheme()
+	if err := clientgoscheme.AddToScheme(scheme); err != nil {
+		t.Fatal(err)
+	}
+	if err := isindirv1alpha3.AddToScheme(scheme); err != nil {
+		t.Fatal(err)
+	}
+	template := isindirv1alpha3.SopsSecretTemplate{Name: "db", StringData: map[string]string{"password": "secret"}}
+	suspended := newEncryptedSopsSecret(t, "suspended", recipient, template)
+	suspended.Spec.Suspend = true
+	newReader := func(namespaceAnnotations map[string]string, paused string) *fake.ClientBuilder {
+		return fake.NewClientBuilder().WithScheme(scheme).WithRuntimeObjects(
+			newEncryptedSopsSecret(t, "active", recipient, template),
+			suspended,
+			&corev1.Namespace{ObjectMeta: metav1.ObjectMeta{Name: "team-a", Annotations: namespaceAnnotations}},
+			&corev1.ConfigMap{
+				ObjectMeta: metav1.ObjectMeta{Name: "pause", Namespace: "sops"},
+				Data:       map[string]string{controllers.PauseConfigMapKey: paused},
+			},
+		)
+	}
+	namespaceSuspended := map[string]string{isindirv1alpha3.SopsSecretSuspendAnnotation: "true"}
+
+	tests := []struct {
+		name         string
+		sopsSecret   string
+		reader       *fake.ClientBuilder
+		suspension   controllers.Suspension
+		expectedCode codes.Code
+	}{
+		{
+			name:       "SopsSecret which is not suspended is mounted",
+			sopsSecret: "active",
+			reader:     newReader(nil, "false"),
+			suspension: controllers.Suspension{NamespaceSuspend: true, OperatorNamespace: "sops", PauseConfigMap: "pause"},
+		},
+		{
+			name:         "SopsSecret with spec.suspend is not mounted",
+			sopsSecret:   "suspended",
+			reader:       newReader(nil, "false"),
+			expectedCode: codes.FailedPrecondition,
+		},
+		{
+			name:         "SopsSecret in suspended namespace is not mounted",
+			sopsSecret:   "active",
+			reader:       newReader(namespaceSuspended, "false"),
+			suspension:   controllers.Suspension{NamespaceSuspend: true},
+			expectedCode: codes.FailedPrecondition,
+		},
+		{
+			name:       "Namespace annotation is ignored without namespace suspend",
+			sopsSecret: "active",
+			reader:     newReader(namespaceSuspended, "false"),
+		},
+		{
+			name:         "SopsSecret is not mounted while the operator is paused",
+			sopsSecret:   "active",
+			reader:       newReader(nil, "true"),
+			suspension:   controllers.Suspension{OperatorNamespace: "sops", PauseConfigMap: "pause"},
+			expectedCode: codes.FailedPrecondition,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			recorder := &testAuditRecorder{}
+			provider := &Provider{
+				Reader:     tt.reader.Build(),
+				Suspension: tt.suspension,
+				Audit:      recorder,
+				Log:        logr.Discard(),
+			}
+			_, err := provider.Mount(context.Background(), &v1alpha1.MountRequest{
+				Attributes: mountAttributes(t, map[string]string{SopsSecretParameter: tt.sopsSecret}),
+				Secrets:    "{}",
+				Permission: "420",
+			})
+			if status.Code(err) != tt.expectedCode {
+				t.Fatalf("expected %s, got %v", tt.expectedCode, err)
+			}
+			if tt.expectedCode == codes.OK {
+				return
+			}
+			if len(recorder.events) != 1 || recorder.events[0].Reason != controllers.STATUS_RECONCILE_SUSPENDED {
+				t.Errorf("expected audit event of suspended mount, got %+v", recorder.events)
+			}
+		})
+	}
+}
@@ -0,0 +1,393 @@
+/* This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at https://mozilla.org/MPL/2.0/. */
+
+// Package v1alpha1 implements the v1alpha1.CSIDriverProvider gRPC contract
+// between Secrets Store CSI driver and its providers. Messages are defined
+// with protobuf descriptors matching provider/v1alpha1/service.proto of the
+// driver, so generated code and the driver module are not needed.
+package v1alpha1
+
+import (
+	"context"
+
+	"google.golang.org/grpc"
+	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/reflect/protodesc"
+	"google.golang.org/protobuf/reflect/protoreflect"
+	"google.golang.org/protobuf/types/descriptorpb"
+	"google.golang.org/protobuf/types/dynamicpb"
+)
+
+const (
+	// ServiceName is the full name of the provider gRPC service
+	ServiceName = "v1alpha1.CSIDriverProvider"
+	// VersionMethod is the full name of the Version method
+	VersionMethod = "/" + ServiceName + "/Version"
+	// MountMethod is the full name of the Mount method
+	MountMethod = "/" + ServiceName + "/Mount"
+)
+
+// VersionRequest is the request of the Version method
+type VersionRequest struct {
+	// Version of the CSI driver provider API
+	Version string
+}
+
+// VersionResponse is the response of the Version method
+type VersionResponse struct {
+	// Version of the CSI driver provider API
+	Version string
+	// RuntimeName is the name of the provider
+	RuntimeName string
+	// RuntimeVersion is the version of the provider
+	RuntimeVersion string
+}
+
+// MountRequest is the request of the Mount method
+type MountRequest struct {
+	// Attributes is JSON object of SecretProviderClass parameters and pod
+	// information added by the driver
+	Attributes string
+	// Secrets is JSON object of node publish secret contents
+	Secrets string
+	// TargetPath is the path the volume is mounted at
+	TargetPath string
+	// Permission is JSON encoded file mode of the files
+	Permission string
+	// CurrentObjectVersion lists versions of the currently mounted objects
+	CurrentObjectVersion []*ObjectVersion
+}
+
+// MountResponse is the response of the Mount method
+type MountResponse struct {
+	// ObjectVersion lists versions of the mounted objects
+	ObjectVersion []*ObjectVersion
+	// Error is set when mount failed
+	Error *Error
+	// Files are written to the volume by the driver
+	Files []*File
+}
+
+// ObjectVersion is the version of a mounted object
+type ObjectVersion struct {
+	ID      string
+	Version string
+}
+
+// Error is the error of a failed mount
+type Error struct {
+	Code string
+}
+
+// File is a file written to the volume
+type File struct {
+	// Path relative to the volume root
+	Path string
+	// Mode is the file mode
+	Mode int32
+	// Contents of the file
+	Contents []byte
+}
+
+// CSIDriverProviderServer is the server API of the provider service
+type CSIDriverProviderServer interface {
+	Version(context.Context, *VersionRequest) (*VersionResponse, error)
+	Mount(context.Context, *MountRequest) (*MountResponse, error)
+}
+
+var (
+	versionRequestDescriptor  protoreflect.MessageDescriptor
+	versionResponseDescriptor protoreflect.MessageDescriptor
+	mountRequestDescriptor    protoreflect.MessageDescriptor
+	mountResponseDescriptor   protoreflect.MessageDescriptor
+	objectVersionDescriptor   protoreflect.MessageDescriptor
+	errorDescriptor           protoreflect.MessageDescriptor
+	fileDescriptor            protoreflect.MessageDescriptor
+)
+
+func init() {
+	optional := descriptorpb.FieldDescriptorProto_LABEL_OPTIONAL.Enum()
+	repeated := descriptorpb.FieldDescriptorProto_LABEL_REPEATED.Enum()
+	field := func(name string, number int32, fieldType descriptorpb.FieldDescriptorProto_Type,
+		label *descriptorpb.FieldDescriptorProto_Label, typeName string,
+	) *descriptorpb.FieldDescriptorProto {
+		f := &descriptorpb.FieldDescriptorProto{
+			Name:   proto.String(name),
+			Number: proto.Int32(number),
+			Type:   fieldType.Enum(),
+			Label:  label,
+		}
+		if typeName != "" {
+			f.TypeName = proto.String(".v1alpha1." + typeName)
+		}
+		return f
+	}
+	message := func(name string, fields ...*descriptorpb.FieldDescriptorProto) *descriptorpb.DescriptorProto {
+		return &descriptorpb.DescriptorProto{Name: proto.String(name), Field: fields}
+	}
+	method := func(name string) *descriptorpb.MethodDescriptorProto {
+		return &descriptorpb.MethodDescriptorProto{
+			Name:       proto.String(name),
+			InputType:  proto.String(".v1alpha1." + name + "Request"),
+			OutputType: proto.String(".v1alpha1." + name + "Response"),
+		}
+	}
+	stringType := descriptorpb.FieldDescriptorProto_TYPE_STRING
+	messageType := descriptorpb.FieldDescriptorProto_TYPE_MESSAGE
+
+	file, err := protodesc.NewFile(&descriptorpb.FileDescriptorProto{
+		Name:    proto.String("provider/v1alpha1/service.proto"),
+		Package: proto.String("v1alpha1"),
+		Syntax:  proto.String("proto3"),
+		MessageType: []*descriptorpb.DescriptorProto{
+			message("VersionRequest",
+				field("version", 1, stringType, optional, ""),
+			),
+			message("VersionResponse",
+				field("version", 1, stringType, optional, ""),
+				field("runtime_name", 2, stringType, optional, ""),
+				field("runtime_version", 3, stringType, optional, ""),
+			),
+			message("MountRequest",
+				field("attributes", 1, stringType, optional, ""),
+				field("secrets", 2, stringType, optional, ""),
+				field("target_path", 3, stringType, optional, ""),
+				field("permission", 4, stringType, optional, ""),
+				field("current_object_version", 5, messageType, repeated, "ObjectVersion"),
+			),
+			message("MountResponse",
+				field("object_version", 1, messageType, repeated, "ObjectVersion"),
+				field("error", 2, messageType, optional, "Error"),
+				field("files", 3, messageType, repeated, "File"),
+			),
+			message("ObjectVersion",
+				field("id", 1, stringType, optional, ""),
+				field("version", 2, stringType, optional, ""),
+			),
+			message("Error",
+				field("code", 1, stringType, optional, ""),
+			),
+			message("File",
+				field("path", 1, stringType, optional, ""),
+				field("mode", 2, descriptorpb.FieldDescriptorProto_TYPE_INT32, optional, ""),
+				field("contents", 3, descriptorpb.FieldDescriptorProto_TYPE_BYTES, optional, ""),
+			),
+		},
+		Service: []*descriptorpb.ServiceDescriptorProto{{
+			Name:   proto.String("CSIDriverProvider"),
+			Method: []*descriptorpb.MethodDescriptorProto{method("Version"), method("Mount")},
+		}},
+	}, nil)
+	if err != nil {
+		panic(err)
+	}
+
+	messages := file.Messages()
+	versionRequestDescriptor = messages.ByName("VersionRequest")
+	versionResponseDescriptor = messages.ByName("VersionResponse")
+	mountRequestDescriptor = messages.ByName("MountRequest")
+	mountResponseDescriptor = messages.ByName("MountResponse")
+	objectVersionDescriptor = messages.ByName("ObjectVersion")
+	errorDescriptor = messages.ByName("Error")
+	fileDescriptor = messages.ByName("File")
+}
+
+// RegisterCSIDriverProviderServer registers the provider service with gRPC server
+func RegisterCSIDriverProviderServer(s grpc.ServiceRegistrar, srv CSIDriverProviderServer) {
+	s.RegisterService(&grpc.ServiceDesc{
+		ServiceName: ServiceName,
+		HandlerType: (*CSIDriverProviderServer)(nil),
+		Methods: []grpc.MethodDesc{
+			{
+				MethodName: "Version",
+				Handler: methodHandler(VersionMethod, versionRequestDescriptor,
+					func(ctx context.Context, srv CSIDriverProviderServer, in protoreflect.Message) (proto.Message, error) {
+						out, err := srv.Version(ctx, &VersionRequest{Version: getString(in, "version")})
+						if err != nil {
+							return nil, err
+						}
+						return out.message(), nil
+					},
+				),
+			},
+			{
+				MethodName: "Mount",
+				Handler: methodHandler(MountMethod, mountRequestDescriptor,
+					func(ctx context.Context, srv CSIDriverProviderServer, in protoreflect.Message) (proto.Message, error) {
+						out, err := srv.Mount(ctx, mountRequestFromMessage(in))
+						if err != nil {
+							return nil, err
+						}
+						return out.message(), nil
+					},
+				),
+			},
+		},
+		Metadata: "provider/v1alpha1/service.proto",
+	}, srv)
+}
+
+func methodHandler(
+	fullMethod string,
+	request protoreflect.MessageDescriptor,
+	call func(context.Context, CSIDriverProviderServer, protoreflect.Message) (proto.Message, error),
+) grpc.MethodHandler {
+	return func(srv any, ctx context.Context, dec func(any) error, interceptor grpc.UnaryServerInterceptor) (any, error) {
+		in := dynamicpb.NewMessage(request)
+		if err := dec(in); err != nil {
+			return nil, err
+		}
+		handler := func(ctx context.Context, req any) (any, error) {
+			return call(ctx, srv.(CSIDriverProviderServer), req.(proto.Message).ProtoReflect())
+		}
+		if interceptor == nil {
+			return handler(ctx, in)
+		}
+		return interceptor(ctx, in, &grpc.UnaryServerInfo{Server: srv, FullMethod: fullMethod}, handler)
+	}
+}
+
+// CSIDriverProviderClient is the client API of the provider service, as
+// used by the driver
+type CSIDriverProviderClient struct {
+	cc grpc.ClientConnInterface
+}
+
+// NewCSIDriverProviderClient returns provider service client using connection cc
+func NewCSIDriverProviderClient(cc grpc.ClientConnInterface) *CSIDriverProviderClient {
+	return &CSIDriverProviderClient{cc: cc}
+}
+
+// Version calls the Version method
+func (c *CSIDriverProviderClient) Version(
+	ctx context.Context, in *VersionRequest, opts ...grpc.CallOption,
+) (*VersionResponse, error) {
+	request := dynamicpb.NewMessage(versionRequestDescriptor)
+	setString(request, "version", in.Version)
+	out := dynamicpb.NewMessage(versionResponseDescriptor)
+	if err := c.cc.Invoke(ctx, VersionMethod, request, out, opts...); err != nil {
+		return nil, err
+	}
+	return &VersionResponse{
+		Version:        getString(out, "version"),
+		RuntimeName:    getString(out, "runtime_name"),
+		RuntimeVersion: getString(out, "runtime_version"),
+	}, nil
+}
+
+// Mount calls the Mount method
+func (c *CSIDriverProviderClient) Mount(
+	ctx context.Context, in *MountRequest, opts ...grpc.CallOption,
+) (*MountResponse, error) {
+	out := dynamicpb.NewMessage(mountResponseDescriptor)
+	if err := c.cc.Invoke(ctx, MountMethod, in.message(), out, opts...); err != nil {
+		return nil, err
+	}
+	return mountResponseFromMessage(out), nil
+}
+
+func (r *VersionResponse) message() proto.Message {
+	m := dynamicpb.NewMessage(versionResponseDescriptor)
+	setString(m, "version", r.Version)
+	setString(m, "runtime_name", r.RuntimeName)
+	setString(m, "runtime_version", r.RuntimeVersion)
+	return m
+}
+
+func (r *MountRequest) message() proto.Message {
+	m := dynamicpb.NewMessage(mountRequestDescriptor)
+	setString(m, "attributes", r.Attributes)
+	setString(m, "secrets", r.Secrets)
+	setString(m, "target_path", r.TargetPath)
+	setString(m, "permission", r.Permission)
+	for _, version := range r.CurrentObjectVersion {
+		appendMessage(m, "current_object_version", version.message())
+	}
+	return m
+}
+
+func mountRequestFromMessage(m protoreflect.Message) *MountRequest {
+	r := &MountRequest{
+		Attributes: getString(m, "attributes"),
+		Secrets:    getString(m, "secrets"),
+		TargetPath: getString(m, "target_path"),
+		Permission: getString(m, "permission"),
+	}
+	for _, version := range getMessages(m, "current_object_version") {
+		r.CurrentObjectVersion = append(r.CurrentObjectVersion, objectVersionFromMessage(version))
+	}
+	return r
+}
+
+func (r *MountResponse) message() proto.Message {
+	m := dynamicpb.NewMessage(mountResponseDescriptor)
+	for _, version := range r.ObjectVersion {
+		appendMessage(m, "object_version", version.message())
+	}
+	if r.Error != nil {
+		e := dynamicpb.NewMessage(errorDescriptor)
+		setString(e, "code", r.Error.Code)
+		m.Set(m.Descriptor().Fields().ByName("error"), protoreflect.ValueOfMessage(e))
+	}
+	for _, file := range r.Files {
+		f := dynamicpb.NewMessage(fileDescriptor)
+		setString(f, "path", file.Path)
+		f.Set(f.Descriptor().Fields().ByName("mode"), protoreflect.ValueOfInt32(file.Mode))
+		f.Set(f.Descriptor().Fields().ByName("contents"), protoreflect.ValueOfBytes(file.Contents))
+		appendMessage(m, "files", f)
+	}
+	return m
+}
+
+func mountResponseFromMessage(m protoreflect.Message) *MountResponse {
+	r := &MountResponse{}
+	for _, version := range getMessages(m, "object_version") {
+		r.ObjectVersion = append(r.ObjectVersion, objectVersionFromMessage(version))
+	}
+	if errorField := m.Descriptor().Fields().ByName("error"); m.Has(errorField) {
+		r.Error = &Error{Code: getString(m.Get(errorField).Message(), "code")}
+	}
+	for _, f := range getMessages(m, "files") {
+		fields := f.Descriptor().Fields()
+		r.Files = append(r.Files, &File{
+			Path:     getString(f, "path"),
+			Mode:     int32(f.Get(fields.ByName("mode")).Int()),
+			Contents: f.Get(fields.ByName("contents")).Bytes(),
+		})
+	}
+	return r
+}
+
+func (v *ObjectVersion) message() protoreflect.Message {
+	m := dynamicpb.NewMessage(objectVersionDescriptor)
+	setString(m, "id", v.ID)
+	setString(m, "version", v.Version)
+	return m
+}
+
+func objectVersionFromMessage(m protoreflect.Message) *ObjectVersion {
+	return &ObjectVersion{ID: getString(m, "id"), Version: getString(m, "version")}
+}
+
+func setString(m protoreflect.Message, name protoreflect.Name, value string) {
+	m.Set(m.Descriptor().Fields().ByName(name), protoreflect.ValueOfString(value))
+}
+
+func getString(m protoreflect.Message, name protoreflect.Name) string {
+	return m.Get(m.Descriptor().Fields().ByName(name)).String()
+}
+
+func appendMessage(m protoreflect.Message, name protoreflect.Name, value protoreflect.Message) {
+	list := m.Mutable(m.Descriptor().Fields().ByName(name)).List()
+	list.Append(protoreflect.ValueOfMessage(value))
+}
+
+func getMessages(m protoreflect.Message, name protoreflect.Name) []protoreflect.Message {
+	list := m.Get(m.Descriptor().Fields().ByName(name)).List()
+	messages := make([]protoreflect.Message, 0, list.Len())
+	for i := 0; i < list.Len(); i++ {
+		messages = append(messages, list.Get(i).Message())
+	}
+	return messages
+}
@@ -0,0 +1,212 @@
+/* This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at https://mozilla.org/MPL/2.0/. */
+
+package v1alpha1
+
+import (
+	"bytes"
+	"reflect"
+	"testing"
+
+	"google.golang.org/protobuf/encoding/protowire"
+	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/types/dynamicpb"
+)
+
+// Field numbers of provider/v1alpha1/service.proto of Secrets Store CSI
+// driver v1.4.8, messages below are encoded and decoded with protowire the
+// way the generated code of the driver does, independently of descriptors
+// of this package.
+const (
+	versionRequestVersion = 1
+
+	versionResponseVersion        = 1
+	versionResponseRuntimeName    = 2
+	versionResponseRuntimeVersion = 3
+
+	mountRequestAttributes           = 1
+	mountRequestSecrets              = 2
+	mountRequestTargetPath           = 3
+	mountRequestPermission           = 4
+	mountRequestCurrentObjectVersion = 5
+
+	mountResponseObjectVersion = 1
+	mountResponseError         = 2
+	mountResponseFiles         = 3
+
+	objectVersionID      = 1
+	objectVersionVersion = 2
+
+	errorCode = 1
+
+	filePath     = 1
+	fileMode     = 2
+	fileContents = 3
+)
+
+// wireField is a decoded field of a message, Message holds fields of
+// embedded messages
+type wireField struct {
+	Number  protowire.Number
+	Type    protowire.Type
+	Bytes   []byte
+	Varint  uint64
+	Message []wireField
+}
+
+func appendString(b []byte, number protowire.Number, value string) []byte {
+	b = protowire.AppendTag(b, number, protowire.BytesType)
+	return protowire.AppendString(b, value)
+}
+
+func appendBytes(b []byte, number protowire.Number, value []byte) []byte {
+	b = protowire.AppendTag(b, number, protowire.BytesType)
+	return protowire.AppendBytes(b, value)
+}
+
+// consumeFields decodes message, fields listed in embedded are decoded as
+// embedded messages
+func consumeFields(t *testing.T, b []byte, embedded ...protowire.Number) []wireField {
+	t.Helper()
+	var fields []wireField
+	for len(b) > 0 {
+		number, wireType, n := protowire.ConsumeTag(b)
+		if n < 0 {
+			t.Fatalf("invalid tag: %v", protowire.ParseError(n))
+		}
+		b = b[n:]
+		field := wireField{Number: number, Type: wireType}
+		switch wireType {
+		case protowire.BytesType:
+			field.Bytes, n = protowire.ConsumeBytes(b)
+		case protowire.VarintType:
+			field.Varint, n = protowire.ConsumeVarint(b)
+		default:
+			t.Fatalf("unexpected wire type %d of field %d", wireType, number)
+		}
+		if n < 0 {
+			t.Fatalf("invalid field %d: %v", number, protowire.ParseError(n))
+		}
+		b = b[n:]
+		for _, e := range embedded {
+			if number == e {
+				field.Message = consumeFields(t, field.Bytes)
+				field.Bytes = nil
+			}
+		}
+		fields = append(fields, field)
+	}
+	return fields
+}
+
+func TestMountRequestWireEncoding(t *testing.T) {
+	var objectVersion []byte
+	objectVersion = appendString(objectVersion, objectVersionID, "app/db")
+	objectVersion = appendString(objectVersion, objectVersionVersion, "v1")
+
+	// MountRequest as sent by the driver
+	var encoded []byte
+	encoded = appendString(encoded, mountRequestAttributes, `{"sopsSecret":"app"}`)
+	encoded = appendString(encoded, mountRequestSecrets, "{}")
+	encoded = appendString(encoded, mountRequestTargetPath, "/var/lib/kubelet/pods/uid/volumes/mount")
+	encoded = appendString(encoded, mountRequestPermission, "420")
+	encoded = appendBytes(encoded, mountRequestCurrentObjectVersion, objectVersion)
+
+	m := dynamicpb.NewMessage(mountRequestDescriptor)
+	if err := proto.Unmarshal(encoded, m); err != nil {
+		t.Fatalf("failed to decode MountRequest: %v", err)
+	}
+	if len(m.GetUnknown()) != 0 {
+		t.Errorf("unexpected unknown fields %v", m.GetUnknown())
+	}
+	expected := &MountRequest{
+		Attributes:           `{"sopsSecret":"app"}`,
+		Secrets:              "{}",
+		TargetPath:           "/var/lib/kubelet/pods/uid/volumes/mount",
+		Permission:           "420",
+		CurrentObjectVersion: []*ObjectVersion{{ID: "app/db", Version: "v1"}},
+	}
+	if request := mountRequestFromMessage(m); !reflect.DeepEqual(request, expected) {
+		t.Errorf("decoded MountRequest %+v, expected %+v", request, expected)
+	}
+
+	// Encoding of this package is decoded by the driver the same way
+	reencoded, err := proto.MarshalOptions{Deterministic: true}.Marshal(expected.message())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(reencoded, encoded) {
+		t.Errorf("MountRequest encoded as %x, expected %x", reencoded, encoded)
+	}
+}
+
+func TestMountResponseWireEncoding(t *testing.T) {
+	response := &MountResponse{
+		ObjectVersion: []*ObjectVersion{{ID: "app/db", Version: "v1"}},
+		Error:         &Error{Code: "NotFound"},
+		Files: []*File{
+			{Path: "password", Mode: 0o644, Contents: []byte("secret")},
+			{Path: "token", Mode: 0o600, Contents: []byte{0, 1}},
+		},
+	}
+	encoded, err := proto.MarshalOptions{Deterministic: true}.Marshal(response.message())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	fields := consumeFields(t, encoded, mountResponseObjectVersion, mountResponseError, mountResponseFiles)
+	expected := []wireField{
+		{Number: mountResponseObjectVersion, Type: protowire.BytesType, Message: []wireField{
+			{Number: objectVersionID, Type: protowire.BytesType, Bytes: []byte("app/db")},
+			{Number: objectVersionVersion, Type: protowire.BytesType, Bytes: []byte("v1")},
+		}},
+		{Number: mountResponseError, Type: protowire.BytesType, Message: []wireField{
+			{Number: errorCode, Type: protowire.BytesType, Bytes: []byte("NotFound")},
+		}},
+		{Number: mountResponseFiles, Type: protowire.BytesType, Message: []wireField{
+			{Number: filePath, Type: protowire.BytesType, Bytes: []byte("password")},
+			{Number: fileMode, Type: protowire.VarintType, Varint: 0o644},
+			{Number: fileContents, Type: protowire.BytesType, Bytes: []byte("secret")},
+		}},
+		{Number: mountResponseFiles, Type: protowire.BytesType, Message: []wireField{
+			{Number: filePath, Type: protowire.BytesType, Bytes: []byte("token")},
+			{Number: fileMode, Type: protowire.VarintType, Varint: 0o600},
+			{Number: fileContents, Type: protowire.BytesType, Bytes: []byte{0, 1}},
+		}},
+	}
+	if !reflect.DeepEqual(fields, expected) {
+		t.Errorf("MountResponse encoded as %+v, expected %+v", fields, expected)
+	}
+
+	m := dynamicpb.NewMessage(mountResponseDescriptor)
+	if err := proto.Unmarshal(encoded, m); err != nil {
+		t.Fatal(err)
+	}
+	if decoded := mountResponseFromMessage(m); !reflect.DeepEqual(decoded, response) {
+		t.Errorf("decoded MountResponse %+v, expected %+v", decoded, response)
+	}
+}
+
+func TestVersionWireEncoding(t *testing.T) {
+	request := dynamicpb.NewMessage(versionRequestDescriptor)
+	if err := proto.Unmarshal(appendString(nil, versionRequestVersion, "v1alpha1"), request); err != nil {
+		t.Fatal(err)
+	}
+	if version := getString(request, "version"); version != "v1alpha1" {
+		t.Errorf("decoded VersionRequest version %q, expected v1alpha1", version)
+	}
+
+	response := &VersionResponse{Version: "v1alpha1", RuntimeName: "sops-secrets-operator", RuntimeVersion: "v0.21.1"}
+	encoded, err := proto.MarshalOptions{Deterministic: true}.Marshal(response.message())
+	if err != nil {
+		t.Fatal(err)
+	}
+	var expected []byte
+	expected = appendString(expected, versionResponseVersion, "v1alpha1")
+	expected = appendString(expected, versionResponseRuntimeName, "sops-secrets-operator")
+	expected = appendString(expected, versionResponseRuntimeVersion, "v0.21.1")
+	if !bytes.Equal(encoded, expected) {
+		t.Errorf("VersionResponse encoded as %x, expected %x", encoded, expected)
+	}
+}
@@ -0,0 +1,413 @@
+/* This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at https://mozilla.org/MPL/2.0/. */
+
+// Package generator builds encrypted SopsSecret resources from sops encrypted
+// files, dotenv files and literals, similar to kustomize secretGenerator.
+package generator
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/getsops/sops/v3"
+	sopsaes "github.com/getsops/sops/v3/aes"
+	sopsage "github.com/getsops/sops/v3/age"
+	sopsazkv "github.com/getsops/sops/v3/azkv"
+	sopsdecrypt "github.com/getsops/sops/v3/decrypt"
+	sopsgcpkms "github.com/getsops/sops/v3/gcpkms"
+	sopshcvault "github.com/getsops/sops/v3/hcvault"
+	sopskms "github.com/getsops/sops/v3/kms"
+	sopspgp "github.com/getsops/sops/v3/pgp"
+	sopsdotenv "github.com/getsops/sops/v3/stores/dotenv"
+	sopsjson "github.com/getsops/sops/v3/stores/json"
+	sopsyaml "github.com/getsops/sops/v3/stores/yaml"
+	sopsversion "github.com/getsops/sops/v3/version"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+
+	isindirv1alpha3 "github.com/isindir/sops-secrets-operator/api/v1alpha3"
+	"github.com/isindir/sops-secrets-operator/internal/controllers"
+)
+
+const (
+	// GeneratorAPIVersion is the apiVersion of the generator configuration
+	GeneratorAPIVersion = "generators.isindir.github.com/v1alpha1"
+	// GeneratorKind is the kind of the generator configuration
+	GeneratorKind = "SopsSecretGenerator"
+
+	// EncryptedSuffix is used to encrypt generated SopsSecrets, only
+	// spec.secretTemplates subtree is encrypted
+	EncryptedSuffix = "Templates"
+
+	// sourceDateEpochEnv follows https://reproducible-builds.org/specs/source-date-epoch/
+	sourceDateEpochEnv = "SOURCE_DATE_EPOCH"
+)
+
+// SopsSecretGenerator is the configuration of the generator
+type SopsSecretGenerator struct {
+	metav1.TypeMeta   `json:",inline"`
+	metav1.ObjectMeta `json:"metadata,omitempty"`
+
+	// Recipients the generated SopsSecret is encrypted for
+	Recipients Recipients `json:"recipients"`
+
+	// Suspend is copied to spec.suspend of the generated SopsSecret
+	Suspend bool `json:"suspend,omitempty"`
+
+	// EnforceOwnership is copied to spec.enforceOwnership of the generated SopsSecret
+	EnforceOwnership *bool `json:"enforceOwnership,omitempty"`
+
+	// Secrets to generate, each one becomes a secret template
+	Secrets []SecretSource `json:"secrets"`
+}
+
+// Recipients lists keys in the same formats as accepted by sops command line
+type Recipients struct {
+	Age     []string `json:"age,omitempty"`
+	Pgp     []string `json:"pgp,omitempty"`
+	Kms     []string `json:"kms,omitempty"`
+	GcpKms  []string `json:"gcpKms,omitempty"`
+	AzureKv []string `json:"azureKv,omitempty"`
+	HcVault []string `json:"hcVault,omitempty"`
+}
+
+// SecretSource defines a single Kubernetes secret and its data sources
+type SecretSource struct {
+	// Name of the Kubernetes secret to create
+	Name string `json:"name"`
+	// Kubernetes secret type, Opaque if not set
+	Type string `json:"type,omitempty"`
+	// Labels to apply to Kubernetes secret
+	Labels map[string]string `json:"labels,omitempty"`
+	// Annotations to apply to Kubernetes secret
+	Annotations map[string]string `json:"annotations,omitempty"`
+
+	// Files are sops encrypted files in `[key=]path` format, decrypted file
+	// content is stored under the key (file name if key is not set)
+	Files []string `json:"files,omitempty"`
+	// Envs are sops encrypted dotenv files, every variable becomes a key
+	Envs []string `json:"envs,omitempty"`
+	// Literals in `key=value` format
+	Literals []string `json:"literals,omitempty"`
+}
+
+// Generate decrypts all sources of the configuration and returns plain text
+// SopsSecret. Relative paths are resolved from baseDir.
+func Generate(config *SopsSecretGenerator, baseDir string) (*isindirv1alpha3.SopsSecret, error) {
+	if config.Name == "" {
+		return nil, fmt.Errorf("%s metadata.name must be specified", GeneratorKind)
+	}
+	if len(config.Secrets) == 0 {
+		return nil, fmt.Errorf("%s %s: at least one secret must be defined", GeneratorKind, config.Name)
+	}
+
+	sopsSecret := &isindirv1alpha3.SopsSecret{
+		TypeMeta: metav1.TypeMeta{
+			APIVersion: isindirv1alpha3.GroupVersion.String(),
+			Kind:       "SopsSecret",
+		},
+		ObjectMeta: metav1.ObjectMeta{
+			Name:        config.Name,
+			Namespace:   config.Namespace,
+			Labels:      config.Labels,
+			Annotations: withoutConfigAnnotations(config.Annotations),
+		},
+		Spec: isindirv1alpha3.SopsSecretSpec{
+			Suspend:          config.Suspend,
+			EnforceOwnership: config.EnforceOwnership,
+		},
+	}
+
+	seenNames := map[string]bool{}
+	for _, source := range config.Secrets {
+		if seenNames[source.Name] {
+			return nil, fmt.Errorf("secret %q is defined more than once", source.Name)
+		}
+		seenNames[source.Name] = true
+
+		template, err := newSecretTemplate(&source, baseDir)
+		if err != nil {
+			return nil, err
+		}
+		// Apply the same name and type rules as the controller
+		if err := controllers.ValidateSecretTemplate(sopsSecret, template); err != nil {
+			return nil, err
+		}
+		sopsSecret.Spec.SecretsTemplate = append(sopsSecret.Spec.SecretsTemplate, *template)
+	}
+
+	return sopsSecret, nil
+}
+
+func newSecretTemplate(source *SecretSource, baseDir string) (*isindirv1alpha3.SopsSecretTemplate, error) {
+	data := map[string][]byte{}
+	add := func(key string, value []byte) error {
+		if key == "" {
+			return fmt.Errorf("secret %q: key must not be empty", source.Name)
+		}
+		if _, ok := data[key]; ok {
+			return fmt.Errorf("secret %q: key %q is defined more than once", source.Name, key)
+		}
+		data[key] = value
+		return nil
+	}
+
+	for _, file := range source.Files {
+		key, path := splitKeyValue(file)
+		if path == "" {
+			key, path = filepath.Base(file), file
+		}
+		cleartext, err := decryptFile(resolvePath(baseDir, path), "")
+		if err != nil {
+			return nil, fmt.Errorf("secret %q: %w", source.Name, err)
+		}
+		if err := add(key, cleartext); err != nil {
+			return nil, err
+		}
+	}
+
+	for _, env := range source.Envs {
+		cleartext, err := decryptFile(resolvePath(baseDir, env), "dotenv")
+		if err != nil {
+			return nil, fmt.Errorf("secret %q: %w", source.Name, err)
+		}
+		branches, err := (&sopsdotenv.Store{}).LoadPlainFile(cleartext)
+		if err != nil {
+			return nil, fmt.Errorf("secret %q: %s: %w", source.Name, env, err)
+		}
+		for _, item := range branches[0] {
+			key, ok := item.Key.(string)
+			if !ok {
+				// comment
+				continue
+			}
+			if err := add(key, []byte(fmt.Sprint(item.Value))); err != nil {
+				return nil, err
+			}
+		}
+	}
+
+	for i, literal := range source.Literals {
+		key, value := splitKeyValue(literal)
+		if !strings.Contains(literal, "=") {
+			return nil, fmt.Errorf("secret %q: literals[%d] must be in key=value format", source.Name, i)
+		}
+		if err := add(key, []byte(value)); err != nil {
+			return nil, err
+		}
+	}
+
+	template := &isindirv1alpha3.SopsSecretTemplate{
+		Name:        source.Name,
+		Type:        source.Type,
+		Labels:      source.Labels,
+		Annotations: source.Annotations,
+		Data:        map[string]string{},
+	}
+	for key, value := range data {
+		template.Data[key] = base64.StdEncoding.EncodeToString(value)
+	}
+	return template, nil
+}
+
+// Encrypt encrypts spec.secretTemplates of plain text SopsSecret for the
+// recipients and returns resulting resource as YAML.
+func Encrypt(sopsSecret *isindirv1alpha3.SopsSecret, recipients *Recipients) ([]byte, error) {
+	keyGroup, err := recipients.keyGroup()
+	if err != nil {
+		return nil, err
+	}
+
+	plainText, err := plainTextDocument(sopsSecret)
+	if err != nil {
+		return nil, err
+	}
+	branches, err := (&sopsjson.Store{}).LoadPlainFile(plainText)
+	if err != nil {
+		return nil, err
+	}
+
+	tree := sops.Tree{
+		Branches: branches,
+		Metadata: sops.Metadata{
+			KeyGroups:        []sops.KeyGroup{keyGroup},
+			EncryptedSuffix:  EncryptedSuffix,
+			MACOnlyEncrypted: true,
+			Version:          sopsversion.Version,
+		},
+	}
+	dataKey, errs := tree.GenerateDataKey()
+	if len(errs) > 0 {
+		return nil, fmt.Errorf("could not encrypt data key: %v", errs)
+	}
+
+	cipher := sopsaes.NewCipher()
+	mac, err := tree.Encrypt(dataKey, cipher)
+	if err != nil {
+		return nil, err
+	}
+	lastModified, err := lastModified()
+	if err != nil {
+		return nil, err
+	}
+	tree.Metadata.LastModified = lastModified
+	tree.Metadata.MessageAuthenticationCode, err = cipher.Encrypt(mac, dataKey, lastModified.Format(time.RFC3339))
+	if err != nil {
+		return nil, fmt.Errorf("could not encrypt MAC: %w", err)
+	}
+
+	return (&sopsyaml.Store{}).EmitEncryptedFile(tree)
+}
+
+func (r *Recipients) keyGroup() (sops.KeyGroup, error) {
+	var keyGroup sops.KeyGroup
+
+	for _, recipient := range r.Age {
+		masterKeys, err := sopsage.MasterKeysFromRecipients(recipient)
+		if err != nil {
+			return nil, err
+		}
+		for _, masterKey := range masterKeys {
+			keyGroup = append(keyGroup, masterKey)
+		}
+	}
+	for _, fingerprint := range r.Pgp {
+		for _, masterKey := range sopspgp.MasterKeysFromFingerprintString(fingerprint) {
+			keyGroup = append(keyGroup, masterKey)
+		}
+	}
+	for _, arn := range r.Kms {
+		for _, masterKey := range sopskms.MasterKeysFromArnString(arn, nil, "") {
+			keyGroup = append(keyGroup, masterKey)
+		}
+	}
+	for _, resourceID := range r.GcpKms {
+		for _, masterKey := range sopsgcpkms.MasterKeysFromResourceIDString(resourceID) {
+			keyGroup = append(keyGroup, masterKey)
+		}
+	}
+	for _, url := range r.AzureKv {
+		masterKeys, err := sopsazkv.MasterKeysFromURLs(url)
+		if err != nil {
+			return nil, err
+		}
+		for _, masterKey := range masterKeys {
+			keyGroup = append(keyGroup, masterKey)
+		}
+	}
+	for _, uri := range r.HcVault {
+		masterKeys, err := sopshcvault.NewMasterKeysFromURIs(uri)
+		if err != nil {
+			return nil, err
+		}
+		for _, masterKey := range masterKeys {
+			keyGroup = append(keyGroup, masterKey)
+		}
+	}
+
+	if len(keyGroup) == 0 {
+		return nil, fmt.Errorf("at least one recipient must be specified")
+	}
+	return keyGroup, nil
+}
+
+// plainTextDocument renders SopsSecret without status and sops metadata with
+// sorted secret templates, so generated output only depends on the input
+func plainTextDocument(sopsSecret *isindirv1alpha3.SopsSecret) ([]byte, error) {
+	templates := append([]isindirv1alpha3.SopsSecretTemplate{}, sopsSecret.Spec.SecretsTemplate...)
+	sort.SliceStable(templates, func(i, j int) bool {
+		return templates[i].Name < templates[j].Name
+	})
+	spec := sopsSecret.Spec
+	spec.SecretsTemplate = templates
+
+	metadata := map[string]interface{}{"name": sopsSecret.Name}
+	if sopsSecret.Namespace != "" {
+		metadata["namespace"] = sopsSecret.Namespace
+	}
+	if len(sopsSecret.Labels) > 0 {
+		metadata["labels"] = sopsSecret.Labels
+	}
+	if len(sopsSecret.Annotations) > 0 {
+		metadata["annotations"] = sopsSecret.Annotations
+	}
+
+	document, err := json.Marshal(map[string]interface{}{
+		"apiVersion": sopsSecret.APIVersion,
+		"kind":       sopsSecret.Kind,
+		"metadata":   metadata,
+		"spec":       spec,
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	// encoding/json sorts map keys, re-encoding sorts keys of API types too,
+	// which keeps the document stable and the MAC verifiable by the controller
+	var value interface{}
+	if err := json.Unmarshal(document, &value); err != nil {
+		return nil, err
+	}
+	return json.Marshal(value)
+}
+
+// lastModified returns SOURCE_DATE_EPOCH if set, to pin sops.lastmodified to
+// the source date. Output still differs between runs, as data key is random
+func lastModified() (time.Time, error) {
+	epoch := os.Getenv(sourceDateEpochEnv)
+	if epoch == "" {
+		return time.Now().UTC(), nil
+	}
+	seconds, err := strconv.ParseInt(epoch, 10, 64)
+	if err != nil {
+		return time.Time{}, fmt.Errorf("invalid %s: %w", sourceDateEpochEnv, err)
+	}
+	return time.Unix(seconds, 0).UTC(), nil
+}
+
+func decryptFile(path string, format string) ([]byte, error) {
+	cleartext, err := sopsdecrypt.File(path, format)
+	if userErr, ok := err.(sops.UserError); ok {
+		err = fmt.Errorf("sops user error: %s", userErr.UserError())
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to decrypt %s: %w", path, err)
+	}
+	return cleartext, nil
+}
+
+// withoutConfigAnnotations drops annotations used by kustomize to configure the function
+func withoutConfigAnnotations(annotations map[string]string) map[string]string {
+	result := map[string]string{}
+	for key, value := range annotations {
+		if strings.HasPrefix(key, "config.kubernetes.io/") ||
+			strings.HasPrefix(key, "internal.config.kubernetes.io/") ||
+			strings.HasPrefix(key, "config.k8s.io/") {
+			continue
+		}
+		result[key] = value
+	}
+	if len(result) == 0 {
+		return nil
+	}
+	return result
+}
+
+func splitKeyValue(value string) (string, string) {
+	key, rest, _ := strings.Cut(value, "=")
+	return key, rest
+}
+
+func resolvePath(baseDir string, path string) string {
+	if filepath.IsAbs(path) {
+		return path
+	}
+	return filepath.Join(baseDir, path)
+}
@@ -0,0 +1,221 @@
+/* This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at https://mozilla.org/MPL/2.0/. */
+
+package generator
+
+import (
+	"bytes"
+	"encoding/base64"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"sigs.k8s.io/yaml"
+
+	isindirv1alpha3 "github.com/isindir/sops-secrets-operator/api/v1alpha3"
+	"github.com/isindir/sops-secrets-operator/internal/controllers"
+)
+
+const ageRecipient = "age1pnmp2nq5qx9z4lpmachyn2ld07xjumn98hpeq77e4glddu96zvms9nn7c8"
+
+var testKeyDir = filepath.Join("..", "..", "config", "age-test-key")
+
+func newTestConfig(secrets ...SecretSource) *SopsSecretGenerator {
+	return &SopsSecretGenerator{
+		TypeMeta: metav1.TypeMeta{APIVersion: GeneratorAPIVersion, Kind: GeneratorKind},
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      "generated",
+			Namespace: "default",
+			Annotations: map[string]string{
+				"config.kubernetes.io/function": "exec:\n  path: ./sopssecret-generator\n",
+				"team":                          "platform",
+			},
+		},
+		Recipients: Recipients{Age: []string{ageRecipient}},
+		Secrets:    secrets,
+	}
+}
+
+func decodedData(t *testing.T, template *isindirv1alpha3.SopsSecretTemplate) map[string]string {
+	t.Helper()
+	data := map[string]string{}
+	for key, value := range template.Data {
+		decoded, err := base64.StdEncoding.DecodeString(value)
+		if err != nil {
+			t.Fatalf("data[%s] is not base64: %v", key, err)
+		}
+		data[key] = string(decoded)
+	}
+	return data
+}
+
+func TestGenerate(t *testing.T) {
+	t.Setenv("SOPS_AGE_KEY_FILE", filepath.Join(testKeyDir, "key-file.txt"))
+
+	config := newTestConfig(
+		SecretSource{
+			Name:     "database",
+			Envs:     []string{"generator/database.enc.env"},
+			Literals: []string{"DB_HOST=db.example.com"},
+		},
+		SecretSource{
+			Name:  "database-env-file",
+			Type:  "custom/type",
+			Files: []string{"database.env=generator/database.enc.env"},
+		},
+	)
+
+	sopsSecret, err := Generate(config, testKeyDir)
+	if err != nil {
+		t.Fatalf("Generate() error = %v", err)
+	}
+
+	if _, ok := sopsSecret.Annotations["config.kubernetes.io/function"]; ok {
+		t.Errorf("Generate() must not copy function configuration annotations")
+	}
+	if sopsSecret.Annotations["team"] != "platform" {
+		t.Errorf("Generate() annotations = %v, want team annotation", sopsSecret.Annotations)
+	}
+	if len(sopsSecret.Spec.SecretsTemplate) != 2 {
+		t.Fatalf("Generate() templates = %d, want 2", len(sopsSecret.Spec.SecretsTemplate))
+	}
+
+	data := decodedData(t, &sopsSecret.Spec.SecretsTemplate[0])
+	expected := map[string]string{
+		"DB_USER":     "generator-user",
+		"DB_PASSWORD": "generator-password",
+		"DB_HOST":     "db.example.com",
+	}
+	for key, value := range expected {
+		if data[key] != value {
+			t.Errorf("Generate() data[%s] = %q, want %q", key, data[key], value)
+		}
+	}
+
+	data = decodedData(t, &sopsSecret.Spec.SecretsTemplate[1])
+	if data["database.env"] != "DB_USER=generator-user\nDB_PASSWORD=generator-password\n" {
+		t.Errorf("Generate() file content = %q", data["database.env"])
+	}
+	if sopsSecret.Spec.SecretsTemplate[1].Type != "custom/type" {
+		t.Errorf("Generate() type = %q, want custom/type", sopsSecret.Spec.SecretsTemplate[1].Type)
+	}
+}
+
+func TestGenerateErrors(t *testing.T) {
+	tests := []struct {
+		name    string
+		secrets []SecretSource
+	}{
+		{
+			name: "No secrets",
+		},
+		{
+			name:    "Template without name",
+			secrets: []SecretSource{{Literals: []string{"key=value"}}},
+		},
+		{
+			name:    "Duplicate secret names",
+			secrets: []SecretSource{{Name: "secret"}, {Name: "secret"}},
+		},
+		{
+			name:    "Duplicate keys",
+			secrets: []SecretSource{{Name: "secret", Literals: []string{"key=value", "key=other"}}},
+		},
+		{
+			name:    "Literal without value",
+			secrets: []SecretSource{{Name: "secret", Literals: []string{"key"}}},
+		},
+		{
+			name:    "Not encrypted file",
+			secrets: []SecretSource{{Name: "secret", Files: []string{"00-raw-test-secrets.yaml"}}},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if _, err := Generate(newTestConfig(tt.secrets...), testKeyDir); err == nil {
+				t.Errorf("Generate() expected error")
+			}
+		})
+	}
+}
+
+func TestRunFunction(t *testing.T) {
+	t.Setenv("SOPS_AGE_KEY_FILE", filepath.Join(testKeyDir, "key-file.txt"))
+	t.Setenv("SOURCE_DATE_EPOCH", "1700000000")
+
+	input := `apiVersion: config.kubernetes.io/v1
+kind: ResourceList
+items:
+  - apiVersion: v1
+    kind: ConfigMap
+    metadata:
+      name: existing
+functionConfig:
+  apiVersion: ` + GeneratorAPIVersion + `
+  kind: ` + GeneratorKind + `
+  metadata:
+    name: generated
+    namespace: default
+  recipients:
+    age:
+      - ` + ageRecipient + `
+  secrets:
+    - name: literal-secret
+      literals:
+        - token=literal-token
+`
+	output := &bytes.Buffer{}
+	if err := RunFunction(strings.NewReader(input), output, testKeyDir); err != nil {
+		t.Fatalf("RunFunction() error = %v", err)
+	}
+
+	list := &struct {
+		Items []isindirv1alpha3.SopsSecret `json:"items"`
+	}{}
+	if err := yaml.Unmarshal(output.Bytes(), list); err != nil {
+		t.Fatalf("failed to parse output: %v", err)
+	}
+	if len(list.Items) != 2 {
+		t.Fatalf("RunFunction() items = %d, want 2", len(list.Items))
+	}
+
+	generated := &list.Items[1]
+	if generated.Sops.LastModified != "2023-11-14T22:13:20Z" {
+		t.Errorf("RunFunction() lastmodified = %q", generated.Sops.LastModified)
+	}
+	if strings.Contains(output.String(), "literal-token") {
+		t.Errorf("RunFunction() output contains plain text value")
+	}
+
+	// The controller must be able to decrypt the generated resource
+	plainTextSopsSecret, err := controllers.DecryptSopsSecret(generated, true)
+	if err != nil {
+		t.Fatalf("DecryptSopsSecret() error = %v", err)
+	}
+	data := decodedData(t, &plainTextSopsSecret.Spec.SecretsTemplate[0])
+	if plainTextSopsSecret.Spec.SecretsTemplate[0].Name != "literal-secret" || data["token"] != "literal-token" {
+		t.Errorf("decrypted template = %+v", plainTextSopsSecret.Spec.SecretsTemplate[0])
+	}
+}
+
+func TestRunFunctionReportsErrors(t *testing.T) {
+	input := `apiVersion: config.kubernetes.io/v1
+kind: ResourceList
+items: []
+functionConfig:
+  apiVersion: v1
+  kind: ConfigMap
+  metadata:
+    name: wrong
+`
+	output := &bytes.Buffer{}
+	if err := RunFunction(strings.NewReader(input), output, testKeyDir); err == nil {
+		t.Fatalf("RunFunction() expected error")
+	}
+	if !strings.Contains(output.String(), "severity: error") {
+		t.Errorf("RunFunction() output must contain error result, got %s", output.String())
+	}
+}
@@ -0,0 +1,95 @@
+/* This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at https://mozilla.org/MPL/2.0/. */
+
+package generator
+
+import (
+	"fmt"
+	"io"
+
+	"sigs.k8s.io/yaml"
+)
+
+// KRM function specification:
+// https://github.com/kubernetes-sigs/kustomize/blob/master/cmd/config/docs/api-conventions/functions-spec.md
+const (
+	resourceListAPIVersion = "config.kubernetes.io/v1"
+	resourceListKind       = "ResourceList"
+)
+
+type resourceList struct {
+	APIVersion     string                   `json:"apiVersion"`
+	Kind           string                   `json:"kind"`
+	Items          []map[string]interface{} `json:"items"`
+	FunctionConfig *SopsSecretGenerator     `json:"functionConfig,omitempty"`
+	Results        []result                 `json:"results,omitempty"`
+}
+
+type result struct {
+	Message  string `json:"message"`
+	Severity string `json:"severity"`
+}
+
+// RunFunction reads a KRM ResourceList from in, appends generated SopsSecret
+// to the items and writes the ResourceList to out. On failure the error is
+// also reported in ResourceList results, as required by the specification.
+func RunFunction(in io.Reader, out io.Writer, baseDir string) error {
+	input, err := io.ReadAll(in)
+	if err != nil {
+		return err
+	}
+
+	list := &resourceList{}
+	if err := yaml.Unmarshal(input, list); err != nil {
+		return fmt.Errorf("failed to parse %s: %w", resourceListKind, err)
+	}
+	if list.Kind != resourceListKind {
+		return fmt.Errorf("expected %s input, found %q", resourceListKind, list.Kind)
+	}
+
+	generated, err := generate(list.FunctionConfig, baseDir)
+	if err != nil {
+		list.Results = append(list.Results, result{Message: err.Error(), Severity: "error"})
+	} else {
+		list.Items = append(list.Items, generated)
+	}
+	list.APIVersion = resourceListAPIVersion
+	list.FunctionConfig = nil
+
+	output, marshalErr := yaml.Marshal(list)
+	if marshalErr != nil {
+		return marshalErr
+	}
+	if _, writeErr := out.Write(output); writeErr != nil {
+		return writeErr
+	}
+	return err
+}
+
+func generate(config *SopsSecretGenerator, baseDir string) (map[string]interface{}, error) {
+	if config == nil {
+		return nil, fmt.Errorf("functionConfig must be specified")
+	}
+	if config.APIVersion != GeneratorAPIVersion || config.Kind != GeneratorKind {
+		return nil, fmt.Errorf(
+			"functionConfig must be %s %s, found %s %s",
+			GeneratorAPIVersion, GeneratorKind, config.APIVersion, config.Kind,
+		)
+	}
+
+	plainTextSopsSecret, err := Generate(config, baseDir)
+	if err != nil {
+		return nil, err
+	}
+	encrypted, err := Encrypt(plainTextSopsSecret, &config.Recipients)
+	if err != nil {
+		return nil, err
+	}
+
+	item := map[string]interface{}{}
+	if err := yaml.Unmarshal(encrypted, &item); err != nil {
+		return nil, err
+	}
+	return item, nil
+}
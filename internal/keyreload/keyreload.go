@@ -0,0 +1,315 @@
+/* This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at https://mozilla.org/MPL/2.0/. */
+
+// Package keyreload watches age key files and GPG keyring files mounted into
+// the operator and reloads key material without restart, so that keys
+// rotated in Secret volumes are used as soon as kubelet updates the volume
+package keyreload
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"filippo.io/age"
+	"github.com/go-logr/logr"
+)
+
+const (
+	// DefaultInterval is the default time between checks of watched files
+	DefaultInterval = 10 * time.Second
+
+	// keyringDirPrefix is the prefix of GnuPG homes created on reload
+	keyringDirPrefix = "keyring-"
+)
+
+// Options configures Reloader
+type Options struct {
+	// AgeKeyFiles are age key files, all identities are loaded on change
+	AgeKeyFiles []string
+	// GPGKeysDir is a directory with GnuPG home files, e.g. Secret volume
+	// with pubring.kbx and private-keys-v1.d, copied to a new GnuPG home on
+	// change, the current GnuPG home is returned by AcquireGnuPGHome
+	GPGKeysDir string
+	// GnuPGHome is the directory new GnuPG homes are created in
+	GnuPGHome string
+	// Interval is the time between checks of watched files
+	Interval time.Duration
+	// OnAgeIdentities is called with identities from all age key files
+	OnAgeIdentities func(identities []age.Identity)
+	// OnReload is called after key material is reloaded
+	OnReload func(ctx context.Context)
+}
+
+// Reloader polls watched files and reloads key material when their content
+// changes. Key material is replaced only when all files load, so decryption
+// never uses partially updated keys.
+type Reloader struct {
+	opts Options
+	log  logr.Logger
+
+	ageDigest string
+	gpgDigest string
+
+	mu sync.Mutex
+	// keyring is the current GnuPG home, nil until GPG keys are loaded
+	keyring *keyring
+	// retired are replaced GnuPG homes still used by decryption
+	retired map[*keyring]bool
+}
+
+// keyring is a GnuPG home created on reload
+type keyring struct {
+	home string
+	// refs is the number of decryptions using the keyring
+	refs int
+}
+
+// NewReloader creates key material reloader
+func NewReloader(opts Options, log logr.Logger) (*Reloader, error) {
+	if len(opts.AgeKeyFiles) == 0 && opts.GPGKeysDir == "" {
+		return nil, errors.New("no age key files or GPG keys directory to watch")
+	}
+	if opts.GPGKeysDir != "" && !filepath.IsAbs(opts.GnuPGHome) {
+		return nil, fmt.Errorf("GnuPG home %q must be an absolute path", opts.GnuPGHome)
+	}
+	if opts.Interval <= 0 {
+		opts.Interval = DefaultInterval
+	}
+	if len(opts.AgeKeyFiles) > 0 && opts.OnAgeIdentities == nil {
+		return nil, errors.New("age identities callback must be set to reload age key files")
+	}
+	return &Reloader{opts: opts, log: log, retired: map[*keyring]bool{}}, nil
+}
+
+// AcquireGnuPGHome returns the current GnuPG home, empty until GPG keys are
+// loaded. The GnuPG home is not removed on reload until release is called,
+// so decryption in progress uses keys of a single keyring.
+func (r *Reloader) AcquireGnuPGHome() (home string, release func()) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	current := r.keyring
+	if current == nil {
+		return "", func() {}
+	}
+	current.refs++
+	var once sync.Once
+	return current.home, func() {
+		once.Do(func() {
+			r.mu.Lock()
+			current.refs--
+			remove := r.retired[current] && current.refs == 0
+			if remove {
+				delete(r.retired, current)
+			}
+			r.mu.Unlock()
+			if remove {
+				r.removeKeyring(current.home)
+			}
+		})
+	}
+}
+
+// Start reloads key material on change until ctx is done
+func (r *Reloader) Start(ctx context.Context) error {
+	for {
+		if r.reload() {
+			if r.opts.OnReload != nil {
+				r.opts.OnReload(ctx)
+			}
+		}
+
+		timer := time.NewTimer(r.opts.Interval)
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return nil
+		case <-timer.C:
+		}
+	}
+}
+
+// NeedLeaderElection returns false, all replicas decrypt data keys
+func (r *Reloader) NeedLeaderElection() bool {
+	return false
+}
+
+// reload loads changed key material, returns true when any key material was
+// replaced
+func (r *Reloader) reload() bool {
+	reloaded := false
+	if len(r.opts.AgeKeyFiles) > 0 {
+		changed, err := r.reloadAgeKeys()
+		if err != nil {
+			r.log.Error(err, "Failed to reload age identities, previous identities are kept")
+		}
+		reloaded = reloaded || changed
+	}
+	if r.opts.GPGKeysDir != "" {
+		changed, err := r.reloadGPGKeys()
+		if err != nil {
+			r.log.Error(err, "Failed to reload GPG keyring, previous keyring is kept")
+		}
+		reloaded = reloaded || changed
+	}
+	return reloaded
+}
+
+func (r *Reloader) reloadAgeKeys() (bool, error) {
+	contents := make([][]byte, 0, len(r.opts.AgeKeyFiles))
+	for _, path := range r.opts.AgeKeyFiles {
+		content, err := os.ReadFile(path)
+		if err != nil {
+			return false, err
+		}
+		contents = append(contents, content)
+	}
+	digest := digestOf(contents...)
+	if digest == r.ageDigest {
+		return false, nil
+	}
+
+	var identities []age.Identity
+	for i, content := range contents {
+		parsed, err := age.ParseIdentities(bytes.NewReader(content))
+		if err != nil {
+			return false, fmt.Errorf("%s: %w", r.opts.AgeKeyFiles[i], err)
+		}
+		identities = append(identities, parsed...)
+	}
+	r.opts.OnAgeIdentities(identities)
+	r.ageDigest = digest
+	r.log.V(0).Info("Reloaded age identities", "files", r.opts.AgeKeyFiles, "identities", len(identities))
+	return true, nil
+}
+
+func (r *Reloader) reloadGPGKeys() (bool, error) {
+	files, err := readKeysDir(r.opts.GPGKeysDir)
+	if err != nil {
+		return false, err
+	}
+	contents := make([][]byte, 0, 2*len(files))
+	for _, file := range files {
+		contents = append(contents, []byte(file.path), file.content)
+	}
+	digest := digestOf(contents...)
+	if digest == r.gpgDigest {
+		return false, nil
+	}
+
+	home, err := os.MkdirTemp(r.opts.GnuPGHome, keyringDirPrefix)
+	if err != nil {
+		return false, err
+	}
+	if err := writeKeysDir(home, files); err != nil {
+		_ = os.RemoveAll(home)
+		return false, err
+	}
+	r.gpgDigest = digest
+	r.log.V(0).Info("Reloaded GPG keyring", "dir", r.opts.GPGKeysDir, "gnupgHome", home)
+
+	r.mu.Lock()
+	previous := r.keyring
+	r.keyring = &keyring{home: home}
+	remove := previous != nil && previous.refs == 0
+	if previous != nil && !remove {
+		r.retired[previous] = true
+	}
+	r.mu.Unlock()
+	if remove {
+		r.removeKeyring(previous.home)
+	}
+	return true, nil
+}
+
+// removeKeyring stops gpg-agent of GnuPG home no longer used and removes it
+func (r *Reloader) removeKeyring(home string) {
+	_ = exec.Command("gpgconf", "--homedir", home, "--kill", "gpg-agent").Run()
+	if err := os.RemoveAll(home); err != nil {
+		r.log.Error(err, "Failed to remove GPG keyring", "gnupgHome", home)
+	}
+}
+
+type keyFile struct {
+	path    string
+	mode    fs.FileMode
+	content []byte
+}
+
+// readKeysDir reads files of a directory recursively following symbolic
+// links, entries starting with ".." are skipped as those are internal to
+// Kubernetes volumes
+func readKeysDir(dir string) ([]keyFile, error) {
+	var files []keyFile
+	var walk func(rel string) error
+	walk = func(rel string) error {
+		entries, err := os.ReadDir(filepath.Join(dir, rel))
+		if err != nil {
+			return err
+		}
+		for _, entry := range entries {
+			if strings.HasPrefix(entry.Name(), "..") {
+				continue
+			}
+			path := filepath.Join(rel, entry.Name())
+			info, err := os.Stat(filepath.Join(dir, path))
+			if err != nil {
+				return err
+			}
+			if info.IsDir() {
+				if err := walk(path); err != nil {
+					return err
+				}
+				continue
+			}
+			content, err := os.ReadFile(filepath.Join(dir, path))
+			if err != nil {
+				return err
+			}
+			files = append(files, keyFile{path: path, mode: info.Mode().Perm(), content: content})
+		}
+		return nil
+	}
+	if err := walk(""); err != nil {
+		return nil, err
+	}
+	return files, nil
+}
+
+// writeKeysDir writes files into GnuPG home, which is accessible by the
+// owner only as GnuPG requires
+func writeKeysDir(home string, files []keyFile) error {
+	if err := os.Chmod(home, 0o700); err != nil {
+		return err
+	}
+	for _, file := range files {
+		path := filepath.Join(home, file.path)
+		if err := os.MkdirAll(filepath.Dir(path), 0o700); err != nil {
+			return err
+		}
+		if err := os.WriteFile(path, file.content, file.mode&0o600|0o400); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// digestOf returns digest of length prefixed contents
+func digestOf(contents ...[]byte) string {
+	h := sha256.New()
+	for _, content := range contents {
+		_, _ = fmt.Fprintf(h, "%d:", len(content))
+		_, _ = h.Write(content)
+	}
+	return fmt.Sprintf("%x", h.Sum(nil))
+}
@@ -0,0 +1,147 @@
+/* This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at https://mozilla.org/MPL/2.0/. */
+
+package keyreload
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"filippo.io/age"
+	"github.com/go-logr/logr"
+)
+
+func writeFile(t *testing.T, path, content string) {
+	t.Helper()
+	if err := os.MkdirAll(filepath.Dir(path), 0o700); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(path, []byte(content), 0o600); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestReloadAgeKeys(t *testing.T) {
+	first, err := age.GenerateX25519Identity()
+	if err != nil {
+		t.Fatal(err)
+	}
+	second, err := age.GenerateX25519Identity()
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyFile := filepath.Join(t.TempDir(), "keys.txt")
+	writeFile(t, keyFile, first.String()+"\n")
+
+	var loaded []age.Identity
+	r, err := NewReloader(Options{
+		AgeKeyFiles:     []string{keyFile},
+		OnAgeIdentities: func(identities []age.Identity) { loaded = identities },
+	}, logr.Discard())
+	if err != nil {
+		t.Fatalf("NewReloader() error = %v", err)
+	}
+	recipientOf := func() string {
+		t.Helper()
+		if len(loaded) != 1 {
+			t.Fatalf("expected 1 identity loaded, got %d", len(loaded))
+		}
+		return loaded[0].(*age.X25519Identity).Recipient().String()
+	}
+
+	if !r.reload() || recipientOf() != first.Recipient().String() {
+		t.Fatal("expected identity to be loaded on first reload")
+	}
+	if r.reload() {
+		t.Error("expected unchanged key file not to be reloaded")
+	}
+
+	// Invalid key file keeps previous identities
+	writeFile(t, keyFile, "AGE-SECRET-KEY-INVALID\n")
+	if r.reload() || recipientOf() != first.Recipient().String() {
+		t.Error("expected previous identity to be kept when key file is invalid")
+	}
+
+	writeFile(t, keyFile, second.String()+"\n")
+	if !r.reload() || recipientOf() != second.Recipient().String() {
+		t.Error("expected rotated identity to be loaded")
+	}
+}
+
+func TestReloadGPGKeys(t *testing.T) {
+	keysDir := t.TempDir()
+	gnupgHome := t.TempDir()
+	writeFile(t, filepath.Join(keysDir, "pubring.kbx"), "public keys")
+	writeFile(t, filepath.Join(keysDir, "private-keys-v1.d", "key.key"), "private key")
+	// Kubernetes volume internals are not copied
+	writeFile(t, filepath.Join(keysDir, "..data", "pubring.kbx"), "public keys")
+
+	r, err := NewReloader(Options{GPGKeysDir: keysDir, GnuPGHome: gnupgHome}, logr.Discard())
+	if err != nil {
+		t.Fatalf("NewReloader() error = %v", err)
+	}
+	if home, _ := r.AcquireGnuPGHome(); home != "" {
+		t.Fatalf("expected no GnuPG home before keys are loaded, got %q", home)
+	}
+	if !r.reload() {
+		t.Fatal("expected keyring to be loaded on first reload")
+	}
+	if os.Getenv("GNUPGHOME") != "" {
+		t.Error("expected GNUPGHOME environment variable not to be changed")
+	}
+	home, release := r.AcquireGnuPGHome()
+	if filepath.Dir(home) != gnupgHome {
+		t.Fatalf("expected GnuPG home in %s, got %q", gnupgHome, home)
+	}
+	if info, err := os.Stat(home); err != nil || info.Mode().Perm() != 0o700 {
+		t.Fatalf("expected GnuPG home accessible by owner only, got %v %v", info, err)
+	}
+	if content, err := os.ReadFile(filepath.Join(home, "private-keys-v1.d", "key.key")); err != nil || string(content) != "private key" {
+		t.Errorf("expected private key to be copied, got %q %v", content, err)
+	}
+	if _, err := os.Stat(filepath.Join(home, "..data")); !os.IsNotExist(err) {
+		t.Errorf("expected volume internals not to be copied, got %v", err)
+	}
+	if r.reload() {
+		t.Error("expected unchanged keyring not to be reloaded")
+	}
+
+	// Keyring used by decryption is kept until released, keyrings not used
+	// are removed on rotation
+	for _, content := range []string{"rotated key", "rotated key again"} {
+		writeFile(t, filepath.Join(keysDir, "private-keys-v1.d", "key.key"), content)
+		if !r.reload() {
+			t.Fatal("expected rotated keyring to be loaded")
+		}
+	}
+	if _, err := os.Stat(home); err != nil {
+		t.Errorf("expected keyring in use to be kept, got %v", err)
+	}
+	if entries, err := os.ReadDir(gnupgHome); err != nil || len(entries) != 2 {
+		t.Errorf("expected current keyring and keyring in use, got %d %v", len(entries), err)
+	}
+	release()
+	release()
+	if _, err := os.Stat(home); !os.IsNotExist(err) {
+		t.Errorf("expected released keyring to be removed, got %v", err)
+	}
+	current, release := r.AcquireGnuPGHome()
+	release()
+	if _, err := os.Stat(current); err != nil {
+		t.Errorf("expected current keyring to be kept, got %v", err)
+	}
+}
+
+func TestNewReloaderValidation(t *testing.T) {
+	if _, err := NewReloader(Options{}, logr.Discard()); err == nil {
+		t.Error("expected error without files to watch")
+	}
+	if _, err := NewReloader(Options{GPGKeysDir: "/keys", GnuPGHome: "gnupg"}, logr.Discard()); err == nil {
+		t.Error("expected error for relative GnuPG home")
+	}
+	if _, err := NewReloader(Options{AgeKeyFiles: []string{"keys.txt"}}, logr.Discard()); err == nil {
+		t.Error("expected error without age identities callback")
+	}
+}
@@ -0,0 +1,362 @@
+/* This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at https://mozilla.org/MPL/2.0/. */
+
+// Package kubectlplugin implements `kubectl sopssecret` plugin commands. The
+// plugin never decrypts SopsSecrets and never reads values of child secrets.
+package kubectlplugin
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"sort"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"k8s.io/apimachinery/pkg/api/meta"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/apimachinery/pkg/types"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+
+	isindirv1alpha3 "github.com/isindir/sops-secrets-operator/api/v1alpha3"
+)
+
+// Ownership states of child secrets
+const (
+	// OwnershipOwned - secret is controlled by the SopsSecret
+	OwnershipOwned = "Owned"
+	// OwnershipNotOwned - secret exists but is not controlled by the SopsSecret
+	OwnershipNotOwned = "NotOwned"
+	// OwnershipManaged - secret is not controlled by the SopsSecret yet, but
+	// is annotated to be taken over at the next reconciliation
+	OwnershipManaged = "Managed"
+	// OwnershipMissing - secret does not exist
+	OwnershipMissing = "Missing"
+	// OwnershipOrphaned - secret is controlled by the SopsSecret, but is not
+	// defined in its templates any more and will be garbage collected
+	OwnershipOrphaned = "Orphaned"
+)
+
+const (
+	OutputTable = "table"
+	OutputJSON  = "json"
+
+	encryptedValuePrefix = "ENC["
+)
+
+// corev1SecretListGVK is used to list metadata of child secrets
+var corev1SecretListGVK = schema.GroupVersionKind{Version: "v1", Kind: "SecretList"}
+
+// resyncPollInterval is the time between checks whether resync request was
+// handled by the operator
+var resyncPollInterval = time.Second
+
+// Plugin executes plugin commands against the cluster
+type Plugin struct {
+	Client client.Client
+	Out    io.Writer
+	Output string
+	// Wait is the maximum time resync waits for the operator to handle the
+	// request, resync does not wait when zero
+	Wait time.Duration
+}
+
+// SopsSecretInfo describes SopsSecret and its children
+type SopsSecretInfo struct {
+	Namespace string `json:"namespace"`
+	Name      string `json:"name"`
+	Status    string `json:"status"`
+	Suspended bool   `json:"suspended"`
+	// SuspendedBy is the reason of Suspended condition set by the operator:
+	// the object, its namespace or the global pause
+	SuspendedBy string      `json:"suspendedBy,omitempty"`
+	Children    []ChildInfo `json:"children"`
+	// EncryptedNames is set if some secret template names are encrypted,
+	// in which case only secrets owned by the SopsSecret can be listed
+	EncryptedNames bool `json:"encryptedNames,omitempty"`
+}
+
+// ChildInfo describes ownership state of a child secret
+type ChildInfo struct {
+	Name      string `json:"name"`
+	Ownership string `json:"ownership"`
+}
+
+// RecipientInfo describes a key SopsSecret is encrypted for
+type RecipientInfo struct {
+	Provider   string `json:"provider"`
+	Identifier string `json:"identifier"`
+	CreatedAt  string `json:"createdAt,omitempty"`
+	// KeyGroup is the index of sops key group the key belongs to, empty
+	// if SopsSecret is not encrypted with key groups
+	KeyGroup string `json:"keyGroup,omitempty"`
+}
+
+// Get shows SopsSecrets in the namespace (all namespaces if empty) with their
+// children. If name is set only that SopsSecret is shown.
+func (p *Plugin) Get(ctx context.Context, namespace string, name string) error {
+	var sopsSecrets []isindirv1alpha3.SopsSecret
+	if name != "" {
+		sopsSecret := &isindirv1alpha3.SopsSecret{}
+		if err := p.Client.Get(ctx, types.NamespacedName{Namespace: namespace, Name: name}, sopsSecret); err != nil {
+			return err
+		}
+		sopsSecrets = append(sopsSecrets, *sopsSecret)
+	} else {
+		sopsSecretList := &isindirv1alpha3.SopsSecretList{}
+		if err := p.Client.List(ctx, sopsSecretList, client.InNamespace(namespace)); err != nil {
+			return err
+		}
+		sopsSecrets = sopsSecretList.Items
+	}
+
+	secretsByNamespace := map[string][]metav1.PartialObjectMetadata{}
+	infos := []SopsSecretInfo{}
+	for i := range sopsSecrets {
+		sopsSecret := &sopsSecrets[i]
+		secrets, ok := secretsByNamespace[sopsSecret.Namespace]
+		if !ok {
+			// Only metadata is fetched, secret values are never read
+			secretList := &metav1.PartialObjectMetadataList{}
+			secretList.SetGroupVersionKind(corev1SecretListGVK)
+			if err := p.Client.List(ctx, secretList, client.InNamespace(sopsSecret.Namespace)); err != nil {
+				return err
+			}
+			secrets = secretList.Items
+			secretsByNamespace[sopsSecret.Namespace] = secrets
+		}
+		infos = append(infos, NewSopsSecretInfo(sopsSecret, secrets))
+	}
+
+	if p.Output == OutputJSON {
+		return p.writeJSON(infos)
+	}
+
+	writer := tabwriter.NewWriter(p.Out, 0, 8, 2, ' ', 0)
+	_, _ = fmt.Fprintln(writer, "NAMESPACE\tNAME\tSTATUS\tSUSPENDED\tCHILD\tOWNERSHIP")
+	for _, info := range infos {
+		if len(info.Children) == 0 {
+			_, _ = fmt.Fprintf(writer, "%s\t%s\t%s\t%t\t<none>\t\n", info.Namespace, info.Name, info.Status, info.Suspended)
+		}
+		for _, child := range info.Children {
+			_, _ = fmt.Fprintf(
+				writer, "%s\t%s\t%s\t%t\t%s\t%s\n",
+				info.Namespace, info.Name, info.Status, info.Suspended, child.Name, child.Ownership,
+			)
+		}
+	}
+	return writer.Flush()
+}
+
+// Resync requests reconciliation of the SopsSecret
+func (p *Plugin) Resync(ctx context.Context, key types.NamespacedName) error {
+	token := time.Now().UTC().Format(time.RFC3339Nano)
+	patch := map[string]interface{}{
+		"metadata": map[string]interface{}{
+			"annotations": map[string]string{
+				isindirv1alpha3.SopsSecretReconcileRequestAnnotation: token,
+			},
+		},
+	}
+	if err := p.mergePatch(ctx, key, patch); err != nil {
+		return err
+	}
+	if _, err := fmt.Fprintf(p.Out, "sopssecret %s/%s resync requested (%s)\n", key.Namespace, key.Name, token); err != nil {
+		return err
+	}
+	if p.Wait <= 0 {
+		return nil
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, p.Wait)
+	defer cancel()
+	ticker := time.NewTicker(resyncPollInterval)
+	defer ticker.Stop()
+	for {
+		sopsSecret := &isindirv1alpha3.SopsSecret{}
+		if err := p.Client.Get(ctx, key, sopsSecret); err != nil {
+			return err
+		}
+		if sopsSecret.Status.LastHandledReconcileAt == token {
+			_, err := fmt.Fprintf(p.Out, "sopssecret %s/%s resynced: %s\n", key.Namespace, key.Name, sopsSecret.Status.Message)
+			return err
+		}
+		select {
+		case <-ctx.Done():
+			return fmt.Errorf("sopssecret %s/%s resync was not handled within %s", key.Namespace, key.Name, p.Wait)
+		case <-ticker.C:
+		}
+	}
+}
+
+// SetSuspend suspends or resumes reconciliation of the SopsSecret
+func (p *Plugin) SetSuspend(ctx context.Context, key types.NamespacedName, suspend bool) error {
+	patch := map[string]interface{}{
+		"spec": map[string]interface{}{
+			"suspend": suspend,
+		},
+	}
+	if err := p.mergePatch(ctx, key, patch); err != nil {
+		return err
+	}
+	action := "resumed"
+	if suspend {
+		action = "suspended"
+	}
+	_, err := fmt.Fprintf(p.Out, "sopssecret %s/%s %s\n", key.Namespace, key.Name, action)
+	return err
+}
+
+// Recipients shows keys SopsSecret is encrypted for
+func (p *Plugin) Recipients(ctx context.Context, key types.NamespacedName) error {
+	sopsSecret := &isindirv1alpha3.SopsSecret{}
+	if err := p.Client.Get(ctx, key, sopsSecret); err != nil {
+		return err
+	}
+	recipients := SopsSecretRecipients(&sopsSecret.Sops)
+
+	if p.Output == OutputJSON {
+		return p.writeJSON(recipients)
+	}
+
+	writer := tabwriter.NewWriter(p.Out, 0, 8, 2, ' ', 0)
+	_, _ = fmt.Fprintln(writer, "PROVIDER\tIDENTIFIER\tCREATED\tKEY GROUP")
+	for _, recipient := range recipients {
+		_, _ = fmt.Fprintf(
+			writer, "%s\t%s\t%s\t%s\n",
+			recipient.Provider, recipient.Identifier, recipient.CreatedAt, recipient.KeyGroup,
+		)
+	}
+	return writer.Flush()
+}
+
+func (p *Plugin) mergePatch(ctx context.Context, key types.NamespacedName, patch map[string]interface{}) error {
+	patchData, err := json.Marshal(patch)
+	if err != nil {
+		return err
+	}
+	sopsSecret := &isindirv1alpha3.SopsSecret{}
+	sopsSecret.Namespace = key.Namespace
+	sopsSecret.Name = key.Name
+	return p.Client.Patch(ctx, sopsSecret, client.RawPatch(types.MergePatchType, patchData))
+}
+
+func (p *Plugin) writeJSON(value interface{}) error {
+	encoder := json.NewEncoder(p.Out)
+	encoder.SetIndent("", "  ")
+	return encoder.Encode(value)
+}
+
+// NewSopsSecretInfo computes ownership state of SopsSecret children from
+// metadata of secrets in the same namespace. Suspended state is taken from
+// the Suspended condition, which covers suspension by the object, its
+// namespace and the global pause.
+func NewSopsSecretInfo(sopsSecret *isindirv1alpha3.SopsSecret, secrets []metav1.PartialObjectMetadata) SopsSecretInfo {
+	info := SopsSecretInfo{
+		Namespace: sopsSecret.Namespace,
+		Name:      sopsSecret.Name,
+		Status:    sopsSecret.Status.Message,
+		Children:  []ChildInfo{},
+	}
+	if condition := meta.FindStatusCondition(
+		sopsSecret.Status.Conditions, isindirv1alpha3.ConditionTypeSuspended,
+	); condition != nil && condition.Status == metav1.ConditionTrue {
+		info.Suspended = true
+		info.SuspendedBy = condition.Reason
+	}
+
+	templateNames := map[string]bool{}
+	for _, template := range sopsSecret.Spec.SecretsTemplate {
+		if strings.HasPrefix(template.Name, encryptedValuePrefix) {
+			info.EncryptedNames = true
+			continue
+		}
+		templateNames[template.Name] = true
+	}
+
+	secretsByName := map[string]*metav1.PartialObjectMetadata{}
+	for i := range secrets {
+		secret := &secrets[i]
+		secretsByName[secret.Name] = secret
+		if metav1.IsControlledBy(secret, sopsSecret) && !templateNames[secret.Name] {
+			ownership := OwnershipOwned
+			if !info.EncryptedNames {
+				ownership = OwnershipOrphaned
+			}
+			info.Children = append(info.Children, ChildInfo{Name: secret.Name, Ownership: ownership})
+		}
+	}
+
+	for name := range templateNames {
+		child := ChildInfo{Name: name, Ownership: OwnershipMissing}
+		if secret, ok := secretsByName[name]; ok {
+			switch {
+			case metav1.IsControlledBy(secret, sopsSecret):
+				child.Ownership = OwnershipOwned
+			case secret.Annotations[isindirv1alpha3.SopsSecretManagedAnnotation] == "true":
+				child.Ownership = OwnershipManaged
+			default:
+				child.Ownership = OwnershipNotOwned
+			}
+		}
+		info.Children = append(info.Children, child)
+	}
+
+	sort.Slice(info.Children, func(i, j int) bool {
+		return info.Children[i].Name < info.Children[j].Name
+	})
+	return info
+}
+
+// SopsSecretRecipients lists keys from sops metadata, encrypted data keys are omitted
+func SopsSecretRecipients(metadata *isindirv1alpha3.SopsMetadata) []RecipientInfo {
+	recipients := keyGroupRecipients(isindirv1alpha3.KeyGroup{
+		AwsKms:   metadata.AwsKms,
+		Pgp:      metadata.Pgp,
+		AzureKms: metadata.AzureKms,
+		HcVault:  metadata.HcVault,
+		GcpKms:   metadata.GcpKms,
+		Age:      metadata.Age,
+	}, "")
+	for i, keyGroup := range metadata.KeyGroups {
+		recipients = append(recipients, keyGroupRecipients(keyGroup, strconv.Itoa(i))...)
+	}
+	return recipients
+}
+
+func keyGroupRecipients(keyGroup isindirv1alpha3.KeyGroup, group string) []RecipientInfo {
+	recipients := []RecipientInfo{}
+	for _, key := range keyGroup.AwsKms {
+		identifier := key.Arn
+		if key.Role != "" {
+			identifier = fmt.Sprintf("%s (role: %s)", identifier, key.Role)
+		}
+		recipients = append(recipients, RecipientInfo{Provider: "kms", Identifier: identifier, CreatedAt: key.CreationDate, KeyGroup: group})
+	}
+	for _, key := range keyGroup.Pgp {
+		recipients = append(recipients, RecipientInfo{Provider: "pgp", Identifier: key.FingerPrint, CreatedAt: key.CreationDate, KeyGroup: group})
+	}
+	for _, key := range keyGroup.AzureKms {
+		identifier := strings.TrimSuffix(key.VaultURL, "/") + "/keys/" + key.KeyName
+		if key.Version != "" {
+			identifier = identifier + "/" + key.Version
+		}
+		recipients = append(recipients, RecipientInfo{Provider: "azure_kv", Identifier: identifier, CreatedAt: key.CreationDate, KeyGroup: group})
+	}
+	for _, key := range keyGroup.HcVault {
+		identifier := fmt.Sprintf("%s/v1/%s/keys/%s", strings.TrimSuffix(key.VaultAddress, "/"), key.EnginePath, key.KeyName)
+		recipients = append(recipients, RecipientInfo{Provider: "hc_vault", Identifier: identifier, CreatedAt: key.CreationDate, KeyGroup: group})
+	}
+	for _, key := range keyGroup.GcpKms {
+		recipients = append(recipients, RecipientInfo{Provider: "gcp_kms", Identifier: key.VaultURL, CreatedAt: key.CreationDate, KeyGroup: group})
+	}
+	for _, key := range keyGroup.Age {
+		recipients = append(recipients, RecipientInfo{Provider: "age", Identifier: key.Recipient, KeyGroup: group})
+	}
+	return recipients
+}
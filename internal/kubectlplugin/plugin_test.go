@@ -0,0 +1,285 @@
+/* This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at https://mozilla.org/MPL/2.0/. */
+
+package kubectlplugin
+
+import (
+	"bytes"
+	"context"
+	"strings"
+	"testing"
+	"time"
+
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/types"
+	clientgoscheme "k8s.io/client-go/kubernetes/scheme"
+	"k8s.io/utils/ptr"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/client/fake"
+	"sigs.k8s.io/controller-runtime/pkg/client/interceptor"
+
+	isindirv1alpha3 "github.com/isindir/sops-secrets-operator/api/v1alpha3"
+)
+
+const encryptedValue = "ENC[AES256_GCM,data:abc=,iv:abc=,tag:abc=,type:str]"
+
+func newTestSopsSecret(templateNames ...string) *isindirv1alpha3.SopsSecret {
+	sopsSecret := &isindirv1alpha3.SopsSecret{
+		ObjectMeta: metav1.ObjectMeta{Name: "test-sopssecret", Namespace: "default", UID: "sopssecret-uid"},
+		Status:     isindirv1alpha3.SopsSecretStatus{Message: "Healthy"},
+		Sops: isindirv1alpha3.SopsMetadata{
+			Age: []isindirv1alpha3.AgeItem{{Recipient: "age1recipient", EncryptedKey: "age-encrypted-data-key"}},
+			Pgp: []isindirv1alpha3.PgpDataItem{{FingerPrint: "FINGERPRINT", EncryptedKey: "pgp-encrypted-data-key", CreationDate: "2026-01-01T00:00:00Z"}},
+		},
+	}
+	for _, name := range templateNames {
+		sopsSecret.Spec.SecretsTemplate = append(sopsSecret.Spec.SecretsTemplate, isindirv1alpha3.SopsSecretTemplate{
+			Name:       name,
+			StringData: map[string]string{"token": encryptedValue},
+		})
+	}
+	return sopsSecret
+}
+
+func newTestSecret(name string, owner *isindirv1alpha3.SopsSecret, annotations map[string]string) corev1.Secret {
+	secret := corev1.Secret{
+		ObjectMeta: metav1.ObjectMeta{Name: name, Namespace: "default", Annotations: annotations},
+		Type:       corev1.SecretTypeOpaque,
+		Data:       map[string][]byte{"token": []byte("plain-text-value")},
+	}
+	if owner != nil {
+		secret.OwnerReferences = []metav1.OwnerReference{{
+			APIVersion: isindirv1alpha3.GroupVersion.String(),
+			Kind:       "SopsSecret",
+			Name:       owner.Name,
+			UID:        owner.UID,
+			Controller: ptr.To(true),
+		}}
+	}
+	return secret
+}
+
+// secretsMetadata returns metadata of secrets as listed by the plugin
+func secretsMetadata(secrets ...corev1.Secret) []metav1.PartialObjectMetadata {
+	metadata := []metav1.PartialObjectMetadata{}
+	for _, secret := range secrets {
+		metadata = append(metadata, metav1.PartialObjectMetadata{ObjectMeta: secret.ObjectMeta})
+	}
+	return metadata
+}
+
+func newTestPlugin(t *testing.T, output string, objects ...runtime.Object) (*Plugin, *bytes.Buffer) {
+	t.Helper()
+	scheme := runtime.NewScheme()
+	if err := clientgoscheme.AddToScheme(scheme); err != nil {
+		t.Fatal(err)
+	}
+	if err := isindirv1alpha3.AddToScheme(scheme); err != nil {
+		t.Fatal(err)
+	}
+	out := &bytes.Buffer{}
+	k8sClient := fake.NewClientBuilder().WithScheme(scheme).WithRuntimeObjects(objects...).Build()
+	return &Plugin{Client: k8sClient, Out: out, Output: output}, out
+}
+
+func TestNewSopsSecretInfo(t *testing.T) {
+	sopsSecret := newTestSopsSecret("owned", "not-owned", "managed", "missing")
+	otherOwner := newTestSopsSecret()
+	otherOwner.Name, otherOwner.UID = "other", "other-uid"
+	secrets := secretsMetadata(
+		newTestSecret("owned", sopsSecret, nil),
+		newTestSecret("not-owned", otherOwner, nil),
+		newTestSecret("managed", nil, map[string]string{isindirv1alpha3.SopsSecretManagedAnnotation: "true"}),
+		newTestSecret("orphaned", sopsSecret, nil),
+		newTestSecret("unrelated", nil, nil),
+	)
+
+	info := NewSopsSecretInfo(sopsSecret, secrets)
+
+	expected := map[string]string{
+		"owned":     OwnershipOwned,
+		"not-owned": OwnershipNotOwned,
+		"managed":   OwnershipManaged,
+		"missing":   OwnershipMissing,
+		"orphaned":  OwnershipOrphaned,
+	}
+	if len(info.Children) != len(expected) {
+		t.Fatalf("NewSopsSecretInfo() children = %+v, want %d children", info.Children, len(expected))
+	}
+	for _, child := range info.Children {
+		if expected[child.Name] != child.Ownership {
+			t.Errorf("NewSopsSecretInfo() child %s ownership = %s, want %s", child.Name, child.Ownership, expected[child.Name])
+		}
+	}
+}
+
+func TestNewSopsSecretInfoEncryptedNames(t *testing.T) {
+	sopsSecret := newTestSopsSecret(encryptedValue)
+	secrets := secretsMetadata(newTestSecret("owned", sopsSecret, nil))
+
+	info := NewSopsSecretInfo(sopsSecret, secrets)
+
+	if !info.EncryptedNames {
+		t.Errorf("NewSopsSecretInfo() EncryptedNames = false, want true")
+	}
+	if len(info.Children) != 1 || info.Children[0].Ownership != OwnershipOwned {
+		t.Errorf("NewSopsSecretInfo() children = %+v, want single owned child", info.Children)
+	}
+}
+
+func TestNewSopsSecretInfoSuspended(t *testing.T) {
+	sopsSecret := newTestSopsSecret("owned")
+
+	if info := NewSopsSecretInfo(sopsSecret, nil); info.Suspended {
+		t.Errorf("NewSopsSecretInfo() Suspended = true without Suspended condition")
+	}
+
+	// Namespace suspension and global pause are only visible in the condition
+	sopsSecret.Status.Conditions = []metav1.Condition{{
+		Type:   isindirv1alpha3.ConditionTypeSuspended,
+		Status: metav1.ConditionTrue,
+		Reason: "NamespaceSuspended",
+	}}
+	info := NewSopsSecretInfo(sopsSecret, nil)
+	if !info.Suspended || info.SuspendedBy != "NamespaceSuspended" {
+		t.Errorf("NewSopsSecretInfo() Suspended = %t, SuspendedBy = %q, want suspended by namespace", info.Suspended, info.SuspendedBy)
+	}
+}
+
+func TestGet(t *testing.T) {
+	sopsSecret := newTestSopsSecret("owned")
+	secret := newTestSecret("owned", sopsSecret, nil)
+	plugin, out := newTestPlugin(t, OutputTable, sopsSecret, &secret)
+	plugin.Client = interceptor.NewClient(plugin.Client.(client.WithWatch), interceptor.Funcs{
+		List: func(ctx context.Context, c client.WithWatch, list client.ObjectList, opts ...client.ListOption) error {
+			if _, ok := list.(*corev1.SecretList); ok {
+				t.Fatal("Get() must list only metadata of secrets")
+			}
+			return c.List(ctx, list, opts...)
+		},
+	})
+
+	if err := plugin.Get(context.Background(), "", ""); err != nil {
+		t.Fatalf("Get() error = %v", err)
+	}
+	if !strings.Contains(out.String(), "test-sopssecret") || !strings.Contains(out.String(), OwnershipOwned) {
+		t.Errorf("Get() output = %q", out.String())
+	}
+	if strings.Contains(out.String(), "plain-text-value") {
+		t.Errorf("Get() output contains secret value")
+	}
+}
+
+func TestSetSuspendAndResync(t *testing.T) {
+	sopsSecret := newTestSopsSecret("owned")
+	plugin, _ := newTestPlugin(t, OutputTable, sopsSecret)
+	ctx := context.Background()
+	key := types.NamespacedName{Namespace: "default", Name: "test-sopssecret"}
+
+	if err := plugin.SetSuspend(ctx, key, true); err != nil {
+		t.Fatalf("SetSuspend() error = %v", err)
+	}
+	if err := plugin.Resync(ctx, key); err != nil {
+		t.Fatalf("Resync() error = %v", err)
+	}
+
+	updated := &isindirv1alpha3.SopsSecret{}
+	if err := plugin.Client.Get(ctx, key, updated); err != nil {
+		t.Fatal(err)
+	}
+	if !updated.Spec.Suspend {
+		t.Errorf("SetSuspend() spec.suspend = false, want true")
+	}
+	if updated.Annotations[isindirv1alpha3.SopsSecretReconcileRequestAnnotation] == "" {
+		t.Errorf("Resync() must set %s annotation", isindirv1alpha3.SopsSecretReconcileRequestAnnotation)
+	}
+
+	if err := plugin.SetSuspend(ctx, key, false); err != nil {
+		t.Fatalf("SetSuspend() error = %v", err)
+	}
+	if err := plugin.Client.Get(ctx, key, updated); err != nil {
+		t.Fatal(err)
+	}
+	if updated.Spec.Suspend {
+		t.Errorf("SetSuspend() spec.suspend = true, want false")
+	}
+}
+
+func TestResyncWait(t *testing.T) {
+	resyncPollInterval = 10 * time.Millisecond
+	plugin, out := newTestPlugin(t, OutputTable, newTestSopsSecret("owned"))
+	key := types.NamespacedName{Namespace: "default", Name: "test-sopssecret"}
+
+	// Request is not handled without operator
+	plugin.Wait = 50 * time.Millisecond
+	if err := plugin.Resync(context.Background(), key); err == nil || !strings.Contains(err.Error(), "not handled") {
+		t.Fatalf("expected resync to time out, got %v", err)
+	}
+
+	// Operator echoes the request token after a few polls
+	gets := 0
+	plugin.Client = interceptor.NewClient(plugin.Client.(client.WithWatch), interceptor.Funcs{
+		Get: func(ctx context.Context, c client.WithWatch, key client.ObjectKey, obj client.Object, opts ...client.GetOption) error {
+			if err := c.Get(ctx, key, obj, opts...); err != nil {
+				return err
+			}
+			if sopsSecret, ok := obj.(*isindirv1alpha3.SopsSecret); ok {
+				if gets++; gets > 2 {
+					sopsSecret.Status.Message = "Healthy"
+					sopsSecret.Status.LastHandledReconcileAt = sopsSecret.Annotations[isindirv1alpha3.SopsSecretReconcileRequestAnnotation]
+				}
+			}
+			return nil
+		},
+	})
+	plugin.Wait = time.Second
+	out.Reset()
+	if err := plugin.Resync(context.Background(), key); err != nil {
+		t.Fatalf("Resync() error = %v", err)
+	}
+	if !strings.Contains(out.String(), "resynced: Healthy") {
+		t.Errorf("Resync() output = %q", out.String())
+	}
+}
+
+func TestRecipients(t *testing.T) {
+	plugin, out := newTestPlugin(t, OutputJSON, newTestSopsSecret("owned"))
+
+	if err := plugin.Recipients(context.Background(), types.NamespacedName{Namespace: "default", Name: "test-sopssecret"}); err != nil {
+		t.Fatalf("Recipients() error = %v", err)
+	}
+	if !strings.Contains(out.String(), "age1recipient") || !strings.Contains(out.String(), "FINGERPRINT") {
+		t.Errorf("Recipients() output = %q", out.String())
+	}
+	if strings.Contains(out.String(), "encrypted-data-key") {
+		t.Errorf("Recipients() output must not contain encrypted data keys")
+	}
+}
+
+func TestSopsSecretRecipientsKeyGroups(t *testing.T) {
+	metadata := &isindirv1alpha3.SopsMetadata{
+		KeyGroups: []isindirv1alpha3.KeyGroup{
+			{Age: []isindirv1alpha3.AgeItem{{Recipient: "age1first", EncryptedKey: "encrypted-data-key"}}},
+			{AwsKms: []isindirv1alpha3.KmsDataItem{{Arn: "arn:aws:kms:eu-west-1:000000000000:key/second"}}},
+		},
+		ShamirThreshold: 2,
+	}
+
+	recipients := SopsSecretRecipients(metadata)
+
+	expected := []RecipientInfo{
+		{Provider: "age", Identifier: "age1first", KeyGroup: "0"},
+		{Provider: "kms", Identifier: "arn:aws:kms:eu-west-1:000000000000:key/second", KeyGroup: "1"},
+	}
+	if len(recipients) != len(expected) {
+		t.Fatalf("SopsSecretRecipients() = %+v, want %+v", recipients, expected)
+	}
+	for i := range expected {
+		if recipients[i] != expected[i] {
+			t.Errorf("SopsSecretRecipients()[%d] = %+v, want %+v", i, recipients[i], expected[i])
+		}
+	}
+}
@@ -0,0 +1,469 @@
+/* This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at https://mozilla.org/MPL/2.0/. */
+
+// Package lint validates SopsSecret manifests before they are applied to the
+// cluster, reporting the problems the operator would otherwise only surface at
+// reconciliation time.
+package lint
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io"
+	"regexp"
+	"sort"
+	"strings"
+
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	utilyaml "k8s.io/apimachinery/pkg/util/yaml"
+	"sigs.k8s.io/yaml"
+
+	isindirv1alpha3 "github.com/isindir/sops-secrets-operator/api/v1alpha3"
+	"github.com/isindir/sops-secrets-operator/internal/controllers"
+)
+
+// Severity of a lint finding
+type Severity string
+
+const (
+	SeverityError   Severity = "error"
+	SeverityWarning Severity = "warning"
+)
+
+// Finding codes, stable identifiers which can be used to filter lint output
+const (
+	CodeParseError             = "parse-error"
+	CodeUnknownField           = "unknown-field"
+	CodeUnsupportedAPIVersion  = "unsupported-api-version"
+	CodeNoTemplates            = "no-templates"
+	CodeTemplateNameMissing    = "template-name-missing"
+	CodeDuplicateTemplateName  = "duplicate-template-name"
+	CodeInvalidBase64          = "invalid-base64"
+	CodeInvalidTemplate        = "invalid-template"
+	CodeUnencryptedValue       = "unencrypted-value"
+	CodeCommentSelector        = "comment-selector"
+	CodeMissingSopsMetadata    = "missing-sops-metadata"
+	CodeNoRecipients           = "no-recipients"
+	CodeInvalidShamirThreshold = "invalid-shamir-threshold"
+	CodeUnsupportedSopsVersion = "unsupported-sops-version"
+	CodeSopsFeatureVersion     = "sops-feature-version"
+	CodeDecryptionFailed       = "decryption-failed"
+	CodeMACMismatch            = "mac-mismatch"
+)
+
+const sopsSecretKind = "SopsSecret"
+
+// Finding is a single problem found in a SopsSecret manifest. Findings never
+// contain secret values, neither encrypted nor decrypted.
+type Finding struct {
+	File     string   `json:"file"`
+	Object   string   `json:"object,omitempty"`
+	Template string   `json:"template,omitempty"`
+	Field    string   `json:"field,omitempty"`
+	Severity Severity `json:"severity"`
+	Code     string   `json:"code"`
+	Message  string   `json:"message"`
+}
+
+// Options controls which checks are performed
+type Options struct {
+	// Decrypt enables checks which require decryption of the SopsSecret
+	// using the key material available to the current process.
+	Decrypt bool
+	// VerifyMAC additionally verifies sops MAC of secret templates the way
+	// the controller does with --verify-mac, implies Decrypt.
+	VerifyMAC bool
+}
+
+// Report aggregates findings for all linted files
+type Report struct {
+	Files    int       `json:"files"`
+	Objects  int       `json:"objects"`
+	Errors   int       `json:"errors"`
+	Warnings int       `json:"warnings"`
+	Findings []Finding `json:"findings"`
+}
+
+// Lint checks all SopsSecret documents found in the content and adds the
+// findings to the report. Documents of other kinds are ignored.
+func (r *Report) Lint(file string, content []byte, opts Options) {
+	r.Files++
+
+	reader := utilyaml.NewYAMLReader(bufio.NewReader(bytes.NewReader(content)))
+	for {
+		document, err := reader.Read()
+		if errors.Is(err, io.EOF) {
+			return
+		}
+		if err != nil {
+			r.add(Finding{File: file, Severity: SeverityError, Code: CodeParseError, Message: err.Error()})
+			return
+		}
+		r.lintDocument(file, document, opts)
+	}
+}
+
+// HasErrors returns true if the report contains findings with error severity,
+// or any findings at all when warnings are treated as errors.
+func (r *Report) HasErrors(warningsAsErrors bool) bool {
+	return r.Errors > 0 || (warningsAsErrors && r.Warnings > 0)
+}
+
+func (r *Report) add(findings ...Finding) {
+	for _, finding := range findings {
+		switch finding.Severity {
+		case SeverityError:
+			r.Errors++
+		case SeverityWarning:
+			r.Warnings++
+		}
+		r.Findings = append(r.Findings, finding)
+	}
+}
+
+func (r *Report) lintDocument(file string, document []byte, opts Options) {
+	typeMeta := metav1.TypeMeta{}
+	if err := yaml.Unmarshal(document, &typeMeta); err != nil {
+		r.add(Finding{File: file, Severity: SeverityError, Code: CodeParseError, Message: err.Error()})
+		return
+	}
+	if typeMeta.Kind != sopsSecretKind {
+		return
+	}
+	r.Objects++
+
+	sopsSecret := &isindirv1alpha3.SopsSecret{}
+	if err := yaml.Unmarshal(document, sopsSecret); err != nil {
+		r.add(Finding{File: file, Severity: SeverityError, Code: CodeParseError, Message: err.Error()})
+		return
+	}
+	object := objectName(sopsSecret)
+
+	if typeMeta.APIVersion != isindirv1alpha3.GroupVersion.String() {
+		r.add(Finding{
+			File:     file,
+			Object:   object,
+			Severity: SeverityWarning,
+			Code:     CodeUnsupportedAPIVersion,
+			Message:  fmt.Sprintf("only %s SopsSecret objects are linted, found %s", isindirv1alpha3.GroupVersion.String(), typeMeta.APIVersion),
+		})
+		return
+	}
+
+	// Fields unknown to the CRD are pruned by the API server, which can
+	// silently change how sops metadata is interpreted.
+	if err := yaml.UnmarshalStrict(document, &isindirv1alpha3.SopsSecret{}); err != nil {
+		r.add(Finding{File: file, Object: object, Severity: SeverityWarning, Code: CodeUnknownField, Message: err.Error()})
+	}
+
+	r.add(Check(file, sopsSecret, opts)...)
+}
+
+// Check runs all checks against a single SopsSecret object
+func Check(file string, sopsSecret *isindirv1alpha3.SopsSecret, opts Options) []Finding {
+	object := objectName(sopsSecret)
+	findings := checkSopsMetadata(&sopsSecret.Sops)
+	findings = append(findings, checkTemplates(sopsSecret.Spec.SecretsTemplate, &sopsSecret.Sops)...)
+
+	if (opts.Decrypt || opts.VerifyMAC) && !hasErrorFinding(findings, CodeMissingSopsMetadata) {
+		verifyMAC := opts.VerifyMAC || sopsSecret.Spec.VerifyMac
+		plainTextSopsSecret, err := controllers.DecryptSopsSecret(sopsSecret, verifyMAC)
+		switch {
+		case errors.Is(err, controllers.ErrUnsupportedSopsVersion):
+			// reported by sops metadata checks
+		case errors.Is(err, controllers.ErrMACMismatch):
+			findings = append(findings, Finding{
+				Field:    "sops.mac",
+				Severity: SeverityError,
+				Code:     CodeMACMismatch,
+				Message:  err.Error() + ", values were changed after encryption or metadata was added, encrypt with sops --mac-only-encrypted to exclude unencrypted values",
+			})
+		case err != nil:
+			findings = append(findings, Finding{
+				Severity: SeverityError,
+				Code:     CodeDecryptionFailed,
+				Message:  err.Error(),
+			})
+		default:
+			findings = appendUnique(findings, checkTemplates(plainTextSopsSecret.Spec.SecretsTemplate, nil)...)
+			findings = appendUnique(findings, checkControllerTemplates(plainTextSopsSecret, findings)...)
+		}
+	}
+
+	for i := range findings {
+		findings[i].File = file
+		findings[i].Object = object
+	}
+	return findings
+}
+
+func checkSopsMetadata(metadata *isindirv1alpha3.SopsMetadata) []Finding {
+	recipients := len(metadata.AwsKms) + len(metadata.Pgp) + len(metadata.AzureKms) +
+		len(metadata.HcVault) + len(metadata.GcpKms) + len(metadata.Age)
+	for _, keyGroup := range metadata.KeyGroups {
+		recipients += len(keyGroup.AwsKms) + len(keyGroup.Pgp) + len(keyGroup.AzureKms) +
+			len(keyGroup.HcVault) + len(keyGroup.GcpKms) + len(keyGroup.Age)
+	}
+
+	if recipients == 0 && metadata.Mac == "" && metadata.Version == "" {
+		return []Finding{{
+			Field:    "sops",
+			Severity: SeverityError,
+			Code:     CodeMissingSopsMetadata,
+			Message:  "sops metadata is missing, object is not encrypted with sops",
+		}}
+	}
+
+	var findings []Finding
+	if recipients == 0 {
+		findings = append(findings, Finding{
+			Field:    "sops",
+			Severity: SeverityError,
+			Code:     CodeNoRecipients,
+			Message:  "sops metadata does not list any key which can decrypt the object",
+		})
+	}
+	if metadata.ShamirThreshold < 0 || metadata.ShamirThreshold > max(len(metadata.KeyGroups), 1) {
+		findings = append(findings, Finding{
+			Field:    "sops.shamir_threshold",
+			Severity: SeverityError,
+			Code:     CodeInvalidShamirThreshold,
+			Message: fmt.Sprintf(
+				"shamir threshold %d can not be satisfied by %d key groups",
+				metadata.ShamirThreshold, len(metadata.KeyGroups),
+			),
+		})
+	}
+	if metadata.EncryptedCommentRegex != "" {
+		findings = append(findings, Finding{
+			Field:    "sops.encrypted_comment_regex",
+			Severity: SeverityError,
+			Code:     CodeCommentSelector,
+			Message:  "values selected by comments can not be decrypted, Kubernetes API does not preserve comments",
+		})
+	}
+	if metadata.UnencryptedCommentRegex != "" {
+		findings = append(findings, Finding{
+			Field:    "sops.unencrypted_comment_regex",
+			Severity: SeverityWarning,
+			Code:     CodeCommentSelector,
+			Message:  "values left unencrypted by comments can not be decrypted, Kubernetes API does not preserve comments",
+		})
+	}
+	findings = append(findings, checkSopsVersion(metadata.Version)...)
+	for _, warning := range controllers.SopsFeatureWarnings(metadata) {
+		findings = append(findings, Finding{
+			Field:    warning.Field,
+			Severity: SeverityWarning,
+			Code:     CodeSopsFeatureVersion,
+			Message:  warning.Message,
+		})
+	}
+	return findings
+}
+
+// checkSopsVersion reports versions the operator refuses to decrypt as
+// errors and versions it decrypts with compatibility warnings as warnings
+func checkSopsVersion(version string) []Finding {
+	if err := controllers.CheckSopsVersion(version); err != nil {
+		return []Finding{{Field: "sops.version", Severity: SeverityError, Code: CodeUnsupportedSopsVersion, Message: err.Error()}}
+	}
+	var findings []Finding
+	for _, warning := range controllers.SopsVersionWarnings(version) {
+		findings = append(findings, Finding{
+			Field:    warning.Field,
+			Severity: SeverityWarning,
+			Code:     CodeUnsupportedSopsVersion,
+			Message:  warning.Message,
+		})
+	}
+	return findings
+}
+
+// checkTemplates validates secret templates, when sops metadata is set values
+// must be sops encrypted, unless metadata selectors leave them unencrypted, and
+// checks requiring plain text are only performed for values which are not
+// encrypted.
+func checkTemplates(templates []isindirv1alpha3.SopsSecretTemplate, metadata *isindirv1alpha3.SopsMetadata) []Finding {
+	requireEncrypted := func(path ...string) bool {
+		return metadata != nil && !leftUnencrypted(metadata, path...)
+	}
+
+	if len(templates) == 0 {
+		return []Finding{{
+			Field:    "spec.secretTemplates",
+			Severity: SeverityError,
+			Code:     CodeNoTemplates,
+			Message:  "at least one secret template must be defined",
+		}}
+	}
+
+	var findings []Finding
+	seenNames := map[string]int{}
+	for i, template := range templates {
+		field := fmt.Sprintf("spec.secretTemplates[%d]", i)
+		name := template.Name
+		if isEncrypted(name) {
+			name = ""
+		}
+
+		switch {
+		case template.Name == "":
+			findings = append(findings, Finding{
+				Field:    field + ".name",
+				Severity: SeverityError,
+				Code:     CodeTemplateNameMissing,
+				Message:  "secret template name must be specified and not empty string",
+			})
+		case name != "":
+			if previous, ok := seenNames[name]; ok {
+				findings = append(findings, Finding{
+					Template: name,
+					Field:    field + ".name",
+					Severity: SeverityError,
+					Code:     CodeDuplicateTemplateName,
+					Message:  fmt.Sprintf("secret template name is already used by spec.secretTemplates[%d]", previous),
+				})
+			} else {
+				seenNames[name] = i
+			}
+		}
+
+		for _, key := range sortedKeys(template.StringData) {
+			if requireEncrypted("stringData", key) && !isEncrypted(template.StringData[key]) {
+				findings = append(findings, unencryptedValueFinding(name, fmt.Sprintf("%s.stringData.%s", field, key)))
+			}
+		}
+		for _, key := range sortedKeys(template.Data) {
+			value := template.Data[key]
+			if isEncrypted(value) {
+				continue
+			}
+			keyField := fmt.Sprintf("%s.data.%s", field, key)
+			if requireEncrypted("data", key) {
+				findings = append(findings, unencryptedValueFinding(name, keyField))
+			}
+			if _, err := base64.StdEncoding.DecodeString(value); err != nil {
+				findings = append(findings, Finding{
+					Template: name,
+					Field:    keyField,
+					Severity: SeverityError,
+					Code:     CodeInvalidBase64,
+					Message:  "data value is not a valid base64 string",
+				})
+			}
+		}
+	}
+	return findings
+}
+
+// checkControllerTemplates runs the controller's own template validation for
+// templates which have no findings yet, to catch anything not covered above.
+func checkControllerTemplates(plainTextSopsSecret *isindirv1alpha3.SopsSecret, findings []Finding) []Finding {
+	var controllerFindings []Finding
+	for i := range plainTextSopsSecret.Spec.SecretsTemplate {
+		field := fmt.Sprintf("spec.secretTemplates[%d]", i)
+		if hasFindingsForField(findings, field) {
+			continue
+		}
+		template := &plainTextSopsSecret.Spec.SecretsTemplate[i]
+		if err := controllers.ValidateSecretTemplate(plainTextSopsSecret, template); err != nil {
+			controllerFindings = append(controllerFindings, Finding{
+				Template: template.Name,
+				Field:    field,
+				Severity: SeverityError,
+				Code:     CodeInvalidTemplate,
+				Message:  err.Error(),
+			})
+		}
+	}
+	return controllerFindings
+}
+
+func unencryptedValueFinding(template string, field string) Finding {
+	return Finding{
+		Template: template,
+		Field:    field,
+		Severity: SeverityError,
+		Code:     CodeUnencryptedValue,
+		Message:  "value is not encrypted, check sops encrypted_suffix/encrypted_regex settings",
+	}
+}
+
+// leftUnencrypted checks if sops unencrypted_suffix or unencrypted_regex
+// selectors leave the value under the given path of secret template
+// unencrypted
+func leftUnencrypted(metadata *isindirv1alpha3.SopsMetadata, path ...string) bool {
+	path = append([]string{"spec", "secretTemplates"}, path...)
+	for _, element := range path {
+		if metadata.UnencryptedSuffix != "" && strings.HasSuffix(element, metadata.UnencryptedSuffix) {
+			return true
+		}
+		if metadata.UnencryptedRegex != "" {
+			if matched, _ := regexp.MatchString(metadata.UnencryptedRegex, element); matched {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// isEncrypted checks if the value has sops encrypted value format
+func isEncrypted(value string) bool {
+	return strings.HasPrefix(value, "ENC[") && strings.HasSuffix(value, "]")
+}
+
+func hasErrorFinding(findings []Finding, code string) bool {
+	for _, finding := range findings {
+		if finding.Code == code && finding.Severity == SeverityError {
+			return true
+		}
+	}
+	return false
+}
+
+func hasFindingsForField(findings []Finding, field string) bool {
+	for _, finding := range findings {
+		if finding.Field == field || strings.HasPrefix(finding.Field, field+".") {
+			return true
+		}
+	}
+	return false
+}
+
+// appendUnique appends findings which are not yet reported for the same field
+func appendUnique(findings []Finding, newFindings ...Finding) []Finding {
+	for _, newFinding := range newFindings {
+		duplicate := false
+		for _, finding := range findings {
+			if finding.Code == newFinding.Code && finding.Field == newFinding.Field {
+				duplicate = true
+				break
+			}
+		}
+		if !duplicate {
+			findings = append(findings, newFinding)
+		}
+	}
+	return findings
+}
+
+func sortedKeys(values map[string]string) []string {
+	keys := make([]string, 0, len(values))
+	for key := range values {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+func objectName(sopsSecret *isindirv1alpha3.SopsSecret) string {
+	if sopsSecret.Namespace == "" {
+		return sopsSecret.Name
+	}
+	return fmt.Sprintf("%s/%s", sopsSecret.Namespace, sopsSecret.Name)
+}
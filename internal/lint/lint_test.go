@@ -0,0 +1,266 @@
+/* This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at https://mozilla.org/MPL/2.0/. */
+
+package lint
+
+import (
+	"os"
+	"path/filepath"
+	"sort"
+	"testing"
+)
+
+const ageRecipient = "age1pnmp2nq5qx9z4lpmachyn2ld07xjumn98hpeq77e4glddu96zvms9nn7c8"
+
+func readTestSecret(t *testing.T, name string) []byte {
+	t.Helper()
+	content, err := os.ReadFile(filepath.Join("..", "..", "config", "age-test-key", name))
+	if err != nil {
+		t.Fatalf("failed to read test secret %s: %v", name, err)
+	}
+	return content
+}
+
+func findingCodes(report *Report) []string {
+	codes := []string{}
+	for _, finding := range report.Findings {
+		codes = append(codes, finding.Code)
+	}
+	sort.Strings(codes)
+	return codes
+}
+
+func equalCodes(a, b []string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
+
+func TestLint(t *testing.T) {
+	tests := []struct {
+		name          string
+		content       string
+		expectedCodes []string
+	}{
+		{
+			name: "Valid encrypted SopsSecret - no findings",
+			content: `apiVersion: isindir.github.com/v1alpha3
+kind: SopsSecret
+metadata:
+  name: valid
+spec:
+  secretTemplates:
+    - name: ENC[AES256_GCM,data:abc=,iv:abc=,tag:abc=,type:str]
+      data:
+        token: ENC[AES256_GCM,data:abc=,iv:abc=,tag:abc=,type:str]
+sops:
+  age:
+    - recipient: ` + ageRecipient + `
+      enc: abc
+  mac: ENC[AES256_GCM,data:abc=,iv:abc=,tag:abc=,type:str]
+  version: 3.7.3
+`,
+			expectedCodes: []string{},
+		},
+		{
+			name: "Other kinds are ignored",
+			content: `apiVersion: v1
+kind: ConfigMap
+metadata:
+  name: ignored
+`,
+			expectedCodes: []string{},
+		},
+		{
+			name: "Plain text SopsSecret - missing sops metadata and unencrypted values",
+			content: `apiVersion: isindir.github.com/v1alpha3
+kind: SopsSecret
+metadata:
+  name: plain
+spec:
+  secretTemplates:
+    - name: plain-secret
+      stringData:
+        token: value
+`,
+			expectedCodes: []string{CodeMissingSopsMetadata, CodeUnencryptedValue},
+		},
+		{
+			name: "Templates without names, duplicate names and invalid base64",
+			content: `apiVersion: isindir.github.com/v1alpha3
+kind: SopsSecret
+metadata:
+  name: templates
+spec:
+  secretTemplates:
+    - name: ""
+    - name: duplicate
+    - name: duplicate
+      data:
+        token: not-base64!
+sops:
+  age:
+    - recipient: ` + ageRecipient + `
+      enc: abc
+  version: 3.7.3
+`,
+			expectedCodes: []string{
+				CodeDuplicateTemplateName, CodeInvalidBase64, CodeTemplateNameMissing, CodeUnencryptedValue,
+			},
+		},
+		{
+			name: "No recipients, unknown field and unsupported sops version",
+			content: `apiVersion: isindir.github.com/v1alpha3
+kind: SopsSecret
+metadata:
+  name: metadata
+spec:
+  secretTemplates:
+    - name: secret
+sops:
+  mac: ENC[AES256_GCM,data:abc=,iv:abc=,tag:abc=,type:str]
+  unknown_selector: value
+  version: 4.0.0
+`,
+			expectedCodes: []string{CodeNoRecipients, CodeUnknownField, CodeUnsupportedSopsVersion},
+		},
+		{
+			name: "Key groups are recipients, shamir threshold exceeding key groups",
+			content: `apiVersion: isindir.github.com/v1alpha3
+kind: SopsSecret
+metadata:
+  name: key-groups
+spec:
+  secretTemplates:
+    - name: ENC[AES256_GCM,data:abc=,iv:abc=,tag:abc=,type:str]
+sops:
+  key_groups:
+    - age:
+        - recipient: ` + ageRecipient + `
+          enc: abc
+  shamir_threshold: 2
+  mac: ENC[AES256_GCM,data:abc=,iv:abc=,tag:abc=,type:str]
+  version: 3.7.3
+`,
+			expectedCodes: []string{CodeInvalidShamirThreshold},
+		},
+		{
+			name: "Older API versions are reported",
+			content: `apiVersion: isindir.github.com/v1alpha2
+kind: SopsSecret
+metadata:
+  name: old
+`,
+			expectedCodes: []string{CodeUnsupportedAPIVersion},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			report := &Report{}
+			report.Lint("test.yaml", []byte(tt.content), Options{})
+
+			codes := findingCodes(report)
+			if !equalCodes(codes, tt.expectedCodes) {
+				t.Errorf("Lint() codes = %v, want %v", codes, tt.expectedCodes)
+			}
+		})
+	}
+}
+
+func TestLintDecrypt(t *testing.T) {
+	t.Setenv("SOPS_AGE_KEY_FILE", filepath.Join("..", "..", "config", "age-test-key", "key-file.txt"))
+
+	tests := []struct {
+		name          string
+		file          string
+		expectedCodes []string
+	}{
+		{
+			name:          "Decryptable SopsSecret - no findings",
+			file:          "00-test-secrets.yaml",
+			expectedCodes: []string{},
+		},
+		{
+			name:          "SopsSecret encrypted with key groups and shamir threshold - no findings",
+			file:          "05-test-secrets-key-groups.yaml",
+			expectedCodes: []string{},
+		},
+		{
+			name:          "SopsSecret encrypted with unencrypted_suffix - no findings",
+			file:          "06-test-secrets-unencrypted-suffix.yaml",
+			expectedCodes: []string{},
+		},
+		{
+			name:          "SopsSecret encrypted with unencrypted_regex - no findings",
+			file:          "07-test-secrets-unencrypted-regex.yaml",
+			expectedCodes: []string{},
+		},
+		{
+			name:          "SopsSecret encrypted with encrypted_comment_regex - comments are lost, decryption failure",
+			file:          "08-test-secrets-encrypted-comment-regex.yaml",
+			expectedCodes: []string{CodeCommentSelector, CodeDecryptionFailed},
+		},
+		{
+			name:          "SopsSecret with spec.verifyMac - MAC verified, no findings",
+			file:          "09-test-secrets-verify-mac.yaml",
+			expectedCodes: []string{},
+		},
+		{
+			name:          "SopsSecret with broken encrypted data - decryption failure",
+			file:          "01-test-secrets.yaml",
+			expectedCodes: []string{CodeDecryptionFailed},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			report := &Report{}
+			report.Lint(tt.file, readTestSecret(t, tt.file), Options{Decrypt: true})
+
+			codes := findingCodes(report)
+			if !equalCodes(codes, tt.expectedCodes) {
+				t.Errorf("Lint() codes = %v, want %v, findings: %+v", codes, tt.expectedCodes, report.Findings)
+			}
+			if report.Objects != 1 {
+				t.Errorf("Lint() objects = %d, want 1", report.Objects)
+			}
+		})
+	}
+}
+
+func TestCheckSopsVersion(t *testing.T) {
+	tests := []struct {
+		name             string
+		version          string
+		expectedSeverity Severity
+	}{
+		{name: "Embedded version is supported", version: "3.13.1"},
+		{name: "Older version is supported", version: "3.7.3"},
+		{name: "Older major version is supported", version: "2.0.0"},
+		{name: "Missing version", expectedSeverity: SeverityWarning},
+		{name: "Invalid version", version: "three", expectedSeverity: SeverityWarning},
+		{name: "Newer patch version", version: "3.13.99", expectedSeverity: SeverityWarning},
+		{name: "Newer minor version", version: "3.14.0", expectedSeverity: SeverityError},
+		{name: "Newer major version", version: "4.0.0", expectedSeverity: SeverityError},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var severity Severity
+			for _, finding := range checkSopsVersion(tt.version) {
+				severity = finding.Severity
+			}
+			if severity != tt.expectedSeverity {
+				t.Errorf("checkSopsVersion(%q) severity = %q, want %q", tt.version, severity, tt.expectedSeverity)
+			}
+		})
+	}
+}
@@ -0,0 +1,318 @@
+/* This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at https://mozilla.org/MPL/2.0/. */
+
+// Package operatorconfig loads versioned operator configuration file, file
+// values are applied to command line flags which were not set explicitly
+package operatorconfig
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+
+	"go.uber.org/zap/zapcore"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"sigs.k8s.io/yaml"
+)
+
+const (
+	// APIVersion is the version of configuration file format
+	APIVersion = "config.isindir.github.com/v1alpha1"
+	// Kind is the kind of configuration file
+	Kind = "OperatorConfig"
+)
+
+// OperatorConfig is the operator configuration file, unset values keep flag
+// defaults
+type OperatorConfig struct {
+	metav1.TypeMeta `json:",inline"`
+
+	Metrics        MetricsConfig        `json:"metrics,omitempty"`
+	Health         HealthConfig         `json:"health,omitempty"`
+	LeaderElection LeaderElectionConfig `json:"leaderElection,omitempty"`
+	Watch          WatchConfig          `json:"watch,omitempty"`
+	Reconcile      ReconcileConfig      `json:"reconcile,omitempty"`
+	Ownership      OwnershipConfig      `json:"ownership,omitempty"`
+	Cache          CacheConfig          `json:"cache,omitempty"`
+	Audit          AuditConfig          `json:"audit,omitempty"`
+	Logging        LoggingConfig        `json:"logging,omitempty"`
+}
+
+// MetricsConfig configures metrics endpoint
+type MetricsConfig struct {
+	// BindAddress is the address the metric endpoint binds to
+	BindAddress *string `json:"bindAddress,omitempty"`
+}
+
+// HealthConfig configures health probes endpoint
+type HealthConfig struct {
+	// HealthProbeBindAddress is the address the probe endpoint binds to
+	HealthProbeBindAddress *string `json:"healthProbeBindAddress,omitempty"`
+}
+
+// LeaderElectionConfig configures leader election between replicas
+type LeaderElectionConfig struct {
+	// LeaderElect enables leader election
+	LeaderElect *bool `json:"leaderElect,omitempty"`
+	// ResourceName is the name of the Lease
+	ResourceName *string `json:"resourceName,omitempty"`
+	// ResourceNamespace is the namespace of the Lease, defaults to operator namespace
+	ResourceNamespace *string `json:"resourceNamespace,omitempty"`
+	// LeaseDuration is the time non-leader replicas wait to acquire the Lease
+	LeaseDuration *metav1.Duration `json:"leaseDuration,omitempty"`
+	// RenewDeadline is the time the leader retries renewing the Lease
+	RenewDeadline *metav1.Duration `json:"renewDeadline,omitempty"`
+	// RetryPeriod is the time between attempts to acquire or renew the Lease
+	RetryPeriod *metav1.Duration `json:"retryPeriod,omitempty"`
+}
+
+// WatchConfig configures namespaces SopsSecrets are watched in
+type WatchConfig struct {
+	// Namespaces to watch, all namespaces when empty
+	Namespaces []string `json:"namespaces,omitempty"`
+}
+
+// ReconcileConfig configures reconciliation of SopsSecrets
+type ReconcileConfig struct {
+	// RequeueDecryptAfter is the number of minutes failed reconciliation is requeued after
+	RequeueDecryptAfter *int64 `json:"requeueDecryptAfter,omitempty"`
+	// MaxConcurrentReconciles is the number of SopsSecrets reconciled in parallel
+	MaxConcurrentReconciles *int `json:"maxConcurrentReconciles,omitempty"`
+	// BackoffBaseDelay is the first delay of exponential backoff of reconciliation errors
+	BackoffBaseDelay *metav1.Duration `json:"backoffBaseDelay,omitempty"`
+	// BackoffMaxDelay is the maximum delay of exponential backoff of reconciliation errors
+	BackoffMaxDelay *metav1.Duration `json:"backoffMaxDelay,omitempty"`
+	// Paused pauses reconciliation of all SopsSecrets, reloaded live
+	Paused *bool `json:"paused,omitempty"`
+	// RecreateStrategy is how child secrets are replaced when an immutable field changes
+	RecreateStrategy *string `json:"recreateStrategy,omitempty"`
+	// MaxDataKeyAge is the age of sops data key SopsSecrets are reported for rotation after
+	MaxDataKeyAge *metav1.Duration `json:"maxDataKeyAge,omitempty"`
+}
+
+// OwnershipConfig configures ownership of pre-existing Secrets
+type OwnershipConfig struct {
+	// DefaultEnforceOwnership is the default of spec.enforceOwnership
+	DefaultEnforceOwnership *bool `json:"defaultEnforceOwnership,omitempty"`
+}
+
+// CacheConfig configures informer cache
+type CacheConfig struct {
+	// SyncPeriod is the time between resyncs of all watched objects
+	SyncPeriod *metav1.Duration `json:"syncPeriod,omitempty"`
+}
+
+// AuditConfig configures decryption audit log
+type AuditConfig struct {
+	// Log is the file audit events are written to, '-' for stdout
+	Log *string `json:"log,omitempty"`
+	// URL audit events are posted to
+	URL *string `json:"url,omitempty"`
+	// BufferSize is the number of audit events kept in memory
+	BufferSize *int `json:"bufferSize,omitempty"`
+	// BatchSize is the maximum number of audit events written at once
+	BatchSize *int `json:"batchSize,omitempty"`
+	// FlushInterval is the maximum time audit events are kept in memory
+	FlushInterval *metav1.Duration `json:"flushInterval,omitempty"`
+}
+
+// LoggingConfig configures logging
+type LoggingConfig struct {
+	// Level is one of debug, info, error or verbosity greater than 0, reloaded live
+	Level *string `json:"level,omitempty"`
+}
+
+// Load reads and validates configuration file, unknown fields are rejected
+func Load(path string) (*OperatorConfig, error) {
+	content, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	return Parse(content)
+}
+
+// Parse decodes and validates configuration, unknown fields are rejected
+func Parse(content []byte) (*OperatorConfig, error) {
+	config := &OperatorConfig{}
+	if err := yaml.UnmarshalStrict(content, config); err != nil {
+		return nil, err
+	}
+	if err := config.Validate(); err != nil {
+		return nil, err
+	}
+	return config, nil
+}
+
+// Validate checks configuration values, all problems are reported at once
+func (c *OperatorConfig) Validate() error {
+	var errs []error
+	invalid := func(field string, format string, args ...any) {
+		errs = append(errs, fmt.Errorf("%s: %s", field, fmt.Sprintf(format, args...)))
+	}
+
+	if c.APIVersion != APIVersion || c.Kind != Kind {
+		invalid("apiVersion/kind", "must be %s/%s, got %s/%s", APIVersion, Kind, c.APIVersion, c.Kind)
+	}
+	if c.Metrics.BindAddress != nil && *c.Metrics.BindAddress == "" {
+		invalid("metrics.bindAddress", "must not be empty, use \"0\" to disable metrics")
+	}
+
+	le := c.LeaderElection
+	for _, d := range []struct {
+		field    string
+		duration *metav1.Duration
+	}{
+		{"leaderElection.leaseDuration", le.LeaseDuration},
+		{"leaderElection.renewDeadline", le.RenewDeadline},
+		{"leaderElection.retryPeriod", le.RetryPeriod},
+		{"reconcile.backoffBaseDelay", c.Reconcile.BackoffBaseDelay},
+		{"reconcile.backoffMaxDelay", c.Reconcile.BackoffMaxDelay},
+		{"cache.syncPeriod", c.Cache.SyncPeriod},
+		{"audit.flushInterval", c.Audit.FlushInterval},
+	} {
+		if d.duration != nil && d.duration.Duration <= 0 {
+			invalid(d.field, "must be positive, got %s", d.duration.Duration)
+		}
+	}
+	if le.LeaseDuration != nil && le.RenewDeadline != nil && le.RenewDeadline.Duration >= le.LeaseDuration.Duration {
+		invalid("leaderElection.renewDeadline", "must be less than leaseDuration")
+	}
+	if le.RenewDeadline != nil && le.RetryPeriod != nil && le.RetryPeriod.Duration >= le.RenewDeadline.Duration {
+		invalid("leaderElection.retryPeriod", "must be less than renewDeadline")
+	}
+	if le.ResourceName != nil && *le.ResourceName == "" {
+		invalid("leaderElection.resourceName", "must not be empty")
+	}
+
+	for _, namespace := range c.Watch.Namespaces {
+		if namespace == "" || strings.Contains(namespace, ",") {
+			invalid("watch.namespaces", "invalid namespace %q", namespace)
+		}
+	}
+
+	if r := c.Reconcile.RequeueDecryptAfter; r != nil && *r < 1 {
+		invalid("reconcile.requeueDecryptAfter", "must be at least 1 minute, got %d", *r)
+	}
+	if m := c.Reconcile.MaxConcurrentReconciles; m != nil && *m < 1 {
+		invalid("reconcile.maxConcurrentReconciles", "must be at least 1, got %d", *m)
+	}
+	if base, limit := c.Reconcile.BackoffBaseDelay, c.Reconcile.BackoffMaxDelay; base != nil && limit != nil && base.Duration > limit.Duration {
+		invalid("reconcile.backoffMaxDelay", "must not be less than backoffBaseDelay")
+	}
+	if a := c.Reconcile.MaxDataKeyAge; a != nil && a.Duration < 0 {
+		invalid("reconcile.maxDataKeyAge", "must not be negative, got %s", a.Duration)
+	}
+
+	if c.Audit.Log != nil && *c.Audit.Log != "" && c.Audit.URL != nil && *c.Audit.URL != "" {
+		invalid("audit", "only one of log and url can be set")
+	}
+	if s := c.Audit.BufferSize; s != nil && *s < 1 {
+		invalid("audit.bufferSize", "must be at least 1, got %d", *s)
+	}
+	if s := c.Audit.BatchSize; s != nil && *s < 1 {
+		invalid("audit.batchSize", "must be at least 1, got %d", *s)
+	}
+
+	if c.Logging.Level != nil {
+		if _, err := ParseLogLevel(*c.Logging.Level); err != nil {
+			invalid("logging.level", "%v", err)
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// ApplyToFlags sets flags from configuration values, flags set on command
+// line are not changed
+func (c *OperatorConfig) ApplyToFlags(flags *flag.FlagSet) error {
+	explicit := map[string]bool{}
+	flags.Visit(func(f *flag.Flag) {
+		explicit[f.Name] = true
+	})
+
+	for name, value := range c.flagValues() {
+		if explicit[name] {
+			continue
+		}
+		if err := flags.Set(name, value); err != nil {
+			return fmt.Errorf("failed to apply configuration to --%s: %w", name, err)
+		}
+	}
+	return nil
+}
+
+// flagValues returns flag values of configuration values which are set
+func (c *OperatorConfig) flagValues() map[string]string {
+	values := map[string]string{}
+	setString := func(name string, value *string) {
+		if value != nil {
+			values[name] = *value
+		}
+	}
+	setBool := func(name string, value *bool) {
+		if value != nil {
+			values[name] = strconv.FormatBool(*value)
+		}
+	}
+	setInt := func(name string, value *int) {
+		if value != nil {
+			values[name] = strconv.Itoa(*value)
+		}
+	}
+	setDuration := func(name string, value *metav1.Duration) {
+		if value != nil {
+			values[name] = value.Duration.String()
+		}
+	}
+
+	setString("metrics-bind-address", c.Metrics.BindAddress)
+	setString("health-probe-bind-address", c.Health.HealthProbeBindAddress)
+	setBool("leader-elect", c.LeaderElection.LeaderElect)
+	setString("leader-election-id", c.LeaderElection.ResourceName)
+	setString("leader-election-namespace", c.LeaderElection.ResourceNamespace)
+	setDuration("leader-election-lease-duration", c.LeaderElection.LeaseDuration)
+	setDuration("leader-election-renew-deadline", c.LeaderElection.RenewDeadline)
+	setDuration("leader-election-retry-period", c.LeaderElection.RetryPeriod)
+	if len(c.Watch.Namespaces) > 0 {
+		values["watch-namespace"] = strings.Join(c.Watch.Namespaces, ",")
+	}
+	if c.Reconcile.RequeueDecryptAfter != nil {
+		values["requeue-decrypt-after"] = strconv.FormatInt(*c.Reconcile.RequeueDecryptAfter, 10)
+	}
+	setInt("max-concurrent-reconciles", c.Reconcile.MaxConcurrentReconciles)
+	setDuration("reconcile-backoff-base-delay", c.Reconcile.BackoffBaseDelay)
+	setDuration("reconcile-backoff-max-delay", c.Reconcile.BackoffMaxDelay)
+	setString("recreate-strategy", c.Reconcile.RecreateStrategy)
+	setDuration("max-data-key-age", c.Reconcile.MaxDataKeyAge)
+	setBool("default-enforce-ownership", c.Ownership.DefaultEnforceOwnership)
+	setDuration("cache-sync-period", c.Cache.SyncPeriod)
+	setString("audit-log", c.Audit.Log)
+	setString("audit-url", c.Audit.URL)
+	setInt("audit-buffer-size", c.Audit.BufferSize)
+	setInt("audit-batch-size", c.Audit.BatchSize)
+	setDuration("audit-flush-interval", c.Audit.FlushInterval)
+	setString("zap-log-level", c.Logging.Level)
+	return values
+}
+
+// Paused returns true when reconciliation of all SopsSecrets is paused
+func (c *OperatorConfig) Paused() bool {
+	return c.Reconcile.Paused != nil && *c.Reconcile.Paused
+}
+
+// ParseLogLevel parses log level as --zap-log-level flag does: debug, info,
+// error, panic or verbosity greater than 0
+func ParseLogLevel(value string) (zapcore.Level, error) {
+	switch strings.ToLower(value) {
+	case "debug", "info", "error", "panic":
+		return zapcore.ParseLevel(value)
+	}
+	verbosity, err := strconv.Atoi(value)
+	if err != nil || verbosity <= 0 {
+		return 0, fmt.Errorf("invalid log level %q", value)
+	}
+	return zapcore.Level(int8(-verbosity)), nil
+}
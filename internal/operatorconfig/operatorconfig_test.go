@@ -0,0 +1,235 @@
+/* This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at https://mozilla.org/MPL/2.0/. */
+
+package operatorconfig
+
+import (
+	"context"
+	"flag"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/go-logr/logr"
+	"go.uber.org/zap/zapcore"
+)
+
+const fullConfig = `
+apiVersion: config.isindir.github.com/v1alpha1
+kind: OperatorConfig
+metrics:
+  bindAddress: 127.0.0.1:8080
+health:
+  healthProbeBindAddress: :8081
+leaderElection:
+  leaderElect: true
+  resourceName: sops-secrets-operator
+  resourceNamespace: sops
+  leaseDuration: 30s
+  renewDeadline: 20s
+  retryPeriod: 5s
+watch:
+  namespaces: [team-a, team-b]
+reconcile:
+  requeueDecryptAfter: 10
+  maxConcurrentReconciles: 4
+  backoffBaseDelay: 1s
+  backoffMaxDelay: 5m
+  paused: true
+  recreateStrategy: recreate-with-temporary
+  maxDataKeyAge: 2160h
+ownership:
+  defaultEnforceOwnership: true
+cache:
+  syncPeriod: 1h
+audit:
+  log: "-"
+  bufferSize: 500
+  batchSize: 50
+  flushInterval: 10s
+logging:
+  level: "2"
+`
+
+func TestParse(t *testing.T) {
+	tests := []struct {
+		name        string
+		content     string
+		expectedErr string
+	}{
+		{
+			name:    "Full configuration",
+			content: fullConfig,
+		},
+		{
+			name:    "Empty configuration",
+			content: "apiVersion: config.isindir.github.com/v1alpha1\nkind: OperatorConfig\n",
+		},
+		{
+			name:        "Unsupported version",
+			content:     "apiVersion: controller-runtime.sigs.k8s.io/v1alpha1\nkind: ControllerManagerConfig\n",
+			expectedErr: "apiVersion/kind",
+		},
+		{
+			name:        "Unknown field",
+			content:     "apiVersion: config.isindir.github.com/v1alpha1\nkind: OperatorConfig\nwebhook:\n  port: 9443\n",
+			expectedErr: "unknown field",
+		},
+		{
+			name: "Invalid leader election durations",
+			content: `apiVersion: config.isindir.github.com/v1alpha1
+kind: OperatorConfig
+leaderElection:
+  leaseDuration: 10s
+  renewDeadline: 15s
+  retryPeriod: 0s
+`,
+			expectedErr: "leaderElection.renewDeadline: must be less than leaseDuration",
+		},
+		{
+			name: "Invalid reconcile and logging settings",
+			content: `apiVersion: config.isindir.github.com/v1alpha1
+kind: OperatorConfig
+reconcile:
+  requeueDecryptAfter: 0
+  maxConcurrentReconciles: 0
+  maxDataKeyAge: -1h
+logging:
+  level: verbose
+`,
+			expectedErr: "logging.level",
+		},
+		{
+			name: "Both audit log and url",
+			content: `apiVersion: config.isindir.github.com/v1alpha1
+kind: OperatorConfig
+audit:
+  log: /var/log/audit.log
+  url: https://audit.example.com
+`,
+			expectedErr: "only one of log and url",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := Parse([]byte(tt.content))
+			if tt.expectedErr == "" {
+				if err != nil {
+					t.Fatalf("Parse() error = %v", err)
+				}
+				return
+			}
+			if err == nil || !strings.Contains(err.Error(), tt.expectedErr) {
+				t.Errorf("expected error containing %q, got %v", tt.expectedErr, err)
+			}
+		})
+	}
+}
+
+func TestApplyToFlags(t *testing.T) {
+	config, err := Parse([]byte(fullConfig))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	flags := flag.NewFlagSet("test", flag.ContinueOnError)
+	metricsAddr := flags.String("metrics-bind-address", ":8080", "")
+	leaderElect := flags.Bool("leader-elect", false, "")
+	leaseDuration := flags.Duration("leader-election-lease-duration", 15*time.Second, "")
+	watchNamespace := flags.String("watch-namespace", "", "")
+	requeueAfter := flags.Int64("requeue-decrypt-after", 5, "")
+	maxConcurrentReconciles := flags.Int("max-concurrent-reconciles", 1, "")
+	for _, name := range []string{
+		"health-probe-bind-address", "leader-election-id", "leader-election-namespace", "audit-log", "audit-url", "zap-log-level",
+		"recreate-strategy",
+	} {
+		flags.String(name, "", "")
+	}
+	for _, name := range []string{
+		"leader-election-renew-deadline", "leader-election-retry-period", "reconcile-backoff-base-delay",
+		"reconcile-backoff-max-delay", "cache-sync-period", "audit-flush-interval", "max-data-key-age",
+	} {
+		flags.Duration(name, 0, "")
+	}
+	flags.Bool("default-enforce-ownership", false, "")
+	flags.Int("audit-buffer-size", 0, "")
+	flags.Int("audit-batch-size", 0, "")
+	if err := flags.Parse([]string{"--metrics-bind-address=:9090", "--requeue-decrypt-after=1"}); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := config.ApplyToFlags(flags); err != nil {
+		t.Fatalf("ApplyToFlags() error = %v", err)
+	}
+	if *metricsAddr != ":9090" || *requeueAfter != 1 {
+		t.Errorf("expected command line flags to override file, got %q and %d", *metricsAddr, *requeueAfter)
+	}
+	if !*leaderElect || *leaseDuration != 30*time.Second || *watchNamespace != "team-a,team-b" || *maxConcurrentReconciles != 4 {
+		t.Errorf("expected file values to be applied, got %t %s %q %d",
+			*leaderElect, *leaseDuration, *watchNamespace, *maxConcurrentReconciles)
+	}
+	if !config.Paused() {
+		t.Error("expected configuration to pause reconciliation")
+	}
+
+	// Flag missing from flag set is reported
+	if err := config.ApplyToFlags(flag.NewFlagSet("empty", flag.ContinueOnError)); err == nil {
+		t.Error("expected error for unknown flag")
+	}
+}
+
+func TestParseLogLevel(t *testing.T) {
+	for value, expected := range map[string]zapcore.Level{
+		"debug": zapcore.DebugLevel,
+		"INFO":  zapcore.InfoLevel,
+		"error": zapcore.ErrorLevel,
+		"3":     zapcore.Level(-3),
+	} {
+		if level, err := ParseLogLevel(value); err != nil || level != expected {
+			t.Errorf("ParseLogLevel(%q) = %v, %v, expected %v", value, level, err, expected)
+		}
+	}
+	for _, value := range []string{"warn", "0", "verbose"} {
+		if _, err := ParseLogLevel(value); err == nil {
+			t.Errorf("expected ParseLogLevel(%q) to fail", value)
+		}
+	}
+}
+
+func TestWatcherCheck(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "config.yaml")
+	initial := []byte("apiVersion: config.isindir.github.com/v1alpha1\nkind: OperatorConfig\n")
+	if err := os.WriteFile(path, initial, 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	var changes []*OperatorConfig
+	w := NewWatcher(path, initial, func(_ context.Context, config *OperatorConfig) {
+		changes = append(changes, config)
+	}, logr.Discard())
+
+	w.check(context.Background())
+	if len(changes) != 0 {
+		t.Fatalf("expected no change for unchanged file, got %d", len(changes))
+	}
+
+	if err := os.WriteFile(path, append(initial, []byte("logging:\n  level: info-ish\n")...), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	w.check(context.Background())
+	if len(changes) != 0 {
+		t.Fatalf("expected invalid configuration to be ignored, got %d changes", len(changes))
+	}
+
+	if err := os.WriteFile(path, append(initial, []byte("reconcile:\n  paused: true\n")...), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	w.check(context.Background())
+	if len(changes) != 1 || !changes[0].Paused() {
+		t.Errorf("expected paused configuration to be reported, got %v", changes)
+	}
+}
@@ -0,0 +1,80 @@
+/* This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at https://mozilla.org/MPL/2.0/. */
+
+package operatorconfig
+
+import (
+	"bytes"
+	"context"
+	"os"
+	"time"
+
+	"github.com/go-logr/logr"
+)
+
+// DefaultWatchInterval is the default time between checks of configuration file
+const DefaultWatchInterval = 10 * time.Second
+
+// Watcher polls configuration file and calls OnChange with valid
+// configuration when file content changes, invalid configuration is logged
+// and ignored
+type Watcher struct {
+	// Path of the configuration file
+	Path string
+	// Interval is the time between checks of the file
+	Interval time.Duration
+	// OnChange is called with changed configuration
+	OnChange func(ctx context.Context, config *OperatorConfig)
+	Log      logr.Logger
+
+	content []byte
+}
+
+// NewWatcher creates configuration file watcher, content is the file
+// content loaded at startup, changes are reported relative to it
+func NewWatcher(path string, content []byte, onChange func(ctx context.Context, config *OperatorConfig), log logr.Logger) *Watcher {
+	return &Watcher{Path: path, Interval: DefaultWatchInterval, OnChange: onChange, Log: log, content: content}
+}
+
+// Start watches configuration file until ctx is done
+func (w *Watcher) Start(ctx context.Context) error {
+	interval := w.Interval
+	if interval <= 0 {
+		interval = DefaultWatchInterval
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-ticker.C:
+			w.check(ctx)
+		}
+	}
+}
+
+// NeedLeaderElection returns false, all replicas apply configuration changes
+func (w *Watcher) NeedLeaderElection() bool {
+	return false
+}
+
+func (w *Watcher) check(ctx context.Context) {
+	content, err := os.ReadFile(w.Path)
+	if err != nil {
+		w.Log.Error(err, "Failed to read operator configuration", "path", w.Path)
+		return
+	}
+	if bytes.Equal(content, w.content) {
+		return
+	}
+	config, err := Parse(content)
+	if err != nil {
+		w.Log.Error(err, "Invalid operator configuration, keeping previous configuration", "path", w.Path)
+		return
+	}
+	w.content = content
+	w.Log.V(0).Info("Operator configuration changed, only log level and pause are applied without restart", "path", w.Path)
+	w.OnChange(ctx, config)
+}
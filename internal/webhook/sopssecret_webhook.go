@@ -0,0 +1,188 @@
+/* This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at https://mozilla.org/MPL/2.0/. */
+
+// Package webhook implements admission webhooks for SopsSecret objects
+package webhook
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"strings"
+
+	"github.com/go-logr/logr"
+	admissionv1 "k8s.io/api/admission/v1"
+	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/types"
+	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/webhook/admission"
+
+	isindirv1alpha3 "github.com/isindir/sops-secrets-operator/api/v1alpha3"
+	"github.com/isindir/sops-secrets-operator/internal/controllers"
+	"github.com/isindir/sops-secrets-operator/internal/lint"
+)
+
+const (
+	// PlaintextModeDisabled - plain text webhook is not served
+	PlaintextModeDisabled = "disabled"
+	// PlaintextModeReject - plain text SopsSecrets are rejected
+	PlaintextModeReject = "reject"
+	// PlaintextModeEncrypt - plain text SopsSecrets without sops metadata are
+	// encrypted for the namespace age recipients, others are rejected. Updates
+	// which replace all secret templates with plain text are encrypted too.
+	PlaintextModeEncrypt = "encrypt"
+)
+
+// PlaintextModes lists valid values of --plaintext-webhook flag
+var PlaintextModes = []string{PlaintextModeDisabled, PlaintextModeReject, PlaintextModeEncrypt}
+
+//+kubebuilder:webhook:path=/mutate-isindir-github-com-v1alpha3-sopssecret,mutating=true,failurePolicy=fail,sideEffects=None,groups=isindir.github.com,resources=sopssecrets,verbs=create;update,versions=v1alpha3,name=msopssecret-v1alpha3.isindir.github.com,admissionReviewVersions=v1
+
+// PlaintextSopsSecretDefaulter rejects or encrypts SopsSecrets which secret
+// templates are not encrypted, so that plain text never reaches etcd
+type PlaintextSopsSecretDefaulter struct {
+	// Mode is one of PlaintextModeReject or PlaintextModeEncrypt
+	Mode string
+	// Reader is used to read namespace age recipients annotation
+	Reader client.Reader
+	// DefaultRecipient returns age recipient used when namespace is not
+	// annotated, normally the operator managed recipient, may be nil
+	DefaultRecipient func() string
+	Log              logr.Logger
+}
+
+// SetupWithManager registers the webhook with the manager webhook server
+func (d *PlaintextSopsSecretDefaulter) SetupWithManager(mgr ctrl.Manager) error {
+	return ctrl.NewWebhookManagedBy(mgr, &isindirv1alpha3.SopsSecret{}).
+		WithDefaulter(d).
+		Complete()
+}
+
+// Default rejects or encrypts plain text SopsSecret
+func (d *PlaintextSopsSecretDefaulter) Default(ctx context.Context, sopsSecret *isindirv1alpha3.SopsSecret) error {
+	missingMetadata, unencryptedFields := findPlaintext(sopsSecret)
+	if !missingMetadata && len(unencryptedFields) == 0 {
+		return nil
+	}
+
+	// Second `kubectl apply` of a plain text manifest patches secret
+	// templates, but keeps sops metadata of the stored object
+	if d.Mode == PlaintextModeEncrypt && !missingMetadata && isUpdate(ctx) && !hasEncryptedValues(sopsSecret) {
+		sopsSecret.Sops = isindirv1alpha3.SopsMetadata{}
+		missingMetadata = true
+	}
+
+	if d.Mode != PlaintextModeEncrypt || !missingMetadata {
+		if missingMetadata {
+			return fmt.Errorf("SopsSecret %s/%s is not encrypted with sops, encrypt it with sops --encrypt",
+				sopsSecret.Namespace, sopsSecret.Name)
+		}
+		return fmt.Errorf("SopsSecret %s/%s has unencrypted values: %s",
+			sopsSecret.Namespace, sopsSecret.Name, strings.Join(unencryptedFields, ", "))
+	}
+
+	recipients, err := d.recipients(ctx, sopsSecret.Namespace)
+	if err != nil {
+		return err
+	}
+	if len(recipients) == 0 {
+		return fmt.Errorf(
+			"SopsSecret %s/%s is not encrypted with sops and namespace has no %s annotation",
+			sopsSecret.Namespace, sopsSecret.Name, isindirv1alpha3.SopsSecretAgeRecipientsAnnotation,
+		)
+	}
+	if err := controllers.EncryptSopsSecret(sopsSecret, recipients); err != nil {
+		return fmt.Errorf("failed to encrypt SopsSecret %s/%s: %w", sopsSecret.Namespace, sopsSecret.Name, err)
+	}
+	// kubectl client side apply stores the plain text manifest in annotation
+	delete(sopsSecret.Annotations, corev1.LastAppliedConfigAnnotation)
+	d.Log.V(0).Info(
+		"Encrypted plain text SopsSecret",
+		"sopssecret", types.NamespacedName{Namespace: sopsSecret.Namespace, Name: sopsSecret.Name},
+		"recipients", recipients,
+	)
+	return nil
+}
+
+// recipients returns age recipients from namespace annotation or the default recipient
+func (d *PlaintextSopsSecretDefaulter) recipients(ctx context.Context, namespaceName string) ([]string, error) {
+	// Namespaced installations can not read namespaces, only the default recipient is used
+	namespace := &corev1.Namespace{}
+	err := d.Reader.Get(ctx, types.NamespacedName{Name: namespaceName}, namespace)
+	if err != nil && !apierrors.IsForbidden(err) {
+		return nil, fmt.Errorf("failed to get namespace %s: %w", namespaceName, err)
+	}
+
+	var recipients []string
+	for _, recipient := range strings.Split(namespace.Annotations[isindirv1alpha3.SopsSecretAgeRecipientsAnnotation], ",") {
+		if recipient = strings.TrimSpace(recipient); recipient != "" {
+			recipients = append(recipients, recipient)
+		}
+	}
+	if len(recipients) == 0 && d.DefaultRecipient != nil {
+		if recipient := d.DefaultRecipient(); recipient != "" {
+			recipients = append(recipients, recipient)
+		}
+	}
+	return recipients, nil
+}
+
+// findPlaintext reports whether sops metadata is missing and which template
+// values are not encrypted, using the same checks as the lint subcommand
+func findPlaintext(sopsSecret *isindirv1alpha3.SopsSecret) (bool, []string) {
+	missingMetadata := false
+	var unencryptedFields []string
+	for _, finding := range lint.Check("", sopsSecret, lint.Options{}) {
+		switch finding.Code {
+		case lint.CodeMissingSopsMetadata:
+			missingMetadata = true
+		case lint.CodeUnencryptedValue:
+			unencryptedFields = append(unencryptedFields, finding.Field)
+		}
+	}
+	return missingMetadata, unencryptedFields
+}
+
+// isUpdate checks if the admission request is an update of stored object
+func isUpdate(ctx context.Context) bool {
+	req, err := admission.RequestFromContext(ctx)
+	return err == nil && req.Operation == admissionv1.Update
+}
+
+// hasEncryptedValues checks if any value of secret templates has sops
+// encrypted value format
+func hasEncryptedValues(sopsSecret *isindirv1alpha3.SopsSecret) bool {
+	templates, err := json.Marshal(sopsSecret.Spec.SecretsTemplate)
+	if err != nil {
+		return true
+	}
+	var values interface{}
+	if err := json.Unmarshal(templates, &values); err != nil {
+		return true
+	}
+
+	var walk func(value interface{}) bool
+	walk = func(value interface{}) bool {
+		switch value := value.(type) {
+		case string:
+			return strings.HasPrefix(value, "ENC[") && strings.HasSuffix(value, "]")
+		case map[string]interface{}:
+			for _, v := range value {
+				if walk(v) {
+					return true
+				}
+			}
+		case []interface{}:
+			for _, v := range value {
+				if walk(v) {
+					return true
+				}
+			}
+		}
+		return false
+	}
+	return walk(values)
+}
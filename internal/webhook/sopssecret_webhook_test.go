@@ -0,0 +1,193 @@
+/* This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at https://mozilla.org/MPL/2.0/. */
+
+package webhook
+
+import (
+	"context"
+	"strings"
+	"testing"
+
+	"filippo.io/age"
+	"github.com/go-logr/logr"
+	admissionv1 "k8s.io/api/admission/v1"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	clientgoscheme "k8s.io/client-go/kubernetes/scheme"
+	"sigs.k8s.io/controller-runtime/pkg/client/fake"
+	"sigs.k8s.io/controller-runtime/pkg/webhook/admission"
+
+	isindirv1alpha3 "github.com/isindir/sops-secrets-operator/api/v1alpha3"
+	"github.com/isindir/sops-secrets-operator/internal/controllers"
+)
+
+func newPlainTextSopsSecret(namespace string) *isindirv1alpha3.SopsSecret {
+	return &isindirv1alpha3.SopsSecret{
+		ObjectMeta: metav1.ObjectMeta{Name: "sopssecret", Namespace: namespace},
+		Spec: isindirv1alpha3.SopsSecretSpec{
+			SecretsTemplate: []isindirv1alpha3.SopsSecretTemplate{{
+				Name:       "my-secret",
+				StringData: map[string]string{"password": "plain-text-password"},
+			}},
+		},
+	}
+}
+
+// appliedWithKubectl sets annotation kubectl client side apply stores the
+// applied manifest in
+func appliedWithKubectl(sopsSecret *isindirv1alpha3.SopsSecret) *isindirv1alpha3.SopsSecret {
+	sopsSecret.Annotations = map[string]string{
+		corev1.LastAppliedConfigAnnotation: `{"spec":{"secretTemplates":[{"name":"my-secret","stringData":{"password":"plain-text-password"}}]}}`,
+	}
+	return sopsSecret
+}
+
+func TestPlaintextSopsSecretDefaulter(t *testing.T) {
+	identity, err := age.GenerateX25519Identity()
+	if err != nil {
+		t.Fatal(err)
+	}
+	recipient := identity.Recipient().String()
+
+	scheme := runtime.NewScheme()
+	if err := clientgoscheme.AddToScheme(scheme); err != nil {
+		t.Fatal(err)
+	}
+	reader := fake.NewClientBuilder().WithScheme(scheme).WithRuntimeObjects(
+		&corev1.Namespace{ObjectMeta: metav1.ObjectMeta{Name: "plain"}},
+		&corev1.Namespace{ObjectMeta: metav1.ObjectMeta{
+			Name:        "annotated",
+			Annotations: map[string]string{isindirv1alpha3.SopsSecretAgeRecipientsAnnotation: recipient},
+		}},
+	).Build()
+
+	encrypted := newPlainTextSopsSecret("plain")
+	if err := controllers.EncryptSopsSecret(encrypted, []string{recipient}); err != nil {
+		t.Fatal(err)
+	}
+	partiallyEncrypted := encrypted.DeepCopy()
+	partiallyEncrypted.Spec.SecretsTemplate[0].StringData["added"] = "plain-text-value"
+
+	// Stored object encrypted for another recipient, patched by the second
+	// kubectl apply of the plain text manifest
+	previousIdentity, err := age.GenerateX25519Identity()
+	if err != nil {
+		t.Fatal(err)
+	}
+	reapplied := newPlainTextSopsSecret("plain")
+	if err := controllers.EncryptSopsSecret(reapplied, []string{previousIdentity.Recipient().String()}); err != nil {
+		t.Fatal(err)
+	}
+	reapplied.Spec = newPlainTextSopsSecret("plain").Spec
+	appliedWithKubectl(reapplied)
+
+	tests := []struct {
+		name             string
+		mode             string
+		sopsSecret       *isindirv1alpha3.SopsSecret
+		update           bool
+		defaultRecipient string
+		expectedErr      string
+		expectEncrypted  bool
+	}{
+		{
+			name:       "Encrypted object is admitted unchanged",
+			mode:       PlaintextModeReject,
+			sopsSecret: encrypted.DeepCopy(),
+		},
+		{
+			name:        "Reject mode - plain text object is rejected",
+			mode:        PlaintextModeReject,
+			sopsSecret:  newPlainTextSopsSecret("annotated"),
+			expectedErr: "is not encrypted with sops",
+		},
+		{
+			name:        "Encrypt mode - partially encrypted object is rejected",
+			mode:        PlaintextModeEncrypt,
+			sopsSecret:  partiallyEncrypted,
+			expectedErr: "spec.secretTemplates[0].stringData.added",
+		},
+		{
+			name:            "Encrypt mode - encrypted for namespace recipients",
+			mode:            PlaintextModeEncrypt,
+			sopsSecret:      appliedWithKubectl(newPlainTextSopsSecret("annotated")),
+			expectEncrypted: true,
+		},
+		{
+			name:             "Encrypt mode - update replacing templates with plain text is encrypted",
+			mode:             PlaintextModeEncrypt,
+			sopsSecret:       reapplied.DeepCopy(),
+			update:           true,
+			defaultRecipient: recipient,
+			expectEncrypted:  true,
+		},
+		{
+			name:             "Encrypt mode - create with sops metadata and plain text templates is rejected",
+			mode:             PlaintextModeEncrypt,
+			sopsSecret:       reapplied.DeepCopy(),
+			defaultRecipient: recipient,
+			expectedErr:      "spec.secretTemplates[0].stringData.password",
+		},
+		{
+			name:             "Encrypt mode - partially encrypted update is rejected",
+			mode:             PlaintextModeEncrypt,
+			sopsSecret:       partiallyEncrypted.DeepCopy(),
+			update:           true,
+			defaultRecipient: recipient,
+			expectedErr:      "spec.secretTemplates[0].stringData.added",
+		},
+		{
+			name:             "Encrypt mode - encrypted for default recipient",
+			mode:             PlaintextModeEncrypt,
+			sopsSecret:       newPlainTextSopsSecret("plain"),
+			defaultRecipient: recipient,
+			expectEncrypted:  true,
+		},
+		{
+			name:        "Encrypt mode - rejected without recipients",
+			mode:        PlaintextModeEncrypt,
+			sopsSecret:  newPlainTextSopsSecret("plain"),
+			expectedErr: isindirv1alpha3.SopsSecretAgeRecipientsAnnotation,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			d := &PlaintextSopsSecretDefaulter{
+				Mode:             tt.mode,
+				Reader:           reader,
+				DefaultRecipient: func() string { return tt.defaultRecipient },
+				Log:              logr.Discard(),
+			}
+			ctx := context.Background()
+			if tt.update {
+				ctx = admission.NewContextWithRequest(ctx, admission.Request{
+					AdmissionRequest: admissionv1.AdmissionRequest{Operation: admissionv1.Update},
+				})
+			}
+			err := d.Default(ctx, tt.sopsSecret)
+			if tt.expectedErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.expectedErr) {
+					t.Fatalf("expected error containing %q, got %v", tt.expectedErr, err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("Default() error = %v", err)
+			}
+
+			missingMetadata, unencryptedFields := findPlaintext(tt.sopsSecret)
+			if missingMetadata || len(unencryptedFields) != 0 {
+				t.Errorf("expected object to be encrypted, got unencrypted fields %v", unencryptedFields)
+			}
+			if tt.expectEncrypted && (len(tt.sopsSecret.Sops.Age) != 1 || tt.sopsSecret.Sops.Age[0].Recipient != recipient) {
+				t.Errorf("expected object to be encrypted for %s, got %v", recipient, tt.sopsSecret.Sops.Age)
+			}
+			if _, ok := tt.sopsSecret.Annotations[corev1.LastAppliedConfigAnnotation]; ok {
+				t.Errorf("expected plain text %s annotation to be removed", corev1.LastAppliedConfigAnnotation)
+			}
+		})
+	}
+}